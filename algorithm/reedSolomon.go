@@ -0,0 +1,284 @@
+package algorithm
+
+import "fmt"
+
+// Arithmetic of GF(2^8) with the polynomial x^8 + x^4 + x^3 + x^2 + 1,
+// addition is xor, multiplication goes through the log tables.
+const gfPolynomial = 0x11d
+
+var (
+	gfExp [512]byte // doubled so that the sum of two logs needs no modulo
+	gfLog [256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= gfPolynomial
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+// gfInv panics on 0, which has no inverse
+func gfInv(a byte) byte {
+	if a == 0 {
+		panic("gfInv(0)")
+	}
+	return gfExp[255-int(gfLog[a])]
+}
+
+// gfPow a^n, with 0^0 = 1
+func gfPow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[(int(gfLog[a])*n)%255]
+}
+
+// gfMatrix is a matrix over GF(2^8), by rows
+type gfMatrix [][]byte
+
+func newGFMatrix(rows, cols int) gfMatrix {
+	mat := make(gfMatrix, rows)
+	for i := range mat {
+		mat[i] = make([]byte, cols)
+	}
+	return mat
+}
+
+func (mat gfMatrix) mul(other gfMatrix) gfMatrix {
+	ret := newGFMatrix(len(mat), len(other[0]))
+	for i := range mat {
+		for j := range other[0] {
+			var v byte
+			for k := range other {
+				v ^= gfMul(mat[i][k], other[k][j])
+			}
+			ret[i][j] = v
+		}
+	}
+	return ret
+}
+
+// invert the square matrix by Gauss-Jordan elimination, error if singular
+func (mat gfMatrix) invert() (gfMatrix, error) {
+	n := len(mat)
+	// [mat | I], reduced to [I | mat^-1]
+	work := newGFMatrix(n, 2*n)
+	for i := range mat {
+		copy(work[i], mat[i])
+		work[i][n+i] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := col
+		for pivot < n && work[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, fmt.Errorf("singular matrix")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+
+		scale := gfInv(work[col][col])
+		for j := range work[col] {
+			work[col][j] = gfMul(work[col][j], scale)
+		}
+
+		for i := 0; i < n; i++ {
+			if i == col || work[i][col] == 0 {
+				continue
+			}
+			factor := work[i][col]
+			for j := range work[i] {
+				work[i][j] ^= gfMul(factor, work[col][j])
+			}
+		}
+	}
+
+	inv := newGFMatrix(n, n)
+	for i := range inv {
+		copy(inv[i], work[i][n:])
+	}
+	return inv, nil
+}
+
+// ReedSolomon is a systematic erasure code: the data shards are kept as they are
+// and the parity shards are computed from them, so that any dataShards of all
+// the shards are enough to rebuild the others.
+// All the shards of a stripe must have the same size.
+type ReedSolomon struct {
+	dataShards   int
+	parityShards int
+
+	// (dataShards+parityShards) x dataShards, the identity on top,
+	// any dataShards rows of it are invertible
+	encoding gfMatrix
+}
+
+// NewReedSolomon code with dataShards data and parityShards parity shards per stripe,
+// at most 256 shards in total
+func NewReedSolomon(dataShards, parityShards int) (*ReedSolomon, error) {
+	if dataShards <= 0 || parityShards < 0 {
+		return nil, fmt.Errorf("Invalid Reed-Solomon code of %d data and %d parity shards", dataShards, parityShards)
+	}
+	total := dataShards + parityShards
+	if total > 256 {
+		return nil, fmt.Errorf("Reed-Solomon code of %d shards, no more than 256 supported", total)
+	}
+
+	// The Vandermonde matrix has any dataShards rows independent,
+	// multiplying by the inverse of its top keeps that and makes it systematic
+	vandermonde := newGFMatrix(total, dataShards)
+	for i := range vandermonde {
+		for j := range vandermonde[i] {
+			vandermonde[i][j] = gfPow(byte(i), j)
+		}
+	}
+	topInv, err := vandermonde[:dataShards].invert()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ReedSolomon{
+		dataShards:   dataShards,
+		parityShards: parityShards,
+		encoding:     vandermonde.mul(topInv),
+	}, nil
+}
+
+// DataShards per stripe
+func (rs *ReedSolomon) DataShards() int {
+	return rs.dataShards
+}
+
+// ParityShards per stripe
+func (rs *ReedSolomon) ParityShards() int {
+	return rs.parityShards
+}
+
+// shardSize of the stripe, error if the present shards differ
+func (rs *ReedSolomon) shardSize(shards [][]byte) (int, error) {
+	if len(shards) != rs.dataShards+rs.parityShards {
+		return 0, fmt.Errorf("Expected %d shards, got %d", rs.dataShards+rs.parityShards, len(shards))
+	}
+	size := -1
+	for _, shard := range shards {
+		if shard == nil {
+			continue
+		}
+		if size >= 0 && len(shard) != size {
+			return 0, fmt.Errorf("Shards of different sizes: %d and %d", size, len(shard))
+		}
+		size = len(shard)
+	}
+	return size, nil
+}
+
+// codeRows computes out[i] = rows[i] * in, for all bytes of the shards
+func codeRows(rows gfMatrix, in [][]byte, out [][]byte) {
+	for i, row := range rows {
+		for j := range out[i] {
+			out[i][j] = 0
+		}
+		for k, coef := range row {
+			if coef == 0 {
+				continue
+			}
+			for j, b := range in[k] {
+				out[i][j] ^= gfMul(coef, b)
+			}
+		}
+	}
+}
+
+// Encode the parity shards from the data shards.
+// shards holds the data shards then the parity shards, the parity shards are allocated if nil.
+func (rs *ReedSolomon) Encode(shards [][]byte) error {
+	if len(shards) != rs.dataShards+rs.parityShards {
+		return fmt.Errorf("Expected %d shards, got %d", rs.dataShards+rs.parityShards, len(shards))
+	}
+	for i := 0; i < rs.dataShards; i++ {
+		if shards[i] == nil {
+			return fmt.Errorf("Data shard %d missing", i)
+		}
+	}
+	size, err := rs.shardSize(shards)
+	if err != nil {
+		return err
+	}
+
+	for i := rs.dataShards; i < len(shards); i++ {
+		if shards[i] == nil {
+			shards[i] = make([]byte, size)
+		}
+	}
+	codeRows(rs.encoding[rs.dataShards:], shards[:rs.dataShards], shards[rs.dataShards:])
+	return nil
+}
+
+// Reconstruct the missing (nil) shards, data and parity, from any dataShards present ones
+func (rs *ReedSolomon) Reconstruct(shards [][]byte) error {
+	size, err := rs.shardSize(shards)
+	if err != nil {
+		return err
+	}
+
+	// the first dataShards present shards, and the rows of the code giving them
+	present := make([][]byte, 0, rs.dataShards)
+	rows := make(gfMatrix, 0, rs.dataShards)
+	for i, shard := range shards {
+		if shard != nil && len(present) < rs.dataShards {
+			present = append(present, shard)
+			rows = append(rows, rs.encoding[i])
+		}
+	}
+	if len(present) < rs.dataShards {
+		return fmt.Errorf("Too few shards to reconstruct: %d of %d needed", len(present), rs.dataShards)
+	}
+
+	decoding, err := rows.invert()
+	if err != nil {
+		return err
+	}
+
+	// The data first, then the parity is encoded again from it
+	var missingRows gfMatrix
+	var missing [][]byte
+	for i := 0; i < rs.dataShards; i++ {
+		if shards[i] == nil {
+			shards[i] = make([]byte, size)
+			missingRows = append(missingRows, decoding[i])
+			missing = append(missing, shards[i])
+		}
+	}
+	codeRows(missingRows, present, missing)
+
+	missingRows, missing = nil, nil
+	for i := rs.dataShards; i < len(shards); i++ {
+		if shards[i] == nil {
+			shards[i] = make([]byte, size)
+			missingRows = append(missingRows, rs.encoding[i])
+			missing = append(missing, shards[i])
+		}
+	}
+	codeRows(missingRows, shards[:rs.dataShards], missing)
+	return nil
+}
@@ -0,0 +1,74 @@
+package algorithm
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/GIFTS-fs/GIFTS/test"
+)
+
+func TestGF(t *testing.T) {
+	af := func(cond bool, msg string) {
+		test.AF(t, cond, msg)
+	}
+
+	for a := 1; a < 256; a++ {
+		af(gfMul(byte(a), gfInv(byte(a))) == 1, fmt.Sprintf("%d * 1/%d != 1", a, a))
+		af(gfMul(byte(a), 1) == byte(a), fmt.Sprintf("%d * 1 != %d", a, a))
+		af(gfMul(byte(a), 0) == 0, fmt.Sprintf("%d * 0 != 0", a))
+	}
+	af(gfMul(3, 7) == gfMul(7, 3), "multiplication should commute")
+	af(gfPow(2, 8) == gfPolynomial&0xff, "2^8 should wrap around the polynomial")
+}
+
+func TestReedSolomon(t *testing.T) {
+	af := func(cond bool, msg string) {
+		test.AF(t, cond, msg)
+	}
+
+	_, err := NewReedSolomon(0, 2)
+	af(err != nil, "Code without data shards should fail")
+	_, err = NewReedSolomon(200, 57)
+	af(err != nil, "Code with more than 256 shards should fail")
+
+	for _, km := range [][2]int{{1, 1}, {3, 2}, {4, 0}, {6, 3}, {10, 4}} {
+		k, m := km[0], km[1]
+		t.Logf("TestReedSolomon: Starting test k=%d m=%d", k, m)
+		rs, err := NewReedSolomon(k, m)
+		af(err == nil, fmt.Sprintf("NewReedSolomon(%d, %d) failed: %v", k, m, err))
+
+		shards := make([][]byte, k+m)
+		for i := 0; i < k; i++ {
+			shards[i] = make([]byte, 100)
+			rand.Read(shards[i])
+		}
+		af(rs.Encode(shards) == nil, "Encode failed")
+		orig := make([][]byte, k+m)
+		for i := range shards {
+			orig[i] = append([]byte{}, shards[i]...)
+		}
+
+		// Lose any m shards, a few times
+		for round := 0; round < 10; round++ {
+			for _, i := range rand.Perm(k + m)[:m] {
+				shards[i] = nil
+			}
+			af(rs.Reconstruct(shards) == nil, "Reconstruct failed")
+			for i := range shards {
+				af(bytes.Equal(shards[i], orig[i]), fmt.Sprintf("Shard %d differs after reconstruction", i))
+			}
+		}
+
+		// One more is too many
+		for _, i := range rand.Perm(k + m)[:m+1] {
+			shards[i] = nil
+		}
+		af(rs.Reconstruct(shards) != nil, "Reconstruct from too few shards should fail")
+	}
+
+	rs, _ := NewReedSolomon(2, 1)
+	af(rs.Encode([][]byte{make([]byte, 2), make([]byte, 3), nil}) != nil, "Encode of different sizes should fail")
+	af(rs.Encode([][]byte{make([]byte, 2), nil, nil}) != nil, "Encode without all data should fail")
+}
@@ -91,6 +91,7 @@ func (r *RunningMedian) Add(add float64) {
 	r.size++
 
 	r.balance(balance)
+	r.delete() // balancing may expose a to-be-deleted top
 
 	r.calculate()
 }
@@ -122,43 +123,42 @@ func (r *RunningMedian) delete() {
 // Delete an element, not concurrency safe.
 // If the element to delete was not Added,
 // the behavior is undefined (may panic eventually)
-// Not tested!
 func (r *RunningMedian) Delete(del float64) {
 	if r.size <= 0 {
 		return
 	}
 
-	balance := 0
 	// logN or buffer
 	if del <= r.lower.Top() {
-		balance--
 		if del == r.lower.Top() {
 			heap.Pop(r.lower)
 		} else {
 			r.delLower++
 			r.del[del]++
 		}
-		if r.size > 1 {
-			heap.Push(r.lower, heap.Pop(r.higher))
-		}
 	} else {
-		balance++
 		if del == r.higher.Top() {
 			heap.Pop(r.higher)
 		} else {
 			r.delHigher++
 			r.del[del]++
 		}
-		heap.Push(r.higher, heap.Pop(r.lower))
 	}
 
 	r.size--
 
 	r.delete() // ensures not moving to-be-deleted data
-	r.balance(balance)
+
+	// restore the invariant on the real (not to-be-deleted) sizes
+	nLower, nHigher := r.lower.Len()-r.delLower, r.higher.Len()-r.delHigher
+	if nLower > nHigher+1 {
+		heap.Push(r.higher, heap.Pop(r.lower))
+	} else if nLower < nHigher {
+		heap.Push(r.lower, heap.Pop(r.higher))
+	}
+
 	r.delete()
 
-	// 1
 	if r.size > 0 {
 		r.calculate()
 	} else {
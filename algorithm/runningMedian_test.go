@@ -301,7 +301,47 @@ func TestRunningMedianDelete(t *testing.T) {
 	running.Add(3)
 	as(running.Median(), 3, "3")
 
-	// TODO!!! add more tests
+	// [1,2,3,4] -> [1,3,4] -> [1,4] -> [1,4,4] -> [4,4]
+	running = NewRunningMedian()
+	running.Add(1)
+	running.Add(2)
+	running.Add(3)
+	running.Add(4)
+	as(running.Median(), 2.5, "2.5")
+	running.Delete(2)
+	as(running.Median(), 3, "3")
+	running.Delete(3)
+	as(running.Median(), 2.5, "2.5")
+	running.Add(4)
+	as(running.Median(), 4, "4")
+	running.Delete(1)
+	as(running.Median(), 4, "4")
+
+	// random mix of Add and Delete against sorting
+	running = NewRunningMedian()
+	var window []float64
+	for i := 0; i < 1000; i++ {
+		if len(window) > 0 && rand.Intn(3) == 0 {
+			del := rand.Intn(len(window))
+			running.Delete(window[del])
+			window = append(window[:del], window[del+1:]...)
+		} else {
+			add := float64(rand.Intn(10))
+			running.Add(add)
+			window = append(window, add)
+		}
+
+		if len(window) == 0 {
+			continue
+		}
+		sorted := append([]float64{}, window...)
+		sort.Float64s(sorted)
+		want := sorted[len(sorted)/2]
+		if len(sorted)%2 == 0 {
+			want = 0.5 * (sorted[len(sorted)/2-1] + sorted[len(sorted)/2])
+		}
+		as(running.Median(), want, fmt.Sprintf("random step %d", i))
+	}
 }
 
 func TestRunningMedian_Add(t *testing.T) {
@@ -13,4 +13,5 @@ echo "Finish building benchmarks"
 echo
 echo "    Usage: ./run-<some-benchmark> -label <some-label> -conf <some-non-default-config-file>.json"
 echo "    The benchmarks (run as clients) use \"config-client.json\" by default"
+echo "    Set \"RPCProtocol\" to 1 in the config to run them over the framed protocol instead of gob"
 echo
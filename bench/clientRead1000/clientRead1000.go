@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"flag"
 	"fmt"
 	"os"
@@ -32,6 +33,7 @@ func main() {
 	flag.Parse()
 	config, err := config.LoadGet(*configPath)
 	bench.ExitUnless(err == nil, fmt.Sprintf("Error loading config: %v", err))
+	bench.UseRPCConfig(config)
 
 	file, err := os.Create(fmt.Sprintf("%vresults-%d.csv", *label, time.Now().UnixNano()))
 	bench.ExitUnless(err == nil, fmt.Sprintf("Failed to create results file: %v", err))
@@ -61,8 +63,8 @@ func main() {
 				data := make([]byte, blockSize)
 				g.Read(data)
 
-				c.Store(fName, 1, data)
-				// err := c.Store(fName, 1, data)
+				c.Store(context.Background(), fName, 1, data)
+				// err := c.Store(context.Background(), fName, 1, data)
 				// bench.ExitUnless(err == nil, fmt.Sprintf("Client.Store failed: %v", err))
 			}
 
@@ -79,8 +81,8 @@ func main() {
 
 						startTime := time.Now()
 						for time.Since(startTime).Seconds() < runTime {
-							client.Read(fNames[nReads%1000])
-							// _, err = client.Read(fNames[nReads%1000])
+							client.Read(context.Background(), fNames[nReads%1000])
+							// _, err = client.Read(context.Background(), fNames[nReads%1000])
 							nReads++
 						}
 
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"flag"
 	"fmt"
 	"os"
@@ -33,6 +34,7 @@ func main() {
 	flag.Parse()
 	config, err := config.LoadGet(*configPath)
 	bench.ExitUnless(err == nil, fmt.Sprintf("Error loading config: %v", err))
+	bench.UseRPCConfig(config)
 
 	file, err := os.Create(fmt.Sprintf("%vresults-%d.csv", *label, time.Now().UnixNano()))
 	bench.ExitUnless(err == nil, fmt.Sprintf("Failed to create results file: %v", err))
@@ -57,7 +59,7 @@ func main() {
 			fName := fmt.Sprintf("file_%d_%d_%d", blockSize, fileSize, nReplicas)
 			data := make([]byte, fileSize)
 			g.Read(data)
-			c.Store(fName, uint(nReplicas), data)
+			c.Store(context.Background(), fName, uint(nReplicas), data)
 
 			for nReaders := 40; nReaders <= 40; nReaders++ {
 
@@ -78,8 +80,8 @@ func main() {
 								done <- float64(nReads*fileSize) / time.Since(startTime).Seconds() / 1000000
 							}()
 							for time.Since(startTime).Seconds() < runTime {
-								client.Read(fName)
-								// _, err = client.Read(fName)
+								client.Read(context.Background(), fName)
+								// _, err = client.Read(context.Background(), fName)
 								// bench.ExitUnless(err == nil, fmt.Sprintf("Client.Read failed: %v", err))
 								nReads++
 							}
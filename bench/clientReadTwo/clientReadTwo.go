@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"flag"
 	"fmt"
 	"os"
@@ -33,6 +34,7 @@ func main() {
 	flag.Parse()
 	config, err := config.LoadGet(*configPath)
 	bench.ExitUnless(err == nil, fmt.Sprintf("Error loading config: %v", err))
+	bench.UseRPCConfig(config)
 
 	file, err := os.Create(fmt.Sprintf("%vresults-%d.csv", *label, time.Now().UnixNano()))
 	bench.ExitUnless(err == nil, fmt.Sprintf("Failed to create results file: %v", err))
@@ -55,7 +57,7 @@ func main() {
 
 		data := make([]byte, fileSize)
 		g.Read(data)
-		c.Store(fName, uint(nReplicas), data)
+		c.Store(context.Background(), fName, uint(nReplicas), data)
 	}
 
 	done := make(chan []int, nFileOneReaders+nFileTwoReaders)
@@ -76,8 +78,8 @@ func main() {
 			defer func() { done <- readArr }()
 			// for startTime := time.Now(); time.Since(startTime).Hours() < 2; {
 			for startTime := time.Now(); time.Since(startTime).Seconds() < float64(runTime); {
-				client.Read(fName)
-				// _, err = client.Read(fName)
+				client.Read(context.Background(), fName)
+				// _, err = client.Read(context.Background(), fName)
 				// bench.ExitUnless(err == nil, fmt.Sprintf("Client.Read failed: %v", err))
 				nReads++
 
@@ -111,8 +113,8 @@ func main() {
 
 			defer func() { done <- readArr }()
 			for startTime := time.Now(); time.Since(startTime).Seconds() < float64(runTime); {
-				client.Read(fName)
-				// _, err = client.Read(fName)
+				client.Read(context.Background(), fName)
+				// _, err = client.Read(context.Background(), fName)
 				// bench.ExitUnless(err == nil, fmt.Sprintf("Client.Read failed: %v", err))
 				nReads++
 
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"math/rand"
@@ -60,7 +61,7 @@ func createFiles(c *client.Client, config *config.Config, fNamePrefix string) (f
 
 		data := make([]byte, fileSize)
 		g.Read(data)
-		c.Store(fName, rFactor, data)
+		c.Store(context.Background(), fName, rFactor, data)
 		files = append(files, fName)
 	}
 	for i := 0; i < nCreateMedium; i++ {
@@ -69,7 +70,7 @@ func createFiles(c *client.Client, config *config.Config, fNamePrefix string) (f
 
 		data := make([]byte, fileSize)
 		g.Read(data)
-		c.Store(fName, rFactor, data)
+		c.Store(context.Background(), fName, rFactor, data)
 		files = append(files, fName)
 	}
 	for i := 0; i < nCreateLarge; i++ {
@@ -78,7 +79,7 @@ func createFiles(c *client.Client, config *config.Config, fNamePrefix string) (f
 
 		data := make([]byte, fileSize)
 		g.Read(data)
-		c.Store(fName, rFactor, data)
+		c.Store(context.Background(), fName, rFactor, data)
 		files = append(files, fName)
 	}
 	for i := 0; i < nCreateColossal; i++ {
@@ -87,7 +88,7 @@ func createFiles(c *client.Client, config *config.Config, fNamePrefix string) (f
 
 		data := make([]byte, fileSize)
 		g.Read(data)
-		c.Store(fName, rFactor, data)
+		c.Store(context.Background(), fName, rFactor, data)
 		files = append(files, fName)
 	}
 
@@ -117,9 +118,9 @@ func doReading(files []string, r *rand.Rand, readers []*client.Client) {
 				case -1:
 					return
 				case 1:
-					r.Read(files[rand.Intn(len(files))])
+					r.Read(context.Background(), files[rand.Intn(len(files))])
 				case 2:
-					r.Read(files[idx])
+					r.Read(context.Background(), files[idx])
 				}
 				time.Sleep(jobPeriod * time.Millisecond)
 			}
@@ -161,6 +162,7 @@ func main() {
 	flag.Parse()
 	config, err := config.LoadGet(*configPath)
 	bench.ExitUnless(err == nil, fmt.Sprintf("Error loading config: %v", err))
+	bench.UseRPCConfig(config)
 
 	// file, err := os.Create(fmt.Sprintf("%vresults-%d.csv", *label, time.Now().UnixNano()))
 	// bench.ExitUnless(err == nil, fmt.Sprintf("Failed to create results file: %v", err))
@@ -1,6 +1,12 @@
 package bench
 
-import "log"
+import (
+	"fmt"
+	"log"
+
+	gifts "github.com/GIFTS-fs/GIFTS"
+	"github.com/GIFTS-fs/GIFTS/config"
+)
 
 const (
 	// DefaultConfigPathClient since client does not need to know the policy
@@ -14,3 +20,11 @@ func ExitUnless(cond bool, msg string) {
 		log.Fatalf(msg)
 	}
 }
+
+// UseRPCConfig of conf for all the RPCs of the benchmark,
+// so the protocols can be compared by their config
+func UseRPCConfig(conf *config.Config) {
+	tlsConfig, err := gifts.LoadTLSConfig(conf.TLSCAFile, conf.TLSCertFile, conf.TLSKeyFile, conf.TLSServerName)
+	ExitUnless(err == nil, fmt.Sprintf("Error loading TLS config: %v", err))
+	config.UseRPC(conf, tlsConfig)
+}
@@ -2,6 +2,7 @@ package bench
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"os"
 	"testing"
@@ -39,7 +40,8 @@ func TestBenchmarkMaster_Lookup(t *testing.T) {
 		fName := fmt.Sprintf("file_%d", n)
 		fNames[n] = fName
 
-		m.Create(fName, config.GiftsBlockSize, 1)
+		m.Create(context.Background(), fName, config.GiftsBlockSize, 1, nil, false)
+		m.Commit(context.Background(), fName, nil)
 	}
 
 	for nReaders := 1; nReaders <= 100; nReaders++ {
@@ -56,7 +58,7 @@ func TestBenchmarkMaster_Lookup(t *testing.T) {
 					defer func() { done <- float64(nReads) }()
 					startTime := time.Now()
 					for time.Since(startTime).Seconds() < runTime {
-						m.Lookup(fNames[nReads%1000])
+						m.Lookup(context.Background(), fNames[nReads%1000])
 						nReads++
 					}
 				}()
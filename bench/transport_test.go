@@ -0,0 +1,80 @@
+package bench
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	gifts "github.com/GIFTS-fs/GIFTS"
+	"github.com/GIFTS-fs/GIFTS/storage"
+	"github.com/GIFTS-fs/GIFTS/structure"
+)
+
+const addrTransport = "localhost:3970"
+
+var serveTransport sync.Once
+
+// rpcStorageOf the transport benchmarks, on a pool in the protocol
+func rpcStorageOf(b *testing.B, protocol gifts.Protocol) (*storage.RPCStorage, func()) {
+	serveTransport.Do(func() {
+		s := storage.NewStorage()
+		s.Logger.Enabled = false
+		if err := storage.ServeRPC(s, addrTransport); err != nil {
+			b.Fatalf("ServeRPC failed: %v", err)
+		}
+	})
+
+	pool := gifts.NewRPCPool(1, 0, 0, protocol, nil)
+	rpcs := storage.NewRPCStorageOn(addrTransport, pool.NewClient(addrTransport, storage.RPCPathStorage))
+	return rpcs, pool.Close
+}
+
+// benchmarkTransport runs f over both protocols, for blocks of some sizes
+func benchmarkTransport(b *testing.B, f func(b *testing.B, rpcs *storage.RPCStorage, block gifts.Block)) {
+	for _, protocol := range []gifts.Protocol{gifts.ProtocolGob, gifts.ProtocolFramed} {
+		for _, blockSize := range []int{4096, 65536, 1048576} {
+			name := fmt.Sprintf("gob/%d", blockSize)
+			if protocol == gifts.ProtocolFramed {
+				name = fmt.Sprintf("framed/%d", blockSize)
+			}
+			b.Run(name, func(b *testing.B) {
+				rpcs, done := rpcStorageOf(b, protocol)
+				defer done()
+				rpcs.Logger.Enabled = false
+
+				block := make(gifts.Block, blockSize)
+				b.SetBytes(int64(blockSize))
+				b.ResetTimer()
+				f(b, rpcs, block)
+			})
+		}
+	}
+}
+
+func BenchmarkTransportSet(b *testing.B) {
+	benchmarkTransport(b, func(b *testing.B, rpcs *storage.RPCStorage, block gifts.Block) {
+		for N := 0; N < b.N; N++ {
+			if err := rpcs.Set(context.Background(), &structure.BlockKV{ID: "block", Data: block}); err != nil {
+				b.Fatalf("Set failed: %v", err)
+			}
+		}
+	})
+}
+
+func BenchmarkTransportGet(b *testing.B) {
+	benchmarkTransport(b, func(b *testing.B, rpcs *storage.RPCStorage, block gifts.Block) {
+		id := fmt.Sprintf("block_%d", len(block))
+		if err := rpcs.Set(context.Background(), &structure.BlockKV{ID: id, Data: block}); err != nil {
+			b.Fatalf("Set failed: %v", err)
+		}
+		b.ResetTimer()
+
+		var ret gifts.Block
+		for N := 0; N < b.N; N++ {
+			if err := rpcs.Get(context.Background(), id, &ret); err != nil {
+				b.Fatalf("Get failed: %v", err)
+			}
+		}
+	})
+}
@@ -1,5 +1,11 @@
 package gifts
 
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+)
+
 // Block is one fixed-size block stored by GIFTS,
 // WARN: the performance depends on the slice type,
 // it must be not raw data to be copied around
@@ -13,3 +19,27 @@ func NBlocks(blockSize, fsize int) (n int) {
 	}
 	return
 }
+
+// NStripes calculates the number of erasure-coded stripes for given file size,
+// each of dataShards data blocks
+func NStripes(blockSize, dataShards, fsize int) int {
+	return NBlocks(blockSize*dataShards, fsize)
+}
+
+// Checksum of the block, to detect corruption from end to end.
+// The empty checksum means unknown and is never verified.
+func Checksum(b Block) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// NewChecksumHash for the Checksum of a block read piece by piece,
+// see ChecksumOf
+func NewChecksumHash() hash.Hash {
+	return sha256.New()
+}
+
+// ChecksumOf the block written to h, the same as Checksum of it whole
+func ChecksumOf(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
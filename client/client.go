@@ -1,8 +1,10 @@
 package client
 
 import (
+	"context"
 	"fmt"
 	"sync"
+	"time"
 
 	gifts "github.com/GIFTS-fs/GIFTS"
 	"github.com/GIFTS-fs/GIFTS/config"
@@ -34,6 +36,7 @@ func NewClient(masters []string, config *config.Config) *Client {
 // Store() must not modify data[] or keep a copy of it.
 // For current version, we just use whatever the Golang slice has:
 // len() with int type
+// The outstanding block transfers are aborted once ctx is done or one of them fails.
 //
 // It returns an error if:
 //		- A file with the specified file name already exists
@@ -41,7 +44,7 @@ func NewClient(masters []string, config *config.Config) *Client {
 //		- The Master does not give us enough blocks in which to store the data
 //
 //		- There is a network error (this is fatal and cannot be recovered from)
-func (c *Client) Store(fname string, rfactor uint, data []byte) error {
+func (c *Client) Store(ctx context.Context, fname string, rfactor uint, data []byte) error {
 	// PRODUCTION: banish all logs
 
 	// Make sure file name is not empty
@@ -59,19 +62,25 @@ func (c *Client) Store(fname string, rfactor uint, data []byte) error {
 	}
 
 	fsize := len(data)
+	nBlocks := gifts.NBlocks(c.config.GiftsBlockSize, fsize)
+
+	// Checksum each block, so that corruption anywhere on the way is detected
+	checksums := make([]string, nBlocks)
+	for i := range checksums {
+		checksums[i] = gifts.Checksum(c.blockOf(data, i))
+	}
 
 	// Get block assignments from Master.
 	// The result is a list where the ith element of the list is another list
 	// that specifies the Storage nodes at which to replicate the ith block of
 	// the file.
-	assignments, err := c.master.Create(fname, fsize, rfactor)
+	// With deduplication the blocks already stored by any file are not uploaded again
+	assignments, err := c.master.Create(ctx, fname, fsize, rfactor, checksums, c.config.ClientDedupEnabled)
 	if err != nil {
 		c.Logger.Printf("Client.Store(fname=%q, rfactor=%d, fsize=%d) => %v", fname, rfactor, fsize, err)
 		return err
 	}
 
-	nBlocks := gifts.NBlocks(c.config.GiftsBlockSize, fsize)
-
 	// Verify that the master gave us the correct number of Storage nodes to
 	// write to.
 	if nBlocks != len(assignments) {
@@ -81,104 +90,220 @@ func (c *Client) Store(fname string, rfactor uint, data []byte) error {
 	}
 
 	// For each block of data
+	// the first failure cancels the outstanding transfers
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stopLease := c.keepLease(ctx, fname)
 	var wg sync.WaitGroup
-	var terr error = nil
+	terr := firstError{cancel: cancel}
 	for i, assignment := range assignments {
-		startIndex := i * c.config.GiftsBlockSize
-		endIndex := (i + 1) * c.config.GiftsBlockSize
-		if endIndex > fsize {
-			endIndex = fsize
+		if assignment.Exists {
+			continue
 		}
-
-		var b gifts.Block = data[startIndex:endIndex]
+		b := c.blockOf(data, i)
 
 		// Write to replicas
 		for _, addr := range assignment.Replicas {
 
-			// Get connection to Storage node.  If one doesn't already exist,
-			// create one.  Note that a failed Load + LoadOrStore is ~14x
-			// faster than a single LoadOrStore for the common scenario (write
-			// once, read many), so this logic is on purpose.
-			rpcs, ok := c.storages.Load(addr)
-			if !ok {
-				rpcs, _ = c.storages.LoadOrStore(addr, storage.NewRPCStorage(addr))
-			}
+			rpcs := c.storageOf(addr)
 
 			// Spawned go routines will stop on first (detected) error
 			wg.Add(1)
-			go func(id string, b gifts.Block) {
+			go func(id string, b gifts.Block, checksum string) {
 				defer wg.Done()
 
 				// Another Set already failed so there's no point in doing this Set
-				if terr != nil {
+				if err := ctx.Err(); err != nil {
+					terr.set(err)
 					return
 				}
 
-				if err := rpcs.(*storage.RPCStorage).Set(&structure.BlockKV{ID: id, Data: b}); err != nil {
-					terr = err
+				if err := rpcs.Set(ctx, &structure.BlockKV{ID: id, Data: b, Checksum: checksum}); err != nil {
+					terr.set(err)
 				}
-			}(assignment.BlockID, b)
+			}(assignment.BlockID, b, checksums[i])
 
 		}
 	}
 
 	wg.Wait()
+	stopLease()
+
+	// Make the file visible only once all blocks are there,
+	// or give the name back
+	err = terr.err
+	if err == nil {
+		err = c.master.Commit(ctx, fname, nil)
+	} else {
+		c.abort(fname)
+	}
 
-	if terr == nil {
+	if err == nil {
 		c.Logger.Printf("Client.Store(fname=%q, rfactor=%d, fsize=%d) => success", fname, rfactor, fsize)
 	} else {
-		c.Logger.Printf("Client.Store(fname=%q, rfactor=%d, fsize=%d) => %v", fname, rfactor, fsize, terr)
+		c.Logger.Printf("Client.Store(fname=%q, rfactor=%d, fsize=%d) => %v", fname, rfactor, fsize, err)
+	}
+	return err
+}
+
+// firstError of concurrent transfers, the others are canceled once it is set
+type firstError struct {
+	once   sync.Once
+	err    error
+	cancel context.CancelFunc
+}
+
+// set the error if it is the first one
+func (e *firstError) set(err error) {
+	e.once.Do(func() {
+		e.err = err
+		e.cancel()
+	})
+}
+
+// abort the creation of fname, best effort,
+// the Master deletes it anyway once the lease expires.
+// Not bound to the context of the creation, it may be the reason to abort.
+func (c *Client) abort(fname string) {
+	if err := c.master.Delete(context.Background(), fname); err != nil {
+		c.Logger.Printf("Client.abort(fname=%q) => %v", fname, err)
+	}
+}
+
+// leaseRenewal is how long a writer goes before renewing the lease of its file,
+// half the lease so that a slow upload does not miss it, 0 if leases never expire
+func (c *Client) leaseRenewal() time.Duration {
+	return time.Second * c.config.MasterCreateLeaseSec / 2
+}
+
+// keepLease of fname renewed in background until stop is called or ctx is done,
+// so that an upload longer than the lease is not deleted under the writer.
+// A failed renewal fails the commit anyway, it is only logged here.
+func (c *Client) keepLease(ctx context.Context, fname string) (stop func()) {
+	interval := c.leaseRenewal()
+	if interval <= 0 {
+		return func() {}
+	}
+
+	done, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(exited)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := c.master.RenewLease(ctx, fname); err != nil {
+					c.Logger.Printf("Client.keepLease(fname=%q) => %v", fname, err)
+				}
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// no renewal racing with the commit
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+// storageOf addr, the connection to the Storage node
+func (c *Client) storageOf(addr string) *storage.RPCStorage {
+	// If one doesn't already exist, create one.
+	// Note that a failed Load + LoadOrStore is ~14x
+	// faster than a single LoadOrStore for the common scenario (write
+	// once, read many), so this logic is on purpose.
+	rpcs, ok := c.storages.Load(addr)
+	if !ok {
+		rpcs, _ = c.storages.LoadOrStore(addr, storage.NewRPCStorage(addr))
+	}
+	return rpcs.(*storage.RPCStorage)
+}
+
+// blockOf data, the ith one
+func (c *Client) blockOf(data []byte, i int) gifts.Block {
+	startIndex := i * c.config.GiftsBlockSize
+	endIndex := (i + 1) * c.config.GiftsBlockSize
+	if endIndex > len(data) {
+		endIndex = len(data)
 	}
-	return terr
+	return data[startIndex:endIndex]
+}
+
+// readBlock from the replicas of the assignment in order,
+// falling back to the next replica on error or if the data does not match the checksum.
+// The failed replicas are reported to the master.
+func (c *Client) readBlock(ctx context.Context, block structure.BlockAssign) (gifts.Block, error) {
+	err := fmt.Errorf("Master didn't return any replicas: %v", block)
+	for _, replica := range block.Replicas {
+		var blockRead gifts.Block
+		if err = c.storageOf(replica).Get(ctx, block.BlockID, &blockRead); err != nil {
+			c.Logger.Printf("Client.readBlock(%q) => %v", block.BlockID, err)
+			if ctx.Err() != nil {
+				// given up, not the fault of the replica
+				return nil, err
+			}
+			go func(replica string) {
+				if err := c.master.ReportUnreachable(context.Background(), replica); err != nil {
+					c.Logger.Printf("Client.readBlock(%q) failed to report %q: %v", block.BlockID, replica, err)
+				}
+			}(replica)
+			continue
+		}
+
+		if block.Checksum == "" || gifts.Checksum(blockRead) == block.Checksum {
+			return blockRead, nil
+		}
+
+		err = fmt.Errorf("Block %q on %q does not match checksum %s", block.BlockID, replica, block.Checksum)
+		c.Logger.Printf("Client.readBlock(%q) => %v", block.BlockID, err)
+		go func(replica string) {
+			if err := c.master.ReportCorrupt(context.Background(), replica, block.BlockID); err != nil {
+				c.Logger.Printf("Client.readBlock(%q) failed to report %q: %v", block.BlockID, replica, err)
+			}
+		}(replica)
+	}
+	return nil, err
 }
 
 // Read reads a file with the specified file name from the remote Storage.
+// Each block is verified against its checksum,
+// the other replicas are tried if one fails or does not match.
+// The outstanding block transfers are aborted once ctx is done or one of them fails.
 // It returns an error if:
 //		- The file does not exist
 // 		- The Master fails or returns inconsistent metadata
 //		- There is a network error
-func (c *Client) Read(fname string) ([]byte, error) {
+func (c *Client) Read(ctx context.Context, fname string) ([]byte, error) {
 	// PRODUCTION: banish all the logs
 
 	// Get location of each block of the file from the Master
-	fb, err := c.master.Lookup(fname)
+	fb, err := c.master.Lookup(ctx, fname)
 	if err != nil {
 		c.Logger.Printf("Client.Read(fname=%q) => %v", fname, err)
 		return []byte{}, err
 	}
 
 	// Verify metadata from Master
-	nBlocks := gifts.NBlocks(c.config.GiftsBlockSize, fb.Fsize)
-	if len(fb.Assignments) != nBlocks {
+	if len(fb.Assignments) != c.nBlocksOf(fb) {
 		msg := fmt.Sprintf("Master returned %d blocks for a file with %d bytes", len(fb.Assignments), fb.Fsize)
 		c.Logger.Printf("Client.Read(fname=%q) => %q", fname, msg)
 		return []byte{}, fmt.Errorf(msg)
 	}
 
+	// the first failure cancels the outstanding transfers
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	var wg sync.WaitGroup
 
 	// Loop over every block
 	bytesRead := make([]byte, fb.Fsize)
-	var terr error = nil
-	for i, block := range fb.Assignments {
-		// return error if not enough replicas provided
-		if len(block.Replicas) < 1 {
-			terr = fmt.Errorf("Master didn't return any replicas: %v", block)
-			break
-		}
-
-		// WARN: hard-code only one
-		replica := block.Replicas[0]
-
-		// Get connection to Storage node.  If one doesn't already exist,
-		// create one.  Note that a failed Load + LoadOrStore is ~14x
-		// faster than a single LoadOrStore for the common scenario (write
-		// once, read many), so this logic is on purpose.
-		rpcs, ok := c.storages.Load(replica)
-		if !ok {
-			rpcs, _ = c.storages.LoadOrStore(replica, storage.NewRPCStorage(replica))
-		}
-
+	terr := firstError{cancel: cancel}
+	for i := 0; i < gifts.NBlocks(c.config.GiftsBlockSize, fb.Fsize); i++ {
 		startIndex := i * c.config.GiftsBlockSize
 		endIndex := (i + 1) * c.config.GiftsBlockSize
 		if endIndex > fb.Fsize {
@@ -187,30 +312,250 @@ func (c *Client) Read(fname string) ([]byte, error) {
 
 		// Spawned go routines will stop on first (detected) error
 		wg.Add(1)
-		go func(id string, start, end int) {
+		go func(i, start, end int) {
 			defer wg.Done()
 			// Another Get already failed so there's no point in doing this Get
-			if terr != nil {
+			if err := ctx.Err(); err != nil {
+				terr.set(err)
 				return
 			}
 
-			var blockRead gifts.Block
-			if err := rpcs.(*storage.RPCStorage).Get(id, &blockRead); err != nil {
-				terr = err
+			blockRead, err := c.dataBlock(ctx, fb, i)
+			if err != nil {
+				terr.set(err)
 			}
 
 			copy(bytesRead[start:end], blockRead)
-		}(block.BlockID, startIndex, endIndex)
+		}(i, startIndex, endIndex)
 
 	}
 
 	wg.Wait()
 
-	if terr != nil {
-		c.Logger.Printf("Client.Read(fname=%q) => %v", fname, terr)
-		return []byte{}, terr
+	if terr.err != nil {
+		c.Logger.Printf("Client.Read(fname=%q) => %v", fname, terr.err)
+		return []byte{}, terr.err
 	}
 
 	c.Logger.Printf("Client.Read(fname=%q) => %d bytes", fname, fb.Fsize)
 	return bytesRead, nil
 }
+
+// ReadAt reads at most n bytes of a file starting at offset off.
+// Only the Storage nodes holding the blocks in the range are contacted,
+// and only for the bytes needed. A partial block cannot be verified
+// against its checksum, that is left to the scrubbers of the Storage nodes.
+// Fewer bytes are returned if the file ends before.
+// It returns an error if:
+//		- The file does not exist
+//		- The offset is negative or beyond the end of the file
+// 		- The Master fails or returns inconsistent metadata
+//		- There is a network error
+func (c *Client) ReadAt(ctx context.Context, fname string, off int, n int) ([]byte, error) {
+	// Get location of each block of the file from the Master
+	fb, err := c.master.Lookup(ctx, fname)
+	if err != nil {
+		c.Logger.Printf("Client.ReadAt(fname=%q, off=%d, n=%d) => %v", fname, off, n, err)
+		return []byte{}, err
+	}
+
+	// Verify metadata from Master
+	if len(fb.Assignments) != c.nBlocksOf(fb) {
+		msg := fmt.Sprintf("Master returned %d blocks for a file with %d bytes", len(fb.Assignments), fb.Fsize)
+		c.Logger.Printf("Client.ReadAt(fname=%q, off=%d, n=%d) => %q", fname, off, n, msg)
+		return []byte{}, fmt.Errorf(msg)
+	}
+
+	if off < 0 || off > fb.Fsize || n < 0 {
+		msg := fmt.Sprintf("Invalid range of a file with %d bytes: offset %d, length %d", fb.Fsize, off, n)
+		c.Logger.Printf("Client.ReadAt(fname=%q, off=%d, n=%d) => %q", fname, off, n, msg)
+		return []byte{}, fmt.Errorf(msg)
+	}
+	if off+n > fb.Fsize {
+		n = fb.Fsize - off
+	}
+
+	// the first failure cancels the outstanding transfers
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+
+	// Loop over the blocks covering [off, off+n)
+	bytesRead := make([]byte, n)
+	terr := firstError{cancel: cancel}
+	for pos := off; pos < off+n; {
+		i := pos / c.config.GiftsBlockSize
+		inBlock := pos - i*c.config.GiftsBlockSize
+		length := c.config.GiftsBlockSize - inBlock
+		if pos+length > off+n {
+			length = off + n - pos
+		}
+
+		// Spawned go routines will stop on first (detected) error
+		wg.Add(1)
+		go func(i, inBlock, start, length int) {
+			defer wg.Done()
+			// Another GetRange already failed so there's no point in doing this one
+			if err := ctx.Err(); err != nil {
+				terr.set(err)
+				return
+			}
+
+			dataRead, err := c.readDataRange(ctx, fb, i, inBlock, length)
+			if err != nil {
+				terr.set(err)
+			}
+
+			copy(bytesRead[start:start+length], dataRead)
+		}(i, inBlock, pos-off, length)
+
+		pos += length
+	}
+
+	wg.Wait()
+
+	if terr.err != nil {
+		c.Logger.Printf("Client.ReadAt(fname=%q, off=%d, n=%d) => %v", fname, off, n, terr.err)
+		return []byte{}, terr.err
+	}
+
+	c.Logger.Printf("Client.ReadAt(fname=%q, off=%d, n=%d) => %d bytes", fname, off, n, n)
+	return bytesRead, nil
+}
+
+// readRange of length bytes at offset of the block from its replicas in order,
+// falling back to the next replica on error or if fewer bytes come back.
+func (c *Client) readRange(ctx context.Context, block structure.BlockAssign, offset, length int) ([]byte, error) {
+	err := fmt.Errorf("Master didn't return any replicas: %v", block)
+	for _, replica := range block.Replicas {
+		var dataRead []byte
+		req := structure.RangeReq{ID: block.BlockID, Offset: offset, Length: length}
+		if err = c.storageOf(replica).GetRange(ctx, &req, &dataRead); err != nil {
+			c.Logger.Printf("Client.readRange(%q) => %v", block.BlockID, err)
+			if ctx.Err() != nil {
+				// given up, not the fault of the replica
+				return nil, err
+			}
+			go func(replica string) {
+				if err := c.master.ReportUnreachable(context.Background(), replica); err != nil {
+					c.Logger.Printf("Client.readRange(%q) failed to report %q: %v", block.BlockID, replica, err)
+				}
+			}(replica)
+			continue
+		}
+
+		if len(dataRead) == length {
+			return dataRead, nil
+		}
+		err = fmt.Errorf("Block %q on %q returned %d of %d bytes at %d", block.BlockID, replica, len(dataRead), length, offset)
+		c.Logger.Printf("Client.readRange(%q) => %v", block.BlockID, err)
+	}
+	return nil, err
+}
+
+// List the names of the files with the prefix, at most limit of them
+// (a default page if <= 0) after the cursor (from the start if empty).
+// The returned cursor gives the next page, it is empty if there is no more.
+// It returns an error if:
+//		- There is a network error
+func (c *Client) List(ctx context.Context, prefix, cursor string, limit int) ([]string, string, error) {
+	ret, err := c.master.List(ctx, prefix, cursor, limit)
+	if err != nil {
+		c.Logger.Printf("Client.List(prefix=%q, cursor=%q, limit=%d) => %v", prefix, cursor, limit, err)
+		return nil, "", err
+	}
+
+	c.Logger.Printf("Client.List(prefix=%q, cursor=%q, limit=%d) => %d files", prefix, cursor, limit, len(ret.Fnames))
+	return ret.Fnames, ret.NextCursor, nil
+}
+
+// Stat returns the metadata of a file with the specified file name.
+// It returns an error if:
+//		- The file does not exist
+//		- There is a network error
+func (c *Client) Stat(ctx context.Context, fname string) (*structure.FileStat, error) {
+	stat, err := c.master.Stat(ctx, fname)
+	if err != nil {
+		c.Logger.Printf("Client.Stat(fname=%q) => %v", fname, err)
+		return nil, err
+	}
+
+	c.Logger.Printf("Client.Stat(fname=%q) => %+v", fname, *stat)
+	return stat, nil
+}
+
+// Mkdir makes a directory and the missing ones above it.
+// Files can also be stored under directories not made yet.
+// It returns an error if:
+//		- The path is invalid or a file is in the way
+//		- There is a network error
+func (c *Client) Mkdir(ctx context.Context, path string) error {
+	if err := c.master.Mkdir(ctx, path); err != nil {
+		c.Logger.Printf("Client.Mkdir(path=%q) => %v", path, err)
+		return err
+	}
+
+	c.Logger.Printf("Client.Mkdir(path=%q) => success", path)
+	return nil
+}
+
+// ReadDir lists a directory, "/" is the root.
+// It returns an error if:
+//		- The directory does not exist
+//		- There is a network error
+func (c *Client) ReadDir(ctx context.Context, path string) ([]structure.DirEntry, error) {
+	entries, err := c.master.ReadDir(ctx, path)
+	if err != nil {
+		c.Logger.Printf("Client.ReadDir(path=%q) => %v", path, err)
+		return nil, err
+	}
+
+	c.Logger.Printf("Client.ReadDir(path=%q) => %d entries", path, len(entries))
+	return entries, nil
+}
+
+// Rmdir removes a directory, with everything under it if recursive.
+// It returns an error if:
+//		- The directory does not exist
+//		- The directory is not empty and recursive is false
+//		- There is a network error
+func (c *Client) Rmdir(ctx context.Context, path string, recursive bool) error {
+	if err := c.master.Rmdir(ctx, path, recursive); err != nil {
+		c.Logger.Printf("Client.Rmdir(path=%q, recursive=%v) => %v", path, recursive, err)
+		return err
+	}
+
+	c.Logger.Printf("Client.Rmdir(path=%q, recursive=%v) => success", path, recursive)
+	return nil
+}
+
+// Rename a file, replacing the file named newName if overwrite.
+// The file is published under the new name atomically, no block is copied.
+// It returns an error if:
+//		- The file does not exist
+//		- A file named newName exists and overwrite is false
+//		- There is a network error
+func (c *Client) Rename(ctx context.Context, oldName, newName string, overwrite bool) error {
+	if err := c.master.Rename(ctx, oldName, newName, overwrite); err != nil {
+		c.Logger.Printf("Client.Rename(old=%q, new=%q, overwrite=%v) => %v", oldName, newName, overwrite, err)
+		return err
+	}
+
+	c.Logger.Printf("Client.Rename(old=%q, new=%q, overwrite=%v) => success", oldName, newName, overwrite)
+	return nil
+}
+
+// Delete deletes a file with the specified file name.
+// The blocks are reclaimed by the Master in background.
+// It returns an error if:
+//		- The file does not exist
+//		- There is a network error
+func (c *Client) Delete(ctx context.Context, fname string) error {
+	if err := c.master.Delete(ctx, fname); err != nil {
+		c.Logger.Printf("Client.Delete(fname=%q) => %v", fname, err)
+		return err
+	}
+
+	c.Logger.Printf("Client.Delete(fname=%q) => success", fname)
+	return nil
+}
@@ -1,11 +1,15 @@
 package client
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	gifts "github.com/GIFTS-fs/GIFTS"
 	"github.com/GIFTS-fs/GIFTS/config"
@@ -35,56 +39,67 @@ func TestClient_Store(t *testing.T) {
 
 	var data []byte
 
+	committed := make(map[string]bool)
+	aborted := make(map[string]bool)
+	c.master.Commit = func(ctx context.Context, fname string, checksums []string) error {
+		committed[fname] = true
+		return nil
+	}
+	c.master.Delete = func(ctx context.Context, fname string) error {
+		aborted[fname] = true
+		return nil
+	}
+
 	// Empty file name
 	t.Logf("TestClient_Store: Starting test #1")
 	data = []byte("")
-	err := c.Store("", 1, data)
+	err := c.Store(context.Background(), "", 1, data)
 	test.AF(t, err != nil, "Expected non-nil error")
 
 	// rfactor is 0
 	t.Logf("TestClient_Store: Starting test #2")
 	data = []byte("")
-	err = c.Store("filename", 0, data)
+	err = c.Store(context.Background(), "filename", 0, data)
 	test.AF(t, err != nil, "Expected non-nil error")
 
 	// Valid call but Master returns incorrect number of blocks
 	t.Logf("TestClient_Store: Starting test #3")
-	c.master.Create = func(fname string, fsize int, rfactor uint) ([]structure.BlockAssign, error) {
+	c.master.Create = func(ctx context.Context, fname string, fsize int, rfactor uint, checksums []string, dedup bool) ([]structure.BlockAssign, error) {
 		block := structure.BlockAssign{BlockID: "ID", Replicas: []string{"r1"}}
 		return []structure.BlockAssign{block, block}, nil
 	}
 	data = []byte("Hello World")
-	err = c.Store("filename_1", 1, data)
+	err = c.Store(context.Background(), "filename_1", 1, data)
 	test.AF(t, err != nil, "Expected non-nil error")
 
 	// Master failure
 	t.Logf("TestClient_Store: Starting test #4")
-	c.master.Create = func(fname string, fsize int, rfactor uint) ([]structure.BlockAssign, error) {
+	c.master.Create = func(ctx context.Context, fname string, fsize int, rfactor uint, checksums []string, dedup bool) ([]structure.BlockAssign, error) {
 		return nil, fmt.Errorf("Master error")
 	}
 	data = []byte("Hello World")
-	err = c.Store("filename_1", 1, data)
+	err = c.Store(context.Background(), "filename_1", 1, data)
 	test.AF(t, err != nil, "Expected non-nil error")
 
 	// Valid call with no data
 	t.Logf("TestClient_Store: Starting test #5")
-	c.master.Create = func(fname string, fsize int, rfactor uint) ([]structure.BlockAssign, error) {
+	c.master.Create = func(ctx context.Context, fname string, fsize int, rfactor uint, checksums []string, dedup bool) ([]structure.BlockAssign, error) {
 		return []structure.BlockAssign{}, nil
 	}
 	data = []byte("")
-	err = c.Store("filename_1", 1, data)
+	err = c.Store(context.Background(), "filename_1", 1, data)
 	test.AF(t, err == nil, fmt.Sprintf("Client.Store failed: \"%v\"", err))
 
 	// Valid call with less than one block of data and one replica
 	t.Logf("TestClient_Store: Starting test #6")
-	c.master.Create = func(fname string, fsize int, rfactor uint) ([]structure.BlockAssign, error) {
+	c.master.Create = func(ctx context.Context, fname string, fsize int, rfactor uint, checksums []string, dedup bool) ([]structure.BlockAssign, error) {
 		block := structure.BlockAssign{BlockID: fname, Replicas: []string{addr1}}
 		return []structure.BlockAssign{block}, nil
 	}
 
 	expected := "Hello World"
 	data = []byte(expected)
-	err = c.Store("filename_1", 1, data)
+	err = c.Store(context.Background(), "filename_1", 1, data)
 	test.AF(t, err == nil, fmt.Sprintf("Client.Store failed: \"%v\"", err))
 
 	ret := gifts.Block{}
@@ -94,7 +109,7 @@ func TestClient_Store(t *testing.T) {
 
 	// Valid call with more than one block of data and one replica
 	t.Logf("TestClient_Store: Starting test #7")
-	c.master.Create = func(fname string, fsize int, rfactor uint) ([]structure.BlockAssign, error) {
+	c.master.Create = func(ctx context.Context, fname string, fsize int, rfactor uint, checksums []string, dedup bool) ([]structure.BlockAssign, error) {
 		block1 := structure.BlockAssign{BlockID: fname + "_1", Replicas: []string{addr1}}
 		block2 := structure.BlockAssign{BlockID: fname + "_2", Replicas: []string{addr1}}
 		return []structure.BlockAssign{block1, block2}, nil
@@ -102,7 +117,7 @@ func TestClient_Store(t *testing.T) {
 
 	expected = strings.Repeat("test string", 1+(c.config.GiftsBlockSize/len("test string")))
 	data = []byte(expected)
-	err = c.Store("filename_2", 1, data)
+	err = c.Store(context.Background(), "filename_2", 1, data)
 	test.AF(t, err == nil, fmt.Sprintf("Client.Store failed: \"%v\"", err))
 
 	err = s1.Get("filename_2_1", &ret)
@@ -116,7 +131,7 @@ func TestClient_Store(t *testing.T) {
 
 	// Valid call with more than one block of data and more than one replica
 	t.Logf("TestClient_Store: Starting test #8")
-	c.master.Create = func(fname string, fsize int, rfactor uint) ([]structure.BlockAssign, error) {
+	c.master.Create = func(ctx context.Context, fname string, fsize int, rfactor uint, checksums []string, dedup bool) ([]structure.BlockAssign, error) {
 		block1 := structure.BlockAssign{BlockID: fname + "_1", Replicas: []string{addr1, addr2}}
 		block2 := structure.BlockAssign{BlockID: fname + "_2", Replicas: []string{addr1, addr2}}
 		return []structure.BlockAssign{block1, block2}, nil
@@ -124,7 +139,7 @@ func TestClient_Store(t *testing.T) {
 
 	expected = strings.Repeat("test string 2", 1+(c.config.GiftsBlockSize/len("test string")))
 	data = []byte(expected)
-	err = c.Store("filename_3", 1, data)
+	err = c.Store(context.Background(), "filename_3", 1, data)
 	test.AF(t, err == nil, fmt.Sprintf("Client.Store failed: \"%v\"", err))
 
 	for _, s := range []*storage.Storage{s1, s2} {
@@ -137,6 +152,54 @@ func TestClient_Store(t *testing.T) {
 		test.AF(t, err == nil, fmt.Sprintf("Storage.Get failed: %v", err))
 		test.AF(t, string(ret) == expected[c.config.GiftsBlockSize:], fmt.Sprintf("Expected %q but found %q", expected, ret))
 	}
+	test.AF(t, committed["filename_3"], "Client.Store should commit the file")
+
+	// Storage node fails, the file is aborted
+	t.Logf("TestClient_Store: Starting test #9")
+	c.master.Create = func(ctx context.Context, fname string, fsize int, rfactor uint, checksums []string, dedup bool) ([]structure.BlockAssign, error) {
+		block := structure.BlockAssign{BlockID: fname, Replicas: []string{"r1"}}
+		return []structure.BlockAssign{block}, nil
+	}
+	err = c.Store(context.Background(), "filename_4", 1, []byte("Hello World"))
+	test.AF(t, err != nil, "Expected non-nil error")
+	test.AF(t, !committed["filename_4"] && aborted["filename_4"], "Client.Store should abort the file instead of committing it")
+
+	// Commit fails
+	t.Logf("TestClient_Store: Starting test #10")
+	c.master.Create = func(ctx context.Context, fname string, fsize int, rfactor uint, checksums []string, dedup bool) ([]structure.BlockAssign, error) {
+		return []structure.BlockAssign{}, nil
+	}
+	c.master.Commit = func(ctx context.Context, fname string, checksums []string) error {
+		return fmt.Errorf("Lease expired")
+	}
+	err = c.Store(context.Background(), "filename_5", 1, []byte(""))
+	test.AF(t, err != nil, "Expected non-nil error")
+
+	// With deduplication the blocks already stored are skipped
+	t.Logf("TestClient_Store: Starting test #11")
+	conf := *config.Get()
+	conf.ClientDedupEnabled = true
+	c = NewClient([]string{"master"}, &conf)
+	c.master.Create = func(ctx context.Context, fname string, fsize int, rfactor uint, checksums []string, dedup bool) ([]structure.BlockAssign, error) {
+		if !dedup || len(checksums) != 2 {
+			return nil, fmt.Errorf("Expected deduplication with 2 checksums")
+		}
+		// the unreachable replica fails the Store if written to
+		block1 := structure.BlockAssign{BlockID: checksums[0], Replicas: []string{"r1"}, Exists: true}
+		block2 := structure.BlockAssign{BlockID: checksums[1], Replicas: []string{addr2}}
+		return []structure.BlockAssign{block1, block2}, nil
+	}
+	c.master.Commit = func(ctx context.Context, fname string, checksums []string) error {
+		return nil
+	}
+	expected = strings.Repeat("test string 3", 1+(c.config.GiftsBlockSize/len("test string")))
+	data = []byte(expected)
+	err = c.Store(context.Background(), "filename_6", 1, data)
+	test.AF(t, err == nil, fmt.Sprintf("Client.Store failed: \"%v\"", err))
+
+	err = s2.Get(gifts.Checksum(data[c.config.GiftsBlockSize:]), &ret)
+	test.AF(t, err == nil, fmt.Sprintf("Storage.Get failed: %v", err))
+	test.AF(t, string(ret) == expected[c.config.GiftsBlockSize:], fmt.Sprintf("Expected %q but found %q", expected, ret))
 }
 
 func TestClient_Read(t *testing.T) {
@@ -155,63 +218,63 @@ func TestClient_Read(t *testing.T) {
 
 	// File does not exist
 	t.Logf("TestClient_Read: Starting test #1")
-	c.master.Lookup = func(fname string) (*structure.FileBlocks, error) {
+	c.master.Lookup = func(ctx context.Context, fname string) (*structure.FileBlocks, error) {
 		return nil, fmt.Errorf("%q does not exist", fname)
 	}
-	ret, err := c.Read("Invalid file")
+	ret, err := c.Read(context.Background(), "Invalid file")
 	test.AF(t, err != nil, "Expected non-nil error")
 
 	// Master fails
 	t.Logf("TestClient_Read: Starting test #2")
-	c.master.Lookup = func(fname string) (*structure.FileBlocks, error) {
+	c.master.Lookup = func(ctx context.Context, fname string) (*structure.FileBlocks, error) {
 		return nil, fmt.Errorf("Master failed")
 	}
-	ret, err = c.Read("filename")
+	ret, err = c.Read(context.Background(), "filename")
 	test.AF(t, err != nil, "Expected non-nil error")
 
 	// Master returns incorrect number of assignments
 	t.Logf("TestClient_Read: Starting test #3")
-	c.master.Lookup = func(fname string) (*structure.FileBlocks, error) {
+	c.master.Lookup = func(ctx context.Context, fname string) (*structure.FileBlocks, error) {
 		ret := structure.FileBlocks{Fsize: c.config.GiftsBlockSize * 2, Assignments: []structure.BlockAssign{}}
 		return &ret, nil
 	}
-	ret, err = c.Read("filename")
+	ret, err = c.Read(context.Background(), "filename")
 	test.AF(t, err != nil, "Expected non-nil error")
 
 	// Master returns incorrect number of Storage nodes for each block
 	t.Logf("TestClient_Read: Starting test #4")
-	c.master.Lookup = func(fname string) (*structure.FileBlocks, error) {
+	c.master.Lookup = func(ctx context.Context, fname string) (*structure.FileBlocks, error) {
 		block := structure.BlockAssign{BlockID: "id1", Replicas: []string{}}
 		ret := structure.FileBlocks{Fsize: 1, Assignments: []structure.BlockAssign{block}}
 		return &ret, nil
 	}
-	ret, err = c.Read("filename")
+	ret, err = c.Read(context.Background(), "filename")
 	test.AF(t, err != nil, "Expected non-nil error")
 
 	// Storage node fails
 	t.Logf("TestClient_Read: Starting test #5")
-	c.master.Lookup = func(fname string) (*structure.FileBlocks, error) {
+	c.master.Lookup = func(ctx context.Context, fname string) (*structure.FileBlocks, error) {
 		block := structure.BlockAssign{BlockID: "id1", Replicas: []string{"r1"}}
 		ret := structure.FileBlocks{Fsize: 1, Assignments: []structure.BlockAssign{block}}
 		return &ret, nil
 	}
-	ret, err = c.Read("filename")
+	ret, err = c.Read(context.Background(), "filename")
 	test.AF(t, err != nil, "Expected non-nil error")
 
 	// Empty file
 	t.Logf("TestClient_Read: Starting test #6")
-	c.master.Lookup = func(fname string) (*structure.FileBlocks, error) {
+	c.master.Lookup = func(ctx context.Context, fname string) (*structure.FileBlocks, error) {
 		ret := structure.FileBlocks{Fsize: 0, Assignments: []structure.BlockAssign{}}
 		return &ret, nil
 	}
-	ret, err = c.Read("emptyfile")
+	ret, err = c.Read(context.Background(), "emptyfile")
 	test.AF(t, err == nil, fmt.Sprintf("Client.Read failed: %v", err))
 	test.AF(t, len(ret) == 0, fmt.Sprintf("Expected 0 bytes, found %q", ret))
 
 	// File with one block
 	t.Logf("TestClient_Read: Starting test #7")
 	data = []byte("Hello World")
-	c.master.Lookup = func(fname string) (*structure.FileBlocks, error) {
+	c.master.Lookup = func(ctx context.Context, fname string) (*structure.FileBlocks, error) {
 		block := structure.BlockAssign{BlockID: "file_1_1", Replicas: []string{addr1}}
 		ret := structure.FileBlocks{Fsize: len(data), Assignments: []structure.BlockAssign{block}}
 		return &ret, nil
@@ -221,14 +284,14 @@ func TestClient_Read(t *testing.T) {
 	err = s1.Set(&kv, new(bool))
 	test.AF(t, err == nil, fmt.Sprintf("Storage.Set failed: %v", err))
 
-	ret, err = c.Read("filename")
+	ret, err = c.Read(context.Background(), "filename")
 	test.AF(t, err == nil, fmt.Sprintf("Client.Read failed: %v", err))
 	test.AF(t, string(ret) == string(data), fmt.Sprintf("Expected %q, found %q", data, ret))
 
 	// File with multiple blocks
 	t.Logf("TestClient_Read: Starting test #8")
 	expected := strings.Repeat("test string", 1+(c.config.GiftsBlockSize/len("test string")))
-	c.master.Lookup = func(fname string) (*structure.FileBlocks, error) {
+	c.master.Lookup = func(ctx context.Context, fname string) (*structure.FileBlocks, error) {
 		block1 := structure.BlockAssign{BlockID: "file_2_1", Replicas: []string{addr1}}
 		block2 := structure.BlockAssign{BlockID: "file_2_2", Replicas: []string{addr2}}
 		fsize := len(expected)
@@ -245,7 +308,283 @@ func TestClient_Read(t *testing.T) {
 	err = s2.Set(&kv, new(bool))
 	test.AF(t, err == nil, fmt.Sprintf("Storage.Set failed: %v", err))
 
-	ret, err = c.Read("file_2")
+	ret, err = c.Read(context.Background(), "file_2")
 	test.AF(t, err == nil, fmt.Sprintf("Client.Read failed: %v", err))
 	test.AF(t, string(ret) == expected, fmt.Sprintf("Expected %q, found %q", expected, ret))
+
+	reported := make(chan string, 10)
+	c.master.ReportCorrupt = func(ctx context.Context, addr, blockID string) error {
+		reported <- "corrupt " + addr
+		return nil
+	}
+	c.master.ReportUnreachable = func(ctx context.Context, addr string) error {
+		reported <- "unreachable " + addr
+		return nil
+	}
+
+	// Corrupted replica, falls back to the next one
+	t.Logf("TestClient_Read: Starting test #9")
+	data = []byte("Hello World")
+	c.master.Lookup = func(ctx context.Context, fname string) (*structure.FileBlocks, error) {
+		block := structure.BlockAssign{BlockID: "file_3_1", Replicas: []string{addr1, addr2}, Checksum: gifts.Checksum(data)}
+		ret := structure.FileBlocks{Fsize: len(data), Assignments: []structure.BlockAssign{block}}
+		return &ret, nil
+	}
+
+	kv = structure.BlockKV{ID: "file_3_1", Data: gifts.Block("Hello Wor1d")}
+	err = s1.Set(&kv, new(bool))
+	test.AF(t, err == nil, fmt.Sprintf("Storage.Set failed: %v", err))
+	kv = structure.BlockKV{ID: "file_3_1", Data: gifts.Block(data)}
+	err = s2.Set(&kv, new(bool))
+	test.AF(t, err == nil, fmt.Sprintf("Storage.Set failed: %v", err))
+
+	ret, err = c.Read(context.Background(), "file_3")
+	test.AF(t, err == nil, fmt.Sprintf("Client.Read failed: %v", err))
+	test.AF(t, string(ret) == string(data), fmt.Sprintf("Expected %q, found %q", data, ret))
+	report := <-reported
+	test.AF(t, report == "corrupt "+addr1, fmt.Sprintf("Expected %q reported corrupt, found %q", addr1, report))
+
+	// All replicas corrupted
+	t.Logf("TestClient_Read: Starting test #10")
+	kv = structure.BlockKV{ID: "file_3_1", Data: gifts.Block("Hello Wor1d")}
+	err = s2.Set(&kv, new(bool))
+	test.AF(t, err == nil, fmt.Sprintf("Storage.Set failed: %v", err))
+
+	ret, err = c.Read(context.Background(), "file_3")
+	test.AF(t, err != nil, "Reading a corrupted block should fail")
+	<-reported
+	<-reported
+
+	// Unreachable replica, falls back to the next one
+	t.Logf("TestClient_Read: Starting test #11")
+	c.master.Lookup = func(ctx context.Context, fname string) (*structure.FileBlocks, error) {
+		block := structure.BlockAssign{BlockID: "file_1_1", Replicas: []string{"r1", addr1}}
+		ret := structure.FileBlocks{Fsize: len(data), Assignments: []structure.BlockAssign{block}}
+		return &ret, nil
+	}
+
+	ret, err = c.Read(context.Background(), "file_1")
+	test.AF(t, err == nil, fmt.Sprintf("Client.Read failed: %v", err))
+	test.AF(t, string(ret) == string(data), fmt.Sprintf("Expected %q, found %q", data, ret))
+	report = <-reported
+	test.AF(t, report == "unreachable r1", fmt.Sprintf("Expected \"r1\" reported unreachable, found %q", report))
+}
+
+func TestClient_ReadAt(t *testing.T) {
+	t.Parallel()
+
+	c := NewClient([]string{"master"}, config.Get())
+
+	addr1 := "localhost:3008"
+	addr2 := "localhost:3009"
+	s1 := storage.NewStorage()
+	s2 := storage.NewStorage()
+	storage.ServeRPC(s1, addr1)
+	storage.ServeRPC(s2, addr2)
+
+	// Three blocks, the first replica of the middle one is down
+	blockSize := c.config.GiftsBlockSize
+	data := make([]byte, 2*blockSize+blockSize/2)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	var assignments []structure.BlockAssign
+	for i := 0; i*blockSize < len(data); i++ {
+		id := fmt.Sprintf("readat_%d", i)
+		replicas := []string{addr1, addr2}
+		if i == 1 {
+			replicas = []string{"r1", addr2}
+		}
+		assignments = append(assignments, structure.BlockAssign{BlockID: id, Replicas: replicas})
+
+		kv := structure.BlockKV{ID: id, Data: c.blockOf(data, i)}
+		test.AF(t, s1.Set(&kv, new(bool)) == nil, "Storage.Set failed")
+		test.AF(t, s2.Set(&kv, new(bool)) == nil, "Storage.Set failed")
+	}
+	c.master.Lookup = func(ctx context.Context, fname string) (*structure.FileBlocks, error) {
+		return &structure.FileBlocks{Fsize: len(data), Assignments: assignments}, nil
+	}
+	c.master.ReportUnreachable = func(ctx context.Context, addr string) error {
+		return nil
+	}
+
+	// Within one block
+	t.Logf("TestClient_ReadAt: Starting test #1")
+	ret, err := c.ReadAt(context.Background(), "filename", 10, 100)
+	test.AF(t, err == nil, fmt.Sprintf("Client.ReadAt failed: %v", err))
+	test.AF(t, bytes.Equal(ret, data[10:110]), "Read data does not match")
+
+	// Across all the blocks, with failover
+	t.Logf("TestClient_ReadAt: Starting test #2")
+	ret, err = c.ReadAt(context.Background(), "filename", blockSize-1, blockSize+2)
+	test.AF(t, err == nil, fmt.Sprintf("Client.ReadAt failed: %v", err))
+	test.AF(t, bytes.Equal(ret, data[blockSize-1:2*blockSize+1]), "Read data does not match")
+
+	// Past the end of the file
+	t.Logf("TestClient_ReadAt: Starting test #3")
+	ret, err = c.ReadAt(context.Background(), "filename", len(data)-5, 100)
+	test.AF(t, err == nil, fmt.Sprintf("Client.ReadAt failed: %v", err))
+	test.AF(t, bytes.Equal(ret, data[len(data)-5:]), fmt.Sprintf("Expected the last 5 bytes, found %d bytes", len(ret)))
+	ret, err = c.ReadAt(context.Background(), "filename", len(data), 1)
+	test.AF(t, err == nil && len(ret) == 0, fmt.Sprintf("Expected no data at the end, found %d bytes, %v", len(ret), err))
+
+	// Invalid range
+	t.Logf("TestClient_ReadAt: Starting test #4")
+	_, err = c.ReadAt(context.Background(), "filename", -1, 1)
+	test.AF(t, err != nil, "Expected non-nil error")
+	_, err = c.ReadAt(context.Background(), "filename", len(data)+1, 1)
+	test.AF(t, err != nil, "Expected non-nil error")
+
+	// All replicas down
+	t.Logf("TestClient_ReadAt: Starting test #5")
+	c.master.Lookup = func(ctx context.Context, fname string) (*structure.FileBlocks, error) {
+		block := structure.BlockAssign{BlockID: "id1", Replicas: []string{"r1"}}
+		return &structure.FileBlocks{Fsize: 1, Assignments: []structure.BlockAssign{block}}, nil
+	}
+	_, err = c.ReadAt(context.Background(), "filename", 0, 1)
+	test.AF(t, err != nil, "Expected non-nil error")
+}
+
+func TestClient_ListStat(t *testing.T) {
+	t.Parallel()
+
+	c := NewClient([]string{"master"}, config.Get())
+
+	// Master fails
+	t.Logf("TestClient_ListStat: Starting test #1")
+	c.master.List = func(ctx context.Context, prefix, cursor string, limit int) (*structure.ListResult, error) {
+		return nil, fmt.Errorf("Master failed")
+	}
+	c.master.Stat = func(ctx context.Context, fname string) (*structure.FileStat, error) {
+		return nil, fmt.Errorf("%q does not exist", fname)
+	}
+	_, _, err := c.List(context.Background(), "", "", 0)
+	test.AF(t, err != nil, "Expected non-nil error")
+	_, err = c.Stat(context.Background(), "filename")
+	test.AF(t, err != nil, "Expected non-nil error")
+
+	// Pages and stat are passed through
+	t.Logf("TestClient_ListStat: Starting test #2")
+	c.master.List = func(ctx context.Context, prefix, cursor string, limit int) (*structure.ListResult, error) {
+		return &structure.ListResult{Fnames: []string{prefix + cursor}, NextCursor: "next"}, nil
+	}
+	c.master.Stat = func(ctx context.Context, fname string) (*structure.FileStat, error) {
+		return &structure.FileStat{Fname: fname, Fsize: 42}, nil
+	}
+	fnames, next, err := c.List(context.Background(), "a/", "b", 1)
+	test.AF(t, err == nil, fmt.Sprintf("Client.List failed: %v", err))
+	test.AF(t, len(fnames) == 1 && fnames[0] == "a/b" && next == "next", fmt.Sprintf("Unexpected page %v, cursor %q", fnames, next))
+	stat, err := c.Stat(context.Background(), "filename")
+	test.AF(t, err == nil, fmt.Sprintf("Client.Stat failed: %v", err))
+	test.AF(t, stat.Fname == "filename" && stat.Fsize == 42, fmt.Sprintf("Unexpected stat %+v", *stat))
+}
+
+func TestClient_Delete(t *testing.T) {
+	t.Parallel()
+
+	c := NewClient([]string{"master"}, config.Get())
+
+	// Master fails
+	t.Logf("TestClient_Delete: Starting test #1")
+	c.master.Delete = func(ctx context.Context, fname string) error {
+		return fmt.Errorf("%q does not exist", fname)
+	}
+	err := c.Delete(context.Background(), "Invalid file")
+	test.AF(t, err != nil, "Expected non-nil error")
+
+	// Valid call
+	t.Logf("TestClient_Delete: Starting test #2")
+	deleted := ""
+	c.master.Delete = func(ctx context.Context, fname string) error {
+		deleted = fname
+		return nil
+	}
+	err = c.Delete(context.Background(), "filename")
+	test.AF(t, err == nil, fmt.Sprintf("Client.Delete failed: %v", err))
+	test.AF(t, deleted == "filename", fmt.Sprintf("Expected \"filename\" deleted, found %q", deleted))
+}
+
+func TestClient_Rename(t *testing.T) {
+	t.Parallel()
+
+	c := NewClient([]string{"master"}, config.Get())
+
+	// Master fails
+	t.Logf("TestClient_Rename: Starting test #1")
+	c.master.Rename = func(ctx context.Context, oldName, newName string, overwrite bool) error {
+		return fmt.Errorf("%q already exists", newName)
+	}
+	err := c.Rename(context.Background(), "tmp", "final", false)
+	test.AF(t, err != nil, "Expected non-nil error")
+
+	// Valid call
+	t.Logf("TestClient_Rename: Starting test #2")
+	renamed := ""
+	c.master.Rename = func(ctx context.Context, oldName, newName string, overwrite bool) error {
+		renamed = fmt.Sprintf("%s->%s %v", oldName, newName, overwrite)
+		return nil
+	}
+	err = c.Rename(context.Background(), "tmp", "final", true)
+	test.AF(t, err == nil, fmt.Sprintf("Client.Rename failed: %v", err))
+	test.AF(t, renamed == "tmp->final true", fmt.Sprintf("Unexpected rename %q", renamed))
+}
+
+func TestClient_Cancel(t *testing.T) {
+	t.Parallel()
+
+	c := NewClient([]string{"master"}, config.Get())
+
+	storage.ServeRPC(storage.NewStorage(), "localhost:3960")
+	hung, err := test.ServeHung("localhost:3961", true)
+	test.AF(t, err == nil, fmt.Sprintf("ServeHung failed: %v", err))
+	defer hung.Close()
+
+	reported := make(chan string, 10)
+	c.master.ReportUnreachable = func(ctx context.Context, addr string) error {
+		reported <- addr
+		return nil
+	}
+
+	// A hung replica holds the Store until the deadline, the file is aborted
+	t.Logf("TestClient_Cancel: Starting test #1")
+	aborted, committed := "", false
+	c.master.Create = func(ctx context.Context, fname string, fsize int, rfactor uint, checksums []string, dedup bool) ([]structure.BlockAssign, error) {
+		return []structure.BlockAssign{{BlockID: "cancel_0", Replicas: []string{"localhost:3960", "localhost:3961"}}}, nil
+	}
+	c.master.Commit = func(ctx context.Context, fname string, checksums []string) error {
+		committed = true
+		return nil
+	}
+	c.master.Delete = func(ctx context.Context, fname string) error {
+		aborted = fname
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = c.Store(ctx, "filename", 2, []byte("data"))
+	test.AF(t, errors.Is(err, context.DeadlineExceeded), fmt.Sprintf("Expected the deadline exceeded, found %v", err))
+	test.AF(t, time.Since(start) < time.Second, fmt.Sprintf("Store took %v", time.Since(start)))
+	test.AF(t, !committed, "Expected the file not committed")
+	test.AF(t, aborted == "filename", fmt.Sprintf("Expected \"filename\" aborted, found %q", aborted))
+
+	// The Read as well, without blaming the replica or trying the next one
+	t.Logf("TestClient_Cancel: Starting test #2")
+	c.master.Lookup = func(ctx context.Context, fname string) (*structure.FileBlocks, error) {
+		return &structure.FileBlocks{Fsize: 4, Assignments: []structure.BlockAssign{{BlockID: "cancel_0", Replicas: []string{"localhost:3961", "localhost:3960"}}}}, nil
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	_, err = c.Read(ctx, "filename")
+	test.AF(t, errors.Is(err, context.DeadlineExceeded), fmt.Sprintf("Expected the deadline exceeded, found %v", err))
+	test.AF(t, time.Since(start) < time.Second, fmt.Sprintf("Read took %v", time.Since(start)))
+	test.AF(t, len(reported) == 0, fmt.Sprintf("Expected no replica reported, found %d", len(reported)))
+
+	// Nothing is transferred once canceled
+	t.Logf("TestClient_Cancel: Starting test #3")
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = c.ReadAt(ctx, "filename", 0, 4)
+	test.AF(t, errors.Is(err, context.Canceled), fmt.Sprintf("Expected the read canceled, found %v", err))
 }
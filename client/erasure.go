@@ -0,0 +1,232 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	gifts "github.com/GIFTS-fs/GIFTS"
+	"github.com/GIFTS-fs/GIFTS/algorithm"
+	"github.com/GIFTS-fs/GIFTS/structure"
+)
+
+// StoreErasure stores a file erasure coded instead of replicated:
+// every stripe of dataShards blocks is stored with parityShards blocks of parity,
+// each on a different Storage node, and any dataShards blocks of a stripe can rebuild it.
+// It costs (dataShards+parityShards)/dataShards times the size of the file,
+// and survives the loss of any parityShards Storage nodes.
+// The Master may still replicate the blocks of a hot file on top.
+//
+// It returns an error if:
+//		- A file with the specified file name already exists
+//		- The erasure code is invalid or wider than the number of Storage nodes
+//		- The Master does not give us enough blocks in which to store the data
+//		- There is a network error
+func (c *Client) StoreErasure(ctx context.Context, fname string, dataShards, parityShards int, data []byte) error {
+	if fname == "" {
+		msg := "File name cannot be empty"
+		c.Logger.Printf("Client.StoreErasure(fname=%q) => %q", fname, msg)
+		return fmt.Errorf(msg)
+	}
+
+	rs, err := algorithm.NewReedSolomon(dataShards, parityShards)
+	if err != nil || parityShards == 0 {
+		msg := fmt.Sprintf("Invalid erasure code of %d data and %d parity blocks", dataShards, parityShards)
+		c.Logger.Printf("Client.StoreErasure(fname=%q) => %q", fname, msg)
+		return fmt.Errorf(msg)
+	}
+
+	fsize := len(data)
+	blocks, err := c.encode(rs, data)
+	if err != nil {
+		c.Logger.Printf("Client.StoreErasure(fname=%q, fsize=%d) => %v", fname, fsize, err)
+		return err
+	}
+
+	checksums := make([]string, len(blocks))
+	for i, b := range blocks {
+		checksums[i] = gifts.Checksum(b)
+	}
+
+	assignments, err := c.master.CreateErasure(ctx, fname, fsize, dataShards, parityShards, checksums)
+	if err != nil {
+		c.Logger.Printf("Client.StoreErasure(fname=%q, fsize=%d) => %v", fname, fsize, err)
+		return err
+	}
+
+	if len(blocks) != len(assignments) {
+		msg := fmt.Sprintf("Need %d blocks but the Master gave us %d", len(blocks), len(assignments))
+		c.Logger.Printf("Client.StoreErasure(fname=%q, fsize=%d) => %q", fname, fsize, msg)
+		return fmt.Errorf(msg)
+	}
+
+	// the first failure cancels the outstanding transfers
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	terr := firstError{cancel: cancel}
+	stopLease := c.keepLease(ctx, fname)
+	for i, assignment := range assignments {
+		wg.Add(1)
+		go func(i int, assignment structure.BlockAssign) {
+			defer wg.Done()
+			if err := c.writeBlock(ctx, assignment, blocks[i], checksums[i]); err != nil {
+				terr.set(err)
+			}
+		}(i, assignment)
+	}
+	wg.Wait()
+	stopLease()
+
+	// Make the file visible only once all blocks are there,
+	// or give the name back
+	if err = terr.err; err == nil {
+		err = c.master.Commit(ctx, fname, nil)
+	} else {
+		c.abort(fname)
+	}
+
+	if err != nil {
+		c.Logger.Printf("Client.StoreErasure(fname=%q, fsize=%d) => %v", fname, fsize, err)
+		return err
+	}
+	c.Logger.Printf("Client.StoreErasure(fname=%q, fsize=%d) => success", fname, fsize)
+	return nil
+}
+
+// encode data into the blocks of its stripes, in the order the Master assigns them.
+// The data blocks are padded to the full size, as the parity is.
+func (c *Client) encode(rs *algorithm.ReedSolomon, data []byte) ([]gifts.Block, error) {
+	k, m := rs.DataShards(), rs.ParityShards()
+	nStripes := gifts.NStripes(c.config.GiftsBlockSize, k, len(data))
+	nData := gifts.NBlocks(c.config.GiftsBlockSize, len(data))
+
+	blocks := make([]gifts.Block, 0, nStripes*(k+m))
+	for s := 0; s < nStripes; s++ {
+		shards := make([][]byte, k+m)
+		for j := 0; j < k; j++ {
+			shards[j] = make([]byte, c.config.GiftsBlockSize)
+			if i := s*k + j; i < nData {
+				copy(shards[j], c.blockOf(data, i))
+			}
+		}
+		if err := rs.Encode(shards); err != nil {
+			return nil, err
+		}
+		for _, shard := range shards {
+			blocks = append(blocks, shard)
+		}
+	}
+	return blocks, nil
+}
+
+// nBlocksOf the file as assigned by the Master:
+// its data blocks, or all the blocks of its stripes if erasure coded
+func (c *Client) nBlocksOf(fb *structure.FileBlocks) int {
+	if fb.DataShards > 0 {
+		return gifts.NStripes(c.config.GiftsBlockSize, fb.DataShards, fb.Fsize) * (fb.DataShards + fb.ParityShards)
+	}
+	return gifts.NBlocks(c.config.GiftsBlockSize, fb.Fsize)
+}
+
+// assignmentOf the ith data block of the file
+func (c *Client) assignmentOf(fb *structure.FileBlocks, i int) structure.BlockAssign {
+	if fb.DataShards > 0 {
+		k := fb.DataShards
+		return fb.Assignments[i/k*(k+fb.ParityShards)+i%k]
+	}
+	return fb.Assignments[i]
+}
+
+// dataBlock i of the file, rebuilt from its stripe if it cannot be read
+func (c *Client) dataBlock(ctx context.Context, fb *structure.FileBlocks, i int) (gifts.Block, error) {
+	block, err := c.readBlock(ctx, c.assignmentOf(fb, i))
+	if fb.DataShards == 0 {
+		return block, err
+	}
+
+	if err != nil {
+		c.Logger.Printf("Client.dataBlock(%d) => %v, rebuilding the stripe", i, err)
+		var shards []gifts.Block
+		if shards, err = c.readStripe(ctx, fb, i/fb.DataShards); err != nil {
+			return nil, err
+		}
+		block = shards[i%fb.DataShards]
+	}
+
+	// without the padding
+	size := fb.Fsize - i*c.config.GiftsBlockSize
+	if size > c.config.GiftsBlockSize {
+		size = c.config.GiftsBlockSize
+	}
+	if len(block) < size {
+		return nil, fmt.Errorf("Block %d is shorter than expected: %d bytes", i, len(block))
+	}
+	return block[:size], nil
+}
+
+// readStripe s of the file, its data blocks.
+// The parity is read only if some data block cannot be.
+func (c *Client) readStripe(ctx context.Context, fb *structure.FileBlocks, s int) ([]gifts.Block, error) {
+	k, m := fb.DataShards, fb.ParityShards
+	rs, err := algorithm.NewReedSolomon(k, m)
+	if err != nil {
+		return nil, err
+	}
+
+	shards := make([][]byte, k+m)
+	read := func(from, to int) (nRead int) {
+		var wg sync.WaitGroup
+		for j := from; j < to; j++ {
+			wg.Add(1)
+			go func(j int) {
+				defer wg.Done()
+				if b, err := c.readBlock(ctx, fb.Assignments[s*(k+m)+j]); err == nil {
+					shards[j] = b
+				}
+			}(j)
+		}
+		wg.Wait()
+
+		for j := from; j < to; j++ {
+			if shards[j] != nil {
+				nRead++
+			}
+		}
+		return
+	}
+
+	if read(0, k) < k {
+		read(k, k+m)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err := rs.Reconstruct(shards); err != nil {
+			return nil, fmt.Errorf("Stripe %d cannot be rebuilt: %v", s, err)
+		}
+	}
+
+	data := make([]gifts.Block, k)
+	for j := range data {
+		data[j] = shards[j]
+	}
+	return data, nil
+}
+
+// readDataRange of length bytes at offset of the ith data block,
+// the whole block is rebuilt from its stripe if the range cannot be read
+func (c *Client) readDataRange(ctx context.Context, fb *structure.FileBlocks, i, offset, length int) ([]byte, error) {
+	data, err := c.readRange(ctx, c.assignmentOf(fb, i), offset, length)
+	if err == nil || fb.DataShards == 0 {
+		return data, err
+	}
+
+	block, err := c.dataBlock(ctx, fb, i)
+	if err != nil {
+		return nil, err
+	}
+	if offset+length > len(block) {
+		return nil, fmt.Errorf("Block %d is shorter than expected: %d bytes", i, len(block))
+	}
+	return block[offset : offset+length], nil
+}
@@ -0,0 +1,114 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/GIFTS-fs/GIFTS/config"
+	"github.com/GIFTS-fs/GIFTS/storage"
+	"github.com/GIFTS-fs/GIFTS/structure"
+	"github.com/GIFTS-fs/GIFTS/test"
+)
+
+func TestClient_Erasure(t *testing.T) {
+	t.Parallel()
+
+	c := NewClient([]string{"master"}, config.Get())
+
+	addrs := []string{"localhost:3700", "localhost:3701", "localhost:3702", "localhost:3703", "localhost:3704"}
+	for _, addr := range addrs {
+		storage.ServeRPC(storage.NewStorage(), addr)
+	}
+
+	// Two stripes of 3+2 blocks, the last one padded
+	blockSize := c.config.GiftsBlockSize
+	data := make([]byte, 4*blockSize+blockSize/2)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	var stored []structure.BlockAssign
+	c.master.CreateErasure = func(ctx context.Context, fname string, fsize int, dataShards, parityShards int, checksums []string) ([]structure.BlockAssign, error) {
+		stored = nil
+		for i, sum := range checksums {
+			replica := addrs[i%(dataShards+parityShards)]
+			stored = append(stored, structure.BlockAssign{BlockID: fmt.Sprintf("ec_%d", i), Checksum: sum, Replicas: []string{replica}})
+		}
+		return stored, nil
+	}
+	c.master.Commit = func(ctx context.Context, fname string, checksums []string) error {
+		return nil
+	}
+	c.master.ReportUnreachable = func(ctx context.Context, addr string) error {
+		return nil
+	}
+
+	// Lookup with the storages at the indices down
+	down := func(indices ...int) {
+		assignments := make([]structure.BlockAssign, len(stored))
+		copy(assignments, stored)
+		for i := range assignments {
+			for _, j := range indices {
+				if assignments[i].Replicas[0] == addrs[j] {
+					assignments[i].Replicas = []string{fmt.Sprintf("r%d", j)}
+				}
+			}
+		}
+		c.master.Lookup = func(ctx context.Context, fname string) (*structure.FileBlocks, error) {
+			return &structure.FileBlocks{Fsize: len(data), Assignments: assignments, DataShards: 3, ParityShards: 2}, nil
+		}
+	}
+
+	// Invalid codes
+	t.Logf("TestClient_Erasure: Starting test #1")
+	test.AF(t, c.StoreErasure(context.Background(), "filename", 0, 2, data) != nil, "Expected non-nil error")
+	test.AF(t, c.StoreErasure(context.Background(), "filename", 3, 0, data) != nil, "Expected non-nil error")
+
+	// Valid call
+	t.Logf("TestClient_Erasure: Starting test #2")
+	err := c.StoreErasure(context.Background(), "filename", 3, 2, data)
+	test.AF(t, err == nil, fmt.Sprintf("Client.StoreErasure failed: %v", err))
+	test.AF(t, len(stored) == 10, fmt.Sprintf("Expected 2 stripes of 5 blocks, found %d blocks", len(stored)))
+	down()
+	ret, err := c.Read(context.Background(), "filename")
+	test.AF(t, err == nil, fmt.Sprintf("Client.Read failed: %v", err))
+	test.AF(t, bytes.Equal(ret, data), "Read data does not match")
+
+	// Any 3 blocks of a stripe are enough
+	for _, lost := range [][]int{{0}, {1, 2}, {0, 4}, {3, 4}} {
+		t.Logf("TestClient_Erasure: Starting test #3, storages %v down", lost)
+		down(lost...)
+		ret, err = c.Read(context.Background(), "filename")
+		test.AF(t, err == nil, fmt.Sprintf("Client.Read failed: %v", err))
+		test.AF(t, bytes.Equal(ret, data), "Read data does not match")
+
+		ret, err = c.ReadAt(context.Background(), "filename", blockSize-1, 3*blockSize)
+		test.AF(t, err == nil, fmt.Sprintf("Client.ReadAt failed: %v", err))
+		test.AF(t, bytes.Equal(ret, data[blockSize-1:4*blockSize-1]), "ReadAt data does not match")
+
+		f, err := c.Open(context.Background(), "filename")
+		test.AF(t, err == nil, fmt.Sprintf("Client.Open failed: %v", err))
+		ret, err = ioutil.ReadAll(f)
+		test.AF(t, err == nil, fmt.Sprintf("File.Read failed: %v", err))
+		test.AF(t, bytes.Equal(ret, data), "Streamed data does not match")
+	}
+
+	// But not 2
+	t.Logf("TestClient_Erasure: Starting test #4")
+	down(0, 1, 4)
+	_, err = c.Read(context.Background(), "filename")
+	test.AF(t, err != nil, "Expected non-nil error")
+	_, err = c.ReadAt(context.Background(), "filename", 0, 1)
+	test.AF(t, err != nil, "Expected non-nil error")
+
+	// Inconsistent metadata
+	t.Logf("TestClient_Erasure: Starting test #5")
+	c.master.Lookup = func(ctx context.Context, fname string) (*structure.FileBlocks, error) {
+		return &structure.FileBlocks{Fsize: len(data), Assignments: stored[:5], DataShards: 3, ParityShards: 2}, nil
+	}
+	_, err = c.Read(context.Background(), "filename")
+	test.AF(t, err != nil, "Expected non-nil error")
+}
@@ -0,0 +1,362 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	gifts "github.com/GIFTS-fs/GIFTS"
+	"github.com/GIFTS-fs/GIFTS/structure"
+)
+
+// Writer uploads a file block by block as the data arrives,
+// so only one block is ever kept in memory.
+type Writer struct {
+	c           *Client
+	ctx         context.Context // of the Create, bounds the uploads
+	fname       string
+	size        int
+	assignments []structure.BlockAssign
+	checksums   []string  // of the blocks written, sent at the commit
+	renewed     time.Time // when the lease of the file was last given or renewed
+
+	buf     []byte // the block being filled
+	iBlock  int    // index of the block being filled
+	written int
+	err     error // sticky, the first failure
+	closed  bool
+}
+
+// Create a file of exactly size bytes to be written through the returned Writer.
+// The replication factor is only a hint, see Store().
+// The file is invisible to readers until Close() commits it.
+// If it is never closed, the Master deletes it once the lease expires,
+// the Writer renews the lease as long as the blocks keep coming.
+// The uploads by the Writer and its commit are given up once ctx is done.
+//
+// It returns an error if:
+//		- A file with the specified file name already exists
+//		- The Master does not give us enough blocks in which to store the data
+//		- There is a network error
+func (c *Client) Create(ctx context.Context, fname string, rfactor uint, size int) (io.WriteCloser, error) {
+	if fname == "" {
+		msg := "File name cannot be empty"
+		c.Logger.Printf("Client.Create(fname=%q, rfactor=%d) => %q", fname, rfactor, msg)
+		return nil, fmt.Errorf(msg)
+	}
+
+	if rfactor <= 0 {
+		msg := "Replication factor must be positive"
+		c.Logger.Printf("Client.Create(fname=%q, rfactor=%d) => %q", fname, rfactor, msg)
+		return nil, fmt.Errorf(msg)
+	}
+
+	if size < 0 {
+		msg := "File size cannot be negative"
+		c.Logger.Printf("Client.Create(fname=%q, rfactor=%d, fsize=%d) => %q", fname, rfactor, size, msg)
+		return nil, fmt.Errorf(msg)
+	}
+
+	// The data is not here yet, so neither are the checksums, they come with the commit.
+	// Without them the blocks cannot be deduplicated either.
+	assignments, err := c.master.Create(ctx, fname, size, rfactor, nil, false)
+	if err != nil {
+		c.Logger.Printf("Client.Create(fname=%q, rfactor=%d, fsize=%d) => %v", fname, rfactor, size, err)
+		return nil, err
+	}
+
+	nBlocks := gifts.NBlocks(c.config.GiftsBlockSize, size)
+	if nBlocks != len(assignments) {
+		msg := fmt.Sprintf("Need %d blocks but the Master gave us %d", nBlocks, len(assignments))
+		c.Logger.Printf("Client.Create(fname=%q, rfactor=%d, fsize=%d) => %q", fname, rfactor, size, msg)
+		return nil, fmt.Errorf(msg)
+	}
+
+	c.Logger.Printf("Client.Create(fname=%q, rfactor=%d, fsize=%d) => success", fname, rfactor, size)
+	return &Writer{
+		c:           c,
+		ctx:         ctx,
+		fname:       fname,
+		size:        size,
+		assignments: assignments,
+		checksums:   make([]string, 0, nBlocks),
+		renewed:     time.Now(),
+		buf:         make([]byte, 0, c.config.GiftsBlockSize),
+	}, nil
+}
+
+// Write p, uploading every block filled up
+func (w *Writer) Write(p []byte) (n int, err error) {
+	if w.closed {
+		return 0, fmt.Errorf("Write to closed file %q", w.fname)
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.written+len(p) > w.size {
+		return 0, fmt.Errorf("Write of %d bytes exceeds the size %d of file %q", len(p), w.size, w.fname)
+	}
+
+	for len(p) > 0 {
+		m := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+m]
+		p = p[m:]
+		n += m
+		w.written += m
+
+		if len(w.buf) == cap(w.buf) {
+			if w.err = w.flush(); w.err != nil {
+				return n, w.err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Close uploads the last block and commits the file, the file must be fully written.
+// The file is aborted if anything failed.
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	if w.err == nil && w.written != w.size {
+		w.err = fmt.Errorf("File %q closed after %d of %d bytes", w.fname, w.written, w.size)
+		w.c.Logger.Printf("Writer.Close(fname=%q) => %v", w.fname, w.err)
+	}
+	if w.err == nil && len(w.buf) > 0 {
+		w.err = w.flush()
+	}
+	if w.err != nil {
+		w.c.abort(w.fname)
+		return w.err
+	}
+
+	if w.err = w.c.master.Commit(w.ctx, w.fname, w.checksums); w.err != nil {
+		w.c.Logger.Printf("Writer.Close(fname=%q) => %v", w.fname, w.err)
+		return w.err
+	}
+
+	w.c.Logger.Printf("Writer.Close(fname=%q) => %d bytes", w.fname, w.written)
+	return nil
+}
+
+// flush the buffered block to all its replicas
+func (w *Writer) flush() error {
+	assignment := w.assignments[w.iBlock]
+	checksum := gifts.Checksum(w.buf)
+	if err := w.c.writeBlock(w.ctx, assignment, w.buf, checksum); err != nil {
+		w.c.Logger.Printf("Writer.flush(fname=%q, block=%d) => %v", w.fname, w.iBlock, err)
+		return err
+	}
+
+	w.checksums = append(w.checksums, checksum)
+	w.iBlock++
+	w.buf = w.buf[:0]
+
+	// a file larger than what can be written within the lease
+	if renewal := w.c.leaseRenewal(); renewal > 0 && time.Since(w.renewed) >= renewal {
+		if err := w.c.master.RenewLease(w.ctx, w.fname); err != nil {
+			w.c.Logger.Printf("Writer.flush(fname=%q, block=%d) => %v", w.fname, w.iBlock-1, err)
+			return err
+		}
+		w.renewed = time.Now()
+	}
+	return nil
+}
+
+// writeBlock to all the replicas of the assignment in parallel,
+// the first failure cancels the others
+func (c *Client) writeBlock(ctx context.Context, assignment structure.BlockAssign, b gifts.Block, checksum string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	terr := firstError{cancel: cancel}
+	for _, addr := range assignment.Replicas {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			if err := c.storageOf(addr).Set(ctx, &structure.BlockKV{ID: assignment.BlockID, Data: b, Checksum: checksum}); err != nil {
+				terr.set(err)
+			}
+		}(addr)
+	}
+	wg.Wait()
+
+	return terr.err
+}
+
+// blockFetch is a block being fetched, or fetched
+type blockFetch struct {
+	done  chan bool // closed once fetched
+	block gifts.Block
+	err   error
+}
+
+// File is a read-only handle of a file.
+// Blocks are fetched only when read, sequential reads fetch a bounded number of blocks ahead.
+// ReadAt is safe for concurrent use, Read and Seek share the offset.
+type File struct {
+	c     *Client
+	ctx   context.Context // of the Open, bounds the fetches
+	fname string
+	fb    *structure.FileBlocks
+
+	offsetLock sync.Mutex
+	offset     int64
+
+	// block index -> *blockFetch, the current blocks and the ones read ahead
+	cacheLock sync.Mutex
+	cache     map[int]*blockFetch
+}
+
+// Open a file for reading.
+// The fetches of the blocks are given up once ctx is done.
+//
+// It returns an error if:
+//		- The file does not exist
+// 		- The Master fails or returns inconsistent metadata
+func (c *Client) Open(ctx context.Context, fname string) (*File, error) {
+	fb, err := c.master.Lookup(ctx, fname)
+	if err != nil {
+		c.Logger.Printf("Client.Open(fname=%q) => %v", fname, err)
+		return nil, err
+	}
+
+	if len(fb.Assignments) != c.nBlocksOf(fb) {
+		msg := fmt.Sprintf("Master returned %d blocks for a file with %d bytes", len(fb.Assignments), fb.Fsize)
+		c.Logger.Printf("Client.Open(fname=%q) => %q", fname, msg)
+		return nil, fmt.Errorf(msg)
+	}
+
+	c.Logger.Printf("Client.Open(fname=%q) => %d bytes", fname, fb.Fsize)
+	return &File{c: c, ctx: ctx, fname: fname, fb: fb, cache: make(map[int]*blockFetch)}, nil
+}
+
+// Size of the file in bytes
+func (f *File) Size() int64 {
+	return int64(f.fb.Fsize)
+}
+
+// Read from the current offset, fetching the next blocks ahead
+func (f *File) Read(p []byte) (int, error) {
+	f.offsetLock.Lock()
+	defer f.offsetLock.Unlock()
+
+	if f.offset >= f.Size() {
+		return 0, io.EOF
+	}
+
+	n, err := f.readAt(p, f.offset, f.c.config.ClientReadAheadBlocks)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		// the next Read tells
+		err = nil
+	}
+	return n, err
+}
+
+// ReadAt reads len(p) bytes at off, without read-ahead
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	return f.readAt(p, off, 0)
+}
+
+// Seek sets the offset of the next Read
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	f.offsetLock.Lock()
+	defer f.offsetLock.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.Size()
+	default:
+		return f.offset, fmt.Errorf("Seek: invalid whence %d", whence)
+	}
+
+	if offset < 0 {
+		return f.offset, fmt.Errorf("Seek: negative offset %d", offset)
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// Close releases the cached blocks
+func (f *File) Close() error {
+	f.cacheLock.Lock()
+	defer f.cacheLock.Unlock()
+	f.cache = make(map[int]*blockFetch)
+	return nil
+}
+
+func (f *File) readAt(p []byte, off int64, readAhead int) (n int, err error) {
+	if off < 0 {
+		return 0, fmt.Errorf("ReadAt: negative offset %d", off)
+	}
+
+	blockSize := int64(f.c.config.GiftsBlockSize)
+	for n < len(p) && off < f.Size() {
+		i := int(off / blockSize)
+		block, err := f.fetch(i, readAhead)
+		if err != nil {
+			return n, err
+		}
+
+		inBlock := off - int64(i)*blockSize
+		if inBlock >= int64(len(block)) {
+			return n, fmt.Errorf("Block %d of %q is shorter than expected: %d bytes", i, f.fname, len(block))
+		}
+
+		m := copy(p[n:], block[inBlock:])
+		n += m
+		off += int64(m)
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// fetch the ith block and start fetching readAhead more after it,
+// the blocks before i are dropped from the cache
+func (f *File) fetch(i, readAhead int) (gifts.Block, error) {
+	nBlocks := gifts.NBlocks(f.c.config.GiftsBlockSize, f.fb.Fsize)
+
+	f.cacheLock.Lock()
+	for j := range f.cache {
+		if j < i || j > i+readAhead {
+			delete(f.cache, j)
+		}
+	}
+	for j := i; j <= i+readAhead && j < nBlocks; j++ {
+		if _, found := f.cache[j]; !found {
+			bf := &blockFetch{done: make(chan bool)}
+			f.cache[j] = bf
+			go func(j int) {
+				bf.block, bf.err = f.c.dataBlock(f.ctx, f.fb, j)
+				close(bf.done)
+			}(j)
+		}
+	}
+	bf := f.cache[i]
+	f.cacheLock.Unlock()
+
+	<-bf.done
+	if bf.err != nil {
+		// do not keep the failure, try again next time
+		f.cacheLock.Lock()
+		if f.cache[i] == bf {
+			delete(f.cache, i)
+		}
+		f.cacheLock.Unlock()
+		return nil, bf.err
+	}
+	return bf.block, nil
+}
@@ -0,0 +1,139 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	gifts "github.com/GIFTS-fs/GIFTS"
+	"github.com/GIFTS-fs/GIFTS/config"
+	"github.com/GIFTS-fs/GIFTS/storage"
+	"github.com/GIFTS-fs/GIFTS/structure"
+	"github.com/GIFTS-fs/GIFTS/test"
+)
+
+func TestClient_Stream(t *testing.T) {
+	t.Parallel()
+
+	c := NewClient([]string{"master"}, config.Get())
+
+	addr1 := "localhost:3600"
+	addr2 := "localhost:3601"
+	storage.ServeRPC(storage.NewStorage(), addr1)
+	storage.ServeRPC(storage.NewStorage(), addr2)
+
+	blockSize := c.config.GiftsBlockSize
+	expected := []byte(strings.Repeat("0123456789", 1+(5*blockSize/2)/10)[:5*blockSize/2])
+
+	var assignments []structure.BlockAssign
+	c.master.Create = func(ctx context.Context, fname string, fsize int, rfactor uint, checksums []string, dedup bool) ([]structure.BlockAssign, error) {
+		assignments = nil
+		for i := 0; i*blockSize < fsize; i++ {
+			assignments = append(assignments, structure.BlockAssign{BlockID: fmt.Sprintf("%s_%d", fname, i), Replicas: []string{addr1, addr2}})
+		}
+		return assignments, nil
+	}
+	var checksums []string
+	c.master.Commit = func(ctx context.Context, fname string, sums []string) error {
+		checksums = sums
+		return nil
+	}
+	aborted := false
+	c.master.Delete = func(ctx context.Context, fname string) error {
+		aborted = true
+		return nil
+	}
+	c.master.Lookup = func(ctx context.Context, fname string) (*structure.FileBlocks, error) {
+		return &structure.FileBlocks{Fsize: len(expected), Assignments: assignments}, nil
+	}
+
+	// Write in odd pieces across the blocks
+	t.Logf("TestClient_Stream: Starting test #1")
+	w, err := c.Create(context.Background(), "stream", 2, len(expected))
+	test.AF(t, err == nil, fmt.Sprintf("Client.Create failed: %v", err))
+	for data := expected; len(data) > 0; {
+		n := 7777
+		if n > len(data) {
+			n = len(data)
+		}
+		m, err := w.Write(data[:n])
+		test.AF(t, err == nil && m == n, fmt.Sprintf("Writer.Write failed: %v", err))
+		data = data[n:]
+	}
+	_, err = w.Write([]byte("x"))
+	test.AF(t, err != nil, "Writing beyond the size should fail")
+	err = w.Close()
+	test.AF(t, err == nil, fmt.Sprintf("Writer.Close failed: %v", err))
+	test.AF(t, len(checksums) == len(assignments), fmt.Sprintf("Expected %d checksums at the commit, found %d", len(assignments), len(checksums)))
+	for i := range checksums {
+		test.AF(t, checksums[i] == gifts.Checksum(c.blockOf(expected, i)), fmt.Sprintf("Wrong checksum of block %d at the commit", i))
+	}
+
+	// Read it all sequentially
+	t.Logf("TestClient_Stream: Starting test #2")
+	f, err := c.Open(context.Background(), "stream")
+	test.AF(t, err == nil, fmt.Sprintf("Client.Open failed: %v", err))
+	test.AF(t, f.Size() == int64(len(expected)), fmt.Sprintf("Expected %d bytes, found %d", len(expected), f.Size()))
+	actual, err := ioutil.ReadAll(f)
+	test.AF(t, err == nil, fmt.Sprintf("ReadAll failed: %v", err))
+	test.AF(t, bytes.Equal(actual, expected), "Read data does not match the written data")
+
+	// Random access across a block boundary
+	t.Logf("TestClient_Stream: Starting test #3")
+	p := make([]byte, 100)
+	off := int64(blockSize - 50)
+	n, err := f.ReadAt(p, off)
+	test.AF(t, err == nil && n == len(p), fmt.Sprintf("File.ReadAt failed: %v", err))
+	test.AF(t, bytes.Equal(p, expected[off:off+100]), "ReadAt data does not match")
+
+	n, err = f.ReadAt(p, int64(len(expected)-10))
+	test.AF(t, err == io.EOF && n == 10, fmt.Sprintf("Expected 10 bytes and EOF at the end, found %d and %v", n, err))
+
+	// Seek
+	t.Logf("TestClient_Stream: Starting test #4")
+	pos, err := f.Seek(-int64(blockSize), io.SeekEnd)
+	test.AF(t, err == nil && pos == int64(len(expected)-blockSize), fmt.Sprintf("File.Seek failed: %v", err))
+	actual, err = ioutil.ReadAll(f)
+	test.AF(t, err == nil, fmt.Sprintf("ReadAll failed: %v", err))
+	test.AF(t, bytes.Equal(actual, expected[pos:]), "Read data after Seek does not match")
+	_, err = f.Seek(-1, io.SeekStart)
+	test.AF(t, err != nil, "Seeking to a negative offset should fail")
+	test.AF(t, f.Close() == nil, "File.Close failed")
+
+	// Closed before fully written
+	t.Logf("TestClient_Stream: Starting test #5")
+	w, err = c.Create(context.Background(), "short", 2, len(expected))
+	test.AF(t, err == nil, fmt.Sprintf("Client.Create failed: %v", err))
+	w.Write(expected[:blockSize+1])
+	test.AF(t, w.Close() != nil, "Closing a partially written file should fail")
+	test.AF(t, aborted, "Closing a partially written file should abort it")
+
+	// A file written for longer than half the lease renews it
+	t.Logf("TestClient_Stream: Starting test #6")
+	renewed := 0
+	c.master.RenewLease = func(ctx context.Context, fname string) error {
+		renewed++
+		return nil
+	}
+	w, err = c.Create(context.Background(), "slow", 2, len(expected))
+	test.AF(t, err == nil, fmt.Sprintf("Client.Create failed: %v", err))
+	w.(*Writer).renewed = time.Now().Add(-time.Second * c.config.MasterCreateLeaseSec)
+	_, err = w.Write(expected)
+	test.AF(t, err == nil, fmt.Sprintf("Writer.Write failed: %v", err))
+	test.AF(t, renewed == 1, fmt.Sprintf("Expected the lease renewed once, found %d", renewed))
+	test.AF(t, w.Close() == nil, "Writer.Close failed")
+
+	c.master.RenewLease = func(ctx context.Context, fname string) error {
+		return fmt.Errorf("Lease of file %q expired", fname)
+	}
+	w, err = c.Create(context.Background(), "late", 2, len(expected))
+	test.AF(t, err == nil, fmt.Sprintf("Client.Create failed: %v", err))
+	w.(*Writer).renewed = time.Now().Add(-time.Second * c.config.MasterCreateLeaseSec)
+	_, err = w.Write(expected)
+	test.AF(t, err != nil, "Writing after the lease expired should fail")
+}
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"time"
 
+	gifts "github.com/GIFTS-fs/GIFTS"
 	"github.com/GIFTS-fs/GIFTS/client"
 	"github.com/GIFTS-fs/GIFTS/config"
+	"github.com/GIFTS-fs/GIFTS/master"
 )
 
 const (
@@ -15,16 +19,42 @@ const (
 	ActionRead = "read"
 	// ActionStore a file
 	ActionStore = "store"
+	// ActionDelete a file
+	ActionDelete = "delete"
+	// ActionRename a file
+	ActionRename = "rename"
+	// ActionList the files with a prefix
+	ActionList = "ls"
+	// ActionStat a file
+	ActionStat = "stat"
+	// ActionMkdir a directory
+	ActionMkdir = "mkdir"
+	// ActionReadDir a directory
+	ActionReadDir = "readdir"
+	// ActionRmdir a directory
+	ActionRmdir = "rmdir"
+	// ActionRepairStatus of the Master
+	ActionRepairStatus = "repair-status"
+	// ActionRegister a Storage to the Master
+	ActionRegister = "register"
+	// ActionDecommission a Storage from the Master
+	ActionDecommission = "decommission"
 )
 
 var (
 	configPath = flag.String("conf", config.GIFTSDefaultConfigPath(), "config file")
 	verbose    = flag.Bool("v", false, "verbose logging")
 	readyAddr  = flag.String("ready", "", "ready notification address")
-	action     = flag.String("action", "", "action: read, store")
+	action     = flag.String("action", "", "action: read, store, delete, rename, ls, stat, mkdir, readdir, rmdir, repair-status, register, decommission")
 	filePath   = flag.String("path", "", "File path, for Store")
-	fileName   = flag.String("file", "", "File name")
+	fileName   = flag.String("file", "", "File name, the prefix for ls, the directory for mkdir, readdir and rmdir")
+	recursive  = flag.Bool("r", false, "rmdir everything under the directory")
+	newName    = flag.String("to", "", "New file name, for rename")
+	overwrite  = flag.Bool("f", false, "rename over an existing file")
 	rfactor    = flag.Uint("rfactor", 0, "replication factor")
+	ecData     = flag.Int("ec-data", 0, "data blocks per stripe, store erasure coded instead of replicated")
+	ecParity   = flag.Int("ec-parity", 0, "parity blocks per stripe, with -ec-data")
+	storage    = flag.String("storage", "", "Storage address, for register and decommission")
 )
 
 func main() {
@@ -34,6 +64,11 @@ func main() {
 	if err != nil {
 		log.Fatalf("Config loading failed: %v\n", err)
 	}
+	tlsConfig, err := gifts.LoadTLSConfig(conf.TLSCAFile, conf.TLSCertFile, conf.TLSKeyFile, conf.TLSServerName)
+	if err != nil {
+		log.Fatalf("TLS config loading failed: %v\n", err)
+	}
+	config.UseRPC(conf, tlsConfig)
 
 	if conf.Master == "" {
 		log.Fatalf("Where is my Master: %v\n", conf)
@@ -41,10 +76,11 @@ func main() {
 
 	c := client.NewClient([]string{conf.Master}, conf)
 	c.Logger.Enabled = *verbose
+	ctx := context.Background()
 
 	if *action == ActionRead {
 		log.Printf("Reading: %q\n", *fileName)
-		data, err := c.Read(*fileName)
+		data, err := c.Read(ctx, *fileName)
 		if err != nil {
 			log.Fatalf("Read failed: %v\n", err)
 		}
@@ -55,10 +91,105 @@ func main() {
 		if err != nil {
 			log.Fatalf("ReadFile (%q) failed: %v\n", *filePath, err)
 		}
-		err = c.Store(*fileName, *rfactor, data)
+		if *ecData > 0 {
+			err = c.StoreErasure(ctx, *fileName, *ecData, *ecParity, data)
+		} else {
+			err = c.Store(ctx, *fileName, *rfactor, data)
+		}
 		if err != nil {
 			log.Fatalf("Store (%q) failed: %v\n", *fileName, err)
 		}
+	} else if *action == ActionDelete {
+		log.Printf("Deleting: %q\n", *fileName)
+		err = c.Delete(ctx, *fileName)
+		if err != nil {
+			log.Fatalf("Delete (%q) failed: %v\n", *fileName, err)
+		}
+	} else if *action == ActionRename {
+		log.Printf("Renaming: %q to %q\n", *fileName, *newName)
+		err = c.Rename(ctx, *fileName, *newName, *overwrite)
+		if err != nil {
+			log.Fatalf("Rename (%q) failed: %v\n", *fileName, err)
+		}
+	} else if *action == ActionList {
+		cursor := ""
+		for {
+			fnames, next, err := c.List(ctx, *fileName, cursor, 0)
+			if err != nil {
+				log.Fatalf("List (%q) failed: %v\n", *fileName, err)
+			}
+			for _, fname := range fnames {
+				fmt.Println(fname)
+			}
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+	} else if *action == ActionStat {
+		stat, err := c.Stat(ctx, *fileName)
+		if err != nil {
+			log.Fatalf("Stat (%q) failed: %v\n", *fileName, err)
+		}
+		fmt.Printf("%+v\n", *stat)
+	} else if *action == ActionMkdir {
+		log.Printf("Making directory: %q\n", *fileName)
+		err = c.Mkdir(ctx, *fileName)
+		if err != nil {
+			log.Fatalf("Mkdir (%q) failed: %v\n", *fileName, err)
+		}
+	} else if *action == ActionReadDir {
+		entries, err := c.ReadDir(ctx, *fileName)
+		if err != nil {
+			log.Fatalf("ReadDir (%q) failed: %v\n", *fileName, err)
+		}
+		for _, entry := range entries {
+			if entry.IsDir {
+				fmt.Println(entry.Name + "/")
+			} else {
+				fmt.Println(entry.Name)
+			}
+		}
+	} else if *action == ActionRmdir {
+		log.Printf("Removing directory: %q\n", *fileName)
+		err = c.Rmdir(ctx, *fileName, *recursive)
+		if err != nil {
+			log.Fatalf("Rmdir (%q) failed: %v\n", *fileName, err)
+		}
+	} else if *action == ActionRepairStatus {
+		status, err := master.NewConn(conf.Master).RepairStatus(ctx)
+		if err != nil {
+			log.Fatalf("RepairStatus failed: %v\n", err)
+		}
+		fmt.Printf("%+v\n", *status)
+	} else if *action == ActionRegister {
+		log.Printf("Registering: %q\n", *storage)
+		err = master.NewConn(conf.Master).RegisterStorage(ctx, *storage)
+		if err != nil {
+			log.Fatalf("RegisterStorage (%q) failed: %v\n", *storage, err)
+		}
+	} else if *action == ActionDecommission {
+		log.Printf("Decommissioning: %q\n", *storage)
+		conn := master.NewConn(conf.Master)
+		err = conn.DecommissionStorage(ctx, *storage)
+		if err != nil {
+			log.Fatalf("DecommissionStorage (%q) failed: %v\n", *storage, err)
+		}
+		// the blocks move away in background, for as long as it takes
+		for {
+			time.Sleep(time.Second)
+			status, err := conn.DecommissionStatus(ctx, *storage)
+			if err != nil {
+				log.Fatalf("DecommissionStatus (%q) failed: %v\n", *storage, err)
+			}
+			log.Printf("%+v\n", *status)
+			if !status.Running {
+				if !status.Done {
+					log.Fatalf("DecommissionStorage (%q) failed: %s\n", *storage, status.Err)
+				}
+				break
+			}
+		}
 	} else {
 		log.Printf("No action specified. Exiting...\n")
 	}
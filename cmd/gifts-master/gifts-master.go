@@ -4,6 +4,7 @@ import (
 	"flag"
 	"log"
 
+	gifts "github.com/GIFTS-fs/GIFTS"
 	"github.com/GIFTS-fs/GIFTS/config"
 	"github.com/GIFTS-fs/GIFTS/master"
 )
@@ -21,6 +22,11 @@ func main() {
 	if err != nil {
 		log.Fatalf("Config loading failed: %v\n", err)
 	}
+	tlsConfig, err := gifts.LoadTLSConfig(conf.TLSCAFile, conf.TLSCertFile, conf.TLSKeyFile, conf.TLSServerName)
+	if err != nil {
+		log.Fatalf("TLS config loading failed: %v\n", err)
+	}
+	config.UseRPC(conf, tlsConfig)
 
 	if len(conf.Storages) <= 0 {
 		log.Printf("Warning: no storage found\n")
@@ -33,5 +39,6 @@ func main() {
 	log.Printf("Starting Master at address %q\n", conf.Master)
 	m := master.NewMaster(conf.Storages, conf)
 	m.Logger.Enabled = *verbose
+	m.TLS = tlsConfig
 	master.ServeRPCBlock(m, conf.Master, nil)
 }
@@ -1,13 +1,20 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 
+	gifts "github.com/GIFTS-fs/GIFTS"
 	"github.com/GIFTS-fs/GIFTS/config"
+	"github.com/GIFTS-fs/GIFTS/master"
 	"github.com/GIFTS-fs/GIFTS/storage"
 )
 
@@ -18,8 +25,22 @@ var (
 	iStorage    = flag.Int("s", -1, "The index of the Storage instance to start")
 	statEnabled = flag.Bool("stat", false, "stat collecting enable")
 	statPrefix  = flag.String("prefix", "", "stat file prefix")
+	dataDir     = flag.String("data", "", "block data directory, overrides StorageDataDir of config")
+	storageAddr = flag.String("addr", "", "address to serve at, instead of the index into Storages of config")
+	register    = flag.Bool("register", false, "register to the Master once ready, for storages added at runtime")
 )
 
+// registerWhenReady tells the master about addr once the storage is served
+func registerWhenReady(masterAddr, addr string, readyChan chan bool) {
+	if !<-readyChan {
+		return
+	}
+	if err := master.NewConn(masterAddr).RegisterStorage(context.Background(), addr); err != nil {
+		log.Fatalf("Registering to Master %q failed: %v\n", masterAddr, err)
+	}
+	log.Printf("Registered to Master %q\n", masterAddr)
+}
+
 func main() {
 	flag.Parse()
 
@@ -27,26 +48,69 @@ func main() {
 	if err != nil {
 		log.Fatalf("Config loading failed: %v\n", err)
 	}
-
-	if len(conf.Storages) <= 0 {
-		log.Fatalf("No storage found\n")
+	tlsConfig, err := gifts.LoadTLSConfig(conf.TLSCAFile, conf.TLSCertFile, conf.TLSKeyFile, conf.TLSServerName)
+	if err != nil {
+		log.Fatalf("TLS config loading failed: %v\n", err)
 	}
+	config.UseRPC(conf, tlsConfig)
 
 	if conf.Master == "" {
 		log.Fatalf("Where is my Master: %v\n", conf)
 	}
 
-	if *iStorage < 0 || *iStorage >= len(conf.Storages) {
-		if *iStorage == -1 {
-			log.Fatalf("Please provide a storage index")
+	addr := *storageAddr
+	name := strings.Replace(addr, ":", "_", -1)
+	if addr == "" {
+		if len(conf.Storages) <= 0 {
+			log.Fatalf("No storage found\n")
+		}
+
+		if *iStorage < 0 || *iStorage >= len(conf.Storages) {
+			if *iStorage == -1 {
+				log.Fatalf("Please provide a storage index or address")
+			}
+			log.Fatalf("Invalid storage index %d", *iStorage)
 		}
-		log.Fatalf("Invalid storage index %d", *iStorage)
+
+		addr = conf.Storages[*iStorage]
+		name = fmt.Sprintf("%d", *iStorage)
 	}
 
-	addr := conf.Storages[*iStorage]
-	log.Printf("Starting Storage at address %q\n", addr)
-	s := storage.NewStorage()
+	dir := *dataDir
+	if dir == "" && conf.StorageDataDir != "" {
+		dir = filepath.Join(conf.StorageDataDir, "storage-"+name)
+	}
+
+	var s *storage.Storage
+	if dir == "" {
+		log.Printf("Starting Storage at address %q (in memory)\n", addr)
+		s = storage.NewStorage()
+	} else {
+		backend, err := storage.NewDiskBackend(dir)
+		if err != nil {
+			log.Fatalf("Data directory %q loading failed: %v\n", dir, err)
+		}
+		log.Printf("Starting Storage at address %q (data in %q)\n", addr, dir)
+		s = storage.NewStorageBackend(backend)
+	}
 	s.Logger.Enabled = *verbose
+	s.Capacity = conf.StorageCapacityBytes
+	s.TLS = tlsConfig
+
+	if conf.StorageScrubIntervalSec > 0 {
+		mc := master.NewConn(conf.Master)
+		report := func(id string) error {
+			return mc.ReportCorrupt(context.Background(), addr, id)
+		}
+		scrubber := storage.NewScrubber(s, conf.StorageScrubBytesPerSec, report)
+		go scrubber.Run(time.Second*conf.StorageScrubIntervalSec, nil)
+	}
+
+	var readyChan chan bool
+	if *register {
+		readyChan = make(chan bool, 1)
+		go registerWhenReady(conf.Master, addr, readyChan)
+	}
 
 	// TODO: instead of awkward signal handling
 	// can easily write to disk per 1 sec in non-critical path
@@ -59,10 +123,10 @@ func main() {
 
 		done := make(chan bool, 1)
 		go s.TrapSignal(*statPrefix, sigsChan, done)
-		go storage.ServeRPCBlock(s, addr, nil)
+		go storage.ServeRPCBlock(s, addr, readyChan)
 		go s.CollectStat()
 		<-done
 	} else {
-		storage.ServeRPCBlock(s, addr, nil)
+		storage.ServeRPCBlock(s, addr, readyChan)
 	}
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 	"path/filepath"
@@ -54,13 +55,13 @@ func main() {
 
 	// create 2 files
 	c := client.NewClient([]string{conf.Master}, conf)
-	c.Store("f1", 1, data)
-	c.Store("f2", 1, append(data, data...))
+	c.Store(context.Background(), "f1", 1, data)
+	c.Store(context.Background(), "f2", 1, append(data, data...))
 
 	// read f1 nRead times
 	for i := 0; i < nRead; i++ {
 		time.Sleep(1 * time.Second)
-		c.Read("f1")
+		c.Read(context.Background(), "f1")
 	}
 
 	// sleep and wait for the temperature to cool down
@@ -69,7 +70,7 @@ func main() {
 	// read f1 nRead times again
 	for i := 0; i < nRead; i++ {
 		time.Sleep(1 * time.Second)
-		c.Read("f1")
+		c.Read(context.Background(), "f1")
 	}
 
 	// sleep and wait for the temperature to cool down
@@ -78,7 +79,7 @@ func main() {
 	// read f2 nRead times
 	for i := 0; i < nRead; i++ {
 		time.Sleep(1 * time.Second)
-		c.Read("f2")
+		c.Read(context.Background(), "f2")
 	}
 
 	// generate plenty of data
@@ -86,12 +87,12 @@ func main() {
 	ge.Read(plentyData)
 
 	// create a plenty file
-	c.Store("f3", 1, plentyData)
+	c.Store(context.Background(), "f3", 1, plentyData)
 
 	// read f3 nRead times
 	for i := 0; i < nRead; i++ {
 		time.Sleep(1 * time.Second)
-		c.Read("f3")
+		c.Read(context.Background(), "f3")
 	}
 
 	// sleep and wait for the temperature to cool down
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 	"path/filepath"
@@ -59,5 +60,5 @@ func main() {
 	ge.Read(plentyData)
 
 	// create a plenty file
-	c.Store("f-plenty", 3, plentyData)
+	c.Store(context.Background(), "f-plenty", 3, plentyData)
 }
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -8,6 +9,7 @@ import (
 	"sync"
 	"time"
 
+	gifts "github.com/GIFTS-fs/GIFTS"
 	"github.com/GIFTS-fs/GIFTS/policy"
 )
 
@@ -28,6 +30,69 @@ type Config struct {
 	Master   string
 	Storages []string
 
+	// root of the on-disk block stores, keep blocks in memory if empty
+	StorageDataDir string
+	// how often the storages verify all their blocks, never if 0
+	StorageScrubIntervalSec time.Duration
+	// how fast the scrubber reads, no limit if 0
+	StorageScrubBytesPerSec int
+	// bytes the blocks of a storage may take, unlimited if 0
+	StorageCapacityBytes int64
+
+	// where the master keeps its journal and snapshots, no persistence if empty
+	MasterDataDir             string
+	MasterSnapshotIntervalSec time.Duration
+
+	// how often the master probes the storages, no failure detection if 0
+	StorageHeartbeatIntervalSec time.Duration
+	// consecutive missed heartbeats before a storage is considered dead
+	StorageDeadAfterMissed int
+	// how often the master looks for blocks that lost replicas,
+	// repair only when a storage dies if 0
+	MasterRepairIntervalSec time.Duration
+	// how often the master compares its metadata with the block reports of the storages,
+	// also how old a file must be before its missing blocks are believed, never if 0
+	MasterReconcileIntervalSec time.Duration
+
+	// how long a created file waits for the commit of its writer
+	// before it is deleted with its blocks, never if 0.
+	// The clients renew it every half of it while they are still writing
+	MasterCreateLeaseSec time.Duration
+
+	// protocol on the wire of the RPCs made, the servers speak all of them
+	RPCProtocol gifts.Protocol
+	// PEM files of the CA of the cluster, and of the certificate and key of the node.
+	// All RPCs are then over TLS, each end verified by the other; plain TCP if none is set.
+	TLSCAFile   string
+	TLSCertFile string
+	TLSKeyFile  string
+	// name the certificates of the peers are verified against, instead of the host of their address.
+	// Needed if the addresses have no host, such as ":4000"
+	TLSServerName string
+	// connections kept to each peer, shared by all the RPCs to it, 1 if 0
+	RPCConnsPerPeer int
+	// how long a connection may stay unused before it is closed, never if 0
+	RPCIdleTimeoutSec time.Duration
+	// how often the idle connections are checked alive, a dead one is dropped
+	// before a call fails on it, never if 0
+	RPCHealthCheckSec time.Duration
+	// how long an RPC may take, its dial included, before it is given up, no deadline if 0
+	RPCCallTimeoutSec time.Duration
+	// how many times an RPC is tried while its server cannot be reached, 2 if 0
+	RPCMaxAttempts int
+	// how long before the first retry, doubled before each next one, no wait if 0
+	RPCRetryBackoffMs time.Duration
+	// upper bound of the wait before a retry, none if 0
+	RPCRetryMaxBackoffMs time.Duration
+	// fraction of each wait drawn at random, so the clients do not retry in lockstep
+	RPCRetryJitter float64
+
+	// how many blocks a streaming reader fetches ahead, no read-ahead if 0
+	ClientReadAheadBlocks int
+	// name the blocks stored by Client.Store() by their content,
+	// so identical blocks are stored once across all files
+	ClientDedupEnabled bool
+
 	DynamicReplicationEnabled   bool
 	MasterRebalanceIntervalSec  time.Duration
 	TrafficDecayCounterHalfLife float64
@@ -37,6 +102,9 @@ type Config struct {
 	BlockPlacementPolicy           policy.BlockPlacementPolicy
 	ReplicaPlacementPolicy         policy.ReplicaPlacementPolicy
 	ReplicaPlacementPermuTableSize int
+	// with BlockPlacementPolicyCapacity, the fraction of its capacity
+	// above which a storage receives no new block or replica, only when full if 0
+	MasterHighWaterMark float64
 }
 
 // Load the system configuration from the config file
@@ -74,6 +142,21 @@ func Get() *Config {
 	return config
 }
 
+// UseRPC settings of conf for all the RPCs of the process, over TLS if tlsConfig is not nil,
+// see gifts.LoadTLSConfig. It replaces gifts.DefaultRPCPool, gifts.DefaultRetryPolicy
+// and gifts.MaxPayload, call it before creating any RPC client or server
+func UseRPC(conf *Config, tlsConfig *tls.Config) {
+	gifts.MaxPayload = conf.GiftsBlockSize + gifts.PayloadSlack
+	gifts.DefaultRPCPool = gifts.NewRPCPool(conf.RPCConnsPerPeer, time.Second*conf.RPCIdleTimeoutSec, time.Second*conf.RPCCallTimeoutSec, conf.RPCProtocol, tlsConfig)
+	gifts.DefaultRPCPool.CheckHealth(time.Second * conf.RPCHealthCheckSec)
+	gifts.DefaultRetryPolicy = gifts.RetryPolicy{
+		MaxAttempts: conf.RPCMaxAttempts,
+		BaseBackoff: time.Millisecond * conf.RPCRetryBackoffMs,
+		MaxBackoff:  time.Millisecond * conf.RPCRetryMaxBackoffMs,
+		Jitter:      conf.RPCRetryJitter,
+	}
+}
+
 // LoadGet loads if not already loaded, it's concurrency safe and ensures singleton
 func LoadGet(path string) (*Config, error) {
 	var err error
@@ -0,0 +1,387 @@
+package gifts
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"time"
+)
+
+// The framed protocol is a net/rpc codec that sends the bulk data of the calls raw
+// instead of through gob, so a block goes from the socket straight to its buffer.
+//
+// A connection starts with framedMagic, the length of the path (uint16) and the path,
+// answered by one byte, framedAccepted if the server is there.
+// Then every request and response is a frame:
+//
+//	header: seq (uint64), name length (uint16), flags (uint8), payload length (uint32)
+//	name:   the method of a request, the error of a response
+//	body:   the rest of the message, gob encoded, if flagBody
+//	payload: the bulk data, if flagPayload
+//
+// All integers are big endian.
+
+var framedMagic = []byte("GIFTS/F1")
+
+const (
+	framedAccepted = 0
+	framedRejected = 1
+
+	framedHeaderSize = 8 + 2 + 1 + 4
+
+	flagBody    = 1 << 0
+	flagPayload = 1 << 1
+	flagError   = 1 << 2
+)
+
+// PayloadSlack is allowed on top of a block in a payload
+const PayloadSlack = 4096
+
+// MaxPayload is the largest payload a framed connection reads, a block and PayloadSlack.
+// A frame claiming more is refused before anything is allocated for it.
+// config.UseRPC sets it from the block size, replace it before serving to configure it.
+var MaxPayload = 64<<20 + PayloadSlack
+
+// Payloader is a message with bulk data, the framed protocol sends it apart from the rest
+type Payloader interface {
+	// SplitPayload into the rest of the message, gob encoded, and the bulk data sent raw
+	SplitPayload() (rest interface{}, payload []byte)
+	// JoinPayload received raw to the rest of the message decoded into the receiver
+	JoinPayload(payload []byte)
+}
+
+// PayloadStreamer is a message the bulk data of which is read as it is sent,
+// rather than held in memory. The gob protocol reads it whole first.
+type PayloadStreamer interface {
+	// OpenPayload splits the message into the rest, a Payloader gob encoded,
+	// and size bytes of bulk data read from payload to its end, closed once sent.
+	// It is opened again for every attempt at sending the message.
+	OpenPayload() (rest interface{}, payload io.ReadCloser, size int, err error)
+}
+
+// payloadError is a streamed payload that could not be read,
+// the call is given up before the server runs it
+type payloadError struct {
+	error
+}
+
+func (e payloadError) Unwrap() error {
+	return e.error
+}
+
+// readPayload of a streamed message whole, joined to the rest
+func readPayload(s PayloadStreamer) (interface{}, error) {
+	rest, payload, size, err := s.OpenPayload()
+	if err != nil {
+		return nil, payloadError{err}
+	}
+	defer payload.Close()
+
+	p, ok := rest.(Payloader)
+	if !ok {
+		return nil, fmt.Errorf("framed: %T takes no payload", rest)
+	}
+	// read to the end, a stream may fail only there, e.g. found corrupted
+	data, err := ioutil.ReadAll(io.LimitReader(payload, int64(size)+1))
+	if err == nil && len(data) != size {
+		err = fmt.Errorf("framed: payload of %d bytes, expected %d", len(data), size)
+	}
+	if err != nil {
+		return nil, payloadError{err}
+	}
+	p.JoinPayload(data)
+	return rest, nil
+}
+
+// payloadReader keeps the error of reading the payload, apart from that of sending it
+type payloadReader struct {
+	r   io.Reader
+	err error
+}
+
+func (pr *payloadReader) Read(p []byte) (n int, err error) {
+	if n, err = pr.r.Read(p); err != nil && err != io.EOF {
+		pr.err = err
+	}
+	return
+}
+
+// splitPayload of a message, a block is all payload
+func splitPayload(body interface{}) (rest interface{}, payload []byte, hasPayload bool) {
+	switch b := body.(type) {
+	case Payloader:
+		rest, payload = b.SplitPayload()
+		return rest, payload, true
+	case *Block:
+		return nil, *b, true
+	case *[]byte:
+		return nil, *b, true
+	}
+	return body, nil, false
+}
+
+// joinPayload to a message decoded, false if it takes none
+func joinPayload(body interface{}, payload []byte) bool {
+	switch b := body.(type) {
+	case Payloader:
+		b.JoinPayload(payload)
+	case *Block:
+		*b = payload
+	case *[]byte:
+		*b = payload
+	default:
+		return false
+	}
+	return true
+}
+
+// framedConn is the reading and writing of frames on a connection,
+// shared by both ends
+type framedConn struct {
+	conn io.ReadWriteCloser
+	r    *bufio.Reader
+	w    *bufio.Writer
+	dec  *gob.Decoder
+	enc  *gob.Encoder
+
+	// of the frame being read
+	flags      uint8
+	payloadLen uint32
+}
+
+func newFramedConn(conn io.ReadWriteCloser, r *bufio.Reader) *framedConn {
+	if r == nil {
+		r = bufio.NewReader(conn)
+	}
+	w := bufio.NewWriter(conn)
+	// gob takes the bufio.Reader as it is and reads no more than its messages,
+	// the payloads after them are left in place
+	return &framedConn{conn: conn, r: r, w: w, dec: gob.NewDecoder(r), enc: gob.NewEncoder(w)}
+}
+
+// writeFrame with the body, its payload apart
+func (c *framedConn) writeFrame(seq uint64, name string, flags uint8, body interface{}) (err error) {
+	var rest interface{}
+	var payload []byte
+	var stream io.Reader
+	size := 0
+	if flags&flagError == 0 {
+		var hasPayload bool
+		if s, ok := body.(PayloadStreamer); ok {
+			var rc io.ReadCloser
+			if rest, rc, size, err = s.OpenPayload(); err != nil {
+				return payloadError{err}
+			}
+			defer rc.Close()
+			stream, hasPayload = rc, true
+		} else if rest, payload, hasPayload = splitPayload(body); hasPayload {
+			stream, size = bytes.NewReader(payload), len(payload)
+		}
+		if hasPayload {
+			flags |= flagPayload
+		}
+		if rest != nil {
+			flags |= flagBody
+		}
+	}
+	if len(name) > 0xffff {
+		name = name[:0xffff]
+	}
+
+	var header [framedHeaderSize]byte
+	binary.BigEndian.PutUint64(header[0:], seq)
+	binary.BigEndian.PutUint16(header[8:], uint16(len(name)))
+	header[10] = flags
+	binary.BigEndian.PutUint32(header[11:], uint32(size))
+	if _, err = c.w.Write(header[:]); err != nil {
+		return
+	}
+	if _, err = c.w.WriteString(name); err != nil {
+		return
+	}
+	if flags&flagBody != 0 {
+		if err = c.enc.Encode(rest); err != nil {
+			return
+		}
+	}
+	if flags&flagPayload != 0 {
+		// the block itself, no copy past the buffer
+		// read to the end, a stream may fail only there, e.g. found corrupted
+		src := &payloadReader{r: io.LimitReader(stream, int64(size)+1)}
+		var n int64
+		if n, err = io.Copy(c.w, src); err == nil && n != int64(size) {
+			src.err = fmt.Errorf("framed: payload of %d bytes, expected %d", n, size)
+		}
+		if src.err != nil {
+			err = payloadError{src.err}
+		}
+		if err != nil {
+			// the frame cannot be completed, nothing else may follow it
+			c.conn.Close()
+			return
+		}
+	}
+	return c.w.Flush()
+}
+
+// readHeader of the next frame and its name
+func (c *framedConn) readHeader() (seq uint64, name string, err error) {
+	var header [framedHeaderSize]byte
+	if _, err = io.ReadFull(c.r, header[:]); err != nil {
+		return
+	}
+	seq = binary.BigEndian.Uint64(header[0:])
+	nameLen := binary.BigEndian.Uint16(header[8:])
+	c.flags = header[10]
+	c.payloadLen = binary.BigEndian.Uint32(header[11:])
+	if int64(c.payloadLen) > int64(MaxPayload) {
+		return 0, "", fmt.Errorf("framed: payload of %d bytes too large", c.payloadLen)
+	}
+
+	nameBuf := make([]byte, nameLen)
+	if _, err = io.ReadFull(c.r, nameBuf); err != nil {
+		return
+	}
+	return seq, string(nameBuf), nil
+}
+
+// readBody of the frame into body, discarded if nil
+func (c *framedConn) readBody(body interface{}) (err error) {
+	if c.flags&flagBody != 0 {
+		// gob discards it if body is nil
+		if err = c.dec.Decode(body); err != nil {
+			return
+		}
+	}
+
+	if c.flags&flagPayload == 0 {
+		return nil
+	}
+	if body == nil {
+		_, err = io.CopyN(ioutil.Discard, c.r, int64(c.payloadLen))
+		return
+	}
+	// from the socket straight to the buffer, once the bufio one is drained
+	payload := make([]byte, c.payloadLen)
+	if _, err = io.ReadFull(c.r, payload); err != nil {
+		return
+	}
+	if !joinPayload(body, payload) {
+		return fmt.Errorf("framed: unexpected payload for %T", body)
+	}
+	return nil
+}
+
+// framedClientCodec is the rpc.ClientCodec of the framed protocol
+type framedClientCodec struct {
+	*framedConn
+}
+
+func (c *framedClientCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	return c.writeFrame(r.Seq, r.ServiceMethod, 0, body)
+}
+
+func (c *framedClientCodec) ReadResponseHeader(r *rpc.Response) (err error) {
+	var name string
+	if r.Seq, name, err = c.readHeader(); err != nil {
+		return
+	}
+	if c.flags&flagError != 0 {
+		r.Error = name
+	}
+	return nil
+}
+
+func (c *framedClientCodec) ReadResponseBody(body interface{}) error {
+	return c.readBody(body)
+}
+
+func (c *framedClientCodec) Close() error {
+	return c.conn.Close()
+}
+
+// framedServerCodec is the rpc.ServerCodec of the framed protocol
+type framedServerCodec struct {
+	*framedConn
+}
+
+func (c *framedServerCodec) ReadRequestHeader(r *rpc.Request) (err error) {
+	r.Seq, r.ServiceMethod, err = c.readHeader()
+	return
+}
+
+func (c *framedServerCodec) ReadRequestBody(body interface{}) error {
+	return c.readBody(body)
+}
+
+func (c *framedServerCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	if r.Error != "" {
+		return c.writeFrame(r.Seq, r.Error, flagError, nil)
+	}
+	return c.writeFrame(r.Seq, "", 0, body)
+}
+
+func (c *framedServerCodec) Close() error {
+	return c.conn.Close()
+}
+
+// dialFramed is dialHTTPPath for the framed protocol
+func dialFramed(ctx context.Context, addr, path string, tlsConfig *tls.Config) (*rpc.Client, error) {
+	// the deadline holds for the handshakes too
+	conn, err := dialTCP(ctx, addr, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	hello := make([]byte, 0, len(framedMagic)+2+len(path))
+	hello = append(hello, framedMagic...)
+	hello = append(hello, byte(len(path)>>8), byte(len(path)))
+	hello = append(hello, path...)
+	var answer [1]byte
+	if _, err = conn.Write(hello); err == nil {
+		_, err = io.ReadFull(conn, answer[:])
+	}
+	if err == nil && answer[0] != framedAccepted {
+		err = fmt.Errorf("no server at path %q", path)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, &net.OpError{Op: "dial-framed", Net: "tcp " + addr, Addr: nil, Err: err}
+	}
+	conn.SetDeadline(time.Time{})
+	return rpc.NewClientWithCodec(&framedClientCodec{newFramedConn(conn, nil)}), nil
+}
+
+// serveFramed the server at path on conn, r has read nothing past the magic,
+// the deadline of the handshake is cleared once done
+func serveFramed(server *rpc.Server, path string, conn net.Conn, r *bufio.Reader) {
+	var hello [2]byte
+	if _, err := io.ReadFull(r, hello[:]); err != nil {
+		conn.Close()
+		return
+	}
+	pathBuf := make([]byte, int(hello[0])<<8|int(hello[1]))
+	if _, err := io.ReadFull(r, pathBuf); err != nil {
+		conn.Close()
+		return
+	}
+	if string(pathBuf) != path {
+		conn.Write([]byte{framedRejected})
+		conn.Close()
+		return
+	}
+	if _, err := conn.Write([]byte{framedAccepted}); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	server.ServeCodec(&framedServerCodec{newFramedConn(conn, r)})
+}
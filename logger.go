@@ -5,6 +5,7 @@ import (
 	"io"
 	"log"
 	"os"
+	"sync/atomic"
 )
 
 // global log switch
@@ -40,8 +41,9 @@ func (t *Logger) Printf(format string, v ...interface{}) {
 
 // NewLogger is the constructor for gifts.Logger
 func NewLogger(name, addr string, enabled bool) *Logger {
-	prefix := fmt.Sprintf(giftsLogFmt, name, addr, os.Getpid(), giftsLoggerID)
-	giftsLoggerID++
+	// loggers are created concurrently, e.g. of the storages a client meets
+	id := atomic.AddUint64(&giftsLoggerID, 1) - 1
+	prefix := fmt.Sprintf(giftsLogFmt, name, addr, os.Getpid(), id)
 
 	return &Logger{logger: log.New(giftsLogWritter, prefix, log.LstdFlags), Enabled: enabled}
 }
@@ -9,14 +9,14 @@ import (
 )
 
 // populateLookupTable for block placement policy 2,
-// can potentially be called multiple times when the storage change in the future (?)
+// called again by rebuildTopology when the storages change
 func (m *Master) populateLookupTable(names []string) {
 	m.placementEntry = algorithm.PopulateLookupTable(m.config.MaglevHashingMultipler, len(names), names)
 	m.placementEntryLen = len(m.placementEntry)
 }
 
 // buildReplicaPermuTable for replica placement policy 2,
-// can potentially be called multiple times when the storage change in the future (?)
+// called again by rebuildTopology when the storages change
 func (m *Master) buildReplicaPermuTable() {
 	// init [1...n]
 	storageList := make([]int, m.nStorage)
@@ -62,7 +62,38 @@ func (m *Master) removeReplicaOf(fb *fileBlock) (s *storeMeta) {
 	return m.removeReplicaOfUnit(fb)
 }
 
+// nextFreeReplicaOf moves the policy forward until a live storage not holding fb,
+// nil if there is no such storage.
+// The capacity policy picks the least full one instead, nil if none has room.
+// Needed once replicas are repaired out of the policy order.
+func (m *Master) nextFreeReplicaOf(fb *fileBlock) *storeMeta {
+	if m.config.BlockPlacementPolicy == policy.BlockPlacementPolicyCapacity {
+		return m.placeOnLeastFull(fb)
+	}
+	for i := 0; i < m.nStorage; i++ {
+		if s := m.nextReplicaOf(fb); s.isAlive() && !fb.hasReplica(s) {
+			return s
+		}
+	}
+	return nil
+}
+
+// nextHeldReplicaOf moves the policy forward until a storage holding fb,
+// nil if there is no such storage.
+func (m *Master) nextHeldReplicaOf(fb *fileBlock) *storeMeta {
+	for i := 0; i < m.nStorage; i++ {
+		if s := m.removeReplicaOf(fb); fb.hasReplica(s) {
+			return s
+		}
+	}
+	return nil
+}
+
 /*
+ * Note on the clocks of a fileBlock:
+ * they may be out of range after the storages shrink,
+ * always take them modulo nStorage.
+ *
  * Note on nextRR and removeRR:
  * With only 2 pointers, cannot tell if full and empty
  * But since there is no need for calling Next on file with 0 rFactor
@@ -73,31 +104,34 @@ func (m *Master) removeReplicaOf(fb *fileBlock) (s *storeMeta) {
 // beg++ end
 // caller's responibility to check if the list is used up
 func (m *Master) nextReplicaOfUnitRR(fb *fileBlock) (s *storeMeta) {
-	s, fb.clockBeg = m.storages[fb.clockBeg], clockTick(fb.clockBeg, m.nStorage, 1)
+	s, fb.clockBeg = m.storages[fb.clockBeg%m.nStorage], clockTick(fb.clockBeg, m.nStorage, 1)
 	return
 }
 
 // beg end++
 // no correctness guaranteed if called with 0 replicas (break the whole algorithm)
 func (m *Master) removeReplicaOfUnitRR(fb *fileBlock) (s *storeMeta) {
-	s, fb.clockEnd = m.storages[fb.clockEnd], clockTick(fb.clockEnd, m.nStorage, 1)
+	s, fb.clockEnd = m.storages[fb.clockEnd%m.nStorage], clockTick(fb.clockEnd, m.nStorage, 1)
 	return
 }
 
 // beg++ end
 func (m *Master) nextReplicaOfUnitPermu(fb *fileBlock) (s *storeMeta) {
-	s, fb.clockBeg = m.storages[m.replicaPermu[fb.permuIndex][fb.clockBeg]], clockTick(fb.clockBeg, m.nStorage, 1)
+	s, fb.clockBeg = m.storages[m.replicaPermu[fb.permuIndex][fb.clockBeg%m.nStorage]], clockTick(fb.clockBeg, m.nStorage, 1)
 	return
 }
 
 // beg end++
 func (m *Master) removeReplicaOfUnitPermu(fb *fileBlock) (s *storeMeta) {
-	s, fb.clockEnd = m.storages[m.replicaPermu[fb.permuIndex][fb.clockEnd]], clockTick(fb.clockEnd, m.nStorage, 1)
+	s, fb.clockEnd = m.storages[m.replicaPermu[fb.permuIndex][fb.clockEnd%m.nStorage]], clockTick(fb.clockEnd, m.nStorage, 1)
 	return
 }
 
 // createAssignments for the request, assume all arguments are valid to the best knowledge of the caller
 func (m *Master) createAssignments(req *structure.FileCreateReq, nBlocks int) (assignments []*fileBlock, nReplica int, blockAssignments []structure.BlockAssign) {
+	m.topologyLock.RLock()
+	defer m.topologyLock.RUnlock()
+
 	// overflow safety checked by caller
 	nReplica = int(req.Rfactor)
 
@@ -109,23 +143,57 @@ func (m *Master) createAssignments(req *structure.FileCreateReq, nBlocks int) (a
 	assignments = make([]*fileBlock, nBlocks)
 	blockAssignments = make([]structure.BlockAssign, nBlocks)
 
+	// the blocks to place, the shared ones already have their replicas
+	fresh := make([]int, 0, nBlocks)
+	var shared []int
+
+	if req.Dedup {
+		// The same content must not be placed twice, even by concurrent creates
+		m.dedupLock.Lock()
+		defer m.dedupLock.Unlock()
+	}
+
 	for i := range assignments {
-		bID := nameBlock(req.Fname, i)
-		assignments[i] = newFileBlock(m.config, bID)
-		blockAssignments[i].BlockID = bID
+		if req.Dedup {
+			if fb, stored := m.shareBlock(req.Checksums[i]); fb != nil {
+				assignments[i] = fb
+				blockAssignments[i] = structure.BlockAssign{BlockID: fb.BlockID, Checksum: fb.checksum, Exists: stored}
+				shared = append(shared, i)
+				continue
+			}
+			assignments[i] = m.newDedupBlock(req.Checksums[i])
+		} else {
+			assignments[i] = newFileBlock(m.config, m.blockIDs.newID())
+		}
+		blockAssignments[i].BlockID = assignments[i].BlockID
+		fresh = append(fresh, i)
 	}
 
+	// Only known after the placement if shared within the file
+	defer func() {
+		for _, i := range shared {
+			for _, r := range assignments[i].getReplicas() {
+				blockAssignments[i].Replicas = append(blockAssignments[i].Replicas, r.Addr)
+			}
+		}
+	}()
+
 	// no replica, no need to consult policy
-	if nReplica == 0 {
+	if nReplica == 0 || len(fresh) == 0 {
+		return
+	}
+
+	if req.DataShards > 0 {
+		m.placeStripes(req, assignments, nReplica, blockAssignments)
 		return
 	}
 
 	switch m.config.BlockPlacementPolicy {
 	case policy.BlockPlacementPolicyPermutation:
 		// New block placement policy 2: Permutation
-		handIdx := m.touchCreateHand(nBlocks)
+		handIdx := m.touchCreateHand(len(fresh))
 
-		for i := range assignments {
+		for _, i := range fresh {
 			// m.Logger.Printf("THRASHING1 Permu block %q is assigned to %v", assignments[i].BlockID, m.placementEntry[handIdx])
 
 			assignments[i].clockEnd = m.placementEntry[handIdx]
@@ -140,6 +208,20 @@ func (m *Master) createAssignments(req *structure.FileCreateReq, nBlocks int) (a
 			}
 		}
 
+	case policy.BlockPlacementPolicyCapacity:
+		// Block placement policy 3: least full first,
+		// the blocks left without any replica fail the create
+		for _, i := range fresh {
+			for j := 0; j < nReplica; j++ {
+				store := m.placeOnLeastFull(assignments[i])
+				if store == nil {
+					break
+				}
+				assignments[i].addReplica(store)
+				blockAssignments[i].Replicas = append(blockAssignments[i].Replicas, store.Addr)
+			}
+		}
+
 	default: // use RR as default
 		// New block placement policy 1: Round-robin
 
@@ -154,16 +236,16 @@ func (m *Master) createAssignments(req *structure.FileCreateReq, nBlocks int) (a
 		var amount, subamount int
 		if m.config.ReplicaPlacementPolicy == policy.ReplicaPlacementPolicyRR {
 			// For legacy code, change in future
-			amount = nBlocks * nReplica
+			amount = len(fresh) * nReplica
 			subamount = nReplica
 		} else {
-			amount = nBlocks
+			amount = len(fresh)
 			subamount = 1
 		}
 
 		handIdx := m.touchCreateHand(amount)
 
-		for i := range assignments {
+		for _, i := range fresh {
 			// m.Logger.Printf("THRASHING1 RR block %q is assigned to %v", assignments[i].BlockID, handIdx)
 			assignments[i].clockEnd = handIdx
 			assignments[i].clockBeg = handIdx
@@ -181,31 +263,59 @@ func (m *Master) createAssignments(req *structure.FileCreateReq, nBlocks int) (a
 	return
 }
 
-// pickReplica for the requested blockID
+// pickReplica for the requested blockID.
+// Dead replicas are skipped unless none is alive, then try the luck with any one.
+// picked is nil if the block has no replica at all.
 func (m *Master) pickReplica(fb *fileBlock) (picked *storeMeta, pickedAddr string) {
-	// Pick block policy 1: (badly) randomly pick one
-	pick := rand.Intn(fb.nReplicas())
-	picked = fb.replicas[pick]
-	pickedAddr = fb.replicas[pick].Addr
+	// the replicas may change meanwhile, stick to one version
+	replicas := fb.getReplicas()
+	nReplica := len(replicas)
+	if nReplica <= 0 {
+		return
+	}
+
+	// Pick block policy 1: (badly) randomly pick one alive
+	start := rand.Intn(nReplica)
+	picked = replicas[start]
+	for i := 0; i < nReplica; i++ {
+		if r := replicas[(start+i)%nReplica]; r.isAlive() {
+			picked = r
+			break
+		}
+	}
+	pickedAddr = picked.Addr
 
 	return
 }
 
-// lookupReplicas for the file
+// lookupReplicas for the file, all replicas of each block in the order to try:
+// the picked one, the other live ones, then the ones considered dead
 func (m *Master) lookupReplicas(fm *fileMeta) (assignment []structure.BlockAssign) {
 	assignment = make([]structure.BlockAssign, fm.nBlocks)
 
 	for i, completeAssignment := range fm.blocks {
 		assignment[i].BlockID = completeAssignment.BlockID
+		assignment[i].Checksum = completeAssignment.checksum
 
-		nReplica := len(completeAssignment.replicas)
-		if nReplica <= 0 {
+		picked, pickedAddr := m.pickReplica(completeAssignment)
+		if picked == nil {
 			continue
 		}
 
-		_, pickedAddr := m.pickReplica(completeAssignment)
-		assignment[i].Replicas = []string{pickedAddr}
-
+		// picked may be gone from this version, it is tried first all the same
+		all := completeAssignment.getReplicas()
+		replicas := append(make([]string, 0, len(all)+1), pickedAddr)
+		for _, r := range all {
+			if r != picked && r.isAlive() {
+				replicas = append(replicas, r.Addr)
+			}
+		}
+		for _, r := range all {
+			if r != picked && !r.isAlive() {
+				replicas = append(replicas, r.Addr)
+			}
+		}
+		assignment[i].Replicas = replicas
 	}
 	return
 }
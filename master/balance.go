@@ -1,6 +1,10 @@
 package master
 
-import "github.com/GIFTS-fs/GIFTS/structure"
+import (
+	"context"
+
+	"github.com/GIFTS-fs/GIFTS/structure"
+)
 
 // enlistment asks the src to store a copy of blockID to dst
 type enlistment struct {
@@ -15,14 +19,18 @@ type enlistment struct {
 // replicateEnlistment copies blockID from src to dst
 func (m *Master) replicateEnlistment(enlistment *enlistment) error {
 	sm, _ := m.sMap.Load(enlistment.src.Addr)
-	return sm.(*storeMeta).rpc.Replicate(&structure.ReplicateKV{ID: enlistment.blockID, Dest: enlistment.dst.Addr})
+	return sm.(*storeMeta).rpc.Replicate(context.Background(), &structure.ReplicateKV{
+		ID:       enlistment.blockID,
+		Dest:     enlistment.dst.Addr,
+		Checksum: enlistment.fileBlock.checksum,
+	})
 }
 
 // dereplicateEnlistment removes blockID from dst (src can be nil)
 func (m *Master) dereplicateEnlistment(enlistment *enlistment) error {
 	sm, _ := m.sMap.Load(enlistment.dst.Addr)
 	var ignore bool
-	return sm.(*storeMeta).rpc.Unset(enlistment.blockID, &ignore)
+	return sm.(*storeMeta).rpc.Unset(context.Background(), enlistment.blockID, &ignore)
 }
 
 // detectUnbalance based on the policy,
@@ -39,9 +47,24 @@ func (m *Master) detectUnbalance() (toUp, toDown []*fileMeta) {
 	m.fMap.Range(func(key interface{}, value interface{}) bool {
 		fm := value.(*fileMeta)
 
+		// the blocks of the files being written may not exist yet
+		if !fm.initialized || !fm.isCommitted() {
+			return true
+		}
+
+		// a shared block serves other files as well, do not drop its replicas for this one
+		// TODO: balance by the traffic of all the files sharing the blocks
+		if fm.dedup {
+			return true
+		}
+
 		// TODO: figure out better ways to put the critical sections
 		// and data read (currentMedian is the median before the for loop currently)
 		m.trafficLock.Lock()
+		if fm.deleted {
+			m.trafficLock.Unlock()
+			return true
+		}
 		prev, tempature := fm.trafficCounter.GetRaw(), fm.trafficCounter.Get()
 		m.trafficMedian.Update(prev, tempature)
 		m.trafficLock.Unlock()
@@ -79,9 +102,10 @@ func (m *Master) detectUnbalance() (toUp, toDown []*fileMeta) {
 	return
 }
 
-// enlistNewReplicas for file fm, returns a list of enlistment.
+// enlistNewReplicas for file fm, returns a list of enlistment,
+// nil if any block cannot have one more replica.
 func (m *Master) enlistNewReplicas(fm *fileMeta) (enlistments []*enlistment) {
-	if fm.nReplica == m.nStorage {
+	if fm.nReplica >= m.nStorage {
 		return nil
 	}
 
@@ -90,14 +114,18 @@ func (m *Master) enlistNewReplicas(fm *fileMeta) (enlistments []*enlistment) {
 	for i, block := range fm.blocks {
 		enlistment := &enlistment{blockID: block.BlockID, fileBlock: block}
 		enlistment.src, _ = m.pickReplica(block)
-		enlistment.dst = m.nextReplicaOf(block)
+		enlistment.dst = m.nextFreeReplicaOf(block)
+		if enlistment.src == nil || enlistment.dst == nil {
+			return nil
+		}
 		enlistments[i] = enlistment
 	}
 
 	return
 }
 
-// dischargeReplicas for file fm, return a slice of enlistments for each block
+// dischargeReplicas for file fm, return a slice of enlistments for each block,
+// nil if any block has no replica to discharge.
 func (m *Master) dischargeReplicas(fm *fileMeta) (enlistments []*enlistment) {
 	if fm.nReplica <= int(fm.rFactor) {
 		return nil
@@ -107,7 +135,10 @@ func (m *Master) dischargeReplicas(fm *fileMeta) (enlistments []*enlistment) {
 
 	for i, block := range fm.blocks {
 		enlistment := &enlistment{blockID: block.BlockID, fileBlock: block}
-		enlistment.dst = m.removeReplicaOf(block)
+		enlistment.dst = m.nextHeldReplicaOf(block)
+		if enlistment.dst == nil {
+			return nil
+		}
 		enlistments[i] = enlistment
 	}
 
@@ -130,6 +161,14 @@ func (m *Master) balance() {
 	m.isBalancing = true
 	m.isBalancingLock.Unlock()
 
+	// Do not race with the repair on the replicas
+	m.replicationLock.Lock()
+	defer m.replicationLock.Unlock()
+
+	// The storages must stay the same during a round
+	m.topologyLock.RLock()
+	defer m.topologyLock.RUnlock()
+
 	// m.Logger.Printf("DEBUG: Start balancing!\n")
 
 	toUp, toDown := m.detectUnbalance()
@@ -144,27 +183,47 @@ func (m *Master) balance() {
 
 	for _, f := range toUp {
 		enlistments := m.enlistNewReplicas(f)
+		if enlistments == nil {
+			continue
+		}
 		for _, enlistment := range enlistments {
 			if err := m.replicateEnlistment(enlistment); err != nil {
 				// TODO: gracefully and atomically handle the error
 				m.Logger.Printf("balance() failed to replicateEnlistment(%v): %v", enlistment, err)
+				m.journalBalanced(f)
 				return
 			}
 			enlistment.fileBlock.addReplica(enlistment.dst)
+			m.trackReplica(f, enlistment.fileBlock, enlistment.dst)
 		}
 		f.nReplica++
+		m.journalBalanced(f)
 	}
 
 	for _, f := range toDown {
 		enlistments := m.dischargeReplicas(f)
+		if enlistments == nil {
+			continue
+		}
 		for _, enlistment := range enlistments {
 			if err := m.dereplicateEnlistment(enlistment); err != nil {
 				// TODO: gracefully and atomically handle the error
 				m.Logger.Printf("balance() failed to dereplicateEnlistment(%v): %v", enlistment, err)
+				m.journalBalanced(f)
 				return
 			}
 			enlistment.fileBlock.rmReplica(enlistment.dst)
+			m.untrackReplica(f, enlistment.fileBlock, enlistment.dst)
 		}
 		f.nReplica--
+		m.journalBalanced(f)
+	}
+}
+
+// journalBalanced logs the (possibly partially) balanced file,
+// the replicas already moved are real whether or not the log succeeds
+func (m *Master) journalBalanced(fm *fileMeta) {
+	if err := m.journalPut(fm); err != nil {
+		m.Logger.Printf("balance() failed to journal %q: %v", fm.fName, err)
 	}
 }
@@ -0,0 +1,81 @@
+package master
+
+import "fmt"
+
+// highWaterMark of the capacity policy, the fraction of its capacity a storage may fill
+func (m *Master) highWaterMark() float64 {
+	if hwm := m.config.MasterHighWaterMark; hwm > 0 && hwm < 1 {
+		return hwm
+	}
+	return 1
+}
+
+// hasRoom tells if one more block fits on s below the high-water mark
+func (m *Master) hasRoom(s *storeMeta) bool {
+	used, capacity := s.space()
+	if capacity <= 0 {
+		return true
+	}
+	return float64(used+int64(m.config.GiftsBlockSize)) <= m.highWaterMark()*float64(capacity)
+}
+
+// fullness of s, the fraction of its capacity used, 0 if unlimited
+func fullness(used, capacity int64) float64 {
+	if capacity <= 0 {
+		return 0
+	}
+	return float64(used) / float64(capacity)
+}
+
+// leastFullOf the live storages with room and not skipped,
+// by the fraction of the capacity used, then the bytes, then the blocks.
+// idx is the index of s in m.storages, s is nil if no storage has room.
+// Caller holds topologyLock.
+func (m *Master) leastFullOf(skip func(s *storeMeta) bool) (idx int, s *storeMeta) {
+	var bestFullness float64
+	var bestUsed int64
+	var bestBlocks int
+	for i, candidate := range m.storages {
+		if !candidate.isAlive() || candidate.isDecommissioning() || skip(candidate) || !m.hasRoom(candidate) {
+			continue
+		}
+
+		used, capacity := candidate.space()
+		f, nBlocks := fullness(used, capacity), candidate.blockCount()
+		if s == nil || f < bestFullness ||
+			(f == bestFullness && (used < bestUsed || (used == bestUsed && nBlocks < bestBlocks))) {
+			idx, s = i, candidate
+			bestFullness, bestUsed, bestBlocks = f, used, nBlocks
+		}
+	}
+	return
+}
+
+// placeOnLeastFull the next replica of fb, nil if no storage has room.
+// The block counts towards the usage of the storage until its next report.
+// Caller holds topologyLock.
+func (m *Master) placeOnLeastFull(fb *fileBlock) *storeMeta {
+	idx, s := m.leastFullOf(fb.hasReplica)
+	if s == nil {
+		return nil
+	}
+	if fb.nReplicas() == 0 {
+		fb.clockEnd, fb.clockBeg = idx, clockTick(idx, m.nStorage, 1)
+	}
+	s.placeBytes(m.config.GiftsBlockSize)
+	return s
+}
+
+// checkPlaced that every block of the new file got a replica,
+// the capacity policy refuses the storages above the high-water mark
+func (m *Master) checkPlaced(fm *fileMeta) error {
+	if fm.nReplica == 0 {
+		return nil
+	}
+	for i, fb := range fm.blocks {
+		if fb.nReplicas() == 0 {
+			return fmt.Errorf("No storage has room for block %d of %q", i, fm.fName)
+		}
+	}
+	return nil
+}
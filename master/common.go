@@ -1,11 +1,42 @@
 package master
 
-import "strconv"
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
 
-func nameBlock(fname string, i int) string {
-	// WARN: very flippant and frivolous way to make BlockID
-	// TODO: use better ways both for security and make it look cool, such as a hash
-	return fname + strconv.FormatInt(int64(i), 16)
+// blockIDGen makes the block IDs, unique across files, renames and restarts.
+// An ID is 128 bits: a random epoch drawn once per run, then a counter.
+// It says nothing about the file, storages only see opaque names.
+type blockIDGen struct {
+	lock  sync.Mutex
+	epoch uint64
+	next  uint64
+}
+
+func newBlockIDGen() *blockIDGen {
+	var b [8]byte
+	g := &blockIDGen{}
+	if _, err := rand.Read(b[:]); err == nil {
+		g.epoch = binary.BigEndian.Uint64(b[:])
+	} else {
+		// no entropy, the clock still differs between runs
+		g.epoch = uint64(time.Now().UnixNano())
+	}
+	return g
+}
+
+// newID returns a block ID never returned before
+func (g *blockIDGen) newID() string {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	id := fmt.Sprintf("%016x%016x", g.epoch, g.next)
+	g.next++
+	return id
 }
 
 // panic if len == 0
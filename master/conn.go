@@ -1,7 +1,7 @@
 package master
 
 import (
-	"net/rpc"
+	"context"
 
 	gifts "github.com/GIFTS-fs/GIFTS"
 	"github.com/GIFTS-fs/GIFTS/structure"
@@ -12,44 +12,302 @@ import (
 type Conn struct {
 	addr   string
 	Create CreateFunc
+	Commit CommitFunc
 	Lookup LookupFunc
+	Delete DeleteFunc
+	Rename RenameFunc
+	List   ListFunc
+	Stat   StatFunc
+
+	Mkdir   MkdirFunc
+	ReadDir ReadDirFunc
+	Rmdir   RmdirFunc
+
+	CreateErasure CreateErasureFunc
+	RenewLease    RenewLeaseFunc
+
+	RepairStatus        RepairStatusFunc
+	ReportCorrupt       ReportCorruptFunc
+	ReportUnreachable   ReportUnreachableFunc
+	RegisterStorage     RegisterStorageFunc
+	DecommissionStorage DecommissionStorageFunc
+	DecommissionStatus  DecommissionStatusFunc
 }
 
 // NewConn constructor for Client.Conn
 func NewConn(addr string) *Conn {
+	return newConnOn(addr, gifts.NewRPCClient(addr, RPCPathMaster))
+}
+
+// newConnOn the transport to the Master at addr
+func newConnOn(addr string, rpcClient gifts.Transport) *Conn {
 	c := Conn{addr: addr}
-	rpcClient := gifts.NewRPCClient(addr, RPCPathMaster)
 	c.makeCreate(rpcClient)
+	c.makeCreateErasure(rpcClient)
+	c.makeCommit(rpcClient)
+	c.makeRenewLease(rpcClient)
 	c.makeLookup(rpcClient)
+	c.makeDelete(rpcClient)
+	c.makeRename(rpcClient)
+	c.makeList(rpcClient)
+	c.makeStat(rpcClient)
+	c.makeMkdir(rpcClient)
+	c.makeReadDir(rpcClient)
+	c.makeRmdir(rpcClient)
+	c.makeRepairStatus(rpcClient)
+	c.makeReportCorrupt(rpcClient)
+	c.makeReportUnreachable(rpcClient)
+	c.makeRegisterStorage(rpcClient)
+	c.makeDecommissionStorage(rpcClient)
+	c.makeDecommissionStatus(rpcClient)
 	return &c
 }
 
 // TODO: fix hard-coding for RPC
-func (c *Conn) makeCreate(rcli *gifts.RPCClient) {
-	c.Create = func(fname string, fsize int, rfactor uint) ([]structure.BlockAssign, error) {
+func (c *Conn) makeCreate(rcli gifts.Transport) {
+	c.Create = func(ctx context.Context, fname string, fsize int, rfactor uint, checksums []string, dedup bool) ([]structure.BlockAssign, error) {
 		var ret []structure.BlockAssign
-		err := rcli.Call(func(conn *rpc.Client) error {
-			return conn.Call(
-				RPCMethodCreate,
-				&structure.FileCreateReq{Fname: fname, Fsize: fsize, Rfactor: rfactor},
-				&ret,
-			)
-		})
+		err := rcli.Call(
+			ctx,
+			RPCMethodCreate,
+			&structure.FileCreateReq{Fname: fname, Fsize: fsize, Rfactor: rfactor, Checksums: checksums, Dedup: dedup},
+			&ret,
+		)
 		return ret, err
 	}
 }
 
 // TODO: fix hard-coding for RPC
-func (c *Conn) makeLookup(rcli *gifts.RPCClient) {
-	c.Lookup = func(fname string) (*structure.FileBlocks, error) {
+func (c *Conn) makeCreateErasure(rcli gifts.Transport) {
+	c.CreateErasure = func(ctx context.Context, fname string, fsize int, dataShards, parityShards int, checksums []string) ([]structure.BlockAssign, error) {
+		var ret []structure.BlockAssign
+		err := rcli.Call(
+			ctx,
+			RPCMethodCreate,
+			&structure.FileCreateReq{
+				Fname:        fname,
+				Fsize:        fsize,
+				Rfactor:      1,
+				Checksums:    checksums,
+				DataShards:   dataShards,
+				ParityShards: parityShards,
+			},
+			&ret,
+		)
+		return ret, err
+	}
+}
+
+// TODO: fix hard-coding for RPC
+func (c *Conn) makeCommit(rcli gifts.Transport) {
+	c.Commit = func(ctx context.Context, fname string, checksums []string) error {
+		var ignore bool
+		return rcli.Call(
+			ctx,
+			RPCMethodCommit,
+			&structure.FileCommitReq{Fname: fname, Checksums: checksums},
+			&ignore,
+		)
+	}
+}
+
+// TODO: fix hard-coding for RPC
+func (c *Conn) makeRenewLease(rcli gifts.Transport) {
+	c.RenewLease = func(ctx context.Context, fname string) error {
+		var ignore bool
+		return rcli.Call(
+			ctx,
+			RPCMethodRenewLease,
+			fname,
+			&ignore,
+		)
+	}
+}
+
+// TODO: fix hard-coding for RPC
+func (c *Conn) makeLookup(rcli gifts.Transport) {
+	c.Lookup = func(ctx context.Context, fname string) (*structure.FileBlocks, error) {
 		var ret *structure.FileBlocks
-		err := rcli.Call(func(conn *rpc.Client) error {
-			return conn.Call(
-				RPCMethodLookup,
-				fname,
-				&ret,
-			)
-		})
+		err := rcli.Call(
+			ctx,
+			RPCMethodLookup,
+			fname,
+			&ret,
+		)
+		return ret, err
+	}
+}
+
+// TODO: fix hard-coding for RPC
+func (c *Conn) makeDelete(rcli gifts.Transport) {
+	c.Delete = func(ctx context.Context, fname string) error {
+		var ignore bool
+		return rcli.Call(
+			ctx,
+			RPCMethodDelete,
+			fname,
+			&ignore,
+		)
+	}
+}
+
+// TODO: fix hard-coding for RPC
+func (c *Conn) makeRename(rcli gifts.Transport) {
+	c.Rename = func(ctx context.Context, oldName, newName string, overwrite bool) error {
+		var ignore bool
+		return rcli.Call(
+			ctx,
+			RPCMethodRename,
+			&structure.RenameReq{Old: oldName, New: newName, Overwrite: overwrite},
+			&ignore,
+		)
+	}
+}
+
+// TODO: fix hard-coding for RPC
+func (c *Conn) makeList(rcli gifts.Transport) {
+	c.List = func(ctx context.Context, prefix, cursor string, limit int) (*structure.ListResult, error) {
+		ret := new(structure.ListResult)
+		err := rcli.Call(
+			ctx,
+			RPCMethodList,
+			&structure.ListReq{Prefix: prefix, Cursor: cursor, Limit: limit},
+			ret,
+		)
+		return ret, err
+	}
+}
+
+// TODO: fix hard-coding for RPC
+func (c *Conn) makeStat(rcli gifts.Transport) {
+	c.Stat = func(ctx context.Context, fname string) (*structure.FileStat, error) {
+		ret := new(structure.FileStat)
+		err := rcli.Call(
+			ctx,
+			RPCMethodStat,
+			fname,
+			ret,
+		)
+		return ret, err
+	}
+}
+
+// TODO: fix hard-coding for RPC
+func (c *Conn) makeMkdir(rcli gifts.Transport) {
+	c.Mkdir = func(ctx context.Context, path string) error {
+		var ignore bool
+		return rcli.Call(
+			ctx,
+			RPCMethodMkdir,
+			path,
+			&ignore,
+		)
+	}
+}
+
+// TODO: fix hard-coding for RPC
+func (c *Conn) makeReadDir(rcli gifts.Transport) {
+	c.ReadDir = func(ctx context.Context, path string) ([]structure.DirEntry, error) {
+		var ret []structure.DirEntry
+		err := rcli.Call(
+			ctx,
+			RPCMethodReadDir,
+			path,
+			&ret,
+		)
+		return ret, err
+	}
+}
+
+// TODO: fix hard-coding for RPC
+func (c *Conn) makeRmdir(rcli gifts.Transport) {
+	c.Rmdir = func(ctx context.Context, path string, recursive bool) error {
+		var ignore bool
+		return rcli.Call(
+			ctx,
+			RPCMethodRmdir,
+			&structure.RmdirReq{Path: path, Recursive: recursive},
+			&ignore,
+		)
+	}
+}
+
+// TODO: fix hard-coding for RPC
+func (c *Conn) makeRepairStatus(rcli gifts.Transport) {
+	c.RepairStatus = func(ctx context.Context) (*structure.RepairStatus, error) {
+		ret := new(structure.RepairStatus)
+		err := rcli.Call(
+			ctx,
+			RPCMethodRepairStatus,
+			true,
+			ret,
+		)
+		return ret, err
+	}
+}
+
+// TODO: fix hard-coding for RPC
+func (c *Conn) makeReportCorrupt(rcli gifts.Transport) {
+	c.ReportCorrupt = func(ctx context.Context, addr, blockID string) error {
+		var ignore bool
+		return rcli.Call(
+			ctx,
+			RPCMethodReportCorrupt,
+			&structure.CorruptReport{Addr: addr, BlockID: blockID},
+			&ignore,
+		)
+	}
+}
+
+// TODO: fix hard-coding for RPC
+func (c *Conn) makeReportUnreachable(rcli gifts.Transport) {
+	c.ReportUnreachable = func(ctx context.Context, addr string) error {
+		var ignore bool
+		return rcli.Call(
+			ctx,
+			RPCMethodReportUnreachable,
+			addr,
+			&ignore,
+		)
+	}
+}
+
+// TODO: fix hard-coding for RPC
+func (c *Conn) makeRegisterStorage(rcli gifts.Transport) {
+	c.RegisterStorage = func(ctx context.Context, addr string) error {
+		var ignore bool
+		return rcli.Call(
+			ctx,
+			RPCMethodRegisterStorage,
+			addr,
+			&ignore,
+		)
+	}
+}
+
+// TODO: fix hard-coding for RPC
+func (c *Conn) makeDecommissionStorage(rcli gifts.Transport) {
+	c.DecommissionStorage = func(ctx context.Context, addr string) error {
+		var ignore bool
+		return rcli.Call(
+			ctx,
+			RPCMethodDecommissionStorage,
+			addr,
+			&ignore,
+		)
+	}
+}
+
+// TODO: fix hard-coding for RPC
+func (c *Conn) makeDecommissionStatus(rcli gifts.Transport) {
+	c.DecommissionStatus = func(ctx context.Context, addr string) (*structure.DecommissionStatus, error) {
+		ret := new(structure.DecommissionStatus)
+		err := rcli.Call(
+			ctx,
+			RPCMethodDecommissionStatus,
+			addr,
+			ret,
+		)
 		return ret, err
 	}
 }
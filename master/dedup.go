@@ -0,0 +1,110 @@
+package master
+
+// dedupBlock is a block named by its content, shared by all the files with the same data.
+// Its data is reclaimed once no file refers to it anymore.
+type dedupBlock struct {
+	fb   *fileBlock
+	refs int // how many blocks of files it stands for
+
+	// the files tracked in the storeMeta holding its replicas,
+	// with how many of their blocks it stands for
+	owners map[*fileMeta]int
+
+	// some file with it was committed, so the data is on the replicas
+	stored bool
+}
+
+// shareBlock with the content given by checksum, nil if none yet.
+// Caller holds dedupLock.
+func (m *Master) shareBlock(checksum string) (fb *fileBlock, stored bool) {
+	db, found := m.dedupBlocks[checksum]
+	if !found {
+		return nil, false
+	}
+	db.refs++
+	return db.fb, db.stored
+}
+
+// newDedupBlock for the content given by checksum, referred to once.
+// The ID is unique still, the block of a content may be reclaimed and uploaded again.
+// Caller holds dedupLock.
+func (m *Master) newDedupBlock(checksum string) *fileBlock {
+	fb := newFileBlock(m.config, checksum+"."+m.blockIDs.newID())
+	fb.checksum = checksum
+	fb.shared = &dedupBlock{fb: fb, refs: 1, owners: make(map[*fileMeta]int)}
+	m.dedupBlocks[checksum] = fb.shared
+	return fb
+}
+
+// storeBlocks marks the shared blocks of fm as stored, once fm is committed
+func (m *Master) storeBlocks(fm *fileMeta) {
+	m.dedupLock.Lock()
+	defer m.dedupLock.Unlock()
+
+	for _, fb := range fm.blocks {
+		if fb.shared != nil {
+			fb.shared.stored = true
+		}
+	}
+}
+
+// releaseBlocks of fm, return the ones no other file refers to, whose data can go
+func (m *Master) releaseBlocks(fm *fileMeta) []*fileBlock {
+	if !fm.dedup {
+		return fm.blocks
+	}
+
+	m.dedupLock.Lock()
+	defer m.dedupLock.Unlock()
+
+	var unused []*fileBlock
+	for _, fb := range fm.blocks {
+		db := fb.shared
+		if db == nil {
+			unused = append(unused, fb)
+			continue
+		}
+		db.refs--
+		if db.refs > 0 {
+			continue
+		}
+		if m.dedupBlocks[fb.checksum] == db {
+			delete(m.dedupBlocks, fb.checksum)
+		}
+		unused = append(unused, fb)
+	}
+	return unused
+}
+
+// ownersOf fb, the files to track its replicas for, at least fm
+func (m *Master) ownersOf(fm *fileMeta, fb *fileBlock) []*fileMeta {
+	if fb.shared == nil {
+		return []*fileMeta{fm}
+	}
+
+	m.dedupLock.Lock()
+	defer m.dedupLock.Unlock()
+
+	owners := make([]*fileMeta, 0, len(fb.shared.owners)+1)
+	if _, found := fb.shared.owners[fm]; !found {
+		owners = append(owners, fm)
+	}
+	for owner := range fb.shared.owners {
+		owners = append(owners, owner)
+	}
+	return owners
+}
+
+// trackReplica records the new replica r of fb in r, for all the files sharing fb
+func (m *Master) trackReplica(fm *fileMeta, fb *fileBlock, r *storeMeta) {
+	for _, owner := range m.ownersOf(fm, fb) {
+		r.addBlock(owner, fb.BlockID)
+	}
+}
+
+// untrackReplica records that r lost its replica of fb, for all the files sharing fb
+func (m *Master) untrackReplica(fm *fileMeta, fb *fileBlock, r *storeMeta) {
+	for _, owner := range m.ownersOf(fm, fb) {
+		r.rmBlock(owner, fb.BlockID)
+	}
+}
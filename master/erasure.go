@@ -0,0 +1,85 @@
+package master
+
+import (
+	"fmt"
+
+	gifts "github.com/GIFTS-fs/GIFTS"
+	"github.com/GIFTS-fs/GIFTS/policy"
+	"github.com/GIFTS-fs/GIFTS/structure"
+)
+
+// nBlocksOf the file to create: its data blocks,
+// or all the blocks of its stripes if erasure coded
+func (m *Master) nBlocksOf(req *structure.FileCreateReq) int {
+	if req.DataShards > 0 {
+		return gifts.NStripes(m.config.GiftsBlockSize, req.DataShards, req.Fsize) * (req.DataShards + req.ParityShards)
+	}
+	return gifts.NBlocks(m.config.GiftsBlockSize, req.Fsize)
+}
+
+// validateErasure code of the file to create, nil if replicated
+func (m *Master) validateErasure(req *structure.FileCreateReq) error {
+	if req.DataShards == 0 && req.ParityShards == 0 {
+		return nil
+	}
+	if req.DataShards <= 0 || req.ParityShards <= 0 {
+		return fmt.Errorf("Invalid erasure code of %d data and %d parity blocks", req.DataShards, req.ParityShards)
+	}
+	if req.Dedup {
+		return fmt.Errorf("Erasure-coded blocks cannot be deduplicated")
+	}
+
+	m.topologyLock.RLock()
+	nStorage := m.nStorage
+	m.topologyLock.RUnlock()
+
+	// otherwise a lost storage may take more than one block of a stripe
+	if width := req.DataShards + req.ParityShards; width > nStorage {
+		return fmt.Errorf("Erasure code of %d blocks per stripe needs as many storages, %d available", width, nStorage)
+	}
+	return nil
+}
+
+// placeStripes of an erasure-coded file: each block of a stripe has its first replica
+// on a distinct storage, the others are placed by the replica placement policy.
+// With the capacity policy a block is left without replica if no storage has room.
+// Caller holds topologyLock.
+func (m *Master) placeStripes(req *structure.FileCreateReq, assignments []*fileBlock, nReplica int, blockAssignments []structure.BlockAssign) {
+	width := req.DataShards + req.ParityShards
+	capacity := m.config.BlockPlacementPolicy == policy.BlockPlacementPolicyCapacity
+	for stripe := 0; stripe < len(assignments); stripe += width {
+		hand := 0
+		if !capacity {
+			hand = m.touchCreateHand(width)
+		}
+		placed := make(map[*storeMeta]bool, width)
+
+		for j := 0; j < width; j++ {
+			fb := assignments[stripe+j]
+			if capacity {
+				// the least full storage without a block of the stripe, if any has room
+				first, s := m.leastFullOf(func(s *storeMeta) bool { return placed[s] })
+				if s == nil {
+					continue
+				}
+				fb.clockEnd, fb.clockBeg = first, clockTick(first, m.nStorage, 1)
+				s.placeBytes(m.config.GiftsBlockSize)
+				fb.addReplica(s)
+			} else {
+				first := clockTick(hand, m.nStorage, j)
+				fb.clockEnd, fb.clockBeg = first, clockTick(first, m.nStorage, 1)
+				fb.addReplica(m.storages[first])
+			}
+			placed[fb.getReplicas()[0]] = true
+
+			for k := 1; k < nReplica; k++ {
+				if s := m.nextFreeReplicaOf(fb); s != nil {
+					fb.addReplica(s)
+				}
+			}
+			for _, r := range fb.getReplicas() {
+				blockAssignments[stripe+j].Replicas = append(blockAssignments[stripe+j].Replicas, r.Addr)
+			}
+		}
+	}
+}
@@ -1,7 +1,11 @@
 package master
 
 import (
-	gifts "github.com/GIFTS-fs/GIFTS"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
 	"github.com/GIFTS-fs/GIFTS/algorithm"
 	"github.com/GIFTS-fs/GIFTS/config"
 	"github.com/GIFTS-fs/GIFTS/policy"
@@ -10,8 +14,14 @@ import (
 
 // fileBlock keeps track of assignment information per block
 type fileBlock struct {
-	BlockID string
+	BlockID  string
+	checksum string      // of the data, empty if unknown
+	shared   *dedupBlock // nil unless named by its content, see structure.FileCreateReq.Dedup
 
+	// Lookup reads the replicas while repair, balance and reconcile change them.
+	// The slice is never changed in place, a new one is published on every change,
+	// so one read by getReplicas stays valid without the lock.
+	replicaLock sync.RWMutex
 	// slice of all replicas
 	replicas []*storeMeta
 	// addr -> *storeMeta
@@ -37,28 +47,45 @@ func newFileBlock(conf *config.Config, bID string) *fileBlock {
 }
 
 func (fb *fileBlock) addReplica(r *storeMeta) {
-	fb.replicas = append(fb.replicas, r)
+	fb.replicaLock.Lock()
+	defer fb.replicaLock.Unlock()
+
+	replicas := make([]*storeMeta, len(fb.replicas), len(fb.replicas)+1)
+	copy(replicas, fb.replicas)
+	fb.replicas = append(replicas, r)
 	fb.rMap[r.Addr] = r
 }
 
 func (fb *fileBlock) rmReplica(r *storeMeta) {
-	if !fb.hasReplica(r) {
+	fb.replicaLock.Lock()
+	defer fb.replicaLock.Unlock()
+
+	if _, ok := fb.rMap[r.Addr]; !ok {
 		return
 	}
 
-	for i := range fb.replicas {
+	replicas := make([]*storeMeta, 0, len(fb.replicas)-1)
+	for _, cur := range fb.replicas {
 		// can we compare pointer address???
 		// may be faster but very insecure
-		if fb.replicas[i].Addr == r.Addr {
-			fb.replicas[i] = fb.replicas[len(fb.replicas)-1]
-			fb.replicas = fb.replicas[:len(fb.replicas)-1]
-			break
+		if cur.Addr != r.Addr {
+			replicas = append(replicas, cur)
 		}
 	}
+	fb.replicas = replicas
 	delete(fb.rMap, r.Addr)
 }
 
+// getReplicas of fb as of now, the caller must not change the slice
+func (fb *fileBlock) getReplicas() []*storeMeta {
+	fb.replicaLock.RLock()
+	defer fb.replicaLock.RUnlock()
+	return fb.replicas
+}
+
 func (fb *fileBlock) hasReplicaAddr(addr string) bool {
+	fb.replicaLock.RLock()
+	defer fb.replicaLock.RUnlock()
 	_, ok := fb.rMap[addr]
 	return ok
 }
@@ -69,30 +96,45 @@ func (fb *fileBlock) hasReplica(r *storeMeta) bool {
 
 // nBlocks number of blocks stored for this file
 func (fb *fileBlock) nReplicas() int {
-	return len(fb.replicas)
+	return len(fb.getReplicas())
 }
 
 type fileMeta struct {
+	// fName only changes on Rename(), under namespaceLock, replicationLock and journalPublishLock
+	fName string
+
 	// const fields
-	fName       string // file name
-	fSize       int    // size of the file, to handle padding
-	nBlocks     int    // save the compution
-	rFactor     uint   // how important the user thinks this file is
-	initialized bool   // if the initialization is complete
+	fSize   int       // size of the file, to handle padding
+	nBlocks int       // save the compution
+	rFactor uint      // how important the user thinks this file is
+	created time.Time // when the file was created
+	dedup   bool      // its blocks may be shared with other files
+
+	// the erasure code, replicated if dataShards is 0, see structure.FileCreateReq
+	dataShards   int
+	parityShards int
+	initialized  bool // if the initialization is complete
+
+	// The file is invisible until its writer commits it,
+	// it is deleted with its blocks if the lease expires before
+	leaseLock   sync.RWMutex
+	committed   bool
+	leaseExpiry time.Time // never expires if zero
 
 	nReplica int          // real number of replica
 	blocks   []*fileBlock // Nodes[i] stores the addr of DataNode with ith Block, where len(Replicas) >= 1
 
 	// trafficLock    sync.Mutex
 	trafficCounter *algorithm.DecayCounter // expontionally decaying read counter
+	deleted        bool                    // no longer counted in trafficMedian, guarded by trafficLock
 }
 
 // fCreate tries to create a new fMeta for fname, return loaded=true if already exists.
 // either because a concurrent create or already exists.
 // Acts like an once constructor for a fname.
 // WARN: loaded=true does not mean the other thread finished the initialization
-// TODO: may change "loaded" to "success" or even error to indicate more failure
-func (m *Master) fCreate(fname string, req *structure.FileCreateReq) (blockAssignments []structure.BlockAssign, loaded bool) {
+// TODO: may change "loaded" to "success"
+func (m *Master) fCreate(fname string, req *structure.FileCreateReq) (blockAssignments []structure.BlockAssign, loaded bool, err error) {
 	fi, loaded := m.fMap.LoadOrStore(fname, &fileMeta{})
 
 	fm := fi.(*fileMeta)
@@ -100,26 +142,175 @@ func (m *Master) fCreate(fname string, req *structure.FileCreateReq) (blockAssig
 		return
 	}
 
+	// Put it in its directory, the name is ours from now on
+	if err = m.linkFile(fname, fm); err != nil {
+		return nil, false, err
+	}
+
 	// This is the "constructor" of fileMeta
 	// Only initialize the data once globally
-	nBlocks := gifts.NBlocks(m.config.GiftsBlockSize, req.Fsize)
+	nBlocks := m.nBlocksOf(req)
+
+	// The file must be durable before anyone can see it,
+	// and tracked before a decommission can miss it
+	m.journalPublishLock.RLock()
+
 	fm.fName = fname
 	fm.fSize = req.Fsize
 	fm.nBlocks = nBlocks
 	fm.rFactor = req.Rfactor
+	fm.created = time.Now()
+	fm.dedup = req.Dedup
+	fm.dataShards = req.DataShards
+	fm.parityShards = req.ParityShards
+	if m.config.MasterCreateLeaseSec > 0 {
+		fm.leaseExpiry = fm.created.Add(time.Second * m.config.MasterCreateLeaseSec)
+	}
 	fm.blocks, fm.nReplica, blockAssignments = m.createAssignments(req, nBlocks)
+	for i, sum := range req.Checksums {
+		fm.blocks[i].checksum = sum
+		blockAssignments[i].Checksum = sum
+	}
 	fm.trafficCounter = algorithm.NewDecayCounter(m.config.TrafficDecayCounterHalfLife)
 	fm.trafficCounter.Reset()
 
+	if err = m.checkPlaced(fm); err == nil {
+		err = m.journalPut(fm)
+	}
+	if err != nil {
+		m.journalPublishLock.RUnlock()
+
+		// nothing was written yet
+		m.releaseBlocks(fm)
+
+		m.namespaceLock.Lock()
+		m.unlinkFile(fname)
+		m.fMap.Delete(fname)
+		m.namespaceLock.Unlock()
+		return nil, false, err
+	}
+	m.trackFile(fm)
+
 	m.trafficLock.Lock()
-	defer m.trafficLock.Unlock()
 	m.trafficMedian.Add(fm.trafficCounter.GetRaw()) // Add(0)
+	m.trafficLock.Unlock()
 
 	fm.initialized = true
+	m.journalPublishLock.RUnlock()
 
 	return
 }
 
+// isCommitted tells if the writer of fm has committed it
+func (fm *fileMeta) isCommitted() bool {
+	fm.leaseLock.RLock()
+	defer fm.leaseLock.RUnlock()
+	return fm.committed
+}
+
+// isExpired tells if the lease of fm ran out before the commit
+func (fm *fileMeta) isExpired(now time.Time) bool {
+	fm.leaseLock.RLock()
+	defer fm.leaseLock.RUnlock()
+	return !fm.committed && !fm.leaseExpiry.IsZero() && now.After(fm.leaseExpiry)
+}
+
+// fCommit makes fm visible, with the checksums of its blocks if given.
+// Once the lease is found expired the commit can never succeed,
+// so the lease collector and the writer cannot both win.
+func (m *Master) fCommit(fm *fileMeta, checksums []string) error {
+	// The commit must be durable before anyone can see it
+	m.journalPublishLock.RLock()
+	defer m.journalPublishLock.RUnlock()
+
+	fm.leaseLock.Lock()
+	defer fm.leaseLock.Unlock()
+
+	if fm.committed {
+		return fmt.Errorf("File %q already committed", fm.fName)
+	}
+	if !fm.leaseExpiry.IsZero() && time.Now().After(fm.leaseExpiry) {
+		return fmt.Errorf("Lease of file %q expired at %v", fm.fName, fm.leaseExpiry)
+	}
+
+	// The checksums of the shared blocks are their names, known since the creation
+	if fm.dedup {
+		checksums = nil
+	}
+
+	rec := recordFileLease(fm, true, time.Time{})
+	for i, sum := range checksums {
+		rec.Blocks[i].Checksum = sum
+	}
+	if err := m.journalPutRecord(rec); err != nil {
+		return err
+	}
+
+	for i, sum := range checksums {
+		fm.blocks[i].checksum = sum
+	}
+	fm.committed = true
+	fm.leaseExpiry = time.Time{}
+	m.storeBlocks(fm)
+	return nil
+}
+
+// fRenewLease of fm for another MasterCreateLeaseSec from now, its writer is still at work.
+// Like the commit, it can never succeed once the lease is found expired.
+func (m *Master) fRenewLease(fm *fileMeta) error {
+	// The renewal must be durable before the old expiry can be acted upon
+	m.journalPublishLock.RLock()
+	defer m.journalPublishLock.RUnlock()
+
+	fm.leaseLock.Lock()
+	defer fm.leaseLock.Unlock()
+
+	if fm.committed {
+		return fmt.Errorf("File %q already committed", fm.fName)
+	}
+	if fm.leaseExpiry.IsZero() {
+		// never expires
+		return nil
+	}
+	now := time.Now()
+	if now.After(fm.leaseExpiry) {
+		return fmt.Errorf("Lease of file %q expired at %v", fm.fName, fm.leaseExpiry)
+	}
+
+	leaseExpiry := now.Add(time.Second * m.config.MasterCreateLeaseSec)
+	if err := m.journalPutRecord(recordFileLease(fm, false, leaseExpiry)); err != nil {
+		return err
+	}
+	fm.leaseExpiry = leaseExpiry
+	return nil
+}
+
+// expireLeases deletes the files not committed in time, with the blocks written so far
+func (m *Master) expireLeases() {
+	now := time.Now()
+
+	var expired []*fileMeta
+	m.fMap.Range(func(key, value interface{}) bool {
+		if fm := value.(*fileMeta); fm.initialized && fm.isExpired(now) {
+			expired = append(expired, fm)
+		}
+		return true
+	})
+
+	for _, fm := range expired {
+		deleted, err := m.fDelete(fm)
+		if err != nil {
+			m.Logger.Printf("expireLeases() failed to delete %q: %v", fm.fName, err)
+			continue
+		}
+		if !deleted {
+			// aborted by the writer, or by another round
+			continue
+		}
+		m.Logger.Printf("expireLeases() deleted %q, not committed before %v", fm.fName, fm.leaseExpiry)
+	}
+}
+
 // return fm and true if found and initialized
 func (m *Master) fLookup(fname string) (*fileMeta, bool) {
 	fm, found := m.fMap.Load(fname)
@@ -135,3 +326,92 @@ func (m *Master) fExist(fname string) bool {
 	_, exist := m.fLookup(fname)
 	return exist
 }
+
+// fDelete removes fm from the namespace and reclaims its blocks in background.
+// Return false if fm was already removed by someone else.
+func (m *Master) fDelete(fm *fileMeta) (bool, error) {
+	m.namespaceLock.Lock()
+	defer m.namespaceLock.Unlock()
+
+	if cur, found := m.fMap.Load(fm.fName); !found || cur.(*fileMeta) != fm {
+		return false, nil
+	}
+
+	// The removal must be durable before anyone can see it
+	m.journalPublishLock.RLock()
+	defer m.journalPublishLock.RUnlock()
+	if err := m.journalDel(fm.fName); err != nil {
+		return false, err
+	}
+	m.unlinkFile(fm.fName)
+	m.forgetFile(fm)
+
+	return true, nil
+}
+
+// forgetFile removes fm from fMap and the storages, its blocks are reclaimed in background.
+// Caller holds namespaceLock and logged the removal.
+func (m *Master) forgetFile(fm *fileMeta) {
+	m.fMap.Delete(fm.fName)
+
+	m.untrackFile(fm)
+
+	m.trafficLock.Lock()
+	m.trafficMedian.Delete(fm.trafficCounter.GetRaw())
+	fm.deleted = true
+	m.trafficLock.Unlock()
+
+	// TODO: a concurrent balance() may still add a replica after this,
+	// leaving an orphan block on that storage
+	go m.unsetBlocks(fm, m.releaseBlocks(fm))
+}
+
+// unsetBlocks of fm on all replicas, best effort
+func (m *Master) unsetBlocks(fm *fileMeta, blocks []*fileBlock) {
+	var ignore bool
+	for _, fb := range blocks {
+		for _, r := range fb.getReplicas() {
+			if err := r.rpc.Unset(context.Background(), fb.BlockID, &ignore); err != nil {
+				m.Logger.Printf("unsetBlocks(%q) failed to unset %q on %q: %v", fm.fName, fb.BlockID, r.Addr, err)
+			}
+		}
+	}
+}
+
+// trackFile records the replicas of fm in the storeMeta holding them
+func (m *Master) trackFile(fm *fileMeta) {
+	if fm.dedup {
+		m.dedupLock.Lock()
+		for _, fb := range fm.blocks {
+			if fb.shared != nil {
+				fb.shared.owners[fm]++
+			}
+		}
+		m.dedupLock.Unlock()
+	}
+
+	for _, fb := range fm.blocks {
+		for _, r := range fb.getReplicas() {
+			r.addBlock(fm, fb.BlockID)
+		}
+	}
+}
+
+// untrackFile removes fm from all the storeMeta holding its replicas
+func (m *Master) untrackFile(fm *fileMeta) {
+	if fm.dedup {
+		m.dedupLock.Lock()
+		for _, fb := range fm.blocks {
+			if fb.shared != nil {
+				delete(fb.shared.owners, fm)
+			}
+		}
+		m.dedupLock.Unlock()
+	}
+
+	for _, fb := range fm.blocks {
+		for _, r := range fb.getReplicas() {
+			r.rmFile(fm)
+		}
+	}
+}
@@ -1,18 +1,110 @@
 package master
 
-import "github.com/GIFTS-fs/GIFTS/structure"
+import (
+	"context"
+
+	gifts "github.com/GIFTS-fs/GIFTS"
+	"github.com/GIFTS-fs/GIFTS/structure"
+)
 
 const (
 	// RPCPathMaster the path that NameNode listens to
 	RPCPathMaster = "/_gifts_master_"
 	// RPCMethodCreate the RPC method name
 	RPCMethodCreate = "Master.Create"
+	// RPCMethodCommit the RPC method name
+	RPCMethodCommit = "Master.Commit"
+	// RPCMethodRenewLease the RPC method name
+	RPCMethodRenewLease = "Master.RenewLease"
 	// RPCMethodLookup the RPC method name
 	RPCMethodLookup = "Master.Lookup"
+	// RPCMethodDelete the RPC method name
+	RPCMethodDelete = "Master.Delete"
+	// RPCMethodRename the RPC method name
+	RPCMethodRename = "Master.Rename"
+	// RPCMethodList the RPC method name
+	RPCMethodList = "Master.List"
+	// RPCMethodStat the RPC method name
+	RPCMethodStat = "Master.Stat"
+	// RPCMethodMkdir the RPC method name
+	RPCMethodMkdir = "Master.Mkdir"
+	// RPCMethodReadDir the RPC method name
+	RPCMethodReadDir = "Master.ReadDir"
+	// RPCMethodRmdir the RPC method name
+	RPCMethodRmdir = "Master.Rmdir"
+	// RPCMethodRepairStatus the RPC method name
+	RPCMethodRepairStatus = "Master.RepairStatus"
+	// RPCMethodReportCorrupt the RPC method name
+	RPCMethodReportCorrupt = "Master.ReportCorrupt"
+	// RPCMethodReportUnreachable the RPC method name
+	RPCMethodReportUnreachable = "Master.ReportUnreachable"
+	// RPCMethodRegisterStorage the RPC method name
+	RPCMethodRegisterStorage = "Master.RegisterStorage"
+	// RPCMethodDecommissionStorage the RPC method name
+	RPCMethodDecommissionStorage = "Master.DecommissionStorage"
+	// RPCMethodDecommissionStatus the RPC method name
+	RPCMethodDecommissionStatus = "Master.DecommissionStatus"
 )
 
+// Only the methods reading or converging to a given state are retried after a lost reply,
+// e.g. not Create, Commit, Delete or Rename, see gifts.RegisterIdempotent
+func init() {
+	gifts.RegisterIdempotent(
+		RPCMethodLookup, RPCMethodStat, RPCMethodList, RPCMethodReadDir, RPCMethodMkdir,
+		RPCMethodRenewLease, RPCMethodRepairStatus, RPCMethodDecommissionStatus, RPCMethodReportUnreachable,
+	)
+}
+
 // CreateFunc is the function signature for Master.Create()
-type CreateFunc func(fname string, fsize int, rfactor uint) ([]structure.BlockAssign, error)
+type CreateFunc func(ctx context.Context, fname string, fsize int, rfactor uint, checksums []string, dedup bool) ([]structure.BlockAssign, error)
+
+// CreateErasureFunc is the function signature for Master.Create() of an erasure coded file
+type CreateErasureFunc func(ctx context.Context, fname string, fsize int, dataShards, parityShards int, checksums []string) ([]structure.BlockAssign, error)
+
+// CommitFunc is the function signature for Master.Commit()
+type CommitFunc func(ctx context.Context, fname string, checksums []string) error
+
+// RenewLeaseFunc is the function signature for Master.RenewLease()
+type RenewLeaseFunc func(ctx context.Context, fname string) error
 
 // LookupFunc is the function signature for Master.Lookup()
-type LookupFunc func(fname string) (*structure.FileBlocks, error)
+type LookupFunc func(ctx context.Context, fname string) (*structure.FileBlocks, error)
+
+// DeleteFunc is the function signature for Master.Delete()
+type DeleteFunc func(ctx context.Context, fname string) error
+
+// RenameFunc is the function signature for Master.Rename()
+type RenameFunc func(ctx context.Context, oldName, newName string, overwrite bool) error
+
+// ListFunc is the function signature for Master.List()
+type ListFunc func(ctx context.Context, prefix, cursor string, limit int) (*structure.ListResult, error)
+
+// StatFunc is the function signature for Master.Stat()
+type StatFunc func(ctx context.Context, fname string) (*structure.FileStat, error)
+
+// MkdirFunc is the function signature for Master.Mkdir()
+type MkdirFunc func(ctx context.Context, path string) error
+
+// ReadDirFunc is the function signature for Master.ReadDir()
+type ReadDirFunc func(ctx context.Context, path string) ([]structure.DirEntry, error)
+
+// RmdirFunc is the function signature for Master.Rmdir()
+type RmdirFunc func(ctx context.Context, path string, recursive bool) error
+
+// RepairStatusFunc is the function signature for Master.RepairStatus()
+type RepairStatusFunc func(ctx context.Context) (*structure.RepairStatus, error)
+
+// ReportCorruptFunc is the function signature for Master.ReportCorrupt()
+type ReportCorruptFunc func(ctx context.Context, addr, blockID string) error
+
+// ReportUnreachableFunc is the function signature for Master.ReportUnreachable()
+type ReportUnreachableFunc func(ctx context.Context, addr string) error
+
+// RegisterStorageFunc is the function signature for Master.RegisterStorage()
+type RegisterStorageFunc func(ctx context.Context, addr string) error
+
+// DecommissionStorageFunc is the function signature for Master.DecommissionStorage()
+type DecommissionStorageFunc func(ctx context.Context, addr string) error
+
+// DecommissionStatusFunc is the function signature for Master.DecommissionStatus()
+type DecommissionStatusFunc func(ctx context.Context, addr string) (*structure.DecommissionStatus, error)
@@ -0,0 +1,552 @@
+package master
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GIFTS-fs/GIFTS/algorithm"
+)
+
+const (
+	journalFileName  = "journal.log"
+	snapshotFileName = "snapshot.json"
+	journalDirPerm   = 0755
+	journalFilePerm  = 0644
+)
+
+// journal operations
+const (
+	opPutFile    = iota // create or overwrite the whole fileRecord
+	opDelFile           // remove the file
+	opAddStorage        // register the storage
+	opRmStorage         // decommission the storage
+	opMkdir             // make the directory
+	opRmdir             // remove the directory and everything under it
+	opRename            // move the file Name to the fileRecord, replacing the one there if any
+)
+
+// blockRecord is the durable form of a fileBlock
+type blockRecord struct {
+	BlockID  string
+	Checksum string `json:",omitempty"`
+	Replicas []string
+	ClockBeg int
+	ClockEnd int
+}
+
+// fileRecord is the durable form of a fileMeta.
+// Records always carry the full state of a file so that replaying is idempotent.
+type fileRecord struct {
+	Fname    string
+	Fsize    int
+	Rfactor  uint
+	NReplica int
+	Created  time.Time
+	Blocks   []blockRecord
+
+	// the blocks are shared by content, see dedupBlock
+	Dedup bool `json:",omitempty"`
+	// the erasure code, replicated if DataShards is 0
+	DataShards   int `json:",omitempty"`
+	ParityShards int `json:",omitempty"`
+
+	// the writer has not committed the file yet, see fileMeta.leaseLock
+	Uncommitted bool      `json:",omitempty"`
+	LeaseExpiry time.Time `json:",omitempty"`
+}
+
+// journalEntry is one line of the journal
+type journalEntry struct {
+	Op   int
+	File *fileRecord `json:",omitempty"`
+	Name string      `json:",omitempty"`
+}
+
+// snapshot is the compacted state of all files
+type snapshot struct {
+	Files []*fileRecord
+	// all directories but the root, the ones with files are also implied by the files
+	Dirs []string `json:",omitempty"`
+	// changes made to the storages in the config, see Master.membership
+	Membership map[string]bool
+}
+
+// journal is the write-ahead log of the master metadata.
+// Every mutation is appended (and synced) before it is acknowledged,
+// snapshots periodically compact the log.
+type journal struct {
+	dir string
+
+	// serializes appends and compaction
+	lock sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+func openJournal(dir string) (*journal, error) {
+	if err := os.MkdirAll(dir, journalDirPerm); err != nil {
+		return nil, err
+	}
+
+	j := &journal{dir: dir}
+	if err := j.reopen(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// reopen the log for appending, caller must hold the lock (or own j exclusively)
+func (j *journal) reopen() (err error) {
+	if j.file != nil {
+		j.file.Close()
+	}
+
+	j.file, err = os.OpenFile(filepath.Join(j.dir, journalFileName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, journalFilePerm)
+	if err != nil {
+		j.file, j.enc = nil, nil
+		return
+	}
+	j.enc = json.NewEncoder(j.file)
+	return
+}
+
+// append one entry and make it durable
+func (j *journal) append(entry *journalEntry) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.enc == nil {
+		return fmt.Errorf("journal at %q is not open", j.dir)
+	}
+	if err := j.enc.Encode(entry); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// load the snapshot and all entries logged after it, in order
+func (j *journal) load() (snap *snapshot, entries []*journalEntry, err error) {
+	snap = &snapshot{}
+
+	data, err := ioutil.ReadFile(filepath.Join(j.dir, snapshotFileName))
+	if err == nil {
+		if err = json.Unmarshal(data, snap); err != nil {
+			return nil, nil, fmt.Errorf("corrupted snapshot: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	file, err := os.Open(filepath.Join(j.dir, journalFileName))
+	if os.IsNotExist(err) {
+		return snap, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	// one entry per line, see journal.append
+	r := bufio.NewReader(file)
+	for lineNo := 1; ; lineNo++ {
+		line, rerr := r.ReadBytes('\n')
+		if rerr != nil && rerr != io.EOF {
+			return nil, nil, rerr
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			entry := new(journalEntry)
+			if err = json.Unmarshal(line, entry); err != nil {
+				// a torn tail is expected if the master crashed in the middle of an append,
+				// nothing after it was ever acknowledged.
+				// Anywhere else the entries after it were, they must not be dropped.
+				if rest, _ := r.Peek(1); len(rest) > 0 {
+					return nil, nil, fmt.Errorf("corrupted journal at line %d: %v", lineNo, err)
+				}
+				return snap, entries, nil
+			}
+			entries = append(entries, entry)
+		}
+		if rerr == io.EOF {
+			return snap, entries, nil
+		}
+	}
+}
+
+// compact writes the snapshot made by takeSnapshot and truncates the log.
+// takeSnapshot is called with the lock held so no entry can be lost in between;
+// entries appended concurrently with takeSnapshot are replayed on top, which is safe
+// since every entry carries the full state.
+func (j *journal) compact(takeSnapshot func() *snapshot) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	data, err := json.Marshal(takeSnapshot())
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(j.dir, snapshotFileName+".tmp-")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, filepath.Join(j.dir, snapshotFileName))
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	// the snapshot is durable, the old log can go
+	if err = os.Truncate(filepath.Join(j.dir, journalFileName), 0); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return j.reopen()
+}
+
+func (j *journal) close() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file, j.enc = nil, nil
+	return err
+}
+
+// recordFile makes the durable form of fm
+func recordFile(fm *fileMeta) *fileRecord {
+	fm.leaseLock.RLock()
+	committed, leaseExpiry := fm.committed, fm.leaseExpiry
+	fm.leaseLock.RUnlock()
+	return recordFileLease(fm, committed, leaseExpiry)
+}
+
+// recordFileLease makes the durable form of fm with the given lease state
+func recordFileLease(fm *fileMeta, committed bool, leaseExpiry time.Time) *fileRecord {
+	rec := &fileRecord{
+		Fname:        fm.fName,
+		Fsize:        fm.fSize,
+		Rfactor:      fm.rFactor,
+		NReplica:     fm.nReplica,
+		Created:      fm.created,
+		Blocks:       make([]blockRecord, len(fm.blocks)),
+		Dedup:        fm.dedup,
+		DataShards:   fm.dataShards,
+		ParityShards: fm.parityShards,
+		Uncommitted:  !committed,
+		LeaseExpiry:  leaseExpiry,
+	}
+	for i, fb := range fm.blocks {
+		rec.Blocks[i].BlockID = fb.BlockID
+		rec.Blocks[i].Checksum = fb.checksum
+		rec.Blocks[i].ClockBeg = fb.clockBeg
+		rec.Blocks[i].ClockEnd = fb.clockEnd
+		replicas := fb.getReplicas()
+		rec.Blocks[i].Replicas = make([]string, len(replicas))
+		for j, r := range replicas {
+			rec.Blocks[i].Replicas[j] = r.Addr
+		}
+	}
+	return rec
+}
+
+// restoreFile rebuilds the fileMeta from its durable form.
+// Replicas on storages that are no longer known are dropped.
+// The shared blocks are restored once, as in shared, the latest record of each.
+func (m *Master) restoreFile(rec *fileRecord, shared map[string]blockRecord) *fileMeta {
+	fm := &fileMeta{
+		fName:    rec.Fname,
+		fSize:    rec.Fsize,
+		nBlocks:  len(rec.Blocks),
+		rFactor:  rec.Rfactor,
+		nReplica: rec.NReplica,
+		created:  rec.Created,
+		dedup:    rec.Dedup,
+		blocks:   make([]*fileBlock, len(rec.Blocks)),
+
+		dataShards:   rec.DataShards,
+		parityShards: rec.ParityShards,
+
+		committed:   !rec.Uncommitted,
+		leaseExpiry: rec.LeaseExpiry,
+	}
+
+	for i, br := range rec.Blocks {
+		if rec.Dedup {
+			if db, found := m.dedupBlocks[br.Checksum]; found && db.fb.BlockID == br.BlockID {
+				db.refs++
+				db.stored = db.stored || !rec.Uncommitted
+				fm.blocks[i] = db.fb
+				continue
+			}
+			if latest, found := shared[br.BlockID]; found {
+				br = latest
+			}
+		}
+
+		fb := newFileBlock(m.config, br.BlockID)
+		fb.checksum = br.Checksum
+		if m.nStorage > 0 {
+			fb.clockBeg = br.ClockBeg % m.nStorage
+			fb.clockEnd = br.ClockEnd % m.nStorage
+		}
+		for _, addr := range br.Replicas {
+			sm, found := m.sMap.Load(addr)
+			if !found {
+				m.Logger.Printf("restoreFile(%q): block %q lost replica on unknown storage %q", rec.Fname, br.BlockID, addr)
+				continue
+			}
+			fb.addReplica(sm.(*storeMeta))
+		}
+		if rec.Dedup {
+			fb.shared = &dedupBlock{fb: fb, refs: 1, owners: make(map[*fileMeta]int), stored: !rec.Uncommitted}
+			m.dedupBlocks[fb.checksum] = fb.shared
+		}
+		fm.blocks[i] = fb
+	}
+
+	fm.trafficCounter = algorithm.NewDecayCounter(m.config.TrafficDecayCounterHalfLife)
+	fm.trafficCounter.Reset()
+	fm.initialized = true
+	return fm
+}
+
+// recoverJournal of the master at dir and replay the metadata in it
+func (m *Master) recoverJournal(dir string) error {
+	j, err := openJournal(dir)
+	if err != nil {
+		return err
+	}
+
+	snap, entries, err := j.load()
+	if err != nil {
+		j.close()
+		return err
+	}
+
+	// The replicas of a shared block change with any of its files,
+	// only the file changing them is logged, so the latest record of the block wins
+	shared := make(map[string]blockRecord)
+	share := func(rec *fileRecord) {
+		if rec.Dedup {
+			for _, br := range rec.Blocks {
+				shared[br.BlockID] = br
+			}
+		}
+	}
+
+	files := make(map[string]*fileRecord)
+	for _, rec := range snap.Files {
+		files[rec.Fname] = rec
+		share(rec)
+	}
+	dirs := make(map[string]bool)
+	for _, dir := range snap.Dirs {
+		dirs[dir] = true
+	}
+	for addr, member := range snap.Membership {
+		m.membership[addr] = member
+	}
+	for _, entry := range entries {
+		switch entry.Op {
+		case opPutFile:
+			files[entry.File.Fname] = entry.File
+			share(entry.File)
+		case opDelFile:
+			delete(files, entry.Name)
+		case opRename:
+			delete(files, entry.Name)
+			files[entry.File.Fname] = entry.File
+			share(entry.File)
+		case opAddStorage:
+			m.membership[entry.Name] = true
+		case opRmStorage:
+			m.membership[entry.Name] = false
+		case opMkdir:
+			dirs[entry.Name] = true
+		case opRmdir:
+			under := entry.Name + "/"
+			for p := range dirs {
+				if p == entry.Name || strings.HasPrefix(p, under) {
+					delete(dirs, p)
+				}
+			}
+			for fname := range files {
+				if strings.HasPrefix(fname, under) {
+					delete(files, fname)
+				}
+			}
+		}
+	}
+
+	// The storages first, the replicas refer to them
+	for addr, member := range m.membership {
+		_, found := m.sMap.Load(addr)
+		if member && !found {
+			m.addStorage(addr)
+		} else if !member && found {
+			m.dropStorage(addr)
+			m.sMap.Delete(addr)
+		}
+	}
+
+	// Nothing is logged until the journal is set below
+	for p := range dirs {
+		if err := m.mkdirAll(p); err != nil {
+			m.Logger.Printf("recoverJournal(%q) failed to restore directory %q: %v", dir, p, err)
+		}
+	}
+
+	for _, rec := range files {
+		parent, name := splitPath(rec.Fname)
+		if err := m.mkdirAll(parent); err != nil {
+			m.Logger.Printf("recoverJournal(%q) failed to restore file %q: %v", dir, rec.Fname, err)
+			continue
+		}
+		fm := m.restoreFile(rec, shared)
+		m.dirs[parent].setChild(name, false)
+		m.fMap.Store(fm.fName, fm)
+		m.trackFile(fm)
+		m.trafficMedian.Add(fm.trafficCounter.GetRaw())
+	}
+
+	m.journal = j
+	m.Logger.Printf("Master.recoverJournal(%q) => %d files restored", dir, len(files))
+
+	// start over with a compacted log
+	return m.snapshot()
+}
+
+// journalPut logs the current state of fm, no-op if persistence is disabled
+func (m *Master) journalPut(fm *fileMeta) error {
+	if m.journal == nil {
+		return nil
+	}
+	return m.journal.append(&journalEntry{Op: opPutFile, File: recordFile(fm)})
+}
+
+// journalPutRecord logs rec as the current state of its file, no-op if persistence is disabled
+func (m *Master) journalPutRecord(rec *fileRecord) error {
+	if m.journal == nil {
+		return nil
+	}
+	return m.journal.append(&journalEntry{Op: opPutFile, File: rec})
+}
+
+// journalDel logs the removal of fname, no-op if persistence is disabled
+func (m *Master) journalDel(fname string) error {
+	if m.journal == nil {
+		return nil
+	}
+	return m.journal.append(&journalEntry{Op: opDelFile, Name: fname})
+}
+
+// journalRename logs the move of the file oldName to rec, which carries the new name,
+// no-op if persistence is disabled
+func (m *Master) journalRename(oldName string, rec *fileRecord) error {
+	if m.journal == nil {
+		return nil
+	}
+	return m.journal.append(&journalEntry{Op: opRename, Name: oldName, File: rec})
+}
+
+// journalMkdir logs the creation of the directory, no-op if persistence is disabled
+func (m *Master) journalMkdir(dir string) error {
+	if m.journal == nil {
+		return nil
+	}
+	return m.journal.append(&journalEntry{Op: opMkdir, Name: dir})
+}
+
+// journalRmdir logs the removal of the directory and everything under it,
+// no-op if persistence is disabled
+func (m *Master) journalRmdir(dir string) error {
+	if m.journal == nil {
+		return nil
+	}
+	return m.journal.append(&journalEntry{Op: opRmdir, Name: dir})
+}
+
+// journalStorage logs the registration (member=true) or decommission of addr,
+// no-op if persistence is disabled
+func (m *Master) journalStorage(addr string, member bool) error {
+	if m.journal == nil {
+		return nil
+	}
+	op := opRmStorage
+	if member {
+		op = opAddStorage
+	}
+	return m.journal.append(&journalEntry{Op: op, Name: addr})
+}
+
+// periodicSnapshot unless the last one is still waiting for a repair or a migration to finish
+func (m *Master) periodicSnapshot() {
+	m.isSnapshottingLock.Lock()
+	if m.isSnapshotting {
+		m.isSnapshottingLock.Unlock()
+		return
+	}
+	defer func() {
+		defer m.isSnapshottingLock.Unlock()
+		m.isSnapshottingLock.Lock()
+		m.isSnapshotting = false
+	}()
+	m.isSnapshotting = true
+	m.isSnapshottingLock.Unlock()
+
+	if err := m.snapshot(); err != nil {
+		m.Logger.Printf("Master.snapshot() => %v", err)
+	}
+}
+
+// snapshot all initialized files and compact the journal
+func (m *Master) snapshot() error {
+	if m.journal == nil {
+		return nil
+	}
+
+	// no replica set half updated by balance, repair, reconcile or a migration
+	m.replicationLock.Lock()
+	defer m.replicationLock.Unlock()
+
+	// wait for the logged but not yet published files
+	m.journalPublishLock.Lock()
+	defer m.journalPublishLock.Unlock()
+
+	return m.journal.compact(func() *snapshot {
+		snap := &snapshot{Membership: m.copyMembership()}
+		for dir := range m.dirs {
+			if dir != "" {
+				snap.Dirs = append(snap.Dirs, dir)
+			}
+		}
+		m.fMap.Range(func(key, value interface{}) bool {
+			if fm := value.(*fileMeta); fm.initialized {
+				snap.Files = append(snap.Files, recordFile(fm))
+			}
+			return true
+		})
+		return snap
+	})
+}
@@ -0,0 +1,190 @@
+package master
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	gifts "github.com/GIFTS-fs/GIFTS"
+
+	"github.com/GIFTS-fs/GIFTS/config"
+	"github.com/GIFTS-fs/GIFTS/structure"
+	"github.com/GIFTS-fs/GIFTS/test"
+)
+
+func TestMaster_Journal(t *testing.T) {
+	af := func(cond bool, msg string) {
+		test.AF(t, cond, msg)
+	}
+
+	dir, err := ioutil.TempDir("", "gifts-master-")
+	af(err == nil, fmt.Sprintf("TempDir failed: %v", err))
+	defer os.RemoveAll(dir)
+
+	conf := *config.Get()
+	conf.MasterDataDir = dir
+	storages := []string{"s1", "s2", "s3"}
+
+	var a1, a2 []structure.BlockAssign
+	var fb *structure.FileBlocks
+
+	m := NewMaster(storages, &conf)
+
+	r1 := structure.FileCreateReq{Fname: "f1", Fsize: 2*conf.GiftsBlockSize + 1, Rfactor: 2, Checksums: []string{"a", "b", "c"}}
+	af(m.Create(&r1, &a1) == nil, "Create f1 failed")
+	af(m.Commit(&structure.FileCommitReq{Fname: "f1"}, nil) == nil, "Commit f1 failed")
+
+	// Compact, then log more on top of the snapshot
+	af(m.snapshot() == nil, "snapshot failed")
+
+	r2 := structure.FileCreateReq{Fname: "f2", Fsize: 1, Rfactor: 1}
+	af(m.Create(&r2, &a2) == nil, "Create f2 failed")
+	af(m.Commit(&structure.FileCommitReq{Fname: "f2", Checksums: []string{"d"}}, nil) == nil, "Commit f2 failed")
+
+	// Files not committed yet survive, still invisible
+	r3 := structure.FileCreateReq{Fname: "f3", Fsize: 1, Rfactor: 1}
+	af(m.Create(&r3, &a2) == nil, "Create f3 failed")
+
+	// Replica changes made by the balancer survive as well
+	sm, _ := m.sMap.Load("s3")
+	fm, _ := m.fLookup("f2")
+	if !fm.blocks[0].hasReplicaAddr("s3") {
+		fm.blocks[0].addReplica(sm.(*storeMeta))
+	} else {
+		sm, _ = m.sMap.Load("s1")
+		fm.blocks[0].addReplica(sm.(*storeMeta))
+	}
+	fm.nReplica++
+	m.journalBalanced(fm)
+
+	// Directories survive as well, before and after the snapshot
+	var ignore bool
+	af(m.Mkdir("d/empty", &ignore) == nil, "Mkdir d/empty failed")
+	af(m.Mkdir("gone/sub", &ignore) == nil, "Mkdir gone/sub failed")
+	r4 := structure.FileCreateReq{Fname: "gone/sub/f4", Fsize: 1, Rfactor: 1}
+	af(m.Create(&r4, &a2) == nil, "Create gone/sub/f4 failed")
+	af(m.Commit(&structure.FileCommitReq{Fname: "gone/sub/f4"}, &ignore) == nil, "Commit gone/sub/f4 failed")
+	af(m.snapshot() == nil, "snapshot failed")
+	af(m.Rmdir(&structure.RmdirReq{Path: "gone", Recursive: true}, &ignore) == nil, "Rmdir gone failed")
+	r5 := structure.FileCreateReq{Fname: "d/f5", Fsize: 1, Rfactor: 1}
+	af(m.Create(&r5, &a2) == nil, "Create d/f5 failed")
+	af(m.Commit(&structure.FileCommitReq{Fname: "d/f5"}, &ignore) == nil, "Commit d/f5 failed")
+	af(m.Rename(&structure.RenameReq{Old: "d/f5", New: "d/f6"}, &ignore) == nil, "Rename d/f5 failed")
+
+	// Shared blocks stay shared
+	sum := gifts.Checksum(gifts.Block("shared"))
+	for _, fname := range []string{"dd1", "dd2"} {
+		r := structure.FileCreateReq{Fname: fname, Fsize: 1, Rfactor: 1, Checksums: []string{sum}, Dedup: true}
+		af(m.Create(&r, &a2) == nil, fmt.Sprintf("Create %q failed", fname))
+		af(m.Commit(&structure.FileCommitReq{Fname: fname}, &ignore) == nil, fmt.Sprintf("Commit %q failed", fname))
+	}
+
+	// So does the erasure code
+	r6 := structure.FileCreateReq{Fname: "ec", Fsize: 1, Rfactor: 1, DataShards: 2, ParityShards: 1}
+	af(m.Create(&r6, &a2) == nil, "Create ec failed")
+	af(m.Commit(&structure.FileCommitReq{Fname: "ec"}, &ignore) == nil, "Commit ec failed")
+
+	// Storages registered at runtime survive as well
+	af(m.RegisterStorage("s4", nil) == nil, "RegisterStorage failed")
+	m.journal.close()
+
+	// Restart
+	m = NewMaster(storages, &conf)
+
+	af(m.Lookup("f1", &fb) == nil, "Lookup f1 after restart failed")
+	af(fb.Fsize == r1.Fsize, fmt.Sprintf("Expected %d bytes, found %d", r1.Fsize, fb.Fsize))
+	af(len(fb.Assignments) == len(a1), fmt.Sprintf("Expected %d blocks, found %d", len(a1), len(fb.Assignments)))
+	for i := range a1 {
+		af(fb.Assignments[i].BlockID == a1[i].BlockID, "Block IDs must survive restart")
+		af(fb.Assignments[i].Checksum == r1.Checksums[i], "Checksums must survive restart")
+	}
+
+	af(m.Lookup("f2", &fb) == nil, "Lookup f2 after restart failed")
+	af(fb.Assignments[0].Checksum == "d", "Checksums given at the commit must survive restart")
+	fm, _ = m.fLookup("f2")
+	af(fm.nReplica == 2, fmt.Sprintf("Expected 2 replicas, found %d", fm.nReplica))
+	af(fm.blocks[0].nReplicas() == 2, fmt.Sprintf("Expected 2 replicas of block 0, found %d", fm.blocks[0].nReplicas()))
+
+	var entries []structure.DirEntry
+	af(m.ReadDir("d", &entries) == nil, "ReadDir d after restart failed")
+	af(fmt.Sprint(entries) == "[{empty true} {f6 false}]", fmt.Sprintf("Unexpected d after restart %v", entries))
+	af(m.ReadDir("gone", &entries) != nil, "Removed directory should stay removed after restart")
+	_, found := m.fLookup("gone/sub/f4")
+	af(!found, "Removed file should stay removed after restart")
+
+	af(m.Lookup("ec", &fb) == nil, "Lookup ec after restart failed")
+	af(fb.DataShards == 2 && fb.ParityShards == 1 && len(fb.Assignments) == 3, "Erasure code must survive restart")
+
+	dd1, _ := m.fLookup("dd1")
+	dd2, _ := m.fLookup("dd2")
+	af(dd1 != nil && dd2 != nil && dd1.blocks[0] == dd2.blocks[0], "Shared block should be shared after restart")
+	af(m.dedupBlocks[sum] != nil && m.dedupBlocks[sum].refs == 2, "Shared block should be referenced twice after restart")
+
+	_, found = m.sMap.Load("s4")
+	af(found && m.nStorage == 4, fmt.Sprintf("Expected 4 storages with s4 after restart, found %d", m.nStorage))
+
+	// Duplicates are still rejected after restart
+	af(m.Create(&r1, &a1) != nil, "Master should not create duplicate file names after restart")
+
+	// Recovery compacted the log into the snapshot
+	info, err := os.Stat(filepath.Join(dir, journalFileName))
+	af(err == nil && info.Size() == 0, "Journal should be empty after recovery")
+
+	af(m.Lookup("f3", &fb) != nil, "Uncommitted f3 should be invisible after restart")
+	af(m.Commit(&structure.FileCommitReq{Fname: "f3"}, nil) == nil, "Commit f3 after restart failed")
+	af(m.Lookup("f3", &fb) == nil, "Lookup f3 after commit failed")
+	m.journal.close()
+}
+
+func TestMaster_JournalCorrupt(t *testing.T) {
+	af := func(cond bool, msg string) {
+		test.AF(t, cond, msg)
+	}
+
+	dir, err := ioutil.TempDir("", "gifts-master-")
+	af(err == nil, fmt.Sprintf("TempDir failed: %v", err))
+	defer os.RemoveAll(dir)
+
+	conf := *config.Get()
+	conf.MasterDataDir = dir
+	storages := []string{"s1", "s2", "s3"}
+
+	var a []structure.BlockAssign
+	var fb *structure.FileBlocks
+
+	m := NewMaster(storages, &conf)
+	for _, fname := range []string{"f1", "f2"} {
+		r := structure.FileCreateReq{Fname: fname, Fsize: 1, Rfactor: 1}
+		af(m.Create(&r, &a) == nil, fmt.Sprintf("Create %q failed", fname))
+		af(m.Commit(&structure.FileCommitReq{Fname: fname}, nil) == nil, fmt.Sprintf("Commit %q failed", fname))
+	}
+	m.journal.close()
+
+	logName := filepath.Join(dir, journalFileName)
+	log, err := ioutil.ReadFile(logName)
+	af(err == nil, fmt.Sprintf("ReadFile failed: %v", err))
+
+	t.Logf("TestMaster_JournalCorrupt: Starting test #1")
+	// A torn tail was never acknowledged, it is dropped
+	torn := append(append([]byte{}, log...), []byte(`{"Op":0,"File":{"Fna`)...)
+	af(ioutil.WriteFile(logName, torn, journalFilePerm) == nil, "WriteFile failed")
+
+	conf.MasterDataDir = ""
+	m = NewMaster(storages, &conf)
+	af(m.recoverJournal(dir) == nil, "Recovery should drop a torn tail")
+	af(m.Lookup("f1", &fb) == nil && m.Lookup("f2", &fb) == nil, "Files before a torn tail should survive")
+	m.journal.close()
+
+	t.Logf("TestMaster_JournalCorrupt: Starting test #2")
+	// A corrupt line with acknowledged entries after it fails the recovery,
+	// and the log is left as it is
+	corrupt := append([]byte(`{"Op":0,"File":{"Fna`+"\n"), log...)
+	af(ioutil.WriteFile(logName, corrupt, journalFilePerm) == nil, "WriteFile failed")
+
+	m = NewMaster(storages, &conf)
+	af(m.recoverJournal(dir) != nil, "Recovery should fail on a corrupt line before the tail")
+	after, err := ioutil.ReadFile(logName)
+	af(err == nil && string(after) == string(corrupt), "Journal should be left untouched after a failed recovery")
+}
@@ -0,0 +1,74 @@
+package master
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// probeStorages sends one round of heartbeats to all storages
+// and updates their liveness
+func (m *Master) probeStorages() {
+	m.isProbingLock.Lock()
+	if m.isProbing {
+		// last round was still waiting for slow storages
+		m.isProbingLock.Unlock()
+		return
+	}
+	defer func() {
+		defer m.isProbingLock.Unlock()
+		m.isProbingLock.Lock()
+		m.isProbing = false
+	}()
+	m.isProbing = true
+	m.isProbingLock.Unlock()
+
+	m.topologyLock.RLock()
+	storages := append([]*storeMeta{}, m.storages...)
+	m.topologyLock.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, s := range storages {
+		wg.Add(1)
+		go func(s *storeMeta) {
+			defer wg.Done()
+			m.probeStorage(s)
+		}(s)
+	}
+	wg.Wait()
+}
+
+// probeStorage sends one heartbeat to s and updates its liveness and space
+func (m *Master) probeStorage(s *storeMeta) {
+	stat, err := s.rpc.Stat(context.Background())
+	if err != nil {
+		if s.missHeartbeat(m.config.StorageDeadAfterMissed) {
+			m.Logger.Printf("Storage %q is dead: %v", s.Addr, err)
+			// do not wait for the next round to restore the redundancy
+			go m.repair()
+		}
+		return
+	}
+
+	s.reportSpace(stat)
+	if s.heartbeat() {
+		m.Logger.Printf("Storage %q is alive again", s.Addr)
+	}
+}
+
+// ReportUnreachable is called by clients that failed to reach a storage,
+// it is probed right away instead of waiting for the next round
+func (m *Master) ReportUnreachable(addr string, ignore *bool) error {
+	sm, found := m.sMap.Load(addr)
+	if !found {
+		err := fmt.Errorf("Storage %q not found", addr)
+		m.Logger.Printf("Master.ReportUnreachable(%q) => %q", addr, err)
+		return err
+	}
+
+	// the client may be the one cut off, only trust our own heartbeat
+	go m.probeStorage(sm.(*storeMeta))
+
+	m.Logger.Printf("Master.ReportUnreachable(%q) => success", addr)
+	return nil
+}
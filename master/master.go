@@ -1,10 +1,10 @@
 package master
 
 import (
+	"crypto/tls"
 	"fmt"
 	"math/rand"
 	"net"
-	"net/http"
 	"net/rpc"
 	"sync"
 	"time"
@@ -20,21 +20,73 @@ import (
 type Master struct {
 	Logger *gifts.Logger
 	config *config.Config
+	// served over TLS if not nil, see gifts.LoadTLSConfig
+	TLS *tls.Config
 
 	// file name -> *fileMeta
 	fMap sync.Map
 
-	// number of storage alive, for 1st phase, it's const
+	// number of storage in the placement tables
 	nStorage int
 	// list of storages, used mainly by Clock
 	storages []*storeMeta
-	// storage addr -> *storeMeta
+	// storage addr -> *storeMeta, also has the ones being decommissioned
 	sMap sync.Map
+	// guards nStorage, storages and the placement tables derived from them
+	topologyLock sync.RWMutex
+
+	// storage addr -> true if registered at runtime, false if decommissioned,
+	// the changes made to the storages given to NewMaster
+	membership     map[string]bool
+	membershipLock sync.Mutex
 
 	// Only one balancing thread at one time
 	isBalancing     bool
 	isBalancingLock sync.Mutex
 
+	// Only one round of heartbeat probes at one time
+	isProbing     bool
+	isProbingLock sync.Mutex
+
+	// Only one reconciliation at one time
+	isReconciling     bool
+	isReconcilingLock sync.Mutex
+
+	// Only one periodic snapshot at one time,
+	// it waits for the replicas to settle
+	isSnapshotting     bool
+	isSnapshottingLock sync.Mutex
+
+	// balance() and repair() both change the replicas, one at a time,
+	// snapshot() holds it to record them whole
+	replicationLock sync.Mutex
+
+	// progress of the latest repair, also guards against concurrent repairs
+	repairStatus     structure.RepairStatus
+	repairStatusLock sync.Mutex
+
+	// storage addr -> progress of its latest decommission, also guards against concurrent ones
+	decommissions    map[string]*structure.DecommissionStatus
+	decommissionLock sync.Mutex
+
+	// dir path -> *dirMeta, "" is the root.
+	// Only changed with journalPublishLock shared, so snapshots can read it
+	dirs map[string]*dirMeta
+	// guards dirs and serializes removals from fMap
+	namespaceLock sync.RWMutex
+
+	// write-ahead log of the metadata, nil if persistence is disabled
+	journal *journal
+	// held shared from logging a file to publishing it, exclusively by snapshots
+	journalPublishLock sync.RWMutex
+
+	// source of the block IDs, never derived from the file names
+	blockIDs *blockIDGen
+
+	// checksum -> the block with that content, shared among the files created with Dedup
+	dedupBlocks map[string]*dedupBlock
+	dedupLock   sync.Mutex
+
 	// traffic statistics
 	trafficMedian *algorithm.RunningMedian
 	trafficLock   sync.Mutex
@@ -69,6 +121,11 @@ func NewMaster(storageAddr []string, config *config.Config) *Master {
 		storages:      make([]*storeMeta, len(storageAddr)),
 		trafficMedian: algorithm.NewRunningMedian(),
 		config:        config,
+		membership:    make(map[string]bool),
+		decommissions: make(map[string]*structure.DecommissionStatus),
+		dirs:          map[string]*dirMeta{"": newDirMeta()},
+		blockIDs:      newBlockIDGen(),
+		dedupBlocks:   make(map[string]*dedupBlock),
 	}
 
 	for i, addr := range storageAddr {
@@ -98,23 +155,88 @@ func NewMaster(storageAddr []string, config *config.Config) *Master {
 		m.removeReplicaOfUnit = m.removeReplicaOfUnitRR
 	}
 
+	// Replay the metadata of the last run
+	if config.MasterDataDir != "" {
+		if err := m.recoverJournal(config.MasterDataDir); err != nil {
+			panic(fmt.Sprintf("Master failed to recover from %q: %v", config.MasterDataDir, err))
+		}
+	}
+
 	return &m
 }
 
 // background tasks of master:
 //
 // 1. periodically attempt to rebalance load across storage
+//
+// 2. periodically snapshot the metadata and compact the journal
+//
+// 3. periodically probe the liveness of storages
+//
+// 4. periodically re-replicate the blocks that lost replicas
+//
+// 5. periodically reconcile the metadata with the block reports
+//
+// 6. periodically delete the files whose lease expired before the commit
 func (m *Master) background() {
+	// nil channels never fire, for the disabled tasks
+	var rebalanceC, snapshotC, heartbeatC, repairC, reconcileC, leaseC <-chan time.Time
+
 	// TODO: make the interval dynamic based on the traffic and number of files?
 	if m.config.DynamicReplicationEnabled {
 		tickerRebalance := time.NewTicker(time.Second * m.config.MasterRebalanceIntervalSec)
 		defer tickerRebalance.Stop()
+		rebalanceC = tickerRebalance.C
+	}
 
-		for {
-			select {
-			case <-tickerRebalance.C:
-				go m.balance()
-			}
+	if m.journal != nil && m.config.MasterSnapshotIntervalSec > 0 {
+		tickerSnapshot := time.NewTicker(time.Second * m.config.MasterSnapshotIntervalSec)
+		defer tickerSnapshot.Stop()
+		snapshotC = tickerSnapshot.C
+	}
+
+	if m.config.StorageHeartbeatIntervalSec > 0 {
+		tickerHeartbeat := time.NewTicker(time.Second * m.config.StorageHeartbeatIntervalSec)
+		defer tickerHeartbeat.Stop()
+		heartbeatC = tickerHeartbeat.C
+	}
+
+	if m.config.MasterRepairIntervalSec > 0 {
+		tickerRepair := time.NewTicker(time.Second * m.config.MasterRepairIntervalSec)
+		defer tickerRepair.Stop()
+		repairC = tickerRepair.C
+	}
+
+	if m.config.MasterReconcileIntervalSec > 0 {
+		tickerReconcile := time.NewTicker(time.Second * m.config.MasterReconcileIntervalSec)
+		defer tickerReconcile.Stop()
+		reconcileC = tickerReconcile.C
+	}
+
+	if m.config.MasterCreateLeaseSec > 0 {
+		tickerLease := time.NewTicker(time.Second * m.config.MasterCreateLeaseSec)
+		defer tickerLease.Stop()
+		leaseC = tickerLease.C
+	}
+
+	if rebalanceC == nil && snapshotC == nil && heartbeatC == nil && repairC == nil && reconcileC == nil && leaseC == nil {
+		return
+	}
+
+	for {
+		select {
+		case <-rebalanceC:
+			go m.balance()
+		case <-snapshotC:
+			go m.periodicSnapshot()
+		case <-heartbeatC:
+			go m.probeStorages()
+		case <-repairC:
+			go m.repair()
+		case <-reconcileC:
+			go m.reconcile()
+		case <-leaseC:
+			go m.expireLeases()
 		}
 	}
 }
@@ -143,9 +265,9 @@ func ServeRPCBlock(m *Master, addr string, readyChan chan bool) (err error) {
 	if err != nil {
 		return
 	}
-
-	mux := http.NewServeMux()
-	mux.Handle(RPCPathMaster, server)
+	if m.TLS != nil {
+		l = tls.NewListener(l, m.TLS)
+	}
 
 	// Start Master's background tasks
 	go m.background()
@@ -155,7 +277,7 @@ func ServeRPCBlock(m *Master, addr string, readyChan chan bool) (err error) {
 	}
 
 	// Serve the Master at the specified IP address and port
-	return http.Serve(l, mux)
+	return gifts.ServeRPC(l, RPCPathMaster, server)
 }
 
 // ServeRPC makes the Master accessible via RPC
@@ -171,8 +293,15 @@ func ServeRPC(m *Master, addr string) (err error) {
 	return
 }
 
-// Create a file: assign replicas for the clients to write
+// Create a file: assign replicas for the clients to write.
+// The file stays invisible until committed, see Commit()
 func (m *Master) Create(req *structure.FileCreateReq, assignments *[]structure.BlockAssign) error {
+	req.Fname = cleanPath(req.Fname)
+	if err := validatePath(req.Fname); err != nil {
+		m.Logger.Printf("Master.Create(%v) => %q", *req, err)
+		return err
+	}
+
 	// File with the same name already exists
 	if m.fExist(req.Fname) {
 		err := fmt.Errorf("File %q already exists", req.Fname)
@@ -186,14 +315,35 @@ func (m *Master) Create(req *structure.FileCreateReq, assignments *[]structure.B
 		return err
 	}
 
+	if err := m.validateErasure(req); err != nil {
+		m.Logger.Printf("Master.Create(%v) => %q", *req, err)
+		return err
+	}
+
+	if len(req.Checksums) != 0 && len(req.Checksums) != m.nBlocksOf(req) {
+		err := fmt.Errorf("Got %d checksums for a file with %d bytes", len(req.Checksums), req.Fsize)
+		m.Logger.Printf("Master.Create(%v) => %q", *req, err)
+		return err
+	}
+
+	if req.Dedup && len(req.Checksums) != m.nBlocksOf(req) {
+		err := fmt.Errorf("Deduplication needs the checksums of all the blocks")
+		m.Logger.Printf("Master.Create(%v) => %q", *req, err)
+		return err
+	}
+
 	var loaded bool
 	var blockAssignments []structure.BlockAssign
+	var err error
 
 	// Create one and only one fMeta for each file
-	if blockAssignments, loaded = m.fCreate(req.Fname, req); loaded {
+	if blockAssignments, loaded, err = m.fCreate(req.Fname, req); loaded {
 		err := fmt.Errorf("File %q already created", req.Fname)
 		m.Logger.Printf("Master.Create(%v) => %q", *req, err)
 		return err
+	} else if err != nil {
+		m.Logger.Printf("Master.Create(%v) => %v", *req, err)
+		return err
 	}
 
 	*assignments = blockAssignments
@@ -202,13 +352,66 @@ func (m *Master) Create(req *structure.FileCreateReq, assignments *[]structure.B
 	return nil
 }
 
+// Commit a file: make it visible once the client wrote all its blocks.
+// It fails if the lease given by Create() already expired,
+// the client should then create the file again.
+func (m *Master) Commit(req *structure.FileCommitReq, ignore *bool) error {
+	req.Fname = cleanPath(req.Fname)
+	fm, found := m.fLookup(req.Fname)
+
+	// Check if the file exists
+	if !found {
+		err := fmt.Errorf("File %q not found", req.Fname)
+		m.Logger.Printf("Master.Commit(%q) => %q", req.Fname, err)
+		return err
+	}
+
+	if len(req.Checksums) != 0 && len(req.Checksums) != fm.nBlocks {
+		err := fmt.Errorf("Got %d checksums for a file with %d blocks", len(req.Checksums), fm.nBlocks)
+		m.Logger.Printf("Master.Commit(%q) => %q", req.Fname, err)
+		return err
+	}
+
+	if err := m.fCommit(fm, req.Checksums); err != nil {
+		m.Logger.Printf("Master.Commit(%q) => %v", req.Fname, err)
+		return err
+	}
+
+	m.Logger.Printf("Master.Commit(%q) => success", req.Fname)
+	return nil
+}
+
+// RenewLease of a file not committed yet: its writer needs longer than the lease given by Create().
+// It fails if the lease already expired, the client should then create the file again.
+func (m *Master) RenewLease(fName string, ignore *bool) error {
+	fName = cleanPath(fName)
+	fm, found := m.fLookup(fName)
+
+	// Check if the file exists
+	if !found {
+		err := fmt.Errorf("File %q not found", fName)
+		m.Logger.Printf("Master.RenewLease(%q) => %q", fName, err)
+		return err
+	}
+
+	if err := m.fRenewLease(fm); err != nil {
+		m.Logger.Printf("Master.RenewLease(%q) => %v", fName, err)
+		return err
+	}
+
+	m.Logger.Printf("Master.RenewLease(%q) => success", fName)
+	return nil
+}
+
 // Lookup a file: find mapping for a file
 func (m *Master) Lookup(fName string, ret **structure.FileBlocks) error {
+	fName = cleanPath(fName)
+
 	// Attempt to look up where the file is stored
 	fm, found := m.fLookup(fName)
 
-	// Check if the file exists
-	if !found {
+	// Check if the file exists, the ones being written do not yet
+	if !found || !fm.isCommitted() {
 		err := fmt.Errorf("File %q not found", fName)
 		m.Logger.Printf("Master.Lookup(%q) => %q", fName, err)
 		return err
@@ -216,8 +419,10 @@ func (m *Master) Lookup(fName string, ret **structure.FileBlocks) error {
 
 	// Figure out which replicas the client should read from
 	*ret = &structure.FileBlocks{
-		Fsize:       fm.fSize,
-		Assignments: m.lookupReplicas(fm),
+		Fsize:        fm.fSize,
+		Assignments:  m.lookupReplicas(fm),
+		DataShards:   fm.dataShards,
+		ParityShards: fm.parityShards,
 	}
 
 	// Keep track of the number of times this file has been read
@@ -226,8 +431,10 @@ func (m *Master) Lookup(fName string, ret **structure.FileBlocks) error {
 		// TODO: shall remove the lock since we don't care the exact data?
 
 		m.trafficLock.Lock()
-		prev, curr := fm.trafficCounter.GetRaw(), fm.trafficCounter.Hit()
-		m.trafficMedian.Update(prev, curr)
+		if !fm.deleted {
+			prev, curr := fm.trafficCounter.GetRaw(), fm.trafficCounter.Hit()
+			m.trafficMedian.Update(prev, curr)
+		}
 		m.trafficLock.Unlock()
 
 		// m.Logger.Printf("DEBUG: traffic for %q: prev: %v curr: %v\n", fm.fName, prev, curr)
@@ -236,3 +443,31 @@ func (m *Master) Lookup(fName string, ret **structure.FileBlocks) error {
 	m.Logger.Printf("Master.Lookup(%q) => %v", fName, *ret)
 	return nil
 }
+
+// Delete a file: remove the metadata and reclaim its blocks in background.
+// Also aborts a file not committed yet.
+func (m *Master) Delete(fName string, ignore *bool) error {
+	fName = cleanPath(fName)
+	fm, found := m.fLookup(fName)
+
+	// Check if the file exists
+	if !found {
+		err := fmt.Errorf("File %q not found", fName)
+		m.Logger.Printf("Master.Delete(%q) => %q", fName, err)
+		return err
+	}
+
+	deleted, err := m.fDelete(fm)
+	if err != nil {
+		m.Logger.Printf("Master.Delete(%q) => %v", fName, err)
+		return err
+	}
+	if !deleted {
+		err := fmt.Errorf("File %q already deleted", fName)
+		m.Logger.Printf("Master.Delete(%q) => %q", fName, err)
+		return err
+	}
+
+	m.Logger.Printf("Master.Delete(%q) => success", fName)
+	return nil
+}
@@ -1,14 +1,19 @@
 package master
 
 import (
+	"context"
 	"fmt"
 	"math"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	gifts "github.com/GIFTS-fs/GIFTS"
 	"github.com/GIFTS-fs/GIFTS/config"
 	"github.com/GIFTS-fs/GIFTS/policy"
+	"github.com/GIFTS-fs/GIFTS/storage"
 	"github.com/GIFTS-fs/GIFTS/structure"
 	"github.com/GIFTS-fs/GIFTS/test"
 )
@@ -35,6 +40,7 @@ func TestMasterLocalEmpty(t *testing.T) {
 	af(mEmpty.Create(&rEmpty, &a) == nil, "Create empty file failed")
 	af(len(a) == 0, "Empty file should have 0 blocks")
 
+	af(mEmpty.Commit(&structure.FileCommitReq{Fname: "empty"}, new(bool)) == nil, "Commit empty failed")
 	af(mEmpty.Lookup("empty", &fb) == nil, "Lookup empty file failed")
 	af(fb.Fsize == 0, "Empty file has size 0")
 	af(len(fb.Assignments) == 0, "Empty file has no assignments")
@@ -47,6 +53,7 @@ func TestMasterLocalEmpty(t *testing.T) {
 	af(len(a[0].BlockID) > 0, "bolck ID must be a non-empty string")
 	af(len(a[0].Replicas) == 0, "empty master have no replicas to assign")
 
+	af(mEmpty.Commit(&structure.FileCommitReq{Fname: "f1"}, new(bool)) == nil, "Commit f1 failed")
 	af(mEmpty.Lookup("f1", &fb) == nil, "Lookup f1 failed")
 	af(fb.Fsize == 1, "lookup f1 should have 1 byte in size")
 	af(len(fb.Assignments) == 1, "lookup f1 should have 1 block assignment")
@@ -62,6 +69,7 @@ func TestMasterLocalEmpty(t *testing.T) {
 	af(len(a[1].BlockID) > 0, "bolck ID must be a non-empty string")
 	af(len(a[1].Replicas) == 0, "empty master have no replicas to assign")
 
+	af(mEmpty.Commit(&structure.FileCommitReq{Fname: "f2"}, new(bool)) == nil, "Commit f2 failed")
 	af(mEmpty.Lookup("f2", &fb) == nil, "Lookup f2 failed")
 	af(fb.Fsize == mEmpty.config.GiftsBlockSize+1, "lookup f2 should have blocksize+1 byte in size")
 	af(len(fb.Assignments) == 2, "lookup f2 should have 2 block assignment")
@@ -86,6 +94,7 @@ func TestMasterLocalOne(t *testing.T) {
 	af(mOne.Create(&rEmpty, &a) == nil, "Create empty file failed")
 	af(len(a) == 0, "Empty file should have 0 blocks")
 
+	af(mOne.Commit(&structure.FileCommitReq{Fname: "empty"}, new(bool)) == nil, "Commit empty failed")
 	af(mOne.Lookup("empty", &fb) == nil, "Lookup empty file failed")
 	af(fb.Fsize == 0, "Empty file has size 0")
 	af(len(fb.Assignments) == 0, "Empty file has no assignments")
@@ -98,6 +107,7 @@ func TestMasterLocalOne(t *testing.T) {
 	af(len(a[0].Replicas) == 1, "one master have one replica to assign")
 	af(a[0].Replicas[0] == "s1", "one master have only one replica to assign")
 
+	af(mOne.Commit(&structure.FileCommitReq{Fname: "f1"}, new(bool)) == nil, "Commit f1 failed")
 	af(mOne.Lookup("f1", &fb) == nil, "Lookup f1 failed")
 	af(fb.Fsize == 1, "lookup f1 should have 1 byte in size")
 	af(len(fb.Assignments) == 1, "lookup f1 should have 1 block assignment")
@@ -116,6 +126,7 @@ func TestMasterLocalOne(t *testing.T) {
 	af(len(a[1].Replicas) == 1, "one master have one replicas to assign")
 	af(a[1].Replicas[0] == "s1", "one master have only one replica to assign")
 
+	af(mOne.Commit(&structure.FileCommitReq{Fname: "f2"}, new(bool)) == nil, "Commit f2 failed")
 	af(mOne.Lookup("f2", &fb) == nil, "Lookup f2 failed")
 	af(fb.Fsize == mOne.config.GiftsBlockSize+1, "lookup f2 should have blocksize+1 byte in size")
 	af(len(fb.Assignments) == 2, "lookup f2 should have 2 block assignment")
@@ -142,24 +153,26 @@ func TestMasterRPCEmpty(t *testing.T) {
 
 	rEmpty := structure.FileCreateReq{Fname: "empty", Fsize: 0, Rfactor: 0}
 
-	a, err = mEmpty.Create(rEmpty.Fname, rEmpty.Fsize, rEmpty.Rfactor)
+	a, err = mEmpty.Create(context.Background(), rEmpty.Fname, rEmpty.Fsize, rEmpty.Rfactor, nil, false)
 	af(err == nil, "Create empty file failed")
 	af(len(a) == 0, "Empty file should have 0 blocks")
 
-	fb, err = mEmpty.Lookup("empty")
+	af(mEmpty.Commit(context.Background(), "empty", nil) == nil, "Commit empty failed")
+	fb, err = mEmpty.Lookup(context.Background(), "empty")
 	af(err == nil, "Lookup empty file failed")
 	af(fb.Fsize == 0, "Empty file has size 0")
 	af(len(fb.Assignments) == 0, "Empty file has no assignments")
 
 	r1 := structure.FileCreateReq{Fname: "f1", Fsize: 1, Rfactor: 1}
 
-	a, err = mEmpty.Create(r1.Fname, r1.Fsize, r1.Rfactor)
+	a, err = mEmpty.Create(context.Background(), r1.Fname, r1.Fsize, r1.Rfactor, nil, false)
 	af(err == nil, "Create 1 block file failed")
 	af(len(a) == 1, "1 byte should have 1 block")
 	af(len(a[0].BlockID) > 0, "bolck ID must be a non-empty string")
 	af(len(a[0].Replicas) == 0, "empty master have no replicas to assign")
 
-	fb, err = mEmpty.Lookup("f1")
+	af(mEmpty.Commit(context.Background(), "f1", nil) == nil, "Commit f1 failed")
+	fb, err = mEmpty.Lookup(context.Background(), "f1")
 	af(err == nil, "Lookup f1 failed")
 	af(fb.Fsize == 1, "lookup f1 should have 1 byte in size")
 	af(len(fb.Assignments) == 1, "lookup f1 should have 1 block assignment")
@@ -168,7 +181,7 @@ func TestMasterRPCEmpty(t *testing.T) {
 
 	r2 := structure.FileCreateReq{Fname: "f2", Fsize: mmEmpty.config.GiftsBlockSize + 1, Rfactor: 1}
 
-	a, err = mEmpty.Create(r2.Fname, r2.Fsize, r2.Rfactor)
+	a, err = mEmpty.Create(context.Background(), r2.Fname, r2.Fsize, r2.Rfactor, nil, false)
 	af(err == nil, "Create 2 block file failed")
 	af(len(a) == 2, "blocksize+1 byte should have 2 block")
 	af(len(a[0].BlockID) > 0, "bolck ID must be a non-empty string")
@@ -176,7 +189,8 @@ func TestMasterRPCEmpty(t *testing.T) {
 	af(len(a[1].BlockID) > 0, "bolck ID must be a non-empty string")
 	af(len(a[1].Replicas) == 0, "empty master have no replicas to assign")
 
-	fb, err = mEmpty.Lookup("f2")
+	af(mEmpty.Commit(context.Background(), "f2", nil) == nil, "Commit f2 failed")
+	fb, err = mEmpty.Lookup(context.Background(), "f2")
 	af(err == nil, "Lookup f2 failed")
 	af(fb.Fsize == mmEmpty.config.GiftsBlockSize+1, "lookup f2 should have blocksize+1 byte in size")
 	af(len(fb.Assignments) == 2, "lookup f2 should have 2 block assignment")
@@ -201,25 +215,27 @@ func TestMasterRPCOne(t *testing.T) {
 
 	rEmpty := structure.FileCreateReq{Fname: "empty", Fsize: 0, Rfactor: 0}
 
-	a, err = mOne.Create(rEmpty.Fname, rEmpty.Fsize, rEmpty.Rfactor)
+	a, err = mOne.Create(context.Background(), rEmpty.Fname, rEmpty.Fsize, rEmpty.Rfactor, nil, false)
 	af(err == nil, "Create empty file failed")
 	af(len(a) == 0, "Empty file should have 0 blocks")
 
-	fb, err = mOne.Lookup("empty")
+	af(mOne.Commit(context.Background(), "empty", nil) == nil, "Commit empty failed")
+	fb, err = mOne.Lookup(context.Background(), "empty")
 	af(err == nil, "Lookup empty file failed")
 	af(fb.Fsize == 0, "Empty file has size 0")
 	af(len(fb.Assignments) == 0, "Empty file has no assignments")
 
 	r1 := structure.FileCreateReq{Fname: "f1", Fsize: 1, Rfactor: 1}
 
-	a, err = mOne.Create(r1.Fname, r1.Fsize, r1.Rfactor)
+	a, err = mOne.Create(context.Background(), r1.Fname, r1.Fsize, r1.Rfactor, nil, false)
 	af(err == nil, "Create 1 block file failed")
 	af(len(a) == 1, "1 byte should have 1 block")
 	af(len(a[0].BlockID) > 0, "bolck ID must be a non-empty string")
 	af(len(a[0].Replicas) == 1, "one master have one replica to assign")
 	af(a[0].Replicas[0] == "s1", "one master have only one replica to assign")
 
-	fb, err = mOne.Lookup("f1")
+	af(mOne.Commit(context.Background(), "f1", nil) == nil, "Commit f1 failed")
+	fb, err = mOne.Lookup(context.Background(), "f1")
 	af(err == nil, "Lookup f1 failed")
 	af(fb.Fsize == 1, "lookup f1 should have 1 byte in size")
 	af(len(fb.Assignments) == 1, "lookup f1 should have 1 block assignment")
@@ -229,7 +245,7 @@ func TestMasterRPCOne(t *testing.T) {
 
 	r2 := structure.FileCreateReq{Fname: "f2", Fsize: mmOne.config.GiftsBlockSize + 1, Rfactor: 1}
 
-	a, err = mOne.Create(r2.Fname, r2.Fsize, r2.Rfactor)
+	a, err = mOne.Create(context.Background(), r2.Fname, r2.Fsize, r2.Rfactor, nil, false)
 	af(err == nil, "Create 2 block file failed")
 	af(len(a) == 2, "blocksize+1 byte should have 2 block")
 	af(len(a[0].BlockID) > 0, "bolck ID must be a non-empty string")
@@ -239,7 +255,8 @@ func TestMasterRPCOne(t *testing.T) {
 	af(len(a[1].Replicas) == 1, "one master have one replicas to assign")
 	af(a[1].Replicas[0] == "s1", "one master have only one replica to assign")
 
-	fb, err = mOne.Lookup("f2")
+	af(mOne.Commit(context.Background(), "f2", nil) == nil, "Commit f2 failed")
+	fb, err = mOne.Lookup(context.Background(), "f2")
 	af(err == nil, "Lookup f2 failed")
 	af(fb.Fsize == mmOne.config.GiftsBlockSize+1, "lookup f2 should have blocksize+1 byte in size")
 	af(len(fb.Assignments) == 2, "lookup f2 should have 2 block assignment")
@@ -260,9 +277,11 @@ func TestMaster_Create(t *testing.T) {
 
 	verifyAssignments := func(m *Master, request structure.FileCreateReq, clock int, assignments []structure.BlockAssign) {
 		if conf.BlockPlacementPolicy == policy.BlockPlacementPolicyRR && conf.ReplicaPlacementPolicy == policy.ReplicaPlacementPolicyRR {
+			fm, _ := m.fLookup(request.Fname)
 			for i := range assignments {
-				blockID := fmt.Sprintf("%s%d", request.Fname, i)
+				blockID := fm.blocks[i].BlockID
 				af(blockID == assignments[i].BlockID, fmt.Sprintf("Expected block name %q, found %q", blockID, assignments[0].BlockID))
+				af(!strings.Contains(blockID, request.Fname), fmt.Sprintf("Block name %q should not reveal the file name", blockID))
 
 				for _, replica := range assignments[i].Replicas {
 					expectedReplica := m.storages[clock]
@@ -292,6 +311,7 @@ func TestMaster_Create(t *testing.T) {
 	request = structure.FileCreateReq{Fname: fName, Fsize: 10, Rfactor: 1}
 	err = m.Create(&request, &assignments)
 	af(err == nil, fmt.Sprintf("Master.Create failed: %v", err))
+	af(m.Commit(&structure.FileCommitReq{Fname: request.Fname}, new(bool)) == nil, "Master.Commit failed")
 
 	err = m.Create(&request, &assignments)
 	af(err != nil, "Master should not create duplicate file names")
@@ -301,6 +321,7 @@ func TestMaster_Create(t *testing.T) {
 	request = structure.FileCreateReq{Fname: fName, Fsize: 0, Rfactor: 1}
 	err = m.Create(&request, &assignments)
 	af(err == nil, fmt.Sprintf("Master.Create failed: %v", err))
+	af(m.Commit(&structure.FileCommitReq{Fname: request.Fname}, new(bool)) == nil, "Master.Commit failed")
 	af(len(assignments) == 0, "Empty file should have 0 blocks")
 
 	// Create file with less than one block of data with 1 replica
@@ -309,6 +330,7 @@ func TestMaster_Create(t *testing.T) {
 	clock = m.createHandRR
 	err = m.Create(&request, &assignments)
 	af(err == nil, fmt.Sprintf("Master.Create failed: %v", err))
+	af(m.Commit(&structure.FileCommitReq{Fname: request.Fname}, new(bool)) == nil, "Master.Commit failed")
 	af(len(assignments) == 1, fmt.Sprintf("Expected 1 blocks, found %d", len(assignments)))
 	verifyAssignments(m, request, clock, assignments)
 
@@ -318,6 +340,7 @@ func TestMaster_Create(t *testing.T) {
 	clock = m.createHandRR
 	err = m.Create(&request, &assignments)
 	af(err == nil, fmt.Sprintf("Master.Create failed: %v", err))
+	af(m.Commit(&structure.FileCommitReq{Fname: request.Fname}, new(bool)) == nil, "Master.Commit failed")
 	af(len(assignments) == 1, fmt.Sprintf("Expected 1 blocks, found %d", len(assignments)))
 	verifyAssignments(m, request, clock, assignments)
 
@@ -327,6 +350,7 @@ func TestMaster_Create(t *testing.T) {
 	clock = m.createHandRR
 	err = m.Create(&request, &assignments)
 	af(err == nil, fmt.Sprintf("Master.Create failed: %v", err))
+	af(m.Commit(&structure.FileCommitReq{Fname: request.Fname}, new(bool)) == nil, "Master.Commit failed")
 	af(len(assignments) == 4, fmt.Sprintf("Expected 4 blocks, found %d", len(assignments)))
 	verifyAssignments(m, request, clock, assignments)
 
@@ -336,6 +360,7 @@ func TestMaster_Create(t *testing.T) {
 	clock = m.createHandRR
 	err = m.Create(&request, &assignments)
 	af(err == nil, fmt.Sprintf("Master.Create failed: %v", err))
+	af(m.Commit(&structure.FileCommitReq{Fname: request.Fname}, new(bool)) == nil, "Master.Commit failed")
 	af(len(assignments) == 0, "Empty file should have 0 blocks")
 	verifyAssignments(m, request, clock, assignments)
 
@@ -345,8 +370,29 @@ func TestMaster_Create(t *testing.T) {
 	clock = m.createHandRR
 	err = m.Create(&request, &assignments)
 	af(err == nil, fmt.Sprintf("Master.Create failed: %v", err))
+	af(m.Commit(&structure.FileCommitReq{Fname: request.Fname}, new(bool)) == nil, "Master.Commit failed")
 	af(len(assignments) == 4, fmt.Sprintf("Expected 4 blocks, found %d", len(assignments)))
 	verifyAssignments(m, request, clock, assignments)
+
+	// Create file with checksums
+	fName = "checksums"
+	request = structure.FileCreateReq{Fname: fName, Fsize: 2 * m.config.GiftsBlockSize, Rfactor: 1, Checksums: []string{"sum0", "sum1"}}
+	err = m.Create(&request, &assignments)
+	af(err == nil, fmt.Sprintf("Master.Create failed: %v", err))
+	af(m.Commit(&structure.FileCommitReq{Fname: request.Fname}, new(bool)) == nil, "Master.Commit failed")
+	var fb *structure.FileBlocks
+	err = m.Lookup(fName, &fb)
+	af(err == nil, fmt.Sprintf("Master.Lookup failed: %v", err))
+	for i := range request.Checksums {
+		af(assignments[i].Checksum == request.Checksums[i], fmt.Sprintf("Expected checksum %q, found %q", request.Checksums[i], assignments[i].Checksum))
+		af(fb.Assignments[i].Checksum == request.Checksums[i], fmt.Sprintf("Expected checksum %q, found %q", request.Checksums[i], fb.Assignments[i].Checksum))
+	}
+
+	// Wrong number of checksums
+	fName = "wrong-checksums"
+	request = structure.FileCreateReq{Fname: fName, Fsize: 2 * m.config.GiftsBlockSize, Rfactor: 1, Checksums: []string{"sum0"}}
+	err = m.Create(&request, &assignments)
+	af(err != nil, "Master should not accept a checksum count not matching the blocks")
 }
 
 func TestMaster_Lookup(t *testing.T) {
@@ -355,9 +401,11 @@ func TestMaster_Lookup(t *testing.T) {
 	}
 
 	verifyAssignments := func(m *Master, request structure.FileCreateReq, assignments []structure.BlockAssign) {
+		fm, _ := m.fLookup(request.Fname)
 		for i := range assignments {
-			blockID := fmt.Sprintf("%s%d", request.Fname, i)
+			blockID := fm.blocks[i].BlockID
 			af(blockID == assignments[i].BlockID, fmt.Sprintf("Expected block name %q, found %q", blockID, assignments[0].BlockID))
+			af(!strings.Contains(blockID, request.Fname), fmt.Sprintf("Block name %q should not reveal the file name", blockID))
 
 			for _, replica := range assignments[i].Replicas {
 				found := false
@@ -390,6 +438,7 @@ func TestMaster_Lookup(t *testing.T) {
 	request = structure.FileCreateReq{Fname: fName, Fsize: 0, Rfactor: 1}
 	err = m.Create(&request, &assignments)
 	af(err == nil, fmt.Sprintf("Master.Create failed: %v", err))
+	af(m.Commit(&structure.FileCommitReq{Fname: request.Fname}, new(bool)) == nil, "Master.Commit failed")
 
 	err = m.Lookup(fName, &fb)
 	af(fb.Fsize == 0, "Empty file should have 0 bytes")
@@ -400,6 +449,7 @@ func TestMaster_Lookup(t *testing.T) {
 	request = structure.FileCreateReq{Fname: fName, Fsize: m.config.GiftsBlockSize - 1, Rfactor: 1}
 	err = m.Create(&request, &assignments)
 	af(err == nil, fmt.Sprintf("Master.Create failed: %v", err))
+	af(m.Commit(&structure.FileCommitReq{Fname: request.Fname}, new(bool)) == nil, "Master.Commit failed")
 
 	err = m.Lookup(fName, &fb)
 	af(request.Fsize == fb.Fsize, fmt.Sprintf("Expected %d bytes, found %d", request.Fsize, fb.Fsize))
@@ -411,6 +461,7 @@ func TestMaster_Lookup(t *testing.T) {
 	request = structure.FileCreateReq{Fname: fName, Fsize: 3*m.config.GiftsBlockSize + 1, Rfactor: 1}
 	err = m.Create(&request, &assignments)
 	af(err == nil, fmt.Sprintf("Master.Create failed: %v", err))
+	af(m.Commit(&structure.FileCommitReq{Fname: request.Fname}, new(bool)) == nil, "Master.Commit failed")
 
 	err = m.Lookup(fName, &fb)
 	af(request.Fsize == fb.Fsize, fmt.Sprintf("Expected %d bytes, found %d", request.Fsize, fb.Fsize))
@@ -422,6 +473,7 @@ func TestMaster_Lookup(t *testing.T) {
 	request = structure.FileCreateReq{Fname: fName, Fsize: m.config.GiftsBlockSize - 1, Rfactor: 2}
 	err = m.Create(&request, &assignments)
 	af(err == nil, fmt.Sprintf("Master.Create failed: %v", err))
+	af(m.Commit(&structure.FileCommitReq{Fname: request.Fname}, new(bool)) == nil, "Master.Commit failed")
 
 	err = m.Lookup(fName, &fb)
 	af(request.Fsize == fb.Fsize, fmt.Sprintf("Expected %d bytes, found %d", request.Fsize, fb.Fsize))
@@ -433,9 +485,1138 @@ func TestMaster_Lookup(t *testing.T) {
 	request = structure.FileCreateReq{Fname: fName, Fsize: 3*m.config.GiftsBlockSize + 1, Rfactor: 1}
 	err = m.Create(&request, &assignments)
 	af(err == nil, fmt.Sprintf("Master.Create failed: %v", err))
+	af(m.Commit(&structure.FileCommitReq{Fname: request.Fname}, new(bool)) == nil, "Master.Commit failed")
 
 	err = m.Lookup(fName, &fb)
 	af(request.Fsize == fb.Fsize, fmt.Sprintf("Expected %d bytes, found %d", request.Fsize, fb.Fsize))
 	af(len(fb.Assignments) == 4, fmt.Sprintf("Expected 4 blocks, found %d", len(fb.Assignments)))
 	verifyAssignments(m, request, assignments)
+
+	// All replicas are returned, the dead ones last
+	fName = "replicas-ordered"
+	request = structure.FileCreateReq{Fname: fName, Fsize: m.config.GiftsBlockSize, Rfactor: 3}
+	err = m.Create(&request, &assignments)
+	af(err == nil, fmt.Sprintf("Master.Create failed: %v", err))
+	af(m.Commit(&structure.FileCommitReq{Fname: request.Fname}, new(bool)) == nil, "Master.Commit failed")
+
+	dead := assignments[0].Replicas[0]
+	sm, _ := m.sMap.Load(dead)
+	sm.(*storeMeta).missHeartbeat(1)
+	for i := 0; i < 10; i++ {
+		err = m.Lookup(fName, &fb)
+		af(err == nil, fmt.Sprintf("Master.Lookup failed: %v", err))
+		replicas := fb.Assignments[0].Replicas
+		af(len(replicas) == 3, fmt.Sprintf("Expected 3 replicas, found %d", len(replicas)))
+		af(replicas[2] == dead, fmt.Sprintf("Expected dead replica %q last, found %v", dead, replicas))
+	}
+}
+
+func TestMaster_Delete(t *testing.T) {
+	af := func(cond bool, msg string) {
+		test.AF(t, cond, msg)
+	}
+
+	addrs := []string{"localhost:4011", "localhost:4012"}
+	storages := make([]*storage.Storage, len(addrs))
+	for i, addr := range addrs {
+		storages[i] = storage.NewStorage()
+		af(storage.ServeRPC(storages[i], addr) == nil, fmt.Sprintf("Failed to serve storage at %q", addr))
+	}
+
+	m := NewMaster(addrs, config.Get())
+
+	var err error
+	var ignore bool
+	var assignments []structure.BlockAssign
+	var fb *structure.FileBlocks
+
+	// File doesn't exist
+	err = m.Delete("doesn't exist", &ignore)
+	af(err != nil, "Deleting a non-existant file should fail")
+
+	// Create a file and write its blocks
+	request := structure.FileCreateReq{Fname: "f1", Fsize: 2*m.config.GiftsBlockSize + 1, Rfactor: 2}
+	err = m.Create(&request, &assignments)
+	af(err == nil, fmt.Sprintf("Master.Create failed: %v", err))
+	af(m.Commit(&structure.FileCommitReq{Fname: request.Fname}, new(bool)) == nil, "Master.Commit failed")
+	for _, a := range assignments {
+		for _, r := range a.Replicas {
+			rpcs := storage.NewRPCStorage(r)
+			af(rpcs.Set(context.Background(), &structure.BlockKV{ID: a.BlockID, Data: []byte("data")}) == nil, "Storage.Set failed")
+		}
+	}
+	for _, s := range m.storages {
+		af(s.nBlocks == 3, fmt.Sprintf("Expected 3 blocks on %q, found %d", s.Addr, s.nBlocks))
+	}
+
+	// Delete it
+	err = m.Delete("f1", &ignore)
+	af(err == nil, fmt.Sprintf("Master.Delete failed: %v", err))
+	err = m.Lookup("f1", &fb)
+	af(err != nil, "Looking up a deleted file should fail")
+	err = m.Delete("f1", &ignore)
+	af(err != nil, "Deleting a deleted file should fail")
+	for _, s := range m.storages {
+		af(s.nBlocks == 0, fmt.Sprintf("Expected 0 blocks on %q, found %d", s.Addr, s.nBlocks))
+		af(len(s.storedFiles) == 0, fmt.Sprintf("Expected no files on %q, found %d", s.Addr, len(s.storedFiles)))
+	}
+	af(m.trafficMedian.Median() == 0, "Deleted file should not count in traffic")
+
+	// Blocks are unset in background
+	for _, a := range assignments {
+		for i := range storages {
+			var block gifts.Block
+			for try := 0; try < 100 && storages[i].Get(a.BlockID, &block) == nil; try++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			af(storages[i].Get(a.BlockID, &block) != nil, fmt.Sprintf("Block %q should be unset on %q", a.BlockID, addrs[i]))
+		}
+	}
+
+	// The name can be reused
+	request.Fsize = 1
+	err = m.Create(&request, &assignments)
+	af(err == nil, fmt.Sprintf("Master.Create after Delete failed: %v", err))
+	af(m.Commit(&structure.FileCommitReq{Fname: request.Fname}, new(bool)) == nil, "Master.Commit failed")
+	err = m.Lookup("f1", &fb)
+	af(err == nil && fb.Fsize == 1, "Lookup of the new file failed")
+}
+
+func TestMaster_Heartbeat(t *testing.T) {
+	af := func(cond bool, msg string) {
+		test.AF(t, cond, msg)
+	}
+
+	addrAlive, addrDead := "localhost:4021", "localhost:4022"
+	sAlive := storage.NewStorage()
+	af(storage.ServeRPC(sAlive, addrAlive) == nil, fmt.Sprintf("Failed to serve storage at %q", addrAlive))
+
+	conf := *config.Get()
+	conf.StorageDeadAfterMissed = 2
+	m := NewMaster([]string{addrAlive, addrDead}, &conf)
+
+	var assignments []structure.BlockAssign
+	var fb *structure.FileBlocks
+
+	request := structure.FileCreateReq{Fname: "f1", Fsize: 4 * m.config.GiftsBlockSize, Rfactor: 2}
+	err := m.Create(&request, &assignments)
+	af(err == nil, fmt.Sprintf("Master.Create failed: %v", err))
+	af(m.Commit(&structure.FileCommitReq{Fname: request.Fname}, new(bool)) == nil, "Master.Commit failed")
+
+	// Everyone is alive before proven dead
+	for _, s := range m.storages {
+		af(s.isAlive(), fmt.Sprintf("Storage %q should be alive before any probe", s.Addr))
+	}
+
+	// One miss is tolerated
+	m.probeStorages()
+	sm, _ := m.sMap.Load(addrDead)
+	dead := sm.(*storeMeta)
+	af(dead.isAlive(), "Storage should survive the first missed heartbeat")
+
+	m.probeStorages()
+	af(!dead.isAlive(), "Storage should be dead after 2 missed heartbeats")
+	sm, _ = m.sMap.Load(addrAlive)
+	af(sm.(*storeMeta).isAlive(), "Live storage should stay alive")
+
+	// Lookup never hands out the dead one
+	for i := 0; i < 20; i++ {
+		err = m.Lookup("f1", &fb)
+		af(err == nil, fmt.Sprintf("Master.Lookup failed: %v", err))
+		for _, a := range fb.Assignments {
+			af(len(a.Replicas) == 1 && a.Replicas[0] == addrAlive, fmt.Sprintf("Expected only %q, found %v", addrAlive, a.Replicas))
+		}
+	}
+
+	// Back alive
+	sDead := storage.NewStorage()
+	af(storage.ServeRPC(sDead, addrDead) == nil, fmt.Sprintf("Failed to serve storage at %q", addrDead))
+	m.probeStorages()
+	af(dead.isAlive(), "Storage should be alive again after a heartbeat")
+}
+
+func TestMaster_Repair(t *testing.T) {
+	af := func(cond bool, msg string) {
+		test.AF(t, cond, msg)
+	}
+
+	addrs := []string{"localhost:4031", "localhost:4032", "localhost:4033"}
+	addrDead := "localhost:4034"
+	storages := make(map[string]*storage.Storage)
+	for _, addr := range addrs {
+		storages[addr] = storage.NewStorage()
+		af(storage.ServeRPC(storages[addr], addr) == nil, fmt.Sprintf("Failed to serve storage at %q", addr))
+	}
+
+	m := NewMaster(append(addrs, addrDead), config.Get())
+
+	var assignments []structure.BlockAssign
+	request := structure.FileCreateReq{Fname: "f1", Fsize: 8 * m.config.GiftsBlockSize, Rfactor: 2}
+	err := m.Create(&request, &assignments)
+	af(err == nil, fmt.Sprintf("Master.Create failed: %v", err))
+	af(m.Commit(&structure.FileCommitReq{Fname: request.Fname}, new(bool)) == nil, "Master.Commit failed")
+
+	// Write the blocks to the storages still alive
+	nLost := 0
+	for _, a := range assignments {
+		for _, r := range a.Replicas {
+			if r == addrDead {
+				nLost++
+				continue
+			}
+			af(storages[r].Set(&structure.BlockKV{ID: a.BlockID, Data: []byte(a.BlockID)}, nil) == nil, "Storage.Set failed")
+		}
+	}
+	af(nLost > 0, "Some blocks should have been placed on the dead storage")
+
+	sm, _ := m.sMap.Load(addrDead)
+	dead := sm.(*storeMeta)
+	dead.missHeartbeat(1)
+	af(!dead.isAlive(), "Storage should be dead")
+
+	m.repair()
+
+	var status structure.RepairStatus
+	af(m.RepairStatus(true, &status) == nil, "Master.RepairStatus failed")
+	af(!status.Running, "Repair should be finished")
+	af(status.NUnderReplicated == nLost, fmt.Sprintf("Expected %d under-replicated blocks, found %d", nLost, status.NUnderReplicated))
+	af(status.NRepaired == nLost, fmt.Sprintf("Expected %d repaired blocks, found %d", nLost, status.NRepaired))
+	af(status.NFailed == 0 && status.NLost == 0, fmt.Sprintf("Expected no failure, found %+v", status))
+
+	fm, _ := m.fLookup("f1")
+	for _, fb := range fm.blocks {
+		af(fb.nReplicas() == 2, fmt.Sprintf("Expected 2 replicas of %q, found %d", fb.BlockID, fb.nReplicas()))
+		af(!fb.hasReplicaAddr(addrDead), fmt.Sprintf("Block %q should not be on the dead storage", fb.BlockID))
+		for _, r := range fb.getReplicas() {
+			var block gifts.Block
+			af(storages[r.Addr].Get(fb.BlockID, &block) == nil, fmt.Sprintf("Block %q should be on %q", fb.BlockID, r.Addr))
+			af(string(block) == fb.BlockID, fmt.Sprintf("Block %q has wrong data %q", fb.BlockID, block))
+		}
+	}
+	af(dead.nBlocks == 0, fmt.Sprintf("Dead storage should hold no block, found %d", dead.nBlocks))
+
+	// Nothing more to do
+	m.repair()
+	af(m.RepairStatus(true, &status) == nil, "Master.RepairStatus failed")
+	af(status.NUnderReplicated == 0, fmt.Sprintf("Expected nothing to repair, found %+v", status))
+}
+
+func TestMaster_Membership(t *testing.T) {
+	af := func(cond bool, msg string) {
+		test.AF(t, cond, msg)
+	}
+
+	addrs := []string{"localhost:4041", "localhost:4042", "localhost:4043"}
+	addrNew := "localhost:4044"
+	storages := make(map[string]*storage.Storage)
+	for _, addr := range append(addrs, addrNew) {
+		storages[addr] = storage.NewStorage()
+		af(storage.ServeRPC(storages[addr], addr) == nil, fmt.Sprintf("Failed to serve storage at %q", addr))
+	}
+
+	m := NewMaster(addrs, config.Get())
+
+	create := func(fname string) []structure.BlockAssign {
+		var assignments []structure.BlockAssign
+		request := structure.FileCreateReq{Fname: fname, Fsize: 8 * m.config.GiftsBlockSize, Rfactor: 2}
+		err := m.Create(&request, &assignments)
+		af(err == nil, fmt.Sprintf("Master.Create failed: %v", err))
+		af(m.Commit(&structure.FileCommitReq{Fname: request.Fname}, new(bool)) == nil, "Master.Commit failed")
+		for _, a := range assignments {
+			for _, r := range a.Replicas {
+				af(storages[r].Set(&structure.BlockKV{ID: a.BlockID, Data: []byte(a.BlockID)}, nil) == nil, "Storage.Set failed")
+			}
+		}
+		return assignments
+	}
+
+	create("f1")
+
+	// Register
+	t.Logf("TestMaster_Membership: Starting test #1")
+	af(m.RegisterStorage(addrNew, nil) == nil, "Master.RegisterStorage failed")
+	af(m.RegisterStorage(addrNew, nil) != nil, "Master should not register a storage twice")
+	af(m.nStorage == 4, fmt.Sprintf("Expected 4 storages, found %d", m.nStorage))
+
+	placed := false
+	for _, a := range create("f2") {
+		for _, r := range a.Replicas {
+			placed = placed || r == addrNew
+		}
+	}
+	af(placed, "New storage should receive blocks")
+
+	// Decommission, while files are still being created
+	t.Logf("TestMaster_Membership: Starting test #2")
+	leaving := addrs[0]
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 8; i++ {
+			create(fmt.Sprintf("g%d", i))
+		}
+		done <- true
+	}()
+	af(m.DecommissionStorage(leaving, nil) == nil, "Master.DecommissionStorage failed")
+	af(m.DecommissionStorage(leaving, nil) != nil, "Master should not decommission a storage twice at once")
+	<-done
+
+	// The blocks move away in background
+	var status structure.DecommissionStatus
+	for try := 0; try < 500; try++ {
+		af(m.DecommissionStatus(leaving, &status) == nil, "Master.DecommissionStatus failed")
+		if !status.Running {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	af(status.Done && status.Err == "", fmt.Sprintf("Decommission should be done, found %+v", status))
+	af(status.NBlocks > 0 && status.NMigrated >= status.NBlocks && status.NFailed == 0, fmt.Sprintf("Expected all blocks migrated, found %+v", status))
+	af(m.DecommissionStatus(addrs[1], &status) != nil, "Storage never decommissioned should have no status")
+
+	af(m.DecommissionStorage(leaving, nil) != nil, "Decommissioned storage should be gone")
+	_, found := m.sMap.Load(leaving)
+	af(!found, "Decommissioned storage should be forgotten")
+	af(m.nStorage == 3, fmt.Sprintf("Expected 3 storages, found %d", m.nStorage))
+
+	m.fMap.Range(func(key, value interface{}) bool {
+		fm := value.(*fileMeta)
+		for _, fb := range fm.blocks {
+			af(fb.nReplicas() == 2, fmt.Sprintf("Expected 2 replicas of %q, found %d", fb.BlockID, fb.nReplicas()))
+			af(!fb.hasReplicaAddr(leaving), fmt.Sprintf("Block %q should not be on the decommissioned storage", fb.BlockID))
+			for _, r := range fb.getReplicas() {
+				var block gifts.Block
+				af(storages[r.Addr].Get(fb.BlockID, &block) == nil, fmt.Sprintf("Block %q should be on %q", fb.BlockID, r.Addr))
+			}
+		}
+		return true
+	})
+
+	af(m.RegisterStorage(leaving, nil) == nil, "Decommissioned storage should be able to come back")
+}
+
+func TestMaster_Reconcile(t *testing.T) {
+	af := func(cond bool, msg string) {
+		test.AF(t, cond, msg)
+	}
+
+	addrs := []string{"localhost:4051", "localhost:4052", "localhost:4053"}
+	storages := make(map[string]*storage.Storage)
+	for _, addr := range addrs {
+		storages[addr] = storage.NewStorage()
+		af(storage.ServeRPC(storages[addr], addr) == nil, fmt.Sprintf("Failed to serve storage at %q", addr))
+	}
+
+	m := NewMaster(addrs, config.Get())
+
+	var assignments []structure.BlockAssign
+	request := structure.FileCreateReq{Fname: "f1", Fsize: 4 * m.config.GiftsBlockSize, Rfactor: 2}
+	err := m.Create(&request, &assignments)
+	af(err == nil, fmt.Sprintf("Master.Create failed: %v", err))
+	af(m.Commit(&structure.FileCommitReq{Fname: request.Fname}, new(bool)) == nil, "Master.Commit failed")
+
+	// The first replica of block 0 is never written
+	phantom := assignments[0].Replicas[0]
+	for i, a := range assignments {
+		for j, r := range a.Replicas {
+			if i == 0 && j == 0 {
+				continue
+			}
+			af(storages[r].Set(&structure.BlockKV{ID: a.BlockID, Data: []byte(a.BlockID)}, nil) == nil, "Storage.Set failed")
+		}
+	}
+
+	// A block of nobody, and a copy of block 1 the master does not know about
+	orphanAt := addrs[0]
+	af(storages[orphanAt].Set(&structure.BlockKV{ID: "orphan", Data: []byte("orphan")}, nil) == nil, "Storage.Set failed")
+	fm, _ := m.fLookup("f1")
+	untrackedAt := ""
+	for _, addr := range addrs {
+		if !fm.blocks[1].hasReplicaAddr(addr) {
+			untrackedAt = addr
+		}
+	}
+	af(storages[untrackedAt].Set(&structure.BlockKV{ID: fm.blocks[1].BlockID, Data: []byte("copy")}, nil) == nil, "Storage.Set failed")
+
+	m.reconcile()
+
+	t.Logf("TestMaster_Reconcile: Starting test #1")
+	af(!fm.blocks[0].hasReplicaAddr(phantom), "Phantom replica should be forgotten")
+	af(fm.blocks[0].nReplicas() == 1, fmt.Sprintf("Expected 1 replica of block 0, found %d", fm.blocks[0].nReplicas()))
+	for _, fb := range fm.blocks[1:] {
+		af(fb.nReplicas() == 2, fmt.Sprintf("Expected 2 replicas of %q, found %d", fb.BlockID, fb.nReplicas()))
+	}
+
+	t.Logf("TestMaster_Reconcile: Starting test #2")
+	var block gifts.Block
+	for i := 0; i < 50 && storages[orphanAt].Get("orphan", &block) == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	af(storages[orphanAt].Get("orphan", &block) != nil, "Orphan block should be deleted")
+	af(storages[untrackedAt].Get(fm.blocks[1].BlockID, &block) == nil, "Untracked replica should be kept")
+
+	// Repair takes it from here
+	t.Logf("TestMaster_Reconcile: Starting test #3")
+	m.repair()
+	af(fm.blocks[0].nReplicas() == 2, fmt.Sprintf("Expected 2 replicas of block 0 after repair, found %d", fm.blocks[0].nReplicas()))
+}
+
+func TestMaster_ReportCorrupt(t *testing.T) {
+	af := func(cond bool, msg string) {
+		test.AF(t, cond, msg)
+	}
+
+	addrs := []string{"localhost:4061", "localhost:4062", "localhost:4063"}
+	storages := make(map[string]*storage.Storage)
+	backends := make(map[string]*storage.MemoryBackend)
+	for _, addr := range addrs {
+		backends[addr] = storage.NewMemoryBackend()
+		storages[addr] = storage.NewStorageBackend(backends[addr])
+		af(storage.ServeRPC(storages[addr], addr) == nil, fmt.Sprintf("Failed to serve storage at %q", addr))
+	}
+
+	m := NewMaster(addrs, config.Get())
+
+	data := gifts.Block("data")
+	var assignments []structure.BlockAssign
+	request := structure.FileCreateReq{Fname: "f1", Fsize: len(data), Rfactor: 2, Checksums: []string{gifts.Checksum(data)}}
+	err := m.Create(&request, &assignments)
+	af(err == nil, fmt.Sprintf("Master.Create failed: %v", err))
+	af(m.Commit(&structure.FileCommitReq{Fname: request.Fname}, new(bool)) == nil, "Master.Commit failed")
+
+	a := assignments[0]
+	for _, r := range a.Replicas {
+		af(storages[r].Set(&structure.BlockKV{ID: a.BlockID, Data: data, Checksum: request.Checksums[0]}, nil) == nil, "Storage.Set failed")
+	}
+
+	fm, _ := m.fLookup("f1")
+	fb := fm.blocks[0]
+
+	// Unknown storage
+	t.Logf("TestMaster_ReportCorrupt: Starting test #1")
+	af(m.ReportCorrupt(&structure.CorruptReport{Addr: "nowhere", BlockID: a.BlockID}, nil) != nil, "Unknown storage should fail")
+
+	// A false report, the storage finds the replica healthy
+	t.Logf("TestMaster_ReportCorrupt: Starting test #2")
+	good := a.Replicas[1]
+	sm, _ := m.sMap.Load(good)
+	m.dropCorrupt(sm.(*storeMeta), a.BlockID)
+	af(fb.nReplicas() == 2, fmt.Sprintf("A healthy replica should be kept, found %d replicas", fb.nReplicas()))
+	var kept gifts.Block
+	af(storages[good].Get(a.BlockID, &kept) == nil && string(kept) == string(data), fmt.Sprintf("Block should stay on %q", good))
+
+	// The first replica rotted on disk, a client found it first
+	t.Logf("TestMaster_ReportCorrupt: Starting test #3")
+	bad := a.Replicas[0]
+	af(backends[bad].Store(a.BlockID, gifts.Block("rot!"), request.Checksums[0]) == nil, "MemoryBackend.Store failed")
+	af(m.ReportCorrupt(&structure.CorruptReport{Addr: bad, BlockID: a.BlockID}, nil) == nil, "Master.ReportCorrupt failed")
+
+	// Forgotten, then repaired from the healthy copy (maybe back to the same storage)
+	repaired := func() bool {
+		m.replicationLock.Lock()
+		defer m.replicationLock.Unlock()
+		for _, r := range fb.getReplicas() {
+			var block gifts.Block
+			if storages[r.Addr].Get(fb.BlockID, &block) != nil || string(block) != string(data) {
+				return false
+			}
+		}
+		return fb.nReplicas() == 2
+	}
+	for i := 0; i < 100 && !repaired(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	m.replicationLock.Lock()
+	defer m.replicationLock.Unlock()
+	af(fb.nReplicas() == 2, fmt.Sprintf("Expected 2 replicas after repair, found %d", fb.nReplicas()))
+	for _, r := range fb.getReplicas() {
+		var block gifts.Block
+		af(storages[r.Addr].Get(fb.BlockID, &block) == nil && string(block) == string(data), fmt.Sprintf("Block should be on %q", r.Addr))
+	}
+}
+
+func TestMaster_Commit(t *testing.T) {
+	af := func(cond bool, msg string) {
+		test.AF(t, cond, msg)
+	}
+
+	addrs := []string{"localhost:4071", "localhost:4072"}
+	storages := make([]*storage.Storage, len(addrs))
+	for i, addr := range addrs {
+		storages[i] = storage.NewStorage()
+		af(storage.ServeRPC(storages[i], addr) == nil, fmt.Sprintf("Failed to serve storage at %q", addr))
+	}
+
+	conf := *config.Get()
+	conf.MasterCreateLeaseSec = 60
+	m := NewMaster(addrs, &conf)
+
+	var err error
+	var ignore bool
+	var assignments []structure.BlockAssign
+	var fb *structure.FileBlocks
+
+	// File doesn't exist
+	t.Logf("TestMaster_Commit: Starting test #1")
+	err = m.Commit(&structure.FileCommitReq{Fname: "doesn't exist"}, &ignore)
+	af(err != nil, "Committing a non-existant file should fail")
+
+	// Invisible until committed, but the name is taken
+	t.Logf("TestMaster_Commit: Starting test #2")
+	request := structure.FileCreateReq{Fname: "f1", Fsize: 2 * m.config.GiftsBlockSize, Rfactor: 2}
+	err = m.Create(&request, &assignments)
+	af(err == nil, fmt.Sprintf("Master.Create failed: %v", err))
+	err = m.Lookup("f1", &fb)
+	af(err != nil, "Looking up an uncommitted file should fail")
+	err = m.Create(&request, &assignments)
+	af(err != nil, "Master should not create a file being written")
+
+	// Commit with the checksums
+	t.Logf("TestMaster_Commit: Starting test #3")
+	err = m.Commit(&structure.FileCommitReq{Fname: "f1", Checksums: []string{"sum0"}}, &ignore)
+	af(err != nil, "Master should not accept a checksum count not matching the blocks")
+	err = m.Commit(&structure.FileCommitReq{Fname: "f1", Checksums: []string{"sum0", "sum1"}}, &ignore)
+	af(err == nil, fmt.Sprintf("Master.Commit failed: %v", err))
+	err = m.Lookup("f1", &fb)
+	af(err == nil, fmt.Sprintf("Master.Lookup failed: %v", err))
+	af(fb.Assignments[1].Checksum == "sum1", fmt.Sprintf("Expected checksum \"sum1\", found %q", fb.Assignments[1].Checksum))
+	err = m.Commit(&structure.FileCommitReq{Fname: "f1"}, &ignore)
+	af(err != nil, "Committing twice should fail")
+
+	// Lease expires with a block written
+	t.Logf("TestMaster_Commit: Starting test #4")
+	request = structure.FileCreateReq{Fname: "f2", Fsize: 2 * m.config.GiftsBlockSize, Rfactor: 2}
+	err = m.Create(&request, &assignments)
+	af(err == nil, fmt.Sprintf("Master.Create failed: %v", err))
+	for _, r := range assignments[0].Replicas {
+		rpcs := storage.NewRPCStorage(r)
+		af(rpcs.Set(context.Background(), &structure.BlockKV{ID: assignments[0].BlockID, Data: []byte("data")}) == nil, "Storage.Set failed")
+	}
+
+	fm, _ := m.fLookup("f2")
+	fm.leaseLock.Lock()
+	fm.leaseExpiry = time.Now().Add(-time.Second)
+	fm.leaseLock.Unlock()
+
+	err = m.Commit(&structure.FileCommitReq{Fname: "f2"}, &ignore)
+	af(err != nil, "Committing after the lease expired should fail")
+
+	m.expireLeases()
+	_, found := m.fLookup("f2")
+	af(!found, "File with an expired lease should be deleted")
+	_, found = m.fLookup("f1")
+	af(found, "Committed file should not be deleted")
+	for i := range storages {
+		var block gifts.Block
+		for try := 0; try < 100 && storages[i].Get(assignments[0].BlockID, &block) == nil; try++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		af(storages[i].Get(assignments[0].BlockID, &block) != nil, fmt.Sprintf("Block %q should be unset on %q", assignments[0].BlockID, addrs[i]))
+	}
+
+	// The name can be reused
+	t.Logf("TestMaster_Commit: Starting test #5")
+	err = m.Create(&request, &assignments)
+	af(err == nil, fmt.Sprintf("Master.Create after expiry failed: %v", err))
+
+	// A writer slower than the lease renews it
+	t.Logf("TestMaster_Commit: Starting test #6")
+	fm, _ = m.fLookup("f2")
+	fm.leaseLock.Lock()
+	fm.leaseExpiry = time.Now().Add(time.Second)
+	fm.leaseLock.Unlock()
+	err = m.RenewLease("f2", &ignore)
+	af(err == nil, fmt.Sprintf("Master.RenewLease failed: %v", err))
+	af(!fm.isExpired(time.Now().Add(time.Minute-time.Second)), "Renewed lease should last MasterCreateLeaseSec from now")
+
+	fm.leaseLock.Lock()
+	fm.leaseExpiry = time.Now().Add(-time.Second)
+	fm.leaseLock.Unlock()
+	err = m.RenewLease("f2", &ignore)
+	af(err != nil, "Renewing an expired lease should fail")
+	err = m.RenewLease("f1", &ignore)
+	af(err != nil, "Renewing the lease of a committed file should fail")
+	err = m.RenewLease("doesn't exist", &ignore)
+	af(err != nil, "Renewing the lease of a non-existant file should fail")
+}
+
+func TestMaster_List(t *testing.T) {
+	af := func(cond bool, msg string) {
+		test.AF(t, cond, msg)
+	}
+
+	m := NewMaster([]string{"s1", "s2"}, config.Get())
+
+	var assignments []structure.BlockAssign
+	var ret structure.ListResult
+
+	for _, fname := range []string{"b/2", "a/1", "b/1", "b/3", "c", "b/0"} {
+		request := structure.FileCreateReq{Fname: fname, Fsize: 1, Rfactor: 1}
+		af(m.Create(&request, &assignments) == nil, fmt.Sprintf("Create %q failed", fname))
+		if fname != "b/0" {
+			af(m.Commit(&structure.FileCommitReq{Fname: fname}, new(bool)) == nil, fmt.Sprintf("Commit %q failed", fname))
+		}
+	}
+
+	// All files, sorted, without the ones being written
+	t.Logf("TestMaster_List: Starting test #1")
+	af(m.List(&structure.ListReq{}, &ret) == nil, "Master.List failed")
+	af(fmt.Sprint(ret.Fnames) == "[a/1 b/1 b/2 b/3 c]", fmt.Sprintf("Unexpected files %v", ret.Fnames))
+	af(ret.NextCursor == "", fmt.Sprintf("Expected no more pages, found cursor %q", ret.NextCursor))
+
+	// Prefix, page by page
+	t.Logf("TestMaster_List: Starting test #2")
+	af(m.List(&structure.ListReq{Prefix: "b/", Limit: 2}, &ret) == nil, "Master.List failed")
+	af(fmt.Sprint(ret.Fnames) == "[b/1 b/2]", fmt.Sprintf("Unexpected first page %v", ret.Fnames))
+	af(ret.NextCursor == "b/2", fmt.Sprintf("Expected cursor \"b/2\", found %q", ret.NextCursor))
+	af(m.List(&structure.ListReq{Prefix: "b/", Cursor: ret.NextCursor, Limit: 2}, &ret) == nil, "Master.List failed")
+	af(fmt.Sprint(ret.Fnames) == "[b/3]", fmt.Sprintf("Unexpected last page %v", ret.Fnames))
+	af(ret.NextCursor == "", fmt.Sprintf("Expected no more pages, found cursor %q", ret.NextCursor))
+
+	// Nothing matches
+	t.Logf("TestMaster_List: Starting test #3")
+	af(m.List(&structure.ListReq{Prefix: "d"}, &ret) == nil, "Master.List failed")
+	af(len(ret.Fnames) == 0, fmt.Sprintf("Expected no files, found %v", ret.Fnames))
+
+	// Paged through the tree in the order of the full names,
+	// a directory sorts after the file names it is a prefix of ("x/" after "x.y")
+	t.Logf("TestMaster_List: Starting test #4")
+	m = NewMaster([]string{"s1", "s2"}, config.Get())
+	all := []string{"x.y", "x/1-", "x/1.z", "x/1/a", "x/10", "x-", "x0", "y/a/b/c", "y/a/d", "y/b", "z"}
+	for _, fname := range all {
+		request := structure.FileCreateReq{Fname: fname, Fsize: 1, Rfactor: 1}
+		af(m.Create(&request, &assignments) == nil, fmt.Sprintf("Create %q failed", fname))
+		af(m.Commit(&structure.FileCommitReq{Fname: fname}, new(bool)) == nil, fmt.Sprintf("Commit %q failed", fname))
+	}
+	af(m.Delete("x/10", new(bool)) == nil, "Delete failed")
+	af(m.Rename(&structure.RenameReq{Old: "z", New: "y/a/e"}, new(bool)) == nil, "Rename failed")
+	all = []string{"x-", "x.y", "x/1-", "x/1.z", "x/1/a", "x0", "y/a/b/c", "y/a/d", "y/a/e", "y/b"}
+
+	for _, prefix := range []string{"", "x", "x/", "x/1", "y/a", "y/a/", "w", "zz"} {
+		var expected []string
+		for _, fname := range all {
+			if strings.HasPrefix(fname, prefix) {
+				expected = append(expected, fname)
+			}
+		}
+		var listed []string
+		req := structure.ListReq{Prefix: prefix, Limit: 2}
+		for {
+			af(m.List(&req, &ret) == nil, "Master.List failed")
+			listed = append(listed, ret.Fnames...)
+			if ret.NextCursor == "" {
+				break
+			}
+			req.Cursor = ret.NextCursor
+		}
+		af(fmt.Sprint(listed) == fmt.Sprint(expected), fmt.Sprintf("Prefix %q: expected %v, found %v", prefix, expected, listed))
+	}
+}
+
+func TestMaster_Stat(t *testing.T) {
+	af := func(cond bool, msg string) {
+		test.AF(t, cond, msg)
+	}
+
+	m := NewMaster([]string{"s1", "s2", "s3"}, config.Get())
+
+	var assignments []structure.BlockAssign
+	var fb *structure.FileBlocks
+	var stat structure.FileStat
+
+	// File doesn't exist
+	t.Logf("TestMaster_Stat: Starting test #1")
+	af(m.Stat("doesn't exist", &stat) != nil, "Stat of a non-existant file should fail")
+
+	// Not committed yet
+	t.Logf("TestMaster_Stat: Starting test #2")
+	before := time.Now()
+	request := structure.FileCreateReq{Fname: "f1", Fsize: 2*m.config.GiftsBlockSize + 1, Rfactor: 2}
+	af(m.Create(&request, &assignments) == nil, "Master.Create failed")
+	af(m.Stat("f1", &stat) != nil, "Stat of an uncommitted file should fail")
+
+	// Committed and read
+	t.Logf("TestMaster_Stat: Starting test #3")
+	af(m.Commit(&structure.FileCommitReq{Fname: "f1"}, new(bool)) == nil, "Master.Commit failed")
+	af(m.Lookup("f1", &fb) == nil, "Master.Lookup failed")
+	for try := 0; try < 100 && stat.Temperature == 0; try++ {
+		// the read is counted in background
+		time.Sleep(10 * time.Millisecond)
+		af(m.Stat("f1", &stat) == nil, "Master.Stat failed")
+	}
+	af(stat.Fname == "f1" && stat.Fsize == request.Fsize, fmt.Sprintf("Unexpected stat %+v", stat))
+	af(stat.NBlocks == 3, fmt.Sprintf("Expected 3 blocks, found %d", stat.NBlocks))
+	af(stat.Rfactor == 2 && stat.NReplica == 2, fmt.Sprintf("Expected 2 replicas, found rfactor %d, nReplica %d", stat.Rfactor, stat.NReplica))
+	af(!stat.Created.Before(before) && !stat.Created.After(time.Now()), fmt.Sprintf("Unexpected creation time %v", stat.Created))
+	af(stat.Temperature > 0, fmt.Sprintf("Expected a read file to be warm, found %v", stat.Temperature))
+}
+
+func TestMaster_Directories(t *testing.T) {
+	af := func(cond bool, msg string) {
+		test.AF(t, cond, msg)
+	}
+
+	addrs := []string{"localhost:4081", "localhost:4082"}
+	storages := make([]*storage.Storage, len(addrs))
+	for i, addr := range addrs {
+		storages[i] = storage.NewStorage()
+		af(storage.ServeRPC(storages[i], addr) == nil, fmt.Sprintf("Failed to serve storage at %q", addr))
+	}
+
+	m := NewMaster(addrs, config.Get())
+
+	var err error
+	var ignore bool
+	var assignments []structure.BlockAssign
+	var entries []structure.DirEntry
+	var fb *structure.FileBlocks
+
+	create := func(fname string) error {
+		request := structure.FileCreateReq{Fname: fname, Fsize: 1, Rfactor: 1}
+		if err := m.Create(&request, &assignments); err != nil {
+			return err
+		}
+		return m.Commit(&structure.FileCommitReq{Fname: fname}, &ignore)
+	}
+	readDir := func(p string) string {
+		af(m.ReadDir(p, &entries) == nil, fmt.Sprintf("Master.ReadDir(%q) failed", p))
+		names := make([]string, len(entries))
+		for i, entry := range entries {
+			names[i] = entry.Name
+			if entry.IsDir {
+				names[i] += "/"
+			}
+		}
+		return fmt.Sprint(names)
+	}
+
+	// Invalid paths
+	t.Logf("TestMaster_Directories: Starting test #1")
+	for _, p := range []string{"", "/", "a//b", "a/", "a/./b", "../a"} {
+		af(create(p) != nil, fmt.Sprintf("Master should not create file %q", p))
+		af(m.Mkdir(p, &ignore) != nil, fmt.Sprintf("Master should not make directory %q", p))
+	}
+
+	// Directories are made on the way
+	t.Logf("TestMaster_Directories: Starting test #2")
+	af(create("data/set1/f1") == nil, "Create data/set1/f1 failed")
+	af(create("/data/set1/f2") == nil, "Create /data/set1/f2 failed")
+	af(m.Mkdir("data/set2/empty", &ignore) == nil, "Master.Mkdir failed")
+	af(m.Mkdir("data/set2", &ignore) == nil, "Master.Mkdir of an existing directory should be a no-op")
+	af(create("top") == nil, "Create top failed")
+
+	request := structure.FileCreateReq{Fname: "data/set1/writing", Fsize: 1, Rfactor: 1}
+	af(m.Create(&request, &assignments) == nil, "Master.Create failed")
+
+	af(readDir("/") == "[data/ top]", fmt.Sprintf("Unexpected root %s", readDir("/")))
+	af(readDir("") == "[data/ top]", fmt.Sprintf("Unexpected root %s", readDir("")))
+	af(readDir("data") == "[set1/ set2/]", fmt.Sprintf("Unexpected data %s", readDir("data")))
+	af(readDir("data/set1") == "[f1 f2]", fmt.Sprintf("Unexpected data/set1 %s", readDir("data/set1")))
+	af(m.ReadDir("data/set1/f1", &entries) != nil, "ReadDir of a file should fail")
+	af(m.Lookup("/data/set1/f2", &fb) == nil, "Lookup with a leading slash failed")
+
+	// Files and directories do not mix
+	t.Logf("TestMaster_Directories: Starting test #3")
+	af(create("data") != nil, "Master should not create a file over a directory")
+	af(create("top/f") != nil, "Master should not create a file under a file")
+	af(m.Mkdir("top", &ignore) != nil, "Master should not make a directory over a file")
+	af(m.Mkdir("top/d", &ignore) != nil, "Master should not make a directory under a file")
+
+	// Removing
+	t.Logf("TestMaster_Directories: Starting test #4")
+	err = m.Rmdir(&structure.RmdirReq{Path: "data/set1"}, &ignore)
+	af(err != nil, "Master should not remove a non-empty directory")
+	err = m.Rmdir(&structure.RmdirReq{Path: "/"}, &ignore)
+	af(err != nil, "Master should not remove the root")
+	err = m.Rmdir(&structure.RmdirReq{Path: "data/set2/empty"}, &ignore)
+	af(err == nil, fmt.Sprintf("Master.Rmdir failed: %v", err))
+	af(readDir("data/set2") == "[]", fmt.Sprintf("Unexpected data/set2 %s", readDir("data/set2")))
+
+	err = m.Rmdir(&structure.RmdirReq{Path: "data", Recursive: true}, &ignore)
+	af(err == nil, fmt.Sprintf("Master.Rmdir failed: %v", err))
+	af(readDir("") == "[top]", fmt.Sprintf("Unexpected root %s", readDir("")))
+	for _, fname := range []string{"data/set1/f1", "data/set1/f2", "data/set1/writing"} {
+		_, found := m.fLookup(fname)
+		af(!found, fmt.Sprintf("%q should be removed", fname))
+	}
+	af(m.ReadDir("data", &entries) != nil, "ReadDir of a removed directory should fail")
+	nBlocks := 0
+	for _, s := range m.storages {
+		nBlocks += s.nBlocks
+	}
+	af(nBlocks == 1, fmt.Sprintf("Expected only the block of top left, found %d", nBlocks))
+
+	// The names can be reused
+	t.Logf("TestMaster_Directories: Starting test #5")
+	af(create("data") == nil, "Create data as a file failed")
+	af(create("top/..") != nil, "Master should not create an invalid path")
+}
+
+func TestMaster_Rename(t *testing.T) {
+	af := func(cond bool, msg string) {
+		test.AF(t, cond, msg)
+	}
+
+	addrs := []string{"localhost:4091", "localhost:4092"}
+	storages := make([]*storage.Storage, len(addrs))
+	for i, addr := range addrs {
+		storages[i] = storage.NewStorage()
+		af(storage.ServeRPC(storages[i], addr) == nil, fmt.Sprintf("Failed to serve storage at %q", addr))
+	}
+
+	m := NewMaster(addrs, config.Get())
+
+	var err error
+	var ignore bool
+	var assignments []structure.BlockAssign
+	var entries []structure.DirEntry
+	var fb *structure.FileBlocks
+
+	create := func(fname string) []structure.BlockAssign {
+		request := structure.FileCreateReq{Fname: fname, Fsize: 1, Rfactor: 1}
+		af(m.Create(&request, &assignments) == nil, fmt.Sprintf("Create %q failed", fname))
+		af(m.Commit(&structure.FileCommitReq{Fname: fname}, &ignore) == nil, fmt.Sprintf("Commit %q failed", fname))
+		return assignments
+	}
+	rename := func(oldName, newName string, overwrite bool) error {
+		return m.Rename(&structure.RenameReq{Old: oldName, New: newName, Overwrite: overwrite}, &ignore)
+	}
+
+	// Publish a temporary file, the blocks stay the same
+	t.Logf("TestMaster_Rename: Starting test #1")
+	tmp := create("tmp/part")
+	err = rename("tmp/part", "out/final", false)
+	af(err == nil, fmt.Sprintf("Master.Rename failed: %v", err))
+	af(m.Lookup("tmp/part", &fb) != nil, "Old name should be gone")
+	af(m.Lookup("out/final", &fb) == nil, "Lookup of the new name failed")
+	af(fb.Assignments[0].BlockID == tmp[0].BlockID, "Rename should keep the blocks")
+	af(m.ReadDir("tmp", &entries) == nil && len(entries) == 0, fmt.Sprintf("Unexpected tmp %v", entries))
+	af(m.ReadDir("out", &entries) == nil && len(entries) == 1 && entries[0].Name == "final", fmt.Sprintf("Unexpected out %v", entries))
+
+	// The old name is free again, with other blocks
+	t.Logf("TestMaster_Rename: Starting test #2")
+	again := create("tmp/part")
+	af(again[0].BlockID != tmp[0].BlockID, "A reused name should not reuse the block IDs")
+
+	// Overwriting
+	t.Logf("TestMaster_Rename: Starting test #3")
+	af(rename("tmp/part", "out/final", false) != nil, "Master should not overwrite without being told")
+	err = rename("tmp/part", "out/final", true)
+	af(err == nil, fmt.Sprintf("Master.Rename with overwrite failed: %v", err))
+	af(m.Lookup("out/final", &fb) == nil, "Lookup of the new name failed")
+	af(fb.Assignments[0].BlockID == again[0].BlockID, "The overwritten file should be replaced")
+	nBlocks := 0
+	for _, s := range m.storages {
+		nBlocks += s.nBlocks
+	}
+	af(nBlocks == 1, fmt.Sprintf("Expected only the block of out/final left, found %d", nBlocks))
+
+	// What cannot be renamed
+	t.Logf("TestMaster_Rename: Starting test #4")
+	af(rename("missing", "x", false) != nil, "Master should not rename a missing file")
+	af(rename("out/final", "tmp", true) != nil, "Master should not rename over a directory")
+	af(rename("out/final", "out/final/x", false) != nil, "Master should not rename under a file")
+	af(rename("out/final", "a//b", false) != nil, "Master should not rename to an invalid path")
+	request := structure.FileCreateReq{Fname: "writing", Fsize: 1, Rfactor: 1}
+	af(m.Create(&request, &assignments) == nil, "Master.Create failed")
+	af(rename("writing", "x", false) != nil, "Master should not rename an uncommitted file")
+	af(rename("out/final", "writing", true) != nil, "Master should not rename over an uncommitted file")
+	af(rename("out/final", "/out/final", false) == nil, "Renaming to the same name should be a no-op")
+}
+
+func TestMaster_BlockIDs(t *testing.T) {
+	af := func(cond bool, msg string) {
+		test.AF(t, cond, msg)
+	}
+
+	conf := *config.Get()
+	conf.GiftsBlockSize = 1
+	m := NewMaster([]string{"s1", "s2"}, &conf)
+
+	var assignments []structure.BlockAssign
+	seen := make(map[string]string)
+	create := func(fname string, fsize int) {
+		request := structure.FileCreateReq{Fname: fname, Fsize: fsize, Rfactor: 1}
+		af(m.Create(&request, &assignments) == nil, fmt.Sprintf("Create %q failed", fname))
+		for i, a := range assignments {
+			owner, found := seen[a.BlockID]
+			af(!found, fmt.Sprintf("Block %d of %q has the ID %q of a block of %q", i, fname, a.BlockID, owner))
+			seen[a.BlockID] = fname
+		}
+	}
+
+	// "a" block 0x10 and "a1" block 0x0 used to be both "a10"
+	t.Logf("TestMaster_BlockIDs: Starting test #1")
+	create("a", 0x11)
+	create("a1", 1)
+
+	// A restarted master does not hand out the IDs again
+	t.Logf("TestMaster_BlockIDs: Starting test #2")
+	m = NewMaster([]string{"s1", "s2"}, &conf)
+	create("b", 0x11)
+}
+
+func TestMaster_Dedup(t *testing.T) {
+	af := func(cond bool, msg string) {
+		test.AF(t, cond, msg)
+	}
+
+	addrs := []string{"localhost:4101", "localhost:4102"}
+	storages := make([]*storage.Storage, len(addrs))
+	for i, addr := range addrs {
+		storages[i] = storage.NewStorage()
+		af(storage.ServeRPC(storages[i], addr) == nil, fmt.Sprintf("Failed to serve storage at %q", addr))
+	}
+
+	conf := *config.Get()
+	conf.GiftsBlockSize = 1
+	m := NewMaster(addrs, &conf)
+
+	var ignore bool
+	var assignments []structure.BlockAssign
+	data := map[string]gifts.Block{"x": gifts.Block("x"), "y": gifts.Block("y"), "z": gifts.Block("z")}
+	sum := func(content string) string {
+		return gifts.Checksum(data[content])
+	}
+
+	// Create with the contents of the blocks, writing the ones not stored yet
+	create := func(fname string, contents ...string) []structure.BlockAssign {
+		request := structure.FileCreateReq{Fname: fname, Fsize: len(contents), Rfactor: 1, Dedup: true}
+		for _, content := range contents {
+			request.Checksums = append(request.Checksums, sum(content))
+		}
+		af(m.Create(&request, &assignments) == nil, fmt.Sprintf("Create %q failed", fname))
+		for i, a := range assignments {
+			if a.Exists {
+				continue
+			}
+			for _, addr := range a.Replicas {
+				kv := structure.BlockKV{ID: a.BlockID, Data: data[contents[i]], Checksum: sum(contents[i])}
+				for j := range addrs {
+					if addrs[j] == addr {
+						af(storages[j].Set(&kv, &ignore) == nil, fmt.Sprintf("Set %q failed", a.BlockID))
+					}
+				}
+			}
+		}
+		return assignments
+	}
+	stored := func(id string) bool {
+		var b gifts.Block
+		for _, s := range storages {
+			if s.Get(id, &b) == nil {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Nothing to share yet
+	t.Logf("TestMaster_Dedup: Starting test #1")
+	a := create("a", "x", "y")
+	af(!a[0].Exists && !a[1].Exists, "The first blocks should not exist yet")
+
+	// Blocks of files not committed are shared, but still written
+	t.Logf("TestMaster_Dedup: Starting test #2")
+	b := create("b", "y", "z")
+	af(b[0].BlockID == a[1].BlockID, "Same content should share the block")
+	af(!b[0].Exists, "Blocks of files not committed may not be written yet")
+	af(fmt.Sprint(b[0].Replicas) == fmt.Sprint(a[1].Replicas), "Shared block should keep its replicas")
+	af(m.Commit(&structure.FileCommitReq{Fname: "a"}, &ignore) == nil, "Commit a failed")
+	af(m.Commit(&structure.FileCommitReq{Fname: "b"}, &ignore) == nil, "Commit b failed")
+
+	// Committed blocks exist, also within a file
+	t.Logf("TestMaster_Dedup: Starting test #3")
+	c := create("c", "x", "x", "z")
+	af(c[0].Exists && c[1].Exists && c[2].Exists, "Committed content should exist")
+	af(c[0].BlockID == a[0].BlockID && c[1].BlockID == a[0].BlockID && c[2].BlockID == b[1].BlockID, "Same content should share the block")
+	af(m.Commit(&structure.FileCommitReq{Fname: "c"}, &ignore) == nil, "Commit c failed")
+
+	// Opt-in only, with all the checksums
+	t.Logf("TestMaster_Dedup: Starting test #4")
+	request := structure.FileCreateReq{Fname: "plain", Fsize: 1, Rfactor: 1, Checksums: []string{sum("x")}}
+	af(m.Create(&request, &assignments) == nil, "Create plain failed")
+	af(assignments[0].BlockID != a[0].BlockID && !assignments[0].Exists, "Blocks should not be shared without Dedup")
+	request = structure.FileCreateReq{Fname: "nosum", Fsize: 1, Rfactor: 1, Dedup: true}
+	af(m.Create(&request, &assignments) != nil, "Dedup without checksums should fail")
+
+	// Blocks are unset only when no file refers to them
+	t.Logf("TestMaster_Dedup: Starting test #5")
+	af(m.Delete("a", &ignore) == nil, "Delete a failed")
+	af(m.Delete("c", &ignore) == nil, "Delete c failed")
+	time.Sleep(100 * time.Millisecond)
+	af(!stored(a[0].BlockID), "Block of x should be unset with its last file")
+	af(stored(a[1].BlockID) && stored(b[1].BlockID), "Blocks of b should stay")
+
+	af(m.Delete("b", &ignore) == nil, "Delete b failed")
+	time.Sleep(100 * time.Millisecond)
+	af(!stored(a[1].BlockID) && !stored(b[1].BlockID), "Blocks of b should be unset with it")
+	af(len(m.dedupBlocks) == 0, fmt.Sprintf("Expected no shared block left, found %d", len(m.dedupBlocks)))
+
+	// The content can be stored again
+	t.Logf("TestMaster_Dedup: Starting test #6")
+	d := create("d", "x")
+	af(!d[0].Exists && d[0].BlockID != a[0].BlockID, "Reclaimed content should be written again under a new ID")
+}
+
+func TestMaster_Erasure(t *testing.T) {
+	af := func(cond bool, msg string) {
+		test.AF(t, cond, msg)
+	}
+
+	conf := *config.Get()
+	conf.GiftsBlockSize = 1
+	m := NewMaster([]string{"s1", "s2", "s3", "s4", "s5", "s6"}, &conf)
+
+	var assignments []structure.BlockAssign
+
+	// Invalid codes
+	t.Logf("TestMaster_Erasure: Starting test #1")
+	for _, km := range [][2]int{{3, 0}, {0, 2}, {-1, 2}, {5, 2}} {
+		request := structure.FileCreateReq{Fname: "invalid", Fsize: 6, Rfactor: 1, DataShards: km[0], ParityShards: km[1]}
+		af(m.Create(&request, &assignments) != nil, fmt.Sprintf("Code of %d data and %d parity blocks should fail", km[0], km[1]))
+	}
+	request := structure.FileCreateReq{Fname: "invalid", Fsize: 6, Rfactor: 1, DataShards: 3, ParityShards: 2, Dedup: true}
+	af(m.Create(&request, &assignments) != nil, "Erasure code with dedup should fail")
+
+	// k+m blocks per stripe, the last stripe padded, each block of a stripe on its own storage
+	t.Logf("TestMaster_Erasure: Starting test #2")
+	request = structure.FileCreateReq{Fname: "ec", Fsize: 7, Rfactor: 2, DataShards: 3, ParityShards: 2}
+	af(m.Create(&request, &assignments) == nil, "Create ec failed")
+	af(len(assignments) == 3*5, fmt.Sprintf("Expected 3 stripes of 5 blocks, found %d blocks", len(assignments)))
+	for stripe := 0; stripe < len(assignments); stripe += 5 {
+		firsts := make(map[string]bool)
+		for _, a := range assignments[stripe : stripe+5] {
+			af(len(a.Replicas) == 2, fmt.Sprintf("Expected 2 replicas of %q, found %d", a.BlockID, len(a.Replicas)))
+			firsts[a.Replicas[0]] = true
+		}
+		af(len(firsts) == 5, fmt.Sprintf("Stripe %d has its blocks on %d storages only", stripe/5, len(firsts)))
+	}
+
+	// The code is part of the metadata
+	t.Logf("TestMaster_Erasure: Starting test #3")
+	af(m.Commit(&structure.FileCommitReq{Fname: "ec"}, new(bool)) == nil, "Commit ec failed")
+	var fb *structure.FileBlocks
+	af(m.Lookup("ec", &fb) == nil, "Lookup ec failed")
+	af(fb.DataShards == 3 && fb.ParityShards == 2, fmt.Sprintf("Expected a code of 3+2 blocks, found %d+%d", fb.DataShards, fb.ParityShards))
+	af(len(fb.Assignments) == 15 && fb.Fsize == 7, "Lookup should return all the blocks of the stripes")
+	var stat structure.FileStat
+	af(m.Stat("ec", &stat) == nil, "Stat ec failed")
+	af(stat.DataShards == 3 && stat.ParityShards == 2, "Stat should return the code")
+}
+
+func TestMaster_Capacity(t *testing.T) {
+	af := func(cond bool, msg string) {
+		test.AF(t, cond, msg)
+	}
+
+	addrs := []string{"localhost:4111", "localhost:4112", "localhost:4113"}
+	used := []int64{90, 10, 50}
+	for i, addr := range addrs {
+		s := storage.NewStorage()
+		s.Capacity = 100
+		af(storage.ServeRPC(s, addr) == nil, fmt.Sprintf("Failed to serve storage at %q", addr))
+		kv := structure.BlockKV{ID: "existing", Data: make(gifts.Block, used[i])}
+		af(s.Set(&kv, new(bool)) == nil, "Storage.Set failed")
+	}
+
+	conf := *config.Get()
+	conf.GiftsBlockSize = 1
+	conf.BlockPlacementPolicy = policy.BlockPlacementPolicyCapacity
+	conf.MasterHighWaterMark = 0.8
+	m := NewMaster(addrs, &conf)
+
+	var assignments []structure.BlockAssign
+	create := func(fname string, fsize int, rfactor uint) error {
+		request := structure.FileCreateReq{Fname: fname, Fsize: fsize, Rfactor: rfactor}
+		return m.Create(&request, &assignments)
+	}
+	report := func(addr string, used int64) {
+		sm, _ := m.sMap.Load(addr)
+		sm.(*storeMeta).reportSpace(&structure.StorageStat{Capacity: 100, Used: used})
+	}
+
+	// The heartbeats report the space
+	t.Logf("TestMaster_Capacity: Starting test #1")
+	m.probeStorages()
+	for i, addr := range addrs {
+		sm, _ := m.sMap.Load(addr)
+		u, c := sm.(*storeMeta).space()
+		af(u == used[i] && c == 100, fmt.Sprintf("Expected %d of 100 bytes used on %q, found %d of %d", used[i], addr, u, c))
+	}
+
+	// Least full first, never above the high-water mark
+	t.Logf("TestMaster_Capacity: Starting test #2")
+	af(create("one", 1, 1) == nil, "Create one failed")
+	af(fmt.Sprint(assignments[0].Replicas) == "[localhost:4112]", fmt.Sprintf("Expected the emptiest storage, found %v", assignments[0].Replicas))
+	af(create("three", 1, 3) == nil, "Create three failed")
+	af(fmt.Sprint(assignments[0].Replicas) == "[localhost:4112 localhost:4113]", fmt.Sprintf("Expected the storages below the mark, found %v", assignments[0].Replicas))
+
+	// Placed blocks count until the next report
+	t.Logf("TestMaster_Capacity: Starting test #3")
+	report(addrs[1], 61)
+	report(addrs[2], 60)
+	af(create("spread", 3, 1) == nil, "Create spread failed")
+	af(assignments[0].Replicas[0] == addrs[2], fmt.Sprintf("Expected %q, found %v", addrs[2], assignments[0].Replicas))
+	af(assignments[1].Replicas[0] == addrs[2], fmt.Sprintf("Expected %q with fewer blocks, found %v", addrs[2], assignments[1].Replicas))
+	af(assignments[2].Replicas[0] == addrs[1], fmt.Sprintf("Expected %q as the other fills up, found %v", addrs[1], assignments[2].Replicas))
+
+	// New replicas are refused as well
+	t.Logf("TestMaster_Capacity: Starting test #4")
+	report(addrs[1], 80)
+	report(addrs[2], 80)
+	fm, _ := m.fLookup("one")
+	m.topologyLock.RLock()
+	af(m.nextFreeReplicaOf(fm.blocks[0]) == nil, "No storage should take a new replica above the mark")
+	m.topologyLock.RUnlock()
+
+	// Nowhere to place, the name is not taken
+	t.Logf("TestMaster_Capacity: Starting test #5")
+	af(create("full", 1, 1) != nil, "Create should fail when all storages are above the mark")
+	report(addrs[2], 0)
+	af(create("full", 1, 1) == nil, "Create full failed once there is room")
+	af(assignments[0].Replicas[0] == addrs[2], fmt.Sprintf("Expected %q, found %v", addrs[2], assignments[0].Replicas))
+
+	// Each block of a stripe on its own storage, or no file
+	t.Logf("TestMaster_Capacity: Starting test #6")
+	report(addrs[0], 0)
+	report(addrs[1], 0)
+	request := structure.FileCreateReq{Fname: "ec", Fsize: 2, Rfactor: 1, DataShards: 2, ParityShards: 1}
+	af(m.Create(&request, &assignments) == nil, "Create ec failed")
+	firsts := make(map[string]bool)
+	for _, a := range assignments {
+		firsts[a.Replicas[0]] = true
+	}
+	af(len(firsts) == 3, fmt.Sprintf("Stripe has its blocks on %d storages only", len(firsts)))
+	report(addrs[0], 80)
+	request.Fname = "ec-full"
+	af(m.Create(&request, &assignments) != nil, "Create of a stripe wider than the storages with room should fail")
+}
+
+func TestMaster_Framed(t *testing.T) {
+	t.Parallel()
+	af := func(cond bool, msg string) {
+		test.AF(t, cond, msg)
+	}
+
+	m := NewMaster([]string{}, config.Get())
+	af(ServeRPC(m, "localhost:4121") == nil, "Failed to serve master")
+	pool := gifts.NewRPCPool(1, 0, 0, gifts.ProtocolFramed, nil)
+	defer pool.Close()
+	mc := newConnOn("localhost:4121", pool.NewClient("localhost:4121", RPCPathMaster))
+
+	// The metadata calls, gob encoded in the frames
+	t.Logf("TestMaster_Framed: Starting test #1")
+	a, err := mc.Create(context.Background(), "f", 1, 1, []string{"sum"}, false)
+	af(err == nil && len(a) == 1, fmt.Sprintf("Create failed: %v", err))
+	af(mc.Commit(context.Background(), "f", nil) == nil, "Commit failed")
+	fb, err := mc.Lookup(context.Background(), "f")
+	af(err == nil && fb.Fsize == 1 && fb.Assignments[0].Checksum == "sum", fmt.Sprintf("Lookup failed: %v %+v", err, fb))
+
+	// Errors of the master are not retried
+	t.Logf("TestMaster_Framed: Starting test #2")
+	_, err = mc.Create(context.Background(), "f", 1, 1, nil, false)
+	af(err != nil && !gifts.IsRetryable(err), fmt.Sprintf("Expected the file to exist, found %v", err))
+	_, err = NewConn("localhost:4121").Lookup(context.Background(), "f")
+	af(err == nil, fmt.Sprintf("Lookup over gob failed: %v", err))
 }
@@ -0,0 +1,501 @@
+package master
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/GIFTS-fs/GIFTS/structure"
+)
+
+const (
+	// page size of List() if not given
+	listDefaultLimit = 1000
+	// largest page size of List()
+	listMaxLimit = 10000
+)
+
+// dirMeta is a directory of the namespace.
+// The files are still found by their full paths in fMap,
+// the directories only keep the tree for ReadDir(), Rmdir() and List().
+type dirMeta struct {
+	// name -> true if a directory, false if a file
+	children map[string]bool
+	// the keys of the children in order, see childKey
+	sorted []string
+}
+
+func newDirMeta() *dirMeta {
+	return &dirMeta{children: make(map[string]bool)}
+}
+
+// childKey orders the children of a directory as the full paths under it:
+// a directory goes by its name and "/", it comes with everything in it
+func childKey(name string, isDir bool) string {
+	if isDir {
+		return name + "/"
+	}
+	return name
+}
+
+// setChild name in the directory, caller holds namespaceLock
+func (d *dirMeta) setChild(name string, isDir bool) {
+	if wasDir, found := d.children[name]; found {
+		if wasDir == isDir {
+			return
+		}
+		d.removeChild(name)
+	}
+	d.children[name] = isDir
+
+	key := childKey(name, isDir)
+	i := sort.SearchStrings(d.sorted, key)
+	d.sorted = append(d.sorted, "")
+	copy(d.sorted[i+1:], d.sorted[i:])
+	d.sorted[i] = key
+}
+
+// removeChild name from the directory, no-op if not in it, caller holds namespaceLock
+func (d *dirMeta) removeChild(name string) {
+	isDir, found := d.children[name]
+	if !found {
+		return
+	}
+	delete(d.children, name)
+
+	i := sort.SearchStrings(d.sorted, childKey(name, isDir))
+	d.sorted = append(d.sorted[:i], d.sorted[i+1:]...)
+}
+
+// cleanPath drops the leading "/", paths are all relative to the root
+func cleanPath(p string) string {
+	return strings.TrimPrefix(p, "/")
+}
+
+// validatePath of a file or directory: names joined by "/",
+// none of them empty, "." or ".."
+func validatePath(p string) error {
+	if p == "" {
+		return fmt.Errorf("Path cannot be empty")
+	}
+	for _, name := range strings.Split(p, "/") {
+		if name == "" || name == "." || name == ".." {
+			return fmt.Errorf("Invalid path %q: bad name %q", p, name)
+		}
+	}
+	return nil
+}
+
+// splitPath into the directory and the name in it
+func splitPath(p string) (dir, name string) {
+	i := strings.LastIndexByte(p, '/')
+	if i < 0 {
+		return "", p
+	}
+	return p[:i], p[i+1:]
+}
+
+// joinPath of the directory and the name in it
+func joinPath(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	return dir + "/" + name
+}
+
+// mkdirAll makes the directory p and the missing ones above it.
+// Caller holds namespaceLock and journalPublishLock shared.
+func (m *Master) mkdirAll(p string) error {
+	if _, found := m.dirs[p]; found {
+		return nil
+	}
+	if _, found := m.fMap.Load(p); found {
+		return fmt.Errorf("%q is a file", p)
+	}
+
+	dir, name := splitPath(p)
+	if err := m.mkdirAll(dir); err != nil {
+		return err
+	}
+
+	if err := m.journalMkdir(p); err != nil {
+		return err
+	}
+	m.dirs[p] = newDirMeta()
+	m.dirs[dir].setChild(name, true)
+	return nil
+}
+
+// linkFile fname into its directory, which is made if missing.
+// fm is the placeholder of fname in fMap, removed if it cannot be linked.
+func (m *Master) linkFile(fname string, fm *fileMeta) error {
+	m.namespaceLock.Lock()
+	defer m.namespaceLock.Unlock()
+
+	// A rename may have taken the name in the meantime
+	if cur, found := m.fMap.Load(fname); !found || cur.(*fileMeta) != fm {
+		return fmt.Errorf("File %q already exists", fname)
+	}
+
+	if _, found := m.dirs[fname]; found {
+		m.fMap.Delete(fname)
+		return fmt.Errorf("%q is a directory", fname)
+	}
+
+	m.journalPublishLock.RLock()
+	defer m.journalPublishLock.RUnlock()
+
+	dir, name := splitPath(fname)
+	if err := m.mkdirAll(dir); err != nil {
+		m.fMap.Delete(fname)
+		return err
+	}
+	m.dirs[dir].setChild(name, false)
+	return nil
+}
+
+// unlinkFile fname from its directory, caller holds namespaceLock
+func (m *Master) unlinkFile(fname string) {
+	dir, name := splitPath(fname)
+	if d, found := m.dirs[dir]; found {
+		d.removeChild(name)
+	}
+}
+
+// fRmdir removes the directory p, and everything under it if recursive
+func (m *Master) fRmdir(p string, recursive bool) error {
+	m.namespaceLock.Lock()
+	defer m.namespaceLock.Unlock()
+
+	d, found := m.dirs[p]
+	if !found {
+		return fmt.Errorf("Directory %q not found", p)
+	}
+	if p == "" {
+		return fmt.Errorf("Cannot remove the root directory")
+	}
+	if !recursive && len(d.children) > 0 {
+		return fmt.Errorf("Directory %q is not empty", p)
+	}
+
+	var dirs []string
+	var files []*fileMeta
+	var collect func(p string) error
+	collect = func(p string) error {
+		dirs = append(dirs, p)
+		for name, isDir := range m.dirs[p].children {
+			child := joinPath(p, name)
+			if isDir {
+				if err := collect(child); err != nil {
+					return err
+				}
+				continue
+			}
+			fi, found := m.fMap.Load(child)
+			if !found {
+				continue
+			}
+			if fm := fi.(*fileMeta); fm.initialized {
+				files = append(files, fm)
+			} else {
+				return fmt.Errorf("File %q is being created", child)
+			}
+		}
+		return nil
+	}
+	if err := collect(p); err != nil {
+		return err
+	}
+
+	// The removal must be durable before anyone can see it
+	m.journalPublishLock.RLock()
+	defer m.journalPublishLock.RUnlock()
+	if err := m.journalRmdir(p); err != nil {
+		return err
+	}
+
+	for _, fm := range files {
+		m.forgetFile(fm)
+	}
+	for _, dir := range dirs {
+		delete(m.dirs, dir)
+	}
+	dir, name := splitPath(p)
+	m.dirs[dir].removeChild(name)
+	return nil
+}
+
+// fRename moves the file oldName to newName, replacing the file there if overwrite.
+// The blocks stay where they are, only the name changes.
+func (m *Master) fRename(oldName, newName string, overwrite bool) error {
+	// The replicators journal the files by name, keep them out
+	m.replicationLock.Lock()
+	defer m.replicationLock.Unlock()
+
+	m.namespaceLock.Lock()
+	defer m.namespaceLock.Unlock()
+
+	fm, found := m.fLookup(oldName)
+	if !found || !fm.isCommitted() {
+		return fmt.Errorf("File %q not found", oldName)
+	}
+	if oldName == newName {
+		return nil
+	}
+	if _, found := m.dirs[newName]; found {
+		return fmt.Errorf("%q is a directory", newName)
+	}
+
+	var target *fileMeta
+	if fi, found := m.fMap.Load(newName); found {
+		target = fi.(*fileMeta)
+		if !overwrite {
+			return fmt.Errorf("File %q already exists", newName)
+		}
+		if !target.initialized || !target.isCommitted() {
+			return fmt.Errorf("File %q is being created", newName)
+		}
+	} else if _, loaded := m.fMap.LoadOrStore(newName, &fileMeta{}); loaded {
+		// a create got there first, otherwise the name is held for us, invisible until logged
+		return fmt.Errorf("File %q is being created", newName)
+	}
+
+	// No one may log or snapshot fm under either name in between
+	m.journalPublishLock.Lock()
+	defer m.journalPublishLock.Unlock()
+
+	dir, name := splitPath(newName)
+	err := m.mkdirAll(dir)
+	if err == nil {
+		rec := recordFile(fm)
+		rec.Fname = newName
+		err = m.journalRename(oldName, rec)
+	}
+	if err != nil {
+		if target == nil {
+			m.fMap.Delete(newName)
+		}
+		return err
+	}
+
+	if target != nil {
+		m.forgetFile(target)
+	}
+	m.fMap.Store(newName, fm)
+	m.fMap.Delete(oldName)
+	m.unlinkFile(oldName)
+	m.dirs[dir].setChild(name, false)
+	fm.fName = newName
+	return nil
+}
+
+// Mkdir makes a directory and the missing ones above it,
+// no-op if it already exists
+func (m *Master) Mkdir(p string, ignore *bool) error {
+	p = cleanPath(p)
+	if err := validatePath(p); err != nil {
+		m.Logger.Printf("Master.Mkdir(%q) => %q", p, err)
+		return err
+	}
+
+	m.namespaceLock.Lock()
+	m.journalPublishLock.RLock()
+	err := m.mkdirAll(p)
+	m.journalPublishLock.RUnlock()
+	m.namespaceLock.Unlock()
+
+	if err != nil {
+		m.Logger.Printf("Master.Mkdir(%q) => %v", p, err)
+		return err
+	}
+
+	m.Logger.Printf("Master.Mkdir(%q) => success", p)
+	return nil
+}
+
+// ReadDir lists a directory in lexicographical order, "" or "/" is the root.
+// The files being written are not listed.
+func (m *Master) ReadDir(p string, ret *[]structure.DirEntry) error {
+	p = cleanPath(p)
+
+	m.namespaceLock.RLock()
+	d, found := m.dirs[p]
+	if !found {
+		m.namespaceLock.RUnlock()
+		err := fmt.Errorf("Directory %q not found", p)
+		m.Logger.Printf("Master.ReadDir(%q) => %q", p, err)
+		return err
+	}
+
+	entries := make([]structure.DirEntry, 0, len(d.children))
+	for name, isDir := range d.children {
+		if !isDir {
+			if fm, found := m.fLookup(joinPath(p, name)); !found || !fm.isCommitted() {
+				continue
+			}
+		}
+		entries = append(entries, structure.DirEntry{Name: name, IsDir: isDir})
+	}
+	m.namespaceLock.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	*ret = entries
+
+	m.Logger.Printf("Master.ReadDir(%q) => %d entries", p, len(entries))
+	return nil
+}
+
+// Rmdir removes a directory, with everything under it if req.Recursive.
+// The blocks of the files removed are reclaimed in background.
+func (m *Master) Rmdir(req *structure.RmdirReq, ignore *bool) error {
+	p := cleanPath(req.Path)
+	if err := m.fRmdir(p, req.Recursive); err != nil {
+		m.Logger.Printf("Master.Rmdir(%+v) => %v", *req, err)
+		return err
+	}
+
+	m.Logger.Printf("Master.Rmdir(%+v) => success", *req)
+	return nil
+}
+
+// Rename a file, atomically replacing the file named req.New if req.Overwrite.
+// Only the name changes, the blocks are not touched.
+func (m *Master) Rename(req *structure.RenameReq, ignore *bool) error {
+	oldName, newName := cleanPath(req.Old), cleanPath(req.New)
+	if err := validatePath(newName); err != nil {
+		m.Logger.Printf("Master.Rename(%+v) => %q", *req, err)
+		return err
+	}
+
+	if err := m.fRename(oldName, newName, req.Overwrite); err != nil {
+		m.Logger.Printf("Master.Rename(%+v) => %v", *req, err)
+		return err
+	}
+
+	m.Logger.Printf("Master.Rename(%+v) => success", *req)
+	return nil
+}
+
+// List the names of the files with the prefix, one page at a time.
+// The files being written are not listed.
+// A page walks the directory tree from the cursor, never the whole namespace.
+func (m *Master) List(req *structure.ListReq, ret *structure.ListResult) error {
+	limit := req.Limit
+	if limit <= 0 {
+		limit = listDefaultLimit
+	}
+	if limit > listMaxLimit {
+		limit = listMaxLimit
+	}
+
+	// one more to tell if there is a next page
+	m.namespaceLock.RLock()
+	fnames := make([]string, 0, limit+1)
+	m.listDir("", req, limit+1, &fnames)
+	m.namespaceLock.RUnlock()
+
+	*ret = structure.ListResult{Fnames: fnames}
+	if len(fnames) > limit {
+		ret.Fnames = fnames[:limit]
+		ret.NextCursor = fnames[limit-1]
+	}
+
+	m.Logger.Printf("Master.List(%+v) => %d files", *req, len(ret.Fnames))
+	return nil
+}
+
+// listDir appends to fnames, in order, the files under the directory p
+// listed by req, until there are n of them.
+// It returns false once there is nothing more to list after them.
+// Caller holds namespaceLock shared.
+func (m *Master) listDir(p string, req *structure.ListReq, n int, fnames *[]string) bool {
+	base := ""
+	if p != "" {
+		base = p + "/"
+	}
+
+	// the children before the first one from the cursor and the prefix have nothing to list
+	from := req.Prefix
+	if req.Cursor > from {
+		from = req.Cursor
+	}
+	start := 0
+	if strings.HasPrefix(from, base) {
+		first := strings.TrimPrefix(from, base)
+		if i := strings.IndexByte(first, '/'); i >= 0 {
+			first = first[:i]
+		}
+		start = sort.SearchStrings(m.dirs[p].sorted, first)
+	} else if from > base {
+		return true
+	}
+
+	for _, key := range m.dirs[p].sorted[start:] {
+		if len(*fnames) >= n {
+			return false
+		}
+
+		path := base + key
+		if !strings.HasPrefix(path, req.Prefix) && !strings.HasPrefix(req.Prefix, path) {
+			if path > req.Prefix {
+				// past all the names with the prefix
+				return false
+			}
+			continue
+		}
+
+		if strings.HasSuffix(key, "/") {
+			if !m.listDir(strings.TrimSuffix(path, "/"), req, n, fnames) {
+				return false
+			}
+			continue
+		}
+
+		if path <= req.Cursor || !strings.HasPrefix(path, req.Prefix) {
+			continue
+		}
+		if fm, found := m.fLookup(path); found && fm.isCommitted() {
+			*fnames = append(*fnames, path)
+		}
+	}
+	return true
+}
+
+// Stat a file: its metadata without the block locations
+func (m *Master) Stat(fName string, ret *structure.FileStat) error {
+	fName = cleanPath(fName)
+	fm, found := m.fLookup(fName)
+
+	// Check if the file exists, the ones being written do not yet
+	if !found || !fm.isCommitted() {
+		err := fmt.Errorf("File %q not found", fName)
+		m.Logger.Printf("Master.Stat(%q) => %q", fName, err)
+		return err
+	}
+
+	*ret = structure.FileStat{
+		Fname:    fName,
+		Fsize:    fm.fSize,
+		NBlocks:  fm.nBlocks,
+		Rfactor:  fm.rFactor,
+		NReplica: fm.nReplica,
+		Created:  fm.created,
+
+		DataShards:   fm.dataShards,
+		ParityShards: fm.parityShards,
+	}
+
+	// Reading the counter decays it, keep the median in sync
+	m.trafficLock.Lock()
+	if !fm.deleted {
+		prev, temperature := fm.trafficCounter.GetRaw(), fm.trafficCounter.Get()
+		m.trafficMedian.Update(prev, temperature)
+		ret.Temperature = temperature
+	}
+	m.trafficLock.Unlock()
+
+	m.Logger.Printf("Master.Stat(%q) => %+v", fName, *ret)
+	return nil
+}
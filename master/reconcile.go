@@ -0,0 +1,150 @@
+package master
+
+import (
+	"context"
+	"time"
+
+	"github.com/GIFTS-fs/GIFTS/structure"
+)
+
+// reconcile the replicas known to the master with the blocks the storages report:
+//
+// 1. a replica the storage does not have (phantom) is forgotten,
+// unless the file is too young for the client to have written it
+//
+// 2. a block no file refers to (orphan) is deleted from the storage
+//
+// 3. a block of a file the master did not place on the storage (untracked) is only logged
+func (m *Master) reconcile() {
+	m.isReconcilingLock.Lock()
+	if m.isReconciling {
+		// last reconciliation was still running
+		m.isReconcilingLock.Unlock()
+		return
+	}
+	defer func() {
+		defer m.isReconcilingLock.Unlock()
+		m.isReconcilingLock.Lock()
+		m.isReconciling = false
+	}()
+	m.isReconciling = true
+	m.isReconcilingLock.Unlock()
+
+	// Do not race with the balancer and the repair on the replicas
+	m.replicationLock.Lock()
+	defer m.replicationLock.Unlock()
+
+	m.topologyLock.RLock()
+	defer m.topologyLock.RUnlock()
+
+	// The reports go first: a block on a storage was written after its file was published,
+	// so any file referred to by a report is already in fMap below
+	reports := make(map[*storeMeta][]structure.BlockInfo)
+	for _, s := range m.storages {
+		if !s.isAlive() {
+			continue
+		}
+		report, err := s.rpc.BlockReport(context.Background())
+		if err != nil {
+			m.Logger.Printf("reconcile() failed to get the block report of %q: %v", s.Addr, err)
+			continue
+		}
+		reports[s] = report
+	}
+
+	referenced := make(map[string]bool)
+	m.fMap.Range(func(key, value interface{}) bool {
+		if fm := value.(*fileMeta); fm.initialized {
+			for _, fb := range fm.blocks {
+				referenced[fb.BlockID] = true
+			}
+		}
+		return true
+	})
+
+	changed := make(map[*fileMeta]bool)
+	for s, report := range reports {
+		m.reconcileStorage(s, report, referenced, changed)
+	}
+
+	for fm := range changed {
+		if err := m.journalPut(fm); err != nil {
+			m.Logger.Printf("reconcile() failed to journal %q: %v", fm.fName, err)
+		}
+	}
+}
+
+// reconcileStorage s with its report, the files with replicas forgotten are added to changed
+func (m *Master) reconcileStorage(s *storeMeta, report []structure.BlockInfo, referenced map[string]bool, changed map[*fileMeta]bool) {
+	held := make(map[string]bool, len(report))
+	for _, info := range report {
+		held[info.ID] = true
+	}
+
+	s.assignmentLock.Lock()
+	files := make([]*blockFile, 0, len(s.storedFiles))
+	for _, bf := range s.storedFiles {
+		files = append(files, bf)
+	}
+	s.assignmentLock.Unlock()
+
+	grace := time.Second * m.config.MasterReconcileIntervalSec
+	tracked := make(map[string]bool)
+	nPhantom, nOrphan, nUntracked := 0, 0, 0
+
+	for _, bf := range files {
+		fm := bf.fm
+		// the blocks of the files being written may not exist yet
+		young := time.Since(fm.created) < grace || !fm.isCommitted()
+
+		for _, fb := range fm.blocks {
+			if !fb.hasReplica(s) {
+				continue
+			}
+			if held[fb.BlockID] {
+				tracked[fb.BlockID] = true
+				continue
+			}
+			if young {
+				continue
+			}
+
+			m.Logger.Printf("reconcile() found phantom replica of block %q of %q on %q", fb.BlockID, fm.fName, s.Addr)
+			fb.rmReplica(s)
+			m.untrackReplica(fm, fb, s)
+			changed[fm] = true
+			nPhantom++
+		}
+	}
+
+	var orphans []string
+	for _, info := range report {
+		if tracked[info.ID] {
+			continue
+		}
+		if !referenced[info.ID] {
+			m.Logger.Printf("reconcile() found orphan block %q (%d bytes) on %q", info.ID, info.Size, s.Addr)
+			orphans = append(orphans, info.ID)
+			nOrphan++
+		} else {
+			m.Logger.Printf("reconcile() found untracked replica of block %q on %q", info.ID, s.Addr)
+			nUntracked++
+		}
+	}
+
+	// reclaim the space in background
+	if len(orphans) > 0 {
+		go func() {
+			var ignore bool
+			for _, id := range orphans {
+				if err := s.rpc.Unset(context.Background(), id, &ignore); err != nil {
+					m.Logger.Printf("reconcile() failed to unset orphan block %q on %q: %v", id, s.Addr, err)
+				}
+			}
+		}()
+	}
+
+	if nPhantom > 0 || nOrphan > 0 || nUntracked > 0 {
+		m.Logger.Printf("reconcile(%q) => %d phantom, %d orphan, %d untracked", s.Addr, nPhantom, nOrphan, nUntracked)
+	}
+}
@@ -0,0 +1,217 @@
+package master
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/GIFTS-fs/GIFTS/structure"
+)
+
+// nLiveStorage counts the storages considered alive, caller holds topologyLock
+func (m *Master) nLiveStorage() (n int) {
+	for _, s := range m.storages {
+		if s.isAlive() {
+			n++
+		}
+	}
+	return
+}
+
+// repair re-replicates every block that has fewer live replicas than its file wants,
+// copying from a surviving replica to the next storage given by the replica placement policy.
+// Dead replicas are forgotten once the block is fully repaired.
+func (m *Master) repair() {
+	m.repairStatusLock.Lock()
+	if m.repairStatus.Running {
+		// last repair thread was still running
+		m.repairStatusLock.Unlock()
+		return
+	}
+	m.repairStatus = structure.RepairStatus{Running: true, LastStart: time.Now()}
+	m.repairStatusLock.Unlock()
+
+	defer func() {
+		m.repairStatusLock.Lock()
+		defer m.repairStatusLock.Unlock()
+		m.repairStatus.Running = false
+		m.repairStatus.LastFinish = time.Now()
+		m.Logger.Printf("repair() => %+v", m.repairStatus)
+	}()
+
+	// Do not race with the balancer on the replicas
+	m.replicationLock.Lock()
+	defer m.replicationLock.Unlock()
+
+	// The storages must stay the same during a round
+	m.topologyLock.RLock()
+	defer m.topologyLock.RUnlock()
+
+	nLive := m.nLiveStorage()
+
+	m.fMap.Range(func(key interface{}, value interface{}) bool {
+		fm := value.(*fileMeta)
+		// the blocks of the files being written may not exist yet
+		if !fm.initialized || !fm.isCommitted() {
+			return true
+		}
+
+		// cannot have more replicas than live storages
+		want := int(fm.rFactor)
+		if want > nLive {
+			want = nLive
+		}
+
+		changed := false
+		for _, fb := range fm.blocks {
+			if m.repairBlock(fm, fb, want) {
+				changed = true
+			}
+		}
+
+		if changed {
+			if err := m.journalPut(fm); err != nil {
+				m.Logger.Printf("repair() failed to journal %q: %v", fm.fName, err)
+			}
+		}
+		return true
+	})
+}
+
+// repairBlock of fm up to want live replicas, return true if the replicas changed
+func (m *Master) repairBlock(fm *fileMeta, fb *fileBlock, want int) (changed bool) {
+	nLive := 0
+	for _, r := range fb.getReplicas() {
+		if r.isAlive() {
+			nLive++
+		}
+	}
+	if nLive >= want && nLive == fb.nReplicas() {
+		return false
+	}
+
+	if nLive < want {
+		m.updateRepairStatus(func(rs *structure.RepairStatus) { rs.NUnderReplicated++ })
+
+		src, _ := m.pickReplica(fb)
+		if src == nil || !src.isAlive() {
+			m.Logger.Printf("repair() lost block %q of %q: no live replica", fb.BlockID, fm.fName)
+			m.updateRepairStatus(func(rs *structure.RepairStatus) { rs.NLost++ })
+			return false
+		}
+
+		for nLive < want {
+			dst := m.nextFreeReplicaOf(fb)
+			if dst == nil {
+				m.Logger.Printf("repair() found no destination for block %q of %q", fb.BlockID, fm.fName)
+				m.updateRepairStatus(func(rs *structure.RepairStatus) { rs.NFailed++ })
+				return
+			}
+
+			if err := m.replicateEnlistment(&enlistment{blockID: fb.BlockID, fileBlock: fb, src: src, dst: dst}); err != nil {
+				m.Logger.Printf("repair() failed to copy block %q from %q to %q: %v", fb.BlockID, src.Addr, dst.Addr, err)
+				m.updateRepairStatus(func(rs *structure.RepairStatus) { rs.NFailed++ })
+				return
+			}
+
+			fb.addReplica(dst)
+			m.trackReplica(fm, fb, dst)
+			nLive++
+			changed = true
+			m.updateRepairStatus(func(rs *structure.RepairStatus) { rs.NRepaired++ })
+		}
+	}
+
+	// Fully repaired, the dead ones are no longer needed
+	for _, r := range fb.getReplicas() {
+		if !r.isAlive() {
+			fb.rmReplica(r)
+			m.untrackReplica(fm, fb, r)
+			changed = true
+		}
+	}
+	return
+}
+
+func (m *Master) updateRepairStatus(update func(*structure.RepairStatus)) {
+	m.repairStatusLock.Lock()
+	defer m.repairStatusLock.Unlock()
+	update(&m.repairStatus)
+}
+
+// RepairStatus reports the progress of the latest round of re-replication
+func (m *Master) RepairStatus(ignore bool, ret *structure.RepairStatus) error {
+	m.repairStatusLock.Lock()
+	defer m.repairStatusLock.Unlock()
+	*ret = m.repairStatus
+	return nil
+}
+
+// ReportCorrupt is called by a storage or a client that found a corrupt replica.
+// The storage checks the replica again in background; if it is corrupt
+// it is forgotten and repaired from a healthy copy.
+func (m *Master) ReportCorrupt(report *structure.CorruptReport, ignore *bool) error {
+	sm, found := m.sMap.Load(report.Addr)
+	if !found {
+		err := fmt.Errorf("Storage %q not found", report.Addr)
+		m.Logger.Printf("Master.ReportCorrupt(%v) => %q", *report, err)
+		return err
+	}
+
+	go m.dropCorrupt(sm.(*storeMeta), report.BlockID)
+
+	m.Logger.Printf("Master.ReportCorrupt(%v) => success", *report)
+	return nil
+}
+
+// dropCorrupt replica of blockID on s if the storage finds it corrupt, then repair
+func (m *Master) dropCorrupt(s *storeMeta, blockID string) {
+	// A client may be wrong (a bad read on its side), only the storage can tell
+	healthy, err := s.rpc.Verify(context.Background(), blockID)
+	if err != nil {
+		m.Logger.Printf("dropCorrupt(%q, %q) failed to verify: %v", s.Addr, blockID, err)
+		return
+	}
+	if healthy {
+		m.Logger.Printf("dropCorrupt(%q, %q): replica verified healthy, kept", s.Addr, blockID)
+		return
+	}
+
+	m.replicationLock.Lock()
+	m.topologyLock.RLock()
+
+	var fm *fileMeta
+	s.assignmentLock.Lock()
+	for _, bf := range s.storedFiles {
+		if bf.hasBlock(blockID) {
+			fm = bf.fm
+			break
+		}
+	}
+	s.assignmentLock.Unlock()
+
+	if fm != nil {
+		for _, fb := range fm.blocks {
+			if fb.BlockID == blockID {
+				fb.rmReplica(s)
+				m.untrackReplica(fm, fb, s)
+			}
+		}
+		// best effort, the storage has already quarantined it,
+		// and must go before the repair may place it there again
+		var ignore bool
+		s.rpc.Unset(context.Background(), blockID, &ignore)
+		if err := m.journalPut(fm); err != nil {
+			m.Logger.Printf("dropCorrupt() failed to journal %q: %v", fm.fName, err)
+		}
+	}
+
+	m.topologyLock.RUnlock()
+	m.replicationLock.Unlock()
+
+	if fm == nil {
+		m.Logger.Printf("dropCorrupt(%q, %q): no such replica", s.Addr, blockID)
+		return
+	}
+	m.repair()
+}
@@ -2,8 +2,11 @@ package master
 
 import (
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/GIFTS-fs/GIFTS/storage"
+	"github.com/GIFTS-fs/GIFTS/structure"
 )
 
 // blockFile of the file to a storage
@@ -39,15 +42,134 @@ type storeMeta struct {
 	rpc  *storage.RPCStorage
 
 	assignmentLock sync.Mutex
-	nBlocks        int // number of blocks assigned
-	storedFiles    map[string]blockFile
+	nBlocks        int                      // number of blocks assigned
+	storedFiles    map[*fileMeta]*blockFile // by the file, its name may change
+
+	// space in bytes as last reported by the heartbeats, use atomic.
+	// used also grows with the blocks placed since, until the next report
+	capacity int64 // unlimited if 0
+	used     int64
+
+	// set once it starts leaving the cluster, use atomic
+	decommissioning int32
+
+	// liveness, maintained by the heartbeat probes of the master
+	alive        int32 // read on the critical path of Lookup, use atomic
+	livenessLock sync.Mutex
+	lastSeen     time.Time
+	nMissed      int // consecutive missed heartbeats
 }
 
 func newStoreMeta(addr string) *storeMeta {
 	s := &storeMeta{
 		Addr:        addr,
 		rpc:         storage.NewRPCStorage(addr),
-		storedFiles: make(map[string]blockFile),
+		storedFiles: make(map[*fileMeta]*blockFile),
+		alive:       1, // innocent until proven dead
+		lastSeen:    time.Now(),
 	}
 	return s
 }
+
+// isDecommissioning if the storage is leaving the cluster
+func (s *storeMeta) isDecommissioning() bool {
+	return atomic.LoadInt32(&s.decommissioning) == 1
+}
+
+func (s *storeMeta) setDecommissioning() {
+	atomic.StoreInt32(&s.decommissioning, 1)
+}
+
+// isAlive to the best knowledge of the master
+func (s *storeMeta) isAlive() bool {
+	return atomic.LoadInt32(&s.alive) == 1
+}
+
+// heartbeat marks the storage alive, return true if it was considered dead
+func (s *storeMeta) heartbeat() (revived bool) {
+	s.livenessLock.Lock()
+	defer s.livenessLock.Unlock()
+
+	s.lastSeen = time.Now()
+	s.nMissed = 0
+	return atomic.SwapInt32(&s.alive, 1) == 0
+}
+
+// missHeartbeat marks the storage dead after maxMissed consecutive misses,
+// return true if it was considered alive
+func (s *storeMeta) missHeartbeat(maxMissed int) (died bool) {
+	s.livenessLock.Lock()
+	defer s.livenessLock.Unlock()
+
+	s.nMissed++
+	if s.nMissed < maxMissed {
+		return false
+	}
+	return atomic.SwapInt32(&s.alive, 0) == 1
+}
+
+// reportSpace of the storage, from its heartbeat
+func (s *storeMeta) reportSpace(stat *structure.StorageStat) {
+	atomic.StoreInt64(&s.capacity, stat.Capacity)
+	atomic.StoreInt64(&s.used, stat.Used)
+}
+
+// placeBytes accounts n more bytes placed on the storage before its next report
+func (s *storeMeta) placeBytes(n int) {
+	atomic.AddInt64(&s.used, int64(n))
+}
+
+// space used and the capacity of the storage, to the best knowledge of the master
+func (s *storeMeta) space() (used, capacity int64) {
+	return atomic.LoadInt64(&s.used), atomic.LoadInt64(&s.capacity)
+}
+
+// blockCount number of blocks assigned to the storage
+func (s *storeMeta) blockCount() int {
+	s.assignmentLock.Lock()
+	defer s.assignmentLock.Unlock()
+	return s.nBlocks
+}
+
+// addBlock records that the storage is assigned blockID of file fm
+func (s *storeMeta) addBlock(fm *fileMeta, blockID string) {
+	s.assignmentLock.Lock()
+	defer s.assignmentLock.Unlock()
+
+	bf, ok := s.storedFiles[fm]
+	if !ok {
+		bf = newBlockFile(fm)
+		s.storedFiles[fm] = bf
+	}
+	if !bf.hasBlock(blockID) {
+		bf.addBlock(blockID)
+		s.nBlocks++
+	}
+}
+
+// rmBlock records that the storage no longer has blockID of file fm
+func (s *storeMeta) rmBlock(fm *fileMeta, blockID string) {
+	s.assignmentLock.Lock()
+	defer s.assignmentLock.Unlock()
+
+	bf, ok := s.storedFiles[fm]
+	if !ok || !bf.hasBlock(blockID) {
+		return
+	}
+	bf.rmBlock(blockID)
+	s.nBlocks--
+	if bf.nBlocks() == 0 {
+		delete(s.storedFiles, fm)
+	}
+}
+
+// rmFile records that the storage no longer has any block of file fm
+func (s *storeMeta) rmFile(fm *fileMeta) {
+	s.assignmentLock.Lock()
+	defer s.assignmentLock.Unlock()
+
+	if bf, ok := s.storedFiles[fm]; ok {
+		s.nBlocks -= bf.nBlocks()
+		delete(s.storedFiles, fm)
+	}
+}
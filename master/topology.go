@@ -0,0 +1,293 @@
+package master
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/GIFTS-fs/GIFTS/policy"
+	"github.com/GIFTS-fs/GIFTS/structure"
+)
+
+// rebuildTopology rebuilds the placement tables after m.storages changed,
+// caller holds topologyLock
+func (m *Master) rebuildTopology() {
+	m.nStorage = len(m.storages)
+
+	names := make([]string, m.nStorage)
+	for i, s := range m.storages {
+		names[i] = s.Addr
+	}
+
+	if m.config.BlockPlacementPolicy == policy.BlockPlacementPolicyPermutation {
+		m.populateLookupTable(names)
+	}
+	if m.config.ReplicaPlacementPolicy == policy.ReplicaPlacementPolicyPermutation {
+		m.buildReplicaPermuTable()
+	}
+
+	m.createHandLock.Lock()
+	defer m.createHandLock.Unlock()
+	if m.nStorage > 0 {
+		m.createHandRR %= m.nStorage
+		m.createHandPermu %= m.nStorage
+	} else {
+		m.createHandRR, m.createHandPermu = 0, 0
+	}
+}
+
+// addStorage to the placement tables, caller holds topologyLock
+func (m *Master) addStorage(addr string) *storeMeta {
+	s := newStoreMeta(addr)
+	m.sMap.Store(addr, s)
+	m.storages = append(m.storages, s)
+	m.rebuildTopology()
+	return s
+}
+
+// dropStorage from the placement tables, it stays in sMap, caller holds topologyLock
+func (m *Master) dropStorage(addr string) (s *storeMeta, found bool) {
+	for i := range m.storages {
+		if m.storages[i].Addr == addr {
+			s, found = m.storages[i], true
+			m.storages = append(m.storages[:i:i], m.storages[i+1:]...)
+			break
+		}
+	}
+	if found {
+		m.rebuildTopology()
+	}
+	return
+}
+
+func (m *Master) setMembership(addr string, member bool) {
+	m.membershipLock.Lock()
+	defer m.membershipLock.Unlock()
+	m.membership[addr] = member
+}
+
+// copyMembership for the snapshot
+func (m *Master) copyMembership() map[string]bool {
+	m.membershipLock.Lock()
+	defer m.membershipLock.Unlock()
+
+	ret := make(map[string]bool, len(m.membership))
+	for addr, member := range m.membership {
+		ret[addr] = member
+	}
+	return ret
+}
+
+// RegisterStorage adds a storage to a running cluster,
+// it starts empty and receives new blocks and replicas right away
+func (m *Master) RegisterStorage(addr string, ignore *bool) error {
+	if addr == "" {
+		err := fmt.Errorf("Storage address cannot be empty")
+		m.Logger.Printf("Master.RegisterStorage(%q) => %q", addr, err)
+		return err
+	}
+
+	m.journalPublishLock.RLock()
+	defer m.journalPublishLock.RUnlock()
+
+	m.topologyLock.Lock()
+	defer m.topologyLock.Unlock()
+
+	if sm, found := m.sMap.Load(addr); found {
+		err := fmt.Errorf("Storage %q already registered", addr)
+		if sm.(*storeMeta).isDecommissioning() {
+			err = fmt.Errorf("Storage %q is being decommissioned", addr)
+		}
+		m.Logger.Printf("Master.RegisterStorage(%q) => %q", addr, err)
+		return err
+	}
+
+	if err := m.journalStorage(addr, true); err != nil {
+		m.Logger.Printf("Master.RegisterStorage(%q) => %v", addr, err)
+		return err
+	}
+	m.setMembership(addr, true)
+	m.addStorage(addr)
+
+	m.Logger.Printf("Master.RegisterStorage(%q) => success", addr)
+	return nil
+}
+
+// DecommissionStorage removes a storage from a running cluster.
+// No new block goes to it once called,
+// then every block on it is migrated to other storages in background,
+// see DecommissionStatus for the progress.
+// If the migration fails, it can be called again to retry.
+func (m *Master) DecommissionStorage(addr string, ignore *bool) error {
+	sm, found := m.sMap.Load(addr)
+	if !found {
+		err := fmt.Errorf("Storage %q not found", addr)
+		m.Logger.Printf("Master.DecommissionStorage(%q) => %q", addr, err)
+		return err
+	}
+	s := sm.(*storeMeta)
+
+	if !m.startDecommission(addr, s.blockCount()) {
+		err := fmt.Errorf("Storage %q is being decommissioned", addr)
+		m.Logger.Printf("Master.DecommissionStorage(%q) => %q", addr, err)
+		return err
+	}
+
+	// Step 1: stop placing anything new to it,
+	// the files being created on it are tracked once we get the lock
+	m.journalPublishLock.Lock()
+	m.topologyLock.Lock()
+	s.setDecommissioning()
+	m.dropStorage(addr)
+	m.topologyLock.Unlock()
+	m.journalPublishLock.Unlock()
+
+	// Step 2 and 3 take as long as copying all its blocks
+	go m.decommission(s)
+
+	m.Logger.Printf("Master.DecommissionStorage(%q) => started", addr)
+	return nil
+}
+
+// decommission s, which is no longer in the placement tables:
+// move everything away, then forget it
+func (m *Master) decommission(s *storeMeta) {
+	// Step 2: move everything away
+	err := m.migrateAway(s)
+
+	// Step 3: forget it
+	if err == nil {
+		m.journalPublishLock.RLock()
+		if err = m.journalStorage(s.Addr, false); err == nil {
+			m.setMembership(s.Addr, false)
+			m.sMap.Delete(s.Addr)
+		}
+		m.journalPublishLock.RUnlock()
+	}
+
+	m.decommissionLock.Lock()
+	defer m.decommissionLock.Unlock()
+	ds := m.decommissions[s.Addr]
+	ds.Running = false
+	ds.Done = err == nil
+	ds.LastFinish = time.Now()
+	if err != nil {
+		ds.Err = err.Error()
+	}
+	m.Logger.Printf("decommission(%q) => %+v", s.Addr, *ds)
+}
+
+// startDecommission of addr with nBlocks on it, false if one is already running
+func (m *Master) startDecommission(addr string, nBlocks int) bool {
+	m.decommissionLock.Lock()
+	defer m.decommissionLock.Unlock()
+
+	if ds, found := m.decommissions[addr]; found && ds.Running {
+		return false
+	}
+	m.decommissions[addr] = &structure.DecommissionStatus{Running: true, LastStart: time.Now(), NBlocks: nBlocks}
+	return true
+}
+
+func (m *Master) updateDecommissionStatus(addr string, update func(*structure.DecommissionStatus)) {
+	m.decommissionLock.Lock()
+	defer m.decommissionLock.Unlock()
+	update(m.decommissions[addr])
+}
+
+// DecommissionStatus reports the progress of the latest decommission of the storage at addr
+func (m *Master) DecommissionStatus(addr string, ret *structure.DecommissionStatus) error {
+	m.decommissionLock.Lock()
+	defer m.decommissionLock.Unlock()
+
+	ds, found := m.decommissions[addr]
+	if !found {
+		err := fmt.Errorf("Storage %q was never decommissioned", addr)
+		m.Logger.Printf("Master.DecommissionStatus(%q) => %q", addr, err)
+		return err
+	}
+	*ret = *ds
+	return nil
+}
+
+// migrateAway every block on s, which is no longer in the placement tables
+func (m *Master) migrateAway(s *storeMeta) error {
+	// Do not race with the balancer and the repair on the replicas
+	m.replicationLock.Lock()
+	defer m.replicationLock.Unlock()
+
+	m.topologyLock.RLock()
+	defer m.topologyLock.RUnlock()
+
+	s.assignmentLock.Lock()
+	files := make([]*blockFile, 0, len(s.storedFiles))
+	for _, bf := range s.storedFiles {
+		files = append(files, bf)
+	}
+	s.assignmentLock.Unlock()
+
+	var failed error
+	for _, bf := range files {
+		fm := bf.fm
+		changed := false
+
+		for _, fb := range fm.blocks {
+			if !fb.hasReplica(s) {
+				continue
+			}
+
+			if err := m.migrateBlock(fm, fb, s); err != nil {
+				m.Logger.Printf("migrateAway(%q) failed to move block %q of %q: %v", s.Addr, fb.BlockID, fm.fName, err)
+				m.updateDecommissionStatus(s.Addr, func(ds *structure.DecommissionStatus) { ds.NFailed++ })
+				failed = err
+				continue
+			}
+			m.updateDecommissionStatus(s.Addr, func(ds *structure.DecommissionStatus) { ds.NMigrated++ })
+			changed = true
+		}
+
+		if changed {
+			if err := m.journalPut(fm); err != nil {
+				m.Logger.Printf("migrateAway(%q) failed to journal %q: %v", s.Addr, fm.fName, err)
+				failed = err
+			}
+		}
+	}
+
+	return failed
+}
+
+// migrateBlock fb of fm from s to the next storage given by the replica placement policy
+func (m *Master) migrateBlock(fm *fileMeta, fb *fileBlock, s *storeMeta) error {
+	dst := m.nextFreeReplicaOf(fb)
+
+	if dst == nil {
+		// nowhere to go, fine as long as the block survives elsewhere
+		for _, r := range fb.getReplicas() {
+			if r != s && r.isAlive() {
+				fb.rmReplica(s)
+				m.untrackReplica(fm, fb, s)
+				return nil
+			}
+		}
+		return fmt.Errorf("no storage to take the last replica")
+	}
+
+	// prefer copying from the others, the leaving one may be busy or dead
+	src := s
+	for _, r := range fb.getReplicas() {
+		if r != s && r.isAlive() {
+			src = r
+			break
+		}
+	}
+
+	if err := m.replicateEnlistment(&enlistment{blockID: fb.BlockID, fileBlock: fb, src: src, dst: dst}); err != nil {
+		return err
+	}
+
+	fb.addReplica(dst)
+	m.trackReplica(fm, fb, dst)
+	fb.rmReplica(s)
+	m.untrackReplica(fm, fb, s)
+	return nil
+}
@@ -11,6 +11,9 @@ const (
 	BlockPlacementPolicyNull BlockPlacementPolicy = iota
 	BlockPlacementPolicyRR
 	BlockPlacementPolicyPermutation
+	// BlockPlacementPolicyCapacity places blocks and new replicas on the least full storages,
+	// by the capacity and usage they report to the heartbeats
+	BlockPlacementPolicyCapacity
 )
 
 // ReplicaPlacementPolicy
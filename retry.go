@@ -0,0 +1,121 @@
+package gifts
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// DefaultRetryPolicy of the RPCClients,
+// replace it before creating them to configure it
+var DefaultRetryPolicy = RetryPolicy{MaxAttempts: 2}
+
+// RetryPolicy tells how many times, and how far apart, a failed call is tried again.
+// Only the retryable errors are, see IsRetryable,
+// and only for the idempotent methods unless the request never left, see RegisterIdempotent.
+type RetryPolicy struct {
+	MaxAttempts int           // in total, 2 if not positive: a broken connection always deserves another one
+	BaseBackoff time.Duration // before the first retry, doubled before each next one, no wait if 0
+	MaxBackoff  time.Duration // upper bound of the backoff, none if 0
+	Jitter      float64       // fraction of each backoff drawn at random, so the callers do not retry in lockstep
+}
+
+// Do f until it succeeds, fails for good, or runs out of attempts,
+// waiting the backoff between two attempts.
+// The error of the last attempt is returned, or that of ctx if it is done while waiting.
+func (r RetryPolicy) Do(ctx context.Context, f func() error) error {
+	return r.DoIf(ctx, IsRetryable, f)
+}
+
+// DoIf is Do with the errors to retry told by retryable
+func (r RetryPolicy) DoIf(ctx context.Context, retryable func(error) bool, f func() error) (err error) {
+	maxAttempts := r.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = 2
+	}
+
+	for attempt := 1; ; attempt++ {
+		if err = f(); !retryable(err) || attempt >= maxAttempts {
+			return
+		}
+
+		if backoff := r.Backoff(attempt); backoff > 0 {
+			timer := time.NewTimer(backoff)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// Backoff before the retry following the attempt (from 1)
+func (r RetryPolicy) Backoff(attempt int) time.Duration {
+	backoff := r.BaseBackoff
+	for i := 1; i < attempt && (r.MaxBackoff <= 0 || backoff < r.MaxBackoff); i++ {
+		backoff *= 2
+	}
+	if r.MaxBackoff > 0 && backoff > r.MaxBackoff {
+		backoff = r.MaxBackoff
+	}
+	if r.Jitter > 0 {
+		backoff -= time.Duration(r.Jitter * rand.Float64() * float64(backoff))
+	}
+	return backoff
+}
+
+// IsRetryable tells if the call failing with err may succeed if made again.
+// Only the failures to reach the server are: an error returned by the server
+// (e.g. "File already exists") would be returned again,
+// so would a streamed payload that could not be read,
+// and a call given up or out of time is not to be prolonged.
+func IsRetryable(err error) bool {
+	if err == nil || isContextError(err) {
+		return false
+	}
+	var serverErr rpc.ServerError
+	var payloadErr payloadError
+	return !errors.As(err, &serverErr) && !errors.As(err, &payloadErr)
+}
+
+// notSentError is a call that failed before its request left, such as a failed dial.
+// The server never saw it, so it can be sent again whatever the method.
+type notSentError struct {
+	error
+}
+
+func (e notSentError) Unwrap() error {
+	return e.error
+}
+
+// IsNotSent tells if the call failing with err never reached the server and may succeed if made again
+func IsNotSent(err error) bool {
+	var notSent notSentError
+	return IsRetryable(err) && errors.As(err, &notSent)
+}
+
+// idempotentMethods are the RPC methods registered by RegisterIdempotent, method -> true
+var idempotentMethods sync.Map
+
+// RegisterIdempotent methods, which have the same effect whether the server runs them once or twice.
+// A call of theirs that may have reached the server is retried,
+// the others are only once known not to have reached it:
+// a reply lost after e.g. a Create ran would fail the retry with "File already exists".
+func RegisterIdempotent(methods ...string) {
+	for _, method := range methods {
+		idempotentMethods.Store(method, true)
+	}
+}
+
+// retryableFor the calls of method, see RegisterIdempotent
+func retryableFor(method string) func(error) bool {
+	if _, idempotent := idempotentMethods.Load(method); idempotent {
+		return IsRetryable
+	}
+	return IsNotSent
+}
@@ -1,79 +1,527 @@
 package gifts
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"net/rpc"
+	"sync"
+	"time"
 )
 
-// RPCCall is the ingredient of a Request
-type RPCCall func(*rpc.Client) error
+// Transport carries the calls to a server, whatever the protocol on the wire.
+// The RPCClient is the one of GIFTS.
+type Transport interface {
+	// Call the method of the server, see RPCClient.Call
+	Call(ctx context.Context, method string, args, reply interface{}) error
+}
+
+// Protocol on the wire of the connections of an RPCPool.
+// The servers speak all of them on the same address.
+type Protocol int
+
+const (
+	// ProtocolGob is net/rpc over HTTP, gob encoded
+	ProtocolGob Protocol = iota
+	// ProtocolFramed sends the blocks raw in binary frames, see framed.go
+	ProtocolFramed
+)
 
 // RPCClient is the client for RPC Calls that
 // delays the connecting until first request,
-// caches the connection,
-// and automatically reconnects after failure.
+// shares the connections of its pool,
+// and automatically reconnects after failure, as its retry policy says.
 // user of RPCClient can have guaranteed connection
 // as long as the server at addr is alive
-// without worrying about the liveness of the underneath connection
+// without worrying about the liveness of the underneath connection.
+// It is safe for concurrent use.
 type RPCClient struct {
-	// logger *Logger
-	addr string
-	path string
-	conn *rpc.Client // will connect on first call
+	addr  string
+	path  string
+	pool  *RPCPool
+	retry RetryPolicy
 }
 
-// NewRPCClient constructor for RPCFactory
+// NewRPCClient constructor for RPCClient, on the DefaultRPCPool
 func NewRPCClient(addr string, path string) *RPCClient {
-	// return &RPCClient{logger: NewLogger("RPCClient", addr, false), addr: addr, path: path}
-	return &RPCClient{addr: addr, path: path}
+	return DefaultRPCPool.NewClient(addr, path)
+}
+
+// try again while the server cannot be reached, a new connection may do better
+func (f *RPCClient) callRPC(ctx context.Context, method string, args, reply interface{}) error {
+	return f.retry.DoIf(ctx, retryableFor(method), func() error {
+		return f.pool.call(ctx, f.addr, f.path, method, args, reply)
+	})
+}
+
+// Call the RPC method of the server, until ctx is done
+// or the call timeout of the pool expires, whichever comes first.
+// The call timeout bounds each attempt, and one running out of it is not tried again:
+// the server may still be at work on it.
+// reply must not be used if an error is returned,
+// the server may still write it after the call is given up.
+// Example usage: Call(ctx, "RPCMethod", arg, &ret)
+func (f *RPCClient) Call(ctx context.Context, method string, args, reply interface{}) error {
+	return f.callRPC(ctx, method, args, reply)
 }
 
-func (f *RPCClient) callRPCUnit(call RPCCall) (dialErr, callErr error) {
-	if dialErr = f.Dial(); dialErr != nil {
-		// f.logger.Printf("Dial error: %v", dialErr.Error())
+// isConnError tells if err broke the connection, rather than being returned by the server.
+// A call given up by the caller or out of time leaves the connection as it was,
+// the other calls on it go on: only a failed read or write,
+// or a failed health check, tells the connection is dead.
+func isConnError(err error) bool {
+	if err == nil || isContextError(err) {
+		return false
+	}
+	_, fromServer := err.(rpc.ServerError)
+	return !fromServer
+}
+
+// isContextError tells if err is the context of the call being done
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// dialHTTPPath is rpc.DialHTTPPath until ctx is done
+func dialHTTPPath(ctx context.Context, addr, path string, tlsConfig *tls.Config) (*rpc.Client, error) {
+	// the deadline holds for the handshakes too
+	conn, err := dialTCP(ctx, addr, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	io.WriteString(conn, "CONNECT "+path+" HTTP/1.0\n\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.Status != "200 Connected to Go RPC" {
+		err = fmt.Errorf("unexpected HTTP response: %s", resp.Status)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, &net.OpError{Op: "dial-http", Net: "tcp " + addr, Addr: nil, Err: err}
+	}
+	conn.SetDeadline(time.Time{})
+	encBuf := bufio.NewWriter(conn)
+	return rpc.NewClientWithCodec(&gobClientCodec{conn, gob.NewDecoder(conn), gob.NewEncoder(encBuf), encBuf}), nil
+}
+
+// gobClientCodec is the one of net/rpc, that reads the streamed payloads whole first
+type gobClientCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+}
+
+func (c *gobClientCodec) WriteRequest(r *rpc.Request, body interface{}) (err error) {
+	if s, ok := body.(PayloadStreamer); ok {
+		if body, err = readPayload(s); err != nil {
+			return
+		}
+	}
+	if err = c.enc.Encode(r); err != nil {
+		return
+	}
+	if err = c.enc.Encode(body); err != nil {
 		return
 	}
+	return c.encBuf.Flush()
+}
 
-	if callErr = call(f.conn); callErr != nil {
-		// f.logger.Printf("call error: %v", callErr.Error())
-		f.Close()
+func (c *gobClientCodec) ReadResponseHeader(r *rpc.Response) error {
+	return c.dec.Decode(r)
+}
+
+func (c *gobClientCodec) ReadResponseBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *gobClientCodec) Close() error {
+	return c.rwc.Close()
+}
+
+// dial the peer in the protocol, over TLS if tlsConfig is not nil
+func dial(ctx context.Context, protocol Protocol, addr, path string, tlsConfig *tls.Config) (*rpc.Client, error) {
+	switch protocol {
+	case ProtocolGob:
+		return dialHTTPPath(ctx, addr, path, tlsConfig)
+	case ProtocolFramed:
+		return dialFramed(ctx, addr, path, tlsConfig)
 	}
-	return
+	return nil, fmt.Errorf("unknown protocol %d", protocol)
+}
+
+// HandshakeTimeout bounds the handshakes of the connections served by ServeRPC,
+// until the protocol and the path are known,
+// replace it before serving to configure it
+var HandshakeTimeout = 10 * time.Second
+
+// ServeRPC the server at path to the clients of every protocol on l, until l fails.
+// The protocol of a connection is told by its first bytes,
+// after the TLS handshake if l is a TLS listener.
+func ServeRPC(l net.Listener, path string, server *rpc.Server) error {
+	httpListener := &connListener{addr: l.Addr(), conns: make(chan net.Conn), done: make(chan bool)}
+	defer httpListener.Close()
+	mux := http.NewServeMux()
+	mux.Handle(path, server)
+	go http.Serve(httpListener, mux)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		go func(conn net.Conn) {
+			// a client that never says a word must not hold the connection,
+			// the deadline holds for the TLS handshake too
+			conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+			r := bufio.NewReader(conn)
+			magic, err := r.Peek(len(framedMagic))
+			if err != nil {
+				conn.Close()
+				return
+			}
+			if string(magic) == string(framedMagic) {
+				r.Discard(len(framedMagic))
+				serveFramed(server, path, conn, r)
+				return
+			}
+			conn.SetDeadline(time.Time{})
+			// what was peeked is still to be read by HTTP
+			if !httpListener.push(&peekedConn{Conn: conn, r: r}) {
+				conn.Close()
+			}
+		}(conn)
+	}
+}
+
+// peekedConn is a connection some bytes of which have been read into r
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// connListener hands the connections pushed to it to the server accepting them
+type connListener struct {
+	addr      net.Addr
+	conns     chan net.Conn
+	done      chan bool
+	closeOnce sync.Once
+}
+
+func (l *connListener) push(conn net.Conn) bool {
+	select {
+	case l.conns <- conn:
+		return true
+	case <-l.done:
+		return false
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, fmt.Errorf("listener of %v closed", l.addr)
+	}
+}
+
+func (l *connListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
+
+// DefaultRPCPool is shared by all RPCClients of the process,
+// replace it before creating them to configure it
+var DefaultRPCPool = NewRPCPool(1, 0, 0, ProtocolGob, nil)
+
+// RPCPool keeps the RPC connections to every peer (address and path),
+// at most connsPerPeer each, used in turns.
+// A net/rpc connection carries any number of concurrent calls,
+// more connections only spread the load.
+// A connection is dropped as soon as a call on it fails to be read or written,
+// once it fails a health check, see CheckHealth, and after idleTimeout without any call.
+// A call that runs out of time is given up alone, the connection is shared.
+// It is safe for concurrent use.
+type RPCPool struct {
+	protocol     Protocol
+	tlsConfig    *tls.Config // plain TCP if nil
+	connsPerPeer int
+	idleTimeout  time.Duration // never if 0
+	callTimeout  time.Duration // no deadline if 0
+
+	lock  sync.Mutex
+	peers map[string]*rpcPeer // by path@addr
+
+	done chan bool
+}
+
+type rpcPeer struct {
+	conns []*pooledConn // nil if not connected
+	next  int           // the one to use next
+}
+
+type pooledConn struct {
+	client   *rpc.Client
+	inflight int
+	lastUsed time.Time
+}
+
+// NewRPCPool with at most connsPerPeer connections to each peer (1 if not positive),
+// closed after idleTimeout without any call, never if 0.
+// Every call, the dial included, is given up after callTimeout, no deadline if 0.
+// The connections are dialed in protocol, over TLS if tlsConfig is not nil.
+func NewRPCPool(connsPerPeer int, idleTimeout, callTimeout time.Duration, protocol Protocol, tlsConfig *tls.Config) *RPCPool {
+	if connsPerPeer <= 0 {
+		connsPerPeer = 1
+	}
+	p := &RPCPool{
+		protocol:     protocol,
+		tlsConfig:    tlsConfig,
+		connsPerPeer: connsPerPeer,
+		idleTimeout:  idleTimeout,
+		callTimeout:  callTimeout,
+		peers:        make(map[string]*rpcPeer),
+		done:         make(chan bool),
+	}
+	if idleTimeout > 0 {
+		go p.evictIdle()
+	}
+	return p
+}
+
+// NewClient for RPC Calls to the peer on the connections of the pool,
+// with the DefaultRetryPolicy
+func (p *RPCPool) NewClient(addr string, path string) *RPCClient {
+	return &RPCClient{addr: addr, path: path, pool: p, retry: DefaultRetryPolicy}
 }
 
-// try twice, in case failed but recovered
-func (f *RPCClient) callRPC(call RPCCall) (err error) {
-	var dialErr error
-	if dialErr, err = f.callRPCUnit(call); dialErr != nil {
-		_, err = f.callRPCUnit(call)
+// call the method on a connection to the peer, dialed if needed
+func (p *RPCPool) call(ctx context.Context, addr, path, method string, args, reply interface{}) (err error) {
+	if p.callTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.callTimeout)
+		defer cancel()
 	}
+
+	peer, i, pc, err := p.get(ctx, addr, path)
+	if err != nil {
+		return notSentError{err}
+	}
+
+	call := pc.client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		err = call.Error
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	p.put(peer, i, pc, err)
 	return
 }
 
-// Dial the server: Dial if not connected
-func (f *RPCClient) Dial() (err error) {
-	if f.conn == nil {
-		// WARN: no concurrent control for performance concern
-		f.conn, err = rpc.DialHTTPPath("tcp", f.addr, f.path)
+// get the next connection to the peer, in use until put back
+func (p *RPCPool) get(ctx context.Context, addr, path string) (peer *rpcPeer, i int, pc *pooledConn, err error) {
+	key := path + "@" + addr
+
+	p.lock.Lock()
+	peer, found := p.peers[key]
+	if !found {
+		peer = &rpcPeer{conns: make([]*pooledConn, p.connsPerPeer)}
+		p.peers[key] = peer
+	}
+	i, peer.next = peer.next, (peer.next+1)%len(peer.conns)
+	if pc = peer.conns[i]; pc != nil {
+		pc.inflight++
+		p.lock.Unlock()
+		return
+	}
+	p.lock.Unlock()
+
+	// Not under the lock, the other peers must not wait for this one
+	client, err := dial(ctx, p.protocol, addr, path, p.tlsConfig)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if pc = peer.conns[i]; pc != nil {
+		// dialed concurrently, keep the first one
+		client.Close()
+	} else {
+		pc = &pooledConn{client: client}
+		peer.conns[i] = pc
 	}
+	pc.inflight++
 	return
 }
 
-// Close the RPC connection
-func (f *RPCClient) Close() (err error) {
-	if f.conn != nil {
-		var c *rpc.Client
-		// WARN: no concurrenct control for performance concern
-		c, f.conn = f.conn, nil
-		// since no concurrency control, c might be nil
-		if c != nil {
-			err = c.Close()
+// put the connection back after a call, dropped if the call broke it
+func (p *RPCPool) put(peer *rpcPeer, i int, pc *pooledConn, callErr error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	pc.inflight--
+	pc.lastUsed = time.Now()
+	// only the first to see it broken closes it
+	if isConnError(callErr) && peer.conns[i] == pc {
+		peer.conns[i] = nil
+		pc.client.Close()
+	}
+}
+
+// evictIdle closes the connections without any call for idleTimeout, until Close
+func (p *RPCPool) evictIdle() {
+	ticker := time.NewTicker(p.idleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case now := <-ticker.C:
+			p.lock.Lock()
+			for _, peer := range p.peers {
+				for i, pc := range peer.conns {
+					if pc != nil && pc.inflight == 0 && now.Sub(pc.lastUsed) >= p.idleTimeout {
+						peer.conns[i] = nil
+						pc.client.Close()
+					}
+				}
+			}
+			p.lock.Unlock()
+		}
+	}
+}
+
+// healthCheckMethod is served by no server, the error it gets back proves the connection alive
+const healthCheckMethod = "GIFTS.HealthCheck"
+
+// CheckHealth of the idle connections every interval, until Close, never if 0.
+// One without any call for interval is sent a probe, and dropped unless its server answers within interval,
+// so the next call dials a new one instead of failing on a connection long dead.
+// It is called once, before the pool is used.
+func (p *RPCPool) CheckHealth(interval time.Duration) {
+	if interval > 0 {
+		go p.checkHealth(interval)
+	}
+}
+
+func (p *RPCPool) checkHealth(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	type idleConn struct {
+		peer *rpcPeer
+		i    int
+		pc   *pooledConn
+	}
+	for {
+		select {
+		case <-p.done:
+			return
+		case now := <-ticker.C:
+			// in use while probed, not evicted under it
+			var idle []idleConn
+			p.lock.Lock()
+			for _, peer := range p.peers {
+				for i, pc := range peer.conns {
+					if pc != nil && pc.inflight == 0 && now.Sub(pc.lastUsed) >= interval {
+						pc.inflight++
+						idle = append(idle, idleConn{peer, i, pc})
+					}
+				}
+			}
+			p.lock.Unlock()
+
+			var wg sync.WaitGroup
+			for _, c := range idle {
+				wg.Add(1)
+				go func(c idleConn) {
+					defer wg.Done()
+					alive := probe(c.pc.client, interval)
+
+					p.lock.Lock()
+					defer p.lock.Unlock()
+					// the probe is no use of it, the idle time goes on
+					c.pc.inflight--
+					if !alive && c.peer.conns[c.i] == c.pc {
+						c.peer.conns[c.i] = nil
+						c.pc.client.Close()
+					}
+				}(c)
+			}
+			wg.Wait()
+		}
+	}
+}
+
+// probe the connection of client, alive if its server answers within timeout
+func probe(client *rpc.Client, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	call := client.Go(healthCheckMethod, true, nil, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return !isConnError(call.Error)
+	case <-timer.C:
+		return false
+	}
+}
+
+// NConns number of open connections to the peer
+func (p *RPCPool) NConns(addr, path string) (n int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if peer, found := p.peers[path+"@"+addr]; found {
+		for _, pc := range peer.conns {
+			if pc != nil {
+				n++
+			}
 		}
 	}
 	return
 }
 
-// Call the RPCCall.
-// Example usage: Call(func(r *rpc.Client) error {return r.Call("RPCMethod", arg, ret)})
-func (f *RPCClient) Call(call RPCCall) error {
-	return f.callRPC(call)
+// Close all the connections of the pool, it must not be used after
+func (p *RPCPool) Close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	select {
+	case <-p.done:
+		return
+	default:
+		close(p.done)
+	}
+	for key, peer := range p.peers {
+		for _, pc := range peer.conns {
+			if pc != nil {
+				pc.client.Close()
+			}
+		}
+		delete(p.peers, key)
+	}
 }
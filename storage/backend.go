@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	gifts "github.com/GIFTS-fs/GIFTS"
+)
+
+// Backend is where a Storage actually keeps its blocks.
+// All implementations must be concurrency-safe.
+type Backend interface {
+	// Load the block with the ID, found=false if not exist
+	Load(id string) (block gifts.Block, found bool)
+	// LoadRange loads at most length bytes of the block with the ID starting at offset,
+	// shorter if the block ends before, found=false if not exist
+	LoadRange(id string, offset, length int) (data []byte, found bool)
+	// Open the block with the ID to read it of size bytes without loading it, found=false if not exist.
+	// What is read is the block when opened, even if it is replaced or deleted after
+	Open(id string) (data io.ReadCloser, size int, found bool)
+	// Has tells if the block with the ID exists, without loading it
+	Has(id string) bool
+	// Store the block with the ID and its checksum in one go, overwrite if already exists.
+	// No checksum is kept if empty, the one of the old block is dropped all the same
+	Store(id string, block gifts.Block, checksum string) error
+	// Delete the block with the ID (and its checksum), no-op if not exist
+	Delete(id string) error
+	// Range calls f for every block (ID and size in bytes) until f returns false
+	Range(f func(id string, size int) bool)
+
+	// LoadChecksum of the block with the ID, found=false if unknown
+	LoadChecksum(id string) (checksum string, found bool)
+	// Quarantine moves the block with the ID out of the inventory,
+	// kept aside for inspection but never served again
+	Quarantine(id string) error
+}
+
+// MemoryBackend keeps all blocks in memory,
+// everything is lost once the process exits.
+// Mainly for tests and benchmarks.
+type MemoryBackend struct {
+	blocks sync.Map
+	// block ID -> checksum
+	checksums sync.Map
+	// block ID -> gifts.Block
+	quarantined sync.Map
+	// serializes the updates of a block and its checksum
+	lock sync.Mutex
+}
+
+// NewMemoryBackend creates an empty in-memory Backend
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{}
+}
+
+// Load the block with the ID
+func (mb *MemoryBackend) Load(id string) (gifts.Block, bool) {
+	value, found := mb.blocks.Load(id)
+	if !found {
+		return nil, false
+	}
+	return value.(gifts.Block), true
+}
+
+// LoadRange of the block with the ID
+func (mb *MemoryBackend) LoadRange(id string, offset, length int) ([]byte, bool) {
+	block, found := mb.Load(id)
+	if !found {
+		return nil, false
+	}
+	start, end := clampRange(len(block), offset, length)
+	return block[start:end], true
+}
+
+// Open the block with the ID, it is never changed in place
+func (mb *MemoryBackend) Open(id string) (io.ReadCloser, int, bool) {
+	block, found := mb.Load(id)
+	if !found {
+		return nil, 0, false
+	}
+	return ioutil.NopCloser(bytes.NewReader(block)), len(block), true
+}
+
+// clampRange [offset, offset+length) to a block of size bytes
+func clampRange(size, offset, length int) (start, end int) {
+	start, end = offset, offset+length
+	if start > size {
+		start = size
+	}
+	if end > size {
+		end = size
+	}
+	return
+}
+
+// Has the block with the ID
+func (mb *MemoryBackend) Has(id string) bool {
+	_, found := mb.blocks.Load(id)
+	return found
+}
+
+// Store the block with the ID and its checksum
+func (mb *MemoryBackend) Store(id string, block gifts.Block, checksum string) error {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+	if checksum == "" {
+		mb.checksums.Delete(id)
+	} else {
+		mb.checksums.Store(id, checksum)
+	}
+	mb.blocks.Store(id, block)
+	return nil
+}
+
+// Delete the block with the ID
+func (mb *MemoryBackend) Delete(id string) error {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+	mb.blocks.Delete(id)
+	mb.checksums.Delete(id)
+	return nil
+}
+
+// Range over all blocks
+func (mb *MemoryBackend) Range(f func(id string, size int) bool) {
+	mb.blocks.Range(func(key, value interface{}) bool {
+		return f(key.(string), len(value.(gifts.Block)))
+	})
+}
+
+// LoadChecksum of the block with the ID
+func (mb *MemoryBackend) LoadChecksum(id string) (string, bool) {
+	value, found := mb.checksums.Load(id)
+	if !found {
+		return "", false
+	}
+	return value.(string), true
+}
+
+// Quarantine the block with the ID
+func (mb *MemoryBackend) Quarantine(id string) error {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+	if block, found := mb.Load(id); found {
+		mb.quarantined.Store(id, block)
+	}
+	mb.blocks.Delete(id)
+	mb.checksums.Delete(id)
+	return nil
+}
@@ -0,0 +1,277 @@
+package storage
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	gifts "github.com/GIFTS-fs/GIFTS"
+)
+
+const (
+	// prefix of the block files, also keeps the empty ID a valid file name
+	diskBlockPrefix = "blk-"
+	// prefix of the checksum files next to the block files
+	diskChecksumPrefix = "sum-"
+	// where the quarantined blocks go
+	diskQuarantineDir = "quarantine"
+	// prefix of the temporary files being written
+	diskTempPrefix = ".tmp-"
+	diskDirPerm    = 0755
+	diskFilePerm   = 0644
+)
+
+// DiskBackend keeps one file per block under a data directory.
+// Writes go to a temporary file first and then get renamed,
+// so a crash never leaves a half-written block behind.
+type DiskBackend struct {
+	dir string
+
+	// block ID -> size in bytes, the inventory of dir
+	index sync.Map
+	// serializes the updates of a file and its index entry
+	indexLock sync.Mutex
+}
+
+// NewDiskBackend opens (creates if needed) the data directory
+// and reloads the inventory of blocks already stored there.
+func NewDiskBackend(dir string) (*DiskBackend, error) {
+	if err := os.MkdirAll(dir, diskDirPerm); err != nil {
+		return nil, err
+	}
+
+	db := &DiskBackend{dir: dir}
+	if err := db.reload(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// block IDs are arbitrary strings (may contain '/'), encode them to be file-name safe
+func encodeBlockFileName(id string) string {
+	return diskBlockPrefix + base64.RawURLEncoding.EncodeToString([]byte(id))
+}
+
+func decodeBlockFileName(name string) (string, error) {
+	if !strings.HasPrefix(name, diskBlockPrefix) {
+		return "", fmt.Errorf("%q is not a block file", name)
+	}
+	id, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(name, diskBlockPrefix))
+	return string(id), err
+}
+
+func (db *DiskBackend) path(id string) string {
+	return filepath.Join(db.dir, encodeBlockFileName(id))
+}
+
+func (db *DiskBackend) checksumPath(id string) string {
+	return filepath.Join(db.dir, diskChecksumPrefix+strings.TrimPrefix(encodeBlockFileName(id), diskBlockPrefix))
+}
+
+// writeTemp writes data to a synced temporary file in dir, return its name
+func (db *DiskBackend) writeTemp(data []byte) (string, error) {
+	tmp, err := ioutil.TempFile(db.dir, diskTempPrefix)
+	if err != nil {
+		return "", err
+	}
+	tmpName := tmp.Name()
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmpName, diskFilePerm)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return "", err
+	}
+	return tmpName, nil
+}
+
+// reload the inventory from dir, clean up leftovers of interrupted writes
+func (db *DiskBackend) reload() error {
+	infos, err := ioutil.ReadDir(db.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+
+		name := info.Name()
+		if strings.HasPrefix(name, diskTempPrefix) {
+			os.Remove(filepath.Join(db.dir, name))
+			continue
+		}
+
+		id, err := decodeBlockFileName(name)
+		if err != nil {
+			// not ours, leave it alone
+			continue
+		}
+		db.index.Store(id, int(info.Size()))
+	}
+	return nil
+}
+
+// Load the block with the ID from disk
+func (db *DiskBackend) Load(id string) (gifts.Block, bool) {
+	if _, found := db.index.Load(id); !found {
+		return nil, false
+	}
+
+	data, err := ioutil.ReadFile(db.path(id))
+	if err != nil {
+		return nil, false
+	}
+	return gifts.Block(data), true
+}
+
+// LoadRange of the block with the ID, without reading the rest of the file
+func (db *DiskBackend) LoadRange(id string, offset, length int) ([]byte, bool) {
+	value, found := db.index.Load(id)
+	if !found {
+		return nil, false
+	}
+
+	f, err := os.Open(db.path(id))
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+
+	start, end := clampRange(value.(int), offset, length)
+	data := make([]byte, end-start)
+	n, err := f.ReadAt(data, int64(start))
+	if err != nil && err != io.EOF {
+		return nil, false
+	}
+	return data[:n], true
+}
+
+// Open the file of the block with the ID,
+// a new one is renamed over it and the open one stays as it was
+func (db *DiskBackend) Open(id string) (io.ReadCloser, int, bool) {
+	if _, found := db.index.Load(id); !found {
+		return nil, 0, false
+	}
+
+	f, err := os.Open(db.path(id))
+	if err != nil {
+		return nil, 0, false
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, false
+	}
+	return f, int(info.Size()), true
+}
+
+// Has the block with the ID in the inventory
+func (db *DiskBackend) Has(id string) bool {
+	_, found := db.index.Load(id)
+	return found
+}
+
+// Store the block with the ID and its checksum next to it,
+// atomically replaces the old ones if exist
+func (db *DiskBackend) Store(id string, block gifts.Block, checksum string) error {
+	tmpName, err := db.writeTemp(block)
+	if err != nil {
+		return fmt.Errorf("DiskBackend.Store(%q): %v", id, err)
+	}
+	var tmpSumName string
+	if checksum != "" {
+		if tmpSumName, err = db.writeTemp([]byte(checksum)); err != nil {
+			os.Remove(tmpName)
+			return fmt.Errorf("DiskBackend.Store(%q): %v", id, err)
+		}
+	}
+
+	db.indexLock.Lock()
+	defer db.indexLock.Unlock()
+
+	// the old checksum must not outlive the old data,
+	// nor the new one come before the new data, a crash in between leaves none
+	if err = os.Remove(db.checksumPath(id)); err != nil && !os.IsNotExist(err) {
+		os.Remove(tmpName)
+		os.Remove(tmpSumName)
+		return fmt.Errorf("DiskBackend.Store(%q): %v", id, err)
+	}
+	if err = os.Rename(tmpName, db.path(id)); err != nil {
+		os.Remove(tmpName)
+		os.Remove(tmpSumName)
+		return fmt.Errorf("DiskBackend.Store(%q): %v", id, err)
+	}
+	db.index.Store(id, len(block))
+	if tmpSumName != "" {
+		if err = os.Rename(tmpSumName, db.checksumPath(id)); err != nil {
+			os.Remove(tmpSumName)
+			return fmt.Errorf("DiskBackend.Store(%q): %v", id, err)
+		}
+	}
+	return nil
+}
+
+// Delete the block with the ID from disk
+func (db *DiskBackend) Delete(id string) error {
+	db.indexLock.Lock()
+	defer db.indexLock.Unlock()
+
+	if err := os.Remove(db.path(id)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("DiskBackend.Delete(%q): %v", id, err)
+	}
+	db.index.Delete(id)
+	os.Remove(db.checksumPath(id))
+	return nil
+}
+
+// Range over all blocks in the inventory
+func (db *DiskBackend) Range(f func(id string, size int) bool) {
+	db.index.Range(func(key, value interface{}) bool {
+		return f(key.(string), value.(int))
+	})
+}
+
+// LoadChecksum of the block with the ID from disk
+func (db *DiskBackend) LoadChecksum(id string) (string, bool) {
+	data, err := ioutil.ReadFile(db.checksumPath(id))
+	if err != nil {
+		return "", false
+	}
+	return string(data), true
+}
+
+// Quarantine the block with the ID by moving it into the quarantine directory
+func (db *DiskBackend) Quarantine(id string) error {
+	db.indexLock.Lock()
+	defer db.indexLock.Unlock()
+
+	if !db.Has(id) {
+		return nil
+	}
+
+	qdir := filepath.Join(db.dir, diskQuarantineDir)
+	if err := os.MkdirAll(qdir, diskDirPerm); err != nil {
+		return fmt.Errorf("DiskBackend.Quarantine(%q): %v", id, err)
+	}
+	if err := os.Rename(db.path(id), filepath.Join(qdir, encodeBlockFileName(id))); err != nil {
+		return fmt.Errorf("DiskBackend.Quarantine(%q): %v", id, err)
+	}
+	db.index.Delete(id)
+	os.Rename(db.checksumPath(id), filepath.Join(qdir, filepath.Base(db.checksumPath(id))))
+	return nil
+}
@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	gifts "github.com/GIFTS-fs/GIFTS"
+	"github.com/GIFTS-fs/GIFTS/structure"
+	"github.com/GIFTS-fs/GIFTS/test"
+)
+
+func TestDiskBackend(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gifts-disk-")
+	test.AF(t, err == nil, fmt.Sprintf("TempDir failed: %v", err))
+	defer os.RemoveAll(dir)
+
+	db, err := NewDiskBackend(dir)
+	test.AF(t, err == nil, fmt.Sprintf("NewDiskBackend failed: %v", err))
+
+	// Missing block
+	t.Logf("TestDiskBackend: Starting test #1")
+	_, found := db.Load("id1")
+	test.AF(t, !found, "Missing block should not be found")
+	test.AF(t, !db.Has("id1"), "Missing block should not exist")
+
+	// Store and load, IDs with path separators
+	t.Logf("TestDiskBackend: Starting test #2")
+	ids := []string{"id1", "dir/file0", "../escape1", ""}
+	for i, id := range ids {
+		err = db.Store(id, gifts.Block(fmt.Sprintf("data_%d", i)), "")
+		test.AF(t, err == nil, fmt.Sprintf("DiskBackend.Store(%q) failed: %v", id, err))
+	}
+	for i, id := range ids {
+		block, found := db.Load(id)
+		test.AF(t, found, fmt.Sprintf("Block %q not found", id))
+		test.AF(t, string(block) == fmt.Sprintf("data_%d", i), fmt.Sprintf("Block %q has wrong data %q", id, block))
+	}
+
+	// Overwrite
+	t.Logf("TestDiskBackend: Starting test #3")
+	err = db.Store("id1", gifts.Block("new data"), "")
+	test.AF(t, err == nil, fmt.Sprintf("DiskBackend.Store failed: %v", err))
+	block, _ := db.Load("id1")
+	test.AF(t, string(block) == "new data", fmt.Sprintf("Expected \"new data\", found %q", block))
+
+	// Load a range, clamped to the end of the block
+	t.Logf("TestDiskBackend: Starting test #4")
+	data, found := db.LoadRange("id1", 4, 3)
+	test.AF(t, found && string(data) == "dat", fmt.Sprintf("Expected \"dat\", found %q", data))
+	data, _ = db.LoadRange("id1", 4, 100)
+	test.AF(t, string(data) == "data", fmt.Sprintf("Expected \"data\", found %q", data))
+	data, _ = db.LoadRange("id1", 100, 1)
+	test.AF(t, len(data) == 0, fmt.Sprintf("Expected no data beyond the end, found %q", data))
+	_, found = db.LoadRange("missing", 0, 1)
+	test.AF(t, !found, "Missing block should not be found")
+
+	// Delete
+	t.Logf("TestDiskBackend: Starting test #5")
+	err = db.Delete("dir/file0")
+	test.AF(t, err == nil, fmt.Sprintf("DiskBackend.Delete failed: %v", err))
+	test.AF(t, !db.Has("dir/file0"), "Deleted block should not exist")
+	err = db.Delete("dir/file0")
+	test.AF(t, err == nil, "Deleting a missing block should be a no-op")
+
+	// Reload inventory, leftover temporary files are cleaned
+	t.Logf("TestDiskBackend: Starting test #6")
+	leftover := filepath.Join(dir, diskTempPrefix+"leftover")
+	ioutil.WriteFile(leftover, []byte("half written"), diskFilePerm)
+
+	reloaded, err := NewDiskBackend(dir)
+	test.AF(t, err == nil, fmt.Sprintf("NewDiskBackend failed: %v", err))
+	n := 0
+	reloaded.Range(func(id string, size int) bool {
+		n++
+		return true
+	})
+	test.AF(t, n == 3, fmt.Sprintf("Expected 3 blocks after reload, found %d", n))
+	block, found = reloaded.Load("id1")
+	test.AF(t, found && string(block) == "new data", fmt.Sprintf("Expected \"new data\", found %q", block))
+	_, err = os.Stat(leftover)
+	test.AF(t, os.IsNotExist(err), "Leftover temporary file should be removed")
+
+	// Checksums survive reload, overwriting replaces or drops them
+	t.Logf("TestDiskBackend: Starting test #7")
+	err = reloaded.Store("id1", gifts.Block("new data"), "sum1")
+	test.AF(t, err == nil, fmt.Sprintf("DiskBackend.Store failed: %v", err))
+
+	reloaded, err = NewDiskBackend(dir)
+	test.AF(t, err == nil, fmt.Sprintf("NewDiskBackend failed: %v", err))
+	sum, found := reloaded.LoadChecksum("id1")
+	test.AF(t, found && sum == "sum1", fmt.Sprintf("Expected \"sum1\", found %q", sum))
+
+	reloaded.Store("id1", gifts.Block("newer data"), "sum2")
+	sum, _ = reloaded.LoadChecksum("id1")
+	test.AF(t, sum == "sum2", fmt.Sprintf("Expected \"sum2\", found %q", sum))
+	reloaded.Store("id1", gifts.Block("newer data"), "")
+	_, found = reloaded.LoadChecksum("id1")
+	test.AF(t, !found, "Overwritten block should drop its checksum")
+
+	// Quarantine
+	t.Logf("TestDiskBackend: Starting test #8")
+	reloaded.Store("id1", gifts.Block("newer data"), "sum1")
+	err = reloaded.Quarantine("id1")
+	test.AF(t, err == nil, fmt.Sprintf("DiskBackend.Quarantine failed: %v", err))
+	test.AF(t, !reloaded.Has("id1"), "Quarantined block should not exist")
+	_, found = reloaded.LoadChecksum("id1")
+	test.AF(t, !found, "Quarantined block should not have a checksum")
+
+	reloaded, err = NewDiskBackend(dir)
+	test.AF(t, err == nil, fmt.Sprintf("NewDiskBackend failed: %v", err))
+	test.AF(t, !reloaded.Has("id1"), "Quarantined block should not come back after reload")
+	_, err = os.Stat(filepath.Join(dir, diskQuarantineDir, encodeBlockFileName("id1")))
+	test.AF(t, err == nil, "Quarantined block should be kept aside")
+
+	// Open reads the block as it was, even if replaced after
+	t.Logf("TestDiskBackend: Starting test #9")
+	reloaded.Store("id2", gifts.Block("old data"), "")
+	f, size, found := reloaded.Open("id2")
+	test.AF(t, found && size == len("old data"), fmt.Sprintf("Expected %d bytes, found %d", len("old data"), size))
+	reloaded.Store("id2", gifts.Block("replaced"), "")
+	data, err = ioutil.ReadAll(f)
+	f.Close()
+	test.AF(t, err == nil && string(data) == "old data", fmt.Sprintf("Expected \"old data\", found %q: %v", data, err))
+	_, _, found = reloaded.Open("missing")
+	test.AF(t, !found, "Missing block should not open")
+}
+
+func TestStorage_DiskRestart(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gifts-storage-")
+	test.AF(t, err == nil, fmt.Sprintf("TempDir failed: %v", err))
+	defer os.RemoveAll(dir)
+
+	db, err := NewDiskBackend(dir)
+	test.AF(t, err == nil, fmt.Sprintf("NewDiskBackend failed: %v", err))
+	s := NewStorageBackend(db)
+
+	err = s.Set(&structure.BlockKV{ID: "id1", Data: gifts.Block("data 1")}, nil)
+	test.AF(t, err == nil, fmt.Sprintf("Storage.Set failed: %v", err))
+
+	// "Restart" the Storage on the same directory
+	db, err = NewDiskBackend(dir)
+	test.AF(t, err == nil, fmt.Sprintf("NewDiskBackend failed: %v", err))
+	s = NewStorageBackend(db)
+
+	var ret gifts.Block
+	err = s.Get("id1", &ret)
+	test.AF(t, err == nil, fmt.Sprintf("Storage.Get failed: %v", err))
+	test.AF(t, string(ret) == "data 1", fmt.Sprintf("Expected \"data 1\", found %q", ret))
+
+	err = s.Unset("id1", nil)
+	test.AF(t, err == nil, fmt.Sprintf("Storage.Unset failed: %v", err))
+	err = s.Get("id1", &ret)
+	test.AF(t, err != nil, "Unset block should be gone")
+}
@@ -1,54 +1,46 @@
 package storage
 
 import (
-	"net/rpc"
+	"context"
 
 	gifts "github.com/GIFTS-fs/GIFTS"
 	"github.com/GIFTS-fs/GIFTS/structure"
 )
 
+// The blocks are named by the master, setting or unsetting one twice is the same as once
+func init() {
+	gifts.RegisterIdempotent(
+		"Storage.Set", "Storage.Get", "Storage.GetRange", "Storage.Replicate", "Storage.Unset",
+		"Storage.Verify", "Storage.Ping", "Storage.Stat", "Storage.BlockReport",
+	)
+}
+
 // RPCStorage is a concurrency-safe key-value store accessible via RPC.
+// A call that fails to reach the node is made again on a new connection,
+// at most RetryPolicy.MaxAttempts times in all, see gifts.RetryPolicy;
+// ctx gives up the call as a whole, the retries with it.
 type RPCStorage struct {
 	Addr   string
 	Logger *gifts.Logger
-	conn   *rpc.Client
+	rcli   gifts.Transport // on the shared connections to Addr
 }
 
 // NewRPCStorage creates a client that allows you to access a raw Storage node
 // that is accessible via RPC at the specified address.
 func NewRPCStorage(addr string) *RPCStorage {
-	logger := gifts.NewLogger("RPCStorage", addr, true)
-	logger.Enabled = false
-	return &RPCStorage{Addr: addr, Logger: logger} // PRODUCTION: banish this
+	return NewRPCStorageOn(addr, gifts.NewRPCClient(addr, RPCPathStorage))
 }
 
-func (s *RPCStorage) connect() (err error) {
-	s.conn, err = rpc.DialHTTPPath("tcp", s.Addr, RPCPathStorage)
-	return
+// NewRPCStorageOn the transport to the Storage node at addr
+func NewRPCStorageOn(addr string, rcli gifts.Transport) *RPCStorage {
+	logger := gifts.NewLogger("RPCStorage", addr, true)
+	logger.Enabled = false
+	return &RPCStorage{Addr: addr, Logger: logger, rcli: rcli} // PRODUCTION: banish this
 }
 
 // Set the data associated with the block's ID
-func (s *RPCStorage) Set(kv *structure.BlockKV) error {
-	var err error
-
-	// If the Call returns an error, try reconnecting to the server and making the call again
-	for try := 0; try < 2; try++ {
-		// Connect to the server
-		if s.conn == nil {
-			if err = s.connect(); err != nil {
-				break
-			}
-		}
-
-		// Perform the call
-		err = s.conn.Call("Storage.Set", kv, nil)
-		if err == nil {
-			break
-		} else if s.conn != nil {
-			s.conn.Close()
-			s.conn = nil
-		}
-	}
+func (s *RPCStorage) Set(ctx context.Context, kv *structure.BlockKV) error {
+	err := s.rcli.Call(ctx, "Storage.Set", kv, nil)
 
 	if err == nil {
 		s.Logger.Printf("%q: RPCStorage.Set(%q, %d bytes) => success", s.Addr, kv.ID, len(kv.Data))
@@ -59,33 +51,27 @@ func (s *RPCStorage) Set(kv *structure.BlockKV) error {
 	return err
 }
 
-// Get the data associated with the block's ID
-func (s *RPCStorage) Get(id string, ret *gifts.Block) error {
-	var err error
+// SetStream is Set with the data read as it is sent, rather than held in memory
+func (s *RPCStorage) SetStream(ctx context.Context, bs *structure.BlockStream) error {
+	err := s.rcli.Call(ctx, "Storage.Set", bs, nil)
+
+	if err == nil {
+		s.Logger.Printf("%q: RPCStorage.SetStream(%q) => success", s.Addr, bs.ID)
+	} else {
+		s.Logger.Printf("%q: RPCStorage.SetStream(%q) => %v", s.Addr, bs.ID, err)
+	}
+
+	return err
+}
 
+// Get the data associated with the block's ID
+func (s *RPCStorage) Get(ctx context.Context, id string, ret *gifts.Block) error {
 	// Clear return value
 	*ret = make([]byte, 0)
 
-	// If the Call returns an error, try reconnecting to the server and making the call again
-	for try := 0; try < 2; try++ {
-		// Connect to the server
-		if s.conn == nil {
-			if err = s.connect(); err != nil {
-				break
-			}
-		}
-
-		// Perform the call
-		err = s.conn.Call("Storage.Get", id, ret)
-		if err == nil {
-			if *ret == nil {
-				*ret = make([]byte, 0)
-			}
-			break
-		} else if s.conn != nil {
-			s.conn.Close()
-			s.conn = nil
-		}
+	err := s.rcli.Call(ctx, "Storage.Get", id, ret)
+	if err == nil && *ret == nil {
+		*ret = make([]byte, 0)
 	}
 
 	if err == nil {
@@ -97,29 +83,29 @@ func (s *RPCStorage) Get(id string, ret *gifts.Block) error {
 	return err
 }
 
-// Replicate the specified block to the destination Storage node
-func (s *RPCStorage) Replicate(kv *structure.ReplicateKV) error {
-	var err error
+// GetRange gets at most req.Length bytes of the block starting at req.Offset
+func (s *RPCStorage) GetRange(ctx context.Context, req *structure.RangeReq, ret *[]byte) error {
+	// Clear return value
+	*ret = make([]byte, 0)
 
-	// If the Call returns an error, try reconnecting to the server and making the call again
-	for try := 0; try < 2; try++ {
-		// Connect to the server
-		if s.conn == nil {
-			if err = s.connect(); err != nil {
-				break
-			}
-		}
-
-		// Perform the call
-		err = s.conn.Call("Storage.Replicate", kv, nil)
-		if err == nil {
-			break
-		} else if s.conn != nil {
-			s.conn.Close()
-			s.conn = nil
-		}
+	err := s.rcli.Call(ctx, "Storage.GetRange", req, ret)
+	if err == nil && *ret == nil {
+		*ret = make([]byte, 0)
+	}
+
+	if err == nil {
+		s.Logger.Printf("%q: RPCStorage.GetRange(%q, %d, %d) => %d bytes", s.Addr, req.ID, req.Offset, req.Length, len(*ret))
+	} else {
+		s.Logger.Printf("%q: RPCStorage.GetRange(%q, %d, %d) => %v", s.Addr, req.ID, req.Offset, req.Length, err)
 	}
 
+	return err
+}
+
+// Replicate the specified block to the destination Storage node
+func (s *RPCStorage) Replicate(ctx context.Context, kv *structure.ReplicateKV) error {
+	err := s.rcli.Call(ctx, "Storage.Replicate", kv, nil)
+
 	if err == nil {
 		s.Logger.Printf("%q: RPCStorage.Replicate(%v) => success", s.Addr, kv)
 	} else {
@@ -130,27 +116,8 @@ func (s *RPCStorage) Replicate(kv *structure.ReplicateKV) error {
 }
 
 // Unset the data associated with the block's ID
-func (s *RPCStorage) Unset(id string, ignore *bool) error {
-	var err error
-
-	// If the Call returns an error, try reconnecting to the server and making the call again
-	for try := 0; try < 2; try++ {
-		// Connect to the server
-		if s.conn == nil {
-			if err = s.connect(); err != nil {
-				break
-			}
-		}
-
-		// Perform the call
-		err = s.conn.Call("Storage.Unset", id, nil)
-		if err == nil {
-			break
-		} else if s.conn != nil {
-			s.conn.Close()
-			s.conn = nil
-		}
-	}
+func (s *RPCStorage) Unset(ctx context.Context, id string, ignore *bool) error {
+	err := s.rcli.Call(ctx, "Storage.Unset", id, nil)
 
 	if err == nil {
 		s.Logger.Printf("%q: RPCStorage.Unset(%q) => success", s.Addr, id)
@@ -160,3 +127,67 @@ func (s *RPCStorage) Unset(id string, ignore *bool) error {
 
 	return err
 }
+
+// Verify asks the Storage node to check the block against its checksum,
+// false if it is corrupt or gone
+func (s *RPCStorage) Verify(ctx context.Context, id string) (bool, error) {
+	var healthy bool
+
+	err := s.rcli.Call(ctx, "Storage.Verify", id, &healthy)
+
+	if err == nil {
+		s.Logger.Printf("%q: RPCStorage.Verify(%q) => %v", s.Addr, id, healthy)
+	} else {
+		s.Logger.Printf("%q: RPCStorage.Verify(%q) => %v", s.Addr, id, err)
+	}
+
+	return healthy, err
+}
+
+// Ping the Storage node to see if it is alive
+func (s *RPCStorage) Ping(ctx context.Context) error {
+	var err error
+	var alive bool
+
+	err = s.rcli.Call(ctx, "Storage.Ping", true, &alive)
+
+	if err == nil {
+		s.Logger.Printf("%q: RPCStorage.Ping() => success", s.Addr)
+	} else {
+		s.Logger.Printf("%q: RPCStorage.Ping() => %v", s.Addr, err)
+	}
+
+	return err
+}
+
+// Stat gets the capacity and the usage of the Storage node
+func (s *RPCStorage) Stat(ctx context.Context) (*structure.StorageStat, error) {
+	var err error
+	var stat structure.StorageStat
+
+	err = s.rcli.Call(ctx, "Storage.Stat", true, &stat)
+
+	if err == nil {
+		s.Logger.Printf("%q: RPCStorage.Stat() => %d of %d bytes", s.Addr, stat.Used, stat.Capacity)
+	} else {
+		s.Logger.Printf("%q: RPCStorage.Stat() => %v", s.Addr, err)
+	}
+
+	return &stat, err
+}
+
+// BlockReport lists all blocks held by the Storage node
+func (s *RPCStorage) BlockReport(ctx context.Context) ([]structure.BlockInfo, error) {
+	var err error
+	var report []structure.BlockInfo
+
+	err = s.rcli.Call(ctx, "Storage.BlockReport", true, &report)
+
+	if err == nil {
+		s.Logger.Printf("%q: RPCStorage.BlockReport() => %d blocks", s.Addr, len(report))
+	} else {
+		s.Logger.Printf("%q: RPCStorage.BlockReport() => %v", s.Addr, err)
+	}
+
+	return report, err
+}
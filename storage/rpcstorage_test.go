@@ -2,8 +2,18 @@ package storage
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/rpc"
 	"os"
+	"sync"
 	"testing"
 	"time"
 
@@ -15,6 +25,12 @@ import (
 	"gonum.org/v1/gonum/stat"
 )
 
+func TestMain(m *testing.M) {
+	// before any server runs, for TestServeRPC_Handshake to wait no longer than that
+	gifts.HandshakeTimeout = time.Second
+	os.Exit(m.Run())
+}
+
 func TestRPCStorage_Set(t *testing.T) {
 	t.Parallel()
 	s := NewStorage()
@@ -24,22 +40,22 @@ func TestRPCStorage_Set(t *testing.T) {
 	rpcs := NewRPCStorage("localhost:3000")
 	t.Log("TestRPCStorage_Set: Starting test #1")
 	kv := &structure.BlockKV{ID: "id1", Data: gifts.Block("data 1")}
-	err := rpcs.Set(kv)
+	err := rpcs.Set(context.Background(), kv)
 	test.AF(t, err == nil, fmt.Sprintf("Storage.Set failed: %v", err))
 	for i := range kv.Data {
 		data, _ := s.blocks.Load("id1")
-		actual := data.(gifts.Block)[i]
+		actual := data[i]
 		test.AF(t, kv.Data[i] == actual, fmt.Sprintf("Expected %c but found %c", kv.Data[i], actual))
 	}
 
 	// Overwrite old data
 	t.Log("TestRPCStorage_Set: Starting test #2")
 	kv.Data = gifts.Block("new data2")
-	err = rpcs.Set(kv)
+	err = rpcs.Set(context.Background(), kv)
 	test.AF(t, err == nil, fmt.Sprintf("Storage.Set failed: %v", err))
 	for i := range kv.Data {
 		data, _ := s.blocks.Load("id1")
-		actual := data.(gifts.Block)[i]
+		actual := data[i]
 		test.AF(t, kv.Data[i] == actual, fmt.Sprintf("Expected %c but found %c", kv.Data[i], actual))
 	}
 
@@ -53,7 +69,7 @@ func TestRPCStorage_Set(t *testing.T) {
 			kv.ID = fmt.Sprintf("id_%d", i)
 			kv.Data = gifts.Block(fmt.Sprintf("data_%d", i))
 
-			err := rpcs.Set(kv)
+			err := rpcs.Set(context.Background(), kv)
 			test.AF(t, err == nil, fmt.Sprintf("Storage.Set failed: %v", err))
 			done <- true
 		}(i)
@@ -70,7 +86,7 @@ func TestRPCStorage_Set(t *testing.T) {
 		for j := range data {
 			expected := data[j]
 			actualData, _ := s.blocks.Load(id)
-			actual := actualData.(gifts.Block)[j]
+			actual := actualData[j]
 			test.AF(t, expected == actual, fmt.Sprintf("ID %s: Expected %c but found %c", id, expected, actual))
 		}
 	}
@@ -85,20 +101,20 @@ func TestRPCStorage_Get(t *testing.T) {
 	t.Log("TestStorage_Get: Starting test #1")
 	rpcs := NewRPCStorage("localhost:3001")
 	data := new(gifts.Block)
-	err := rpcs.Get("fake_id", data)
+	err := rpcs.Get(context.Background(), "fake_id", data)
 	test.AF(t, err != nil, "Storage.Set: Expected non-nil error")
 
 	// Get empty data
 	t.Log("TestStorage_Get: Starting test #2")
-	s.blocks.Store("id1", gifts.Block(""))
-	err = rpcs.Get("id1", data)
+	s.blocks.Store("id1", gifts.Block(""), "")
+	err = rpcs.Get(context.Background(), "id1", data)
 	test.AF(t, err == nil, fmt.Sprintf("Storage.Get failed: %v", err))
 	test.AF(t, len(*data) == 0, fmt.Sprintf("Expected empty data, found %q", *data))
 
 	// Get some data
 	t.Log("TestStorage_Get: Starting test #3")
-	s.blocks.Store("id2", gifts.Block("some data"))
-	err = rpcs.Get("id2", data)
+	s.blocks.Store("id2", gifts.Block("some data"), "")
+	err = rpcs.Get(context.Background(), "id2", data)
 	test.AF(t, err == nil, fmt.Sprintf("Storage.Get failed: %v", err))
 	test.AF(t, string(*data) == "some data", fmt.Sprintf("Expected \"some data\", found %q", *data))
 
@@ -108,7 +124,7 @@ func TestRPCStorage_Get(t *testing.T) {
 	for i := 0; i < nBlocks; i++ {
 		id := fmt.Sprintf("id_%d", i)
 		data := gifts.Block(fmt.Sprintf("data_%d", i))
-		s.blocks.Store(id, data)
+		s.blocks.Store(id, data, "")
 	}
 
 	nGets := 100
@@ -120,7 +136,7 @@ func TestRPCStorage_Get(t *testing.T) {
 			id := fmt.Sprintf("id_%d", index)
 
 			actual := new(gifts.Block)
-			err := rpcs.Get(id, actual)
+			err := rpcs.Get(context.Background(), id, actual)
 			test.AF(t, err == nil, fmt.Sprintf("Storage.Get failed: %v", err))
 			test.AF(t, string(*actual) == expected, fmt.Sprintf("Expected %q, found %q", expected, *data))
 
@@ -133,13 +149,39 @@ func TestRPCStorage_Get(t *testing.T) {
 	}
 }
 
+func TestRPCStorage_GetRange(t *testing.T) {
+	t.Parallel()
+	s := NewStorage()
+	ServeRPC(s, "localhost:3007")
+
+	// Attempt to get a missing ID
+	t.Log("TestRPCStorage_GetRange: Starting test #1")
+	rpcs := NewRPCStorage("localhost:3007")
+	data := new([]byte)
+	err := rpcs.GetRange(context.Background(), &structure.RangeReq{ID: "fake_id", Offset: 0, Length: 1}, data)
+	test.AF(t, err != nil, "RPCStorage.GetRange: Expected non-nil error")
+
+	// Get a range
+	t.Log("TestRPCStorage_GetRange: Starting test #2")
+	s.blocks.Store("id1", gifts.Block("some data"), "")
+	err = rpcs.GetRange(context.Background(), &structure.RangeReq{ID: "id1", Offset: 5, Length: 4}, data)
+	test.AF(t, err == nil, fmt.Sprintf("RPCStorage.GetRange failed: %v", err))
+	test.AF(t, string(*data) == "data", fmt.Sprintf("Expected \"data\", found %q", *data))
+
+	// Empty range
+	t.Log("TestRPCStorage_GetRange: Starting test #3")
+	err = rpcs.GetRange(context.Background(), &structure.RangeReq{ID: "id1", Offset: 9, Length: 4}, data)
+	test.AF(t, err == nil, fmt.Sprintf("RPCStorage.GetRange failed: %v", err))
+	test.AF(t, *data != nil && len(*data) == 0, fmt.Sprintf("Expected empty data, found %q", *data))
+}
+
 func TestRPCStorage_Replicate(t *testing.T) {
 	t.Parallel()
 	var kv structure.ReplicateKV
 	var err error
 
 	s1 := NewStorage()
-	s1.blocks.Store("valid_id", gifts.Block("Hello World"))
+	s1.blocks.Store("valid_id", gifts.Block("Hello World"), "")
 	ServeRPC(s1, "localhost:3200")
 	rs := NewRPCStorage("localhost:3200")
 
@@ -150,26 +192,26 @@ func TestRPCStorage_Replicate(t *testing.T) {
 	t.Logf("TestStorage_Replicate: Starting test #1")
 	kv.ID = "Invalid ID"
 	kv.Dest = "localhost:3201"
-	err = rs.Replicate(&kv)
+	err = rs.Replicate(context.Background(), &kv)
 	test.AF(t, err != nil, "Invalid block ID should fail")
 
 	// Invalid destination
 	t.Logf("TestStorage_Replicate: Starting test #2")
 	kv.ID = "valid_id"
 	kv.Dest = "localhost:3300"
-	err = rs.Replicate(&kv)
+	err = rs.Replicate(context.Background(), &kv)
 	test.AF(t, err != nil, "Invalid destination should fail")
 
 	// Valid ID and destination
 	t.Logf("TestStorage_Replicate: Starting test #2")
 	kv.ID = "valid_id"
 	kv.Dest = "localhost:3201"
-	err = rs.Replicate(&kv)
+	err = rs.Replicate(context.Background(), &kv)
 	test.AF(t, err == nil, fmt.Sprintf("Storage.Replicate failed: %v", err))
 
 	expected, _ := s1.blocks.Load("valid_id")
 	actual, _ := s2.blocks.Load("valid_id")
-	test.AF(t, string(expected.(gifts.Block)) == string(actual.(gifts.Block)), fmt.Sprintf("Expected %q, found %q", expected, actual))
+	test.AF(t, string(expected) == string(actual), fmt.Sprintf("Expected %q, found %q", expected, actual))
 }
 
 func TestRPCStorage_Unset(t *testing.T) {
@@ -177,16 +219,16 @@ func TestRPCStorage_Unset(t *testing.T) {
 	s := NewStorage()
 	ServeRPC(s, "localhost:3002")
 
-	// Missing ID
+	// Missing ID, already gone
 	t.Log("TestStorage_Set: Starting test #1")
 	rpcs := NewRPCStorage("localhost:3002")
-	err := rpcs.Unset("id1", nil)
-	test.AF(t, err != nil, "Expected non-nil error")
+	err := rpcs.Unset(context.Background(), "id1", nil)
+	test.AF(t, err == nil, fmt.Sprintf("Unset of a missing block failed: %v", err))
 
 	// Unset data
 	t.Log("TestStorage_Set: Starting test #2")
-	s.blocks.Store("id1", gifts.Block("data 1"))
-	err = rpcs.Unset("id1", nil)
+	s.blocks.Store("id1", gifts.Block("data 1"), "")
+	err = rpcs.Unset(context.Background(), "id1", nil)
 	test.AF(t, err == nil, fmt.Sprintf("Storage.Unset failed: %v", err))
 	actual, found := s.blocks.Load("id1")
 	test.AF(t, !found, "Expected no data")
@@ -198,13 +240,13 @@ func TestRPCStorage_Unset(t *testing.T) {
 	for i := 0; i < nUnsets; i++ {
 		id := fmt.Sprintf("id_%d", i)
 		data := gifts.Block(fmt.Sprintf("data_%d", i))
-		s.blocks.Store(id, data)
+		s.blocks.Store(id, data, "")
 	}
 
 	done := make(chan bool, nUnsets)
 	for i := 0; i < nUnsets; i++ {
 		go func(i int) {
-			err := rpcs.Unset(fmt.Sprintf("id_%d", i), nil)
+			err := rpcs.Unset(context.Background(), fmt.Sprintf("id_%d", i), nil)
 			test.AF(t, err == nil, fmt.Sprintf("Storage.Unset failed: %v", err))
 			done <- true
 		}(i)
@@ -246,7 +288,7 @@ func TestBenchmarkRPCStorage_Set(t *testing.T) {
 				g.Read(kv.Data)
 
 				startTime := time.Now()
-				rpcs.Set(&kv)
+				rpcs.Set(context.Background(), &kv)
 				testElapsed += time.Since(startTime).Nanoseconds()
 			}
 			runElapsed += (testElapsed / nTestsPerRun)
@@ -292,7 +334,7 @@ func TestBenchmarkRPCStorage_Get(t *testing.T) {
 
 				kv := structure.BlockKV{ID: id, Data: gifts.Block(make([]byte, blockSize))}
 				g.Read(kv.Data)
-				err := rpcs.Set(&kv)
+				err := rpcs.Set(context.Background(), &kv)
 				test.AF(t, err == nil, fmt.Sprintf("RPCStorage.Set failed: %v", err))
 			}
 
@@ -310,7 +352,7 @@ func TestBenchmarkRPCStorage_Get(t *testing.T) {
 
 						startTime := time.Now()
 						for time.Since(startTime).Seconds() < runTime {
-							rs.Get(ids[nReads%nBlocks], data)
+							rs.Get(context.Background(), ids[nReads%nBlocks], data)
 							nReads++
 						}
 
@@ -337,3 +379,588 @@ func TestBenchmarkRPCStorage_Get(t *testing.T) {
 		}
 	}
 }
+
+func TestRPCStorage_Ping(t *testing.T) {
+	t.Parallel()
+	s := NewStorage()
+	ServeRPC(s, "localhost:3400")
+
+	// Alive
+	t.Log("TestRPCStorage_Ping: Starting test #1")
+	rpcs := NewRPCStorage("localhost:3400")
+	err := rpcs.Ping(context.Background())
+	test.AF(t, err == nil, fmt.Sprintf("RPCStorage.Ping failed: %v", err))
+
+	// Nobody there
+	t.Log("TestRPCStorage_Ping: Starting test #2")
+	rpcs = NewRPCStorage("localhost:3401")
+	err = rpcs.Ping(context.Background())
+	test.AF(t, err != nil, "Ping to nowhere should fail")
+}
+
+func TestRPCStorage_BlockReport(t *testing.T) {
+	t.Parallel()
+	s := NewStorage()
+	ServeRPC(s, "localhost:3500")
+	rpcs := NewRPCStorage("localhost:3500")
+
+	// Empty
+	t.Log("TestRPCStorage_BlockReport: Starting test #1")
+	report, err := rpcs.BlockReport(context.Background())
+	test.AF(t, err == nil, fmt.Sprintf("RPCStorage.BlockReport failed: %v", err))
+	test.AF(t, len(report) == 0, fmt.Sprintf("Expected no block, found %d", len(report)))
+
+	// Some blocks
+	t.Log("TestRPCStorage_BlockReport: Starting test #2")
+	blocks := map[string]string{"id1": "a", "id2": "bb", "id3": "ccc"}
+	for id, data := range blocks {
+		rpcs.Set(context.Background(), &structure.BlockKV{ID: id, Data: gifts.Block(data)})
+	}
+	report, err = rpcs.BlockReport(context.Background())
+	test.AF(t, err == nil, fmt.Sprintf("RPCStorage.BlockReport failed: %v", err))
+	test.AF(t, len(report) == len(blocks), fmt.Sprintf("Expected %d blocks, found %d", len(blocks), len(report)))
+	for _, info := range report {
+		test.AF(t, info.Size == len(blocks[info.ID]), fmt.Sprintf("Block %q has wrong size %d", info.ID, info.Size))
+	}
+}
+
+func TestRPCStorage_Stat(t *testing.T) {
+	t.Parallel()
+	s := NewStorage()
+	s.Capacity = 100
+	ServeRPC(s, "localhost:3800")
+	rpcs := NewRPCStorage("localhost:3800")
+
+	// Empty
+	t.Log("TestRPCStorage_Stat: Starting test #1")
+	stat, err := rpcs.Stat(context.Background())
+	test.AF(t, err == nil, fmt.Sprintf("RPCStorage.Stat failed: %v", err))
+	test.AF(t, stat.Capacity == 100 && stat.Used == 0 && stat.NBlocks == 0, fmt.Sprintf("Unexpected stat of empty storage %+v", stat))
+
+	// Some blocks, overwritten ones count once
+	t.Log("TestRPCStorage_Stat: Starting test #2")
+	for id, data := range map[string]string{"id1": "a", "id2": "bb", "id3": "ccc"} {
+		rpcs.Set(context.Background(), &structure.BlockKV{ID: id, Data: gifts.Block(data)})
+	}
+	rpcs.Set(context.Background(), &structure.BlockKV{ID: "id3", Data: gifts.Block("dddd")})
+	stat, err = rpcs.Stat(context.Background())
+	test.AF(t, err == nil, fmt.Sprintf("RPCStorage.Stat failed: %v", err))
+	test.AF(t, stat.Used == 7 && stat.NBlocks == 3, fmt.Sprintf("Expected 7 bytes in 3 blocks, found %+v", stat))
+
+	// Nobody there
+	t.Log("TestRPCStorage_Stat: Starting test #3")
+	_, err = NewRPCStorage("localhost:3801").Stat(context.Background())
+	test.AF(t, err != nil, "Stat of nowhere should fail")
+}
+
+func TestRPCStorage_Concurrent(t *testing.T) {
+	t.Parallel()
+	s := NewStorage()
+	ServeRPC(s, "localhost:3900")
+
+	// Many goroutines on one RPCStorage share its connections
+	t.Log("TestRPCStorage_Concurrent: Starting test #1")
+	rpcs := NewRPCStorage("localhost:3900")
+	var wg sync.WaitGroup
+	errs := make([]error, 50)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := fmt.Sprintf("id%d", i)
+			if errs[i] = rpcs.Set(context.Background(), &structure.BlockKV{ID: id, Data: gifts.Block(id)}); errs[i] != nil {
+				return
+			}
+			var b gifts.Block
+			if errs[i] = rpcs.Get(context.Background(), id, &b); errs[i] == nil && string(b) != id {
+				errs[i] = fmt.Errorf("Expected %q, found %q", id, b)
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		test.AF(t, err == nil, fmt.Sprintf("Call %d failed: %v", i, err))
+	}
+
+	// At most the configured connections per peer, closed once idle
+	t.Log("TestRPCStorage_Concurrent: Starting test #2")
+	pool := gifts.NewRPCPool(2, 100*time.Millisecond, 0, gifts.ProtocolGob, nil)
+	defer pool.Close()
+	rcli := pool.NewClient("localhost:3900", RPCPathStorage)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var alive bool
+			rcli.Call(context.Background(), "Storage.Ping", true, &alive)
+		}()
+	}
+	wg.Wait()
+	n := pool.NConns("localhost:3900", RPCPathStorage)
+	test.AF(t, n == 2, fmt.Sprintf("Expected 2 connections, found %d", n))
+	time.Sleep(300 * time.Millisecond)
+	n = pool.NConns("localhost:3900", RPCPathStorage)
+	test.AF(t, n == 0, fmt.Sprintf("Expected the idle connections closed, found %d", n))
+
+	// Reconnects after that
+	var alive bool
+	err := rcli.Call(context.Background(), "Storage.Ping", true, &alive)
+	test.AF(t, err == nil && alive, fmt.Sprintf("Call after the eviction failed: %v", err))
+
+	// Errors of the server keep the connection
+	t.Log("TestRPCStorage_Concurrent: Starting test #3")
+	for i := 0; i < 2; i++ {
+		var b gifts.Block
+		err = rcli.Call(context.Background(), "Storage.Get", "nonexistent", &b)
+		test.AF(t, err != nil, "Get of nonexistent block should fail")
+	}
+	n = pool.NConns("localhost:3900", RPCPathStorage)
+	test.AF(t, n == 2, fmt.Sprintf("Expected the connections kept, found %d", n))
+}
+
+func TestRPCStorage_Timeout(t *testing.T) {
+	t.Parallel()
+	hung, err := test.ServeHung("localhost:3950", true)
+	test.AF(t, err == nil, fmt.Sprintf("ServeHung failed: %v", err))
+	defer hung.Close()
+	mute, err := test.ServeHung("localhost:3951", false)
+	test.AF(t, err == nil, fmt.Sprintf("ServeHung failed: %v", err))
+	defer mute.Close()
+
+	pool := gifts.NewRPCPool(1, 0, 100*time.Millisecond, gifts.ProtocolGob, nil)
+	defer pool.Close()
+
+	// A call never answered runs out of time, its connection is kept for the other calls
+	t.Log("TestRPCStorage_Timeout: Starting test #1")
+	rcli := pool.NewClient("localhost:3950", RPCPathStorage)
+	var b gifts.Block
+	start := time.Now()
+	err = rcli.Call(context.Background(), "Storage.Get", "id", &b)
+	test.AF(t, errors.Is(err, context.DeadlineExceeded), fmt.Sprintf("Expected the deadline exceeded, found %v", err))
+	test.AF(t, time.Since(start) < time.Second, fmt.Sprintf("Call took %v", time.Since(start)))
+	n := pool.NConns("localhost:3950", RPCPathStorage)
+	test.AF(t, n == 1, fmt.Sprintf("Expected the connection kept, found %d", n))
+
+	// So does the dial to a node hung before the handshake
+	t.Log("TestRPCStorage_Timeout: Starting test #2")
+	start = time.Now()
+	err = pool.NewClient("localhost:3951", RPCPathStorage).Call(context.Background(), "Storage.Get", "id", &b)
+	test.AF(t, err != nil, "Call to a hung node should fail")
+	test.AF(t, time.Since(start) < time.Second, fmt.Sprintf("Call took %v", time.Since(start)))
+
+	// A call given up by the caller keeps the connection
+	t.Log("TestRPCStorage_Timeout: Starting test #3")
+	pool = gifts.NewRPCPool(1, 0, 0, gifts.ProtocolGob, nil)
+	defer pool.Close()
+	rcli = pool.NewClient("localhost:3950", RPCPathStorage)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	err = rcli.Call(ctx, "Storage.Get", "id", &b)
+	test.AF(t, errors.Is(err, context.Canceled), fmt.Sprintf("Expected the call canceled, found %v", err))
+	n = pool.NConns("localhost:3950", RPCPathStorage)
+	test.AF(t, n == 1, fmt.Sprintf("Expected the connection kept, found %d", n))
+}
+
+// slowService answers its calls after the delay asked
+type slowService struct{}
+
+func (slowService) Sleep(d time.Duration, ignore *bool) error {
+	time.Sleep(d)
+	return nil
+}
+
+func TestRPCStorage_TimeoutShared(t *testing.T) {
+	t.Parallel()
+	server := rpc.NewServer()
+	server.RegisterName("Slow", slowService{})
+	l, err := net.Listen("tcp", "localhost:3967")
+	test.AF(t, err == nil, fmt.Sprintf("Listen failed: %v", err))
+	defer l.Close()
+	go gifts.ServeRPC(l, RPCPathStorage, server)
+
+	// One call out of time does not fail the others on the same connection
+	t.Log("TestRPCStorage_TimeoutShared: Starting test #1")
+	for _, protocol := range []gifts.Protocol{gifts.ProtocolGob, gifts.ProtocolFramed} {
+		pool := gifts.NewRPCPool(1, 0, 0, protocol, nil)
+		rcli := pool.NewClient("localhost:3967", RPCPathStorage)
+
+		var wg sync.WaitGroup
+		var slowErr, fastErr error
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			slowErr = rcli.Call(ctx, "Slow.Sleep", time.Second, new(bool))
+		}()
+		go func() {
+			defer wg.Done()
+			// still running when the other one runs out of time
+			fastErr = rcli.Call(context.Background(), "Slow.Sleep", 300*time.Millisecond, new(bool))
+		}()
+		wg.Wait()
+
+		test.AF(t, errors.Is(slowErr, context.DeadlineExceeded), fmt.Sprintf("Expected the deadline exceeded, found %v", slowErr))
+		test.AF(t, fastErr == nil, fmt.Sprintf("The other call on the connection failed: %v", fastErr))
+		n := pool.NConns("localhost:3967", RPCPathStorage)
+		test.AF(t, n == 1, fmt.Sprintf("Expected the connection kept, found %d", n))
+		pool.Close()
+	}
+}
+
+func TestRPCStorage_Retry(t *testing.T) {
+	t.Parallel()
+	s := NewStorage()
+	ServeRPC(s, "localhost:3952")
+
+	// Exponential backoff, bounded, jittered
+	t.Log("TestRPCStorage_Retry: Starting test #1")
+	r := gifts.RetryPolicy{MaxAttempts: 5, BaseBackoff: 10 * time.Millisecond, MaxBackoff: 40 * time.Millisecond}
+	for attempt, expected := range []time.Duration{10, 20, 40, 40} {
+		backoff := r.Backoff(attempt + 1)
+		test.AF(t, backoff == expected*time.Millisecond, fmt.Sprintf("Expected backoff %v after attempt %d, found %v", expected*time.Millisecond, attempt+1, backoff))
+	}
+	r.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		backoff := r.Backoff(2)
+		test.AF(t, backoff > 10*time.Millisecond && backoff <= 20*time.Millisecond, fmt.Sprintf("Backoff %v out of the jitter", backoff))
+	}
+
+	// Only the failures to reach the server are retried
+	t.Log("TestRPCStorage_Retry: Starting test #2")
+	test.AF(t, !gifts.IsRetryable(nil), "nil should not be retried")
+	test.AF(t, !gifts.IsRetryable(rpc.ServerError("File already exists")), "Errors of the server should not be retried")
+	test.AF(t, !gifts.IsRetryable(context.Canceled), "Canceled calls should not be retried")
+	test.AF(t, !gifts.IsRetryable(fmt.Errorf("call: %w", context.DeadlineExceeded)), "Calls out of time should not be retried")
+	test.AF(t, gifts.IsRetryable(rpc.ErrShutdown), "Broken connections should be retried")
+	test.AF(t, gifts.IsRetryable(io.ErrUnexpectedEOF), "Broken connections should be retried")
+
+	var b gifts.Block
+	err := NewRPCStorage("localhost:3952").Get(context.Background(), "nonexistent", &b)
+	test.AF(t, err != nil && !gifts.IsRetryable(err), fmt.Sprintf("Expected a permanent error, found %v", err))
+	err = NewRPCStorage("localhost:3953").Get(context.Background(), "nonexistent", &b)
+	test.AF(t, err != nil && gifts.IsRetryable(err), fmt.Sprintf("Expected a retryable error, found %v", err))
+
+	// At most MaxAttempts, a permanent error at once
+	t.Log("TestRPCStorage_Retry: Starting test #3")
+	r = gifts.RetryPolicy{MaxAttempts: 3, BaseBackoff: 10 * time.Millisecond}
+	attempts := 0
+	start := time.Now()
+	err = r.Do(context.Background(), func() error {
+		attempts++
+		return rpc.ErrShutdown
+	})
+	test.AF(t, err == rpc.ErrShutdown && attempts == 3, fmt.Sprintf("Expected 3 attempts, found %d: %v", attempts, err))
+	test.AF(t, time.Since(start) >= 30*time.Millisecond, fmt.Sprintf("Expected the backoff waited, took %v", time.Since(start)))
+
+	attempts = 0
+	err = r.Do(context.Background(), func() error {
+		attempts++
+		return rpc.ServerError("File already exists")
+	})
+	test.AF(t, err != nil && attempts == 1, fmt.Sprintf("Expected 1 attempt, found %d: %v", attempts, err))
+
+	// Not beyond the context
+	t.Log("TestRPCStorage_Retry: Starting test #4")
+	r = gifts.RetryPolicy{MaxAttempts: 3, BaseBackoff: time.Hour}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = r.Do(ctx, func() error { return rpc.ErrShutdown })
+	test.AF(t, errors.Is(err, context.DeadlineExceeded), fmt.Sprintf("Expected the deadline exceeded, found %v", err))
+
+	// A call that may have run is only retried if its method is idempotent
+	t.Log("TestRPCStorage_Retry: Starting test #5")
+	l, err := net.Listen("tcp", "localhost:3956")
+	test.AF(t, err == nil, fmt.Sprintf("Listen failed: %v", err))
+	defer l.Close()
+	var lock sync.Mutex
+	accepted := 0
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			lock.Lock()
+			accepted++
+			lock.Unlock()
+			// hangs up once the request is in, as if it crashed running it
+			r := bufio.NewReader(conn)
+			if _, err := http.ReadRequest(r); err == nil {
+				io.WriteString(conn, "HTTP/1.0 200 Connected to Go RPC\n\n")
+				r.ReadByte()
+			}
+			conn.Close()
+		}
+	}()
+	nAccepted := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		n := accepted
+		accepted = 0
+		return n
+	}
+
+	pool := gifts.NewRPCPool(1, 0, 0, gifts.ProtocolGob, nil)
+	defer pool.Close()
+	cli := pool.NewClient("localhost:3956", RPCPathStorage)
+	var ignore bool
+	err = cli.Call(context.Background(), "Test.Create", true, &ignore)
+	test.AF(t, err != nil && !gifts.IsNotSent(err), fmt.Sprintf("Expected the connection broken after sending, found %v", err))
+	test.AF(t, nAccepted() == 1, "A method not idempotent should not be retried once sent")
+	err = cli.Call(context.Background(), "Storage.Unset", "id", &ignore)
+	test.AF(t, err != nil, "Expected the connection broken")
+	test.AF(t, nAccepted() == gifts.DefaultRetryPolicy.MaxAttempts, "An idempotent method should be retried")
+
+	// Not sent at all, whatever the method
+	err = pool.NewClient("localhost:3957", RPCPathStorage).Call(context.Background(), "Test.Create", true, &ignore)
+	test.AF(t, err != nil && gifts.IsNotSent(err), fmt.Sprintf("Expected a failed dial, found %v", err))
+}
+
+func TestRPCStorage_Framed(t *testing.T) {
+	t.Parallel()
+	ServeRPC(NewStorage(), "localhost:3954")
+	ServeRPC(NewStorage(), "localhost:3955")
+
+	pool := gifts.NewRPCPool(1, 0, 0, gifts.ProtocolFramed, nil)
+	defer pool.Close()
+	framed := func(addr string) *RPCStorage {
+		return NewRPCStorageOn(addr, pool.NewClient(addr, RPCPathStorage))
+	}
+	rpcs := framed("localhost:3954")
+
+	// Blocks of any size, empty ones too
+	t.Log("TestRPCStorage_Framed: Starting test #1")
+	for _, size := range []int{0, 1, 4096, 1 << 20} {
+		id := fmt.Sprintf("id_%d", size)
+		data := make(gifts.Block, size)
+		generate.NewGenerate().Read(data)
+		err := rpcs.Set(context.Background(), &structure.BlockKV{ID: id, Data: data, Checksum: gifts.Checksum(data)})
+		test.AF(t, err == nil, fmt.Sprintf("Set of %d bytes failed: %v", size, err))
+
+		var b gifts.Block
+		err = rpcs.Get(context.Background(), id, &b)
+		test.AF(t, err == nil && bytes.Equal(b, data), fmt.Sprintf("Get of %d bytes failed: %v", size, err))
+	}
+
+	var part []byte
+	err := rpcs.GetRange(context.Background(), &structure.RangeReq{ID: "id_4096", Offset: 10, Length: 20}, &part)
+	test.AF(t, err == nil && len(part) == 20, fmt.Sprintf("GetRange failed: %v", err))
+
+	// Errors of the server come back as they are, the connection still usable
+	t.Log("TestRPCStorage_Framed: Starting test #2")
+	var b gifts.Block
+	err = rpcs.Get(context.Background(), "nonexistent", &b)
+	test.AF(t, err != nil && !gifts.IsRetryable(err), fmt.Sprintf("Expected an error of the server, found %v", err))
+	err = rpcs.Set(context.Background(), &structure.BlockKV{ID: "corrupt", Data: gifts.Block("data"), Checksum: "bad"})
+	test.AF(t, err != nil && !gifts.IsRetryable(err), fmt.Sprintf("Expected an error of the server, found %v", err))
+	test.AF(t, rpcs.Ping(context.Background()) == nil, "Ping failed")
+	n := pool.NConns("localhost:3954", RPCPathStorage)
+	test.AF(t, n == 1, fmt.Sprintf("Expected the connection kept, found %d", n))
+
+	// The other calls, the gob clients on the same address
+	t.Log("TestRPCStorage_Framed: Starting test #3")
+	stat, err := rpcs.Stat(context.Background())
+	test.AF(t, err == nil && stat.NBlocks == 4, fmt.Sprintf("Stat failed: %v %+v", err, stat))
+	report, err := rpcs.BlockReport(context.Background())
+	test.AF(t, err == nil && len(report) == 4, fmt.Sprintf("BlockReport failed: %v %v", err, report))
+	err = rpcs.Replicate(context.Background(), &structure.ReplicateKV{ID: "id_4096", Dest: "localhost:3955"})
+	test.AF(t, err == nil, fmt.Sprintf("Replicate failed: %v", err))
+	err = framed("localhost:3955").Get(context.Background(), "id_4096", &b)
+	test.AF(t, err == nil && len(b) == 4096, fmt.Sprintf("Get of the replica failed: %v", err))
+	err = NewRPCStorage("localhost:3954").Get(context.Background(), "id_4096", &b)
+	test.AF(t, err == nil && len(b) == 4096, fmt.Sprintf("Get over gob failed: %v", err))
+	err = rpcs.Unset(context.Background(), "id_4096", nil)
+	test.AF(t, err == nil, fmt.Sprintf("Unset failed: %v", err))
+
+	// Concurrent calls on the one connection
+	t.Log("TestRPCStorage_Framed: Starting test #4")
+	var wg sync.WaitGroup
+	errs := make([]error, 20)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := fmt.Sprintf("concurrent_%d", i)
+			if errs[i] = rpcs.Set(context.Background(), &structure.BlockKV{ID: id, Data: gifts.Block(id)}); errs[i] != nil {
+				return
+			}
+			var b gifts.Block
+			if errs[i] = rpcs.Get(context.Background(), id, &b); errs[i] == nil && string(b) != id {
+				errs[i] = fmt.Errorf("Expected %q, found %q", id, b)
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		test.AF(t, err == nil, fmt.Sprintf("Call %d failed: %v", i, err))
+	}
+
+	// Nothing at an unknown path
+	t.Log("TestRPCStorage_Framed: Starting test #5")
+	err = pool.NewClient("localhost:3954", "/nowhere").Call(context.Background(), "Storage.Ping", true, new(bool))
+	test.AF(t, err != nil, "Expected non-nil error")
+}
+
+func TestRPCStorage_SetStream(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gifts-stream-")
+	test.AF(t, err == nil, fmt.Sprintf("TempDir failed: %v", err))
+	defer os.RemoveAll(dir)
+	db, err := NewDiskBackend(dir)
+	test.AF(t, err == nil, fmt.Sprintf("NewDiskBackend failed: %v", err))
+
+	src, dst := NewStorageBackend(db), NewStorage()
+	ServeRPC(src, "localhost:3962")
+	ServeRPC(dst, "localhost:3963")
+
+	data := make(gifts.Block, 1<<20)
+	generate.NewGenerate().Read(data)
+	err = src.Set(&structure.BlockKV{ID: "id1", Data: data, Checksum: gifts.Checksum(data)}, nil)
+	test.AF(t, err == nil, fmt.Sprintf("Storage.Set failed: %v", err))
+
+	pool := gifts.NewRPCPool(1, 0, 0, gifts.ProtocolFramed, nil)
+	defer pool.Close()
+	open := func(id string) func() (io.ReadCloser, int, error) {
+		return func() (io.ReadCloser, int, error) {
+			r, size, _ := db.Open(id)
+			return newCheckedReader(id, r, gifts.Checksum(data)), size, nil
+		}
+	}
+
+	// Over either protocol, the destination gets the block whole
+	t.Log("TestRPCStorage_SetStream: Starting test #1")
+	for i, rpcs := range []*RPCStorage{
+		NewRPCStorage("localhost:3963"),
+		NewRPCStorageOn("localhost:3963", pool.NewClient("localhost:3963", RPCPathStorage)),
+	} {
+		id := fmt.Sprintf("stream_%d", i)
+		err = rpcs.SetStream(context.Background(), &structure.BlockStream{ID: id, Checksum: gifts.Checksum(data), Open: open("id1")})
+		test.AF(t, err == nil, fmt.Sprintf("SetStream failed: %v", err))
+		block, found := dst.blocks.Load(id)
+		test.AF(t, found && bytes.Equal(block, data), fmt.Sprintf("Expected the block streamed as %q", id))
+	}
+
+	// Replicate streams it from the backend
+	t.Log("TestRPCStorage_SetStream: Starting test #2")
+	err = NewRPCStorage("localhost:3962").Replicate(context.Background(), &structure.ReplicateKV{ID: "id1", Dest: "localhost:3963"})
+	test.AF(t, err == nil, fmt.Sprintf("Replicate failed: %v", err))
+	block, found := dst.blocks.Load("id1")
+	test.AF(t, found && bytes.Equal(block, data), "Expected the block replicated")
+
+	// A corrupted block is found out at its end, it never reaches the destination
+	t.Log("TestRPCStorage_SetStream: Starting test #3")
+	data[0]++
+	ioutil.WriteFile(db.path("id1"), data, diskFilePerm)
+	data[0]--
+	dst.blocks.Delete("id1")
+
+	rpcs := NewRPCStorageOn("localhost:3963", pool.NewClient("localhost:3963", RPCPathStorage))
+	err = rpcs.SetStream(context.Background(), &structure.BlockStream{ID: "corrupt", Checksum: gifts.Checksum(data), Open: open("id1")})
+	test.AF(t, err != nil && !gifts.IsRetryable(err), fmt.Sprintf("Expected a checksum mismatch, found %v", err))
+	test.AF(t, pool.NConns("localhost:3963", RPCPathStorage) == 0, "Expected the connection of the broken frame dropped")
+	test.AF(t, rpcs.Ping(context.Background()) == nil, "Ping failed")
+	test.AF(t, !dst.blocks.Has("corrupt"), "Corrupted block should not be stored")
+
+	err = NewRPCStorage("localhost:3962").Replicate(context.Background(), &structure.ReplicateKV{ID: "id1", Dest: "localhost:3963"})
+	test.AF(t, err != nil, "Replicate of a corrupted block should fail")
+	test.AF(t, !dst.blocks.Has("id1"), "Corrupted block should not be replicated")
+}
+
+func TestServeRPC_Handshake(t *testing.T) {
+	t.Parallel()
+	ServeRPC(NewStorage(), "localhost:3964")
+
+	// A client that says nothing is let go
+	t.Log("TestServeRPC_Handshake: Starting test #1")
+	conn, err := net.Dial("tcp", "localhost:3964")
+	test.AF(t, err == nil, fmt.Sprintf("Dial failed: %v", err))
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	var ne net.Error
+	test.AF(t, err != nil && !(errors.As(err, &ne) && ne.Timeout()), fmt.Sprintf("Expected the connection closed by the server, found %v", err))
+
+	// Past the handshake, a connection may stay idle
+	t.Log("TestServeRPC_Handshake: Starting test #2")
+	for _, protocol := range []gifts.Protocol{gifts.ProtocolGob, gifts.ProtocolFramed} {
+		pool := gifts.NewRPCPool(1, 0, 0, protocol, nil)
+		rpcs := NewRPCStorageOn("localhost:3964", pool.NewClient("localhost:3964", RPCPathStorage))
+		test.AF(t, rpcs.Ping(context.Background()) == nil, "Ping failed")
+		time.Sleep(2 * gifts.HandshakeTimeout)
+		test.AF(t, rpcs.Ping(context.Background()) == nil, "Ping after idling failed")
+		test.AF(t, pool.NConns("localhost:3964", RPCPathStorage) == 1, "Expected the connection kept")
+		pool.Close()
+	}
+}
+
+func TestServeRPC_MaxPayload(t *testing.T) {
+	t.Parallel()
+	ServeRPC(NewStorage(), "localhost:3968")
+
+	conn, err := net.Dial("tcp", "localhost:3968")
+	test.AF(t, err == nil, fmt.Sprintf("Dial failed: %v", err))
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// The framed handshake, see framed.go
+	t.Log("TestServeRPC_MaxPayload: Starting test #1")
+	hello := append([]byte("GIFTS/F1"), 0, byte(len(RPCPathStorage)))
+	hello = append(hello, RPCPathStorage...)
+	_, err = conn.Write(hello)
+	test.AF(t, err == nil, fmt.Sprintf("Write failed: %v", err))
+	answer := make([]byte, 1)
+	_, err = io.ReadFull(conn, answer)
+	test.AF(t, err == nil && answer[0] == 0, fmt.Sprintf("Handshake failed: %v", err))
+
+	// A request claiming a payload past the block, refused before it is read
+	t.Log("TestServeRPC_MaxPayload: Starting test #2")
+	name := "Storage.Set"
+	header := make([]byte, 8+2+1+4)
+	binary.BigEndian.PutUint16(header[8:], uint16(len(name)))
+	header[10] = 1 << 1
+	binary.BigEndian.PutUint32(header[11:], uint32(gifts.MaxPayload+1))
+	_, err = conn.Write(append(header, name...))
+	test.AF(t, err == nil, fmt.Sprintf("Write failed: %v", err))
+	_, err = conn.Read(answer)
+	var ne net.Error
+	test.AF(t, err != nil && !(errors.As(err, &ne) && ne.Timeout()), fmt.Sprintf("Expected the connection closed by the server, found %v", err))
+}
+
+func TestRPCPool_HealthCheck(t *testing.T) {
+	t.Parallel()
+	ServeRPC(NewStorage(), "localhost:3965")
+	hung, err := test.ServeHung("localhost:3966", true)
+	test.AF(t, err == nil, fmt.Sprintf("ServeHung failed: %v", err))
+	defer hung.Close()
+
+	// An idle connection to a live server is kept
+	t.Log("TestRPCPool_HealthCheck: Starting test #1")
+	for _, protocol := range []gifts.Protocol{gifts.ProtocolGob, gifts.ProtocolFramed} {
+		pool := gifts.NewRPCPool(1, 0, 0, protocol, nil)
+		pool.CheckHealth(100 * time.Millisecond)
+		rpcs := NewRPCStorageOn("localhost:3965", pool.NewClient("localhost:3965", RPCPathStorage))
+		test.AF(t, rpcs.Ping(context.Background()) == nil, "Ping failed")
+		time.Sleep(350 * time.Millisecond)
+		n := pool.NConns("localhost:3965", RPCPathStorage)
+		test.AF(t, n == 1, fmt.Sprintf("Expected the connection kept, found %d", n))
+		test.AF(t, rpcs.Ping(context.Background()) == nil, "Ping after the checks failed")
+		pool.Close()
+	}
+
+	// One to a server gone silent is dropped, without any call failing on it
+	t.Log("TestRPCPool_HealthCheck: Starting test #2")
+	pool := gifts.NewRPCPool(1, 0, 0, gifts.ProtocolGob, nil)
+	defer pool.Close()
+	pool.CheckHealth(100 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	err = pool.NewClient("localhost:3966", RPCPathStorage).Call(ctx, "Storage.Ping", true, new(bool))
+	test.AF(t, errors.Is(err, context.Canceled), fmt.Sprintf("Expected the call canceled, found %v", err))
+	n := pool.NConns("localhost:3966", RPCPathStorage)
+	test.AF(t, n == 1, fmt.Sprintf("Expected the connection kept by the canceled call, found %d", n))
+	time.Sleep(500 * time.Millisecond)
+	n = pool.NConns("localhost:3966", RPCPathStorage)
+	test.AF(t, n == 0, fmt.Sprintf("Expected the silent connection dropped, found %d", n))
+}
@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"time"
+
+	gifts "github.com/GIFTS-fs/GIFTS"
+)
+
+// ReportCorruptFunc tells the master a block of the Storage failed verification
+type ReportCorruptFunc func(id string) error
+
+// Scrubber periodically re-reads every block of a Storage and verifies it
+// against its checksum. Corrupt blocks are quarantined and reported,
+// so the master can re-replicate them from a healthy copy.
+type Scrubber struct {
+	s           *Storage
+	bytesPerSec int // no rate limit if <= 0
+	report      ReportCorruptFunc
+}
+
+// NewScrubber for the Storage, reading at most bytesPerSec.
+// report can be nil if there is no master to tell.
+func NewScrubber(s *Storage, bytesPerSec int, report ReportCorruptFunc) *Scrubber {
+	return &Scrubber{s: s, bytesPerSec: bytesPerSec, report: report}
+}
+
+// Run a full pass every interval until done is closed, blocks
+func (sc *Scrubber) Run(interval time.Duration, done chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			nScanned, nCorrupt := sc.ScrubOnce()
+			sc.s.Logger.Printf("Scrubber.ScrubOnce() => %d scanned, %d corrupt", nScanned, nCorrupt)
+		case <-done:
+			return
+		}
+	}
+}
+
+// ScrubOnce verifies every block with a known checksum once
+func (sc *Scrubber) ScrubOnce() (nScanned, nCorrupt int) {
+	// Do not hold the backend while reading
+	var ids []string
+	sc.s.blocks.Range(func(id string, size int) bool {
+		ids = append(ids, id)
+		return true
+	})
+
+	for _, id := range ids {
+		block, found := sc.s.blocks.Load(id)
+		if !found {
+			// gone in the middle
+			continue
+		}
+		nScanned++
+
+		if !sc.verify(id, block) {
+			if sc.quarantine(id) {
+				nCorrupt++
+			}
+		}
+
+		sc.throttle(len(block))
+	}
+	return
+}
+
+// verify block against the checksum stored with it, true if unknown
+func (sc *Scrubber) verify(id string, block gifts.Block) bool {
+	checksum, found := sc.s.blocks.LoadChecksum(id)
+	return !found || gifts.Checksum(block) == checksum
+}
+
+// quarantine and report the block if it is still corrupt, return false if it was rewritten
+func (sc *Scrubber) quarantine(id string) bool {
+	// A concurrent Set may have replaced the block between reading it and its checksum, check again
+	sc.s.blocksLock.Lock()
+	block, found := sc.s.blocks.Load(id)
+	if !found || sc.verify(id, block) {
+		sc.s.blocksLock.Unlock()
+		return false
+	}
+	err := sc.s.blocks.Quarantine(id)
+	sc.s.blocksLock.Unlock()
+
+	if err != nil {
+		sc.s.Logger.Printf("Scrubber.quarantine(%q) => %v", id, err)
+		return false
+	}
+	sc.s.Logger.Printf("Scrubber.quarantine(%q) => corrupt block quarantined", id)
+
+	if sc.report != nil {
+		if err := sc.report(id); err != nil {
+			sc.s.Logger.Printf("Scrubber.quarantine(%q) failed to report: %v", id, err)
+		}
+	}
+	return true
+}
+
+// throttle to the rate limit after reading n bytes
+func (sc *Scrubber) throttle(n int) {
+	if sc.bytesPerSec > 0 {
+		time.Sleep(time.Duration(n) * time.Second / time.Duration(sc.bytesPerSec))
+	}
+}
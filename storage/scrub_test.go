@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	gifts "github.com/GIFTS-fs/GIFTS"
+	"github.com/GIFTS-fs/GIFTS/structure"
+	"github.com/GIFTS-fs/GIFTS/test"
+)
+
+func TestScrubber(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gifts-scrub-")
+	test.AF(t, err == nil, fmt.Sprintf("TempDir failed: %v", err))
+	defer os.RemoveAll(dir)
+
+	db, err := NewDiskBackend(dir)
+	test.AF(t, err == nil, fmt.Sprintf("NewDiskBackend failed: %v", err))
+
+	for _, backend := range []Backend{NewMemoryBackend(), db} {
+		s := NewStorageBackend(backend)
+
+		var reported []string
+		sc := NewScrubber(s, 0, func(id string) error {
+			reported = append(reported, id)
+			return nil
+		})
+
+		for i := 0; i < 4; i++ {
+			data := gifts.Block(fmt.Sprintf("data_%d", i))
+			err := s.Set(&structure.BlockKV{ID: fmt.Sprintf("id_%d", i), Data: data, Checksum: gifts.Checksum(data)}, nil)
+			test.AF(t, err == nil, fmt.Sprintf("Storage.Set failed: %v", err))
+		}
+		err := s.Set(&structure.BlockKV{ID: "no_checksum", Data: gifts.Block("data")}, nil)
+		test.AF(t, err == nil, fmt.Sprintf("Storage.Set failed: %v", err))
+
+		// All healthy
+		t.Logf("TestScrubber: Starting test #1")
+		nScanned, nCorrupt := sc.ScrubOnce()
+		test.AF(t, nScanned == 5, fmt.Sprintf("Expected 5 blocks scanned, found %d", nScanned))
+		test.AF(t, nCorrupt == 0, fmt.Sprintf("Expected no corrupt block, found %d", nCorrupt))
+
+		// Rot one block behind the back of the checksum
+		t.Logf("TestScrubber: Starting test #2")
+		switch b := backend.(type) {
+		case *MemoryBackend:
+			b.blocks.Store("id_1", gifts.Block("data_X"))
+		case *DiskBackend:
+			ioutil.WriteFile(b.path("id_1"), []byte("data_X"), diskFilePerm)
+		}
+
+		nScanned, nCorrupt = sc.ScrubOnce()
+		test.AF(t, nScanned == 5, fmt.Sprintf("Expected 5 blocks scanned, found %d", nScanned))
+		test.AF(t, nCorrupt == 1, fmt.Sprintf("Expected 1 corrupt block, found %d", nCorrupt))
+		test.AF(t, len(reported) == 1 && reported[0] == "id_1", fmt.Sprintf("Expected id_1 reported, found %v", reported))
+
+		var ret gifts.Block
+		test.AF(t, s.Get("id_1", &ret) != nil, "Corrupt block should not be served")
+		test.AF(t, s.Get("id_0", &ret) == nil, "Healthy block should still be served")
+
+		// Written again by the repair
+		t.Logf("TestScrubber: Starting test #3")
+		data := gifts.Block("data_1")
+		err = s.Set(&structure.BlockKV{ID: "id_1", Data: data, Checksum: gifts.Checksum(data)}, nil)
+		test.AF(t, err == nil, fmt.Sprintf("Storage.Set failed: %v", err))
+		_, nCorrupt = sc.ScrubOnce()
+		test.AF(t, nCorrupt == 0, fmt.Sprintf("Expected no corrupt block, found %d", nCorrupt))
+	}
+}
+
+func TestScrubber_ConcurrentSet(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gifts-scrub-")
+	test.AF(t, err == nil, fmt.Sprintf("TempDir failed: %v", err))
+	defer os.RemoveAll(dir)
+
+	db, err := NewDiskBackend(dir)
+	test.AF(t, err == nil, fmt.Sprintf("NewDiskBackend failed: %v", err))
+
+	for _, backend := range []Backend{NewMemoryBackend(), db} {
+		s := NewStorageBackend(backend)
+		s.Logger.Enabled = false
+		sc := NewScrubber(s, 0, nil)
+
+		// Sets of the same ID racing each other and the scrubber
+		t.Logf("TestScrubber_ConcurrentSet: Starting test #1")
+		nWriters, nSets := 4, 50
+		done := make(chan bool, nWriters)
+		for w := 0; w < nWriters; w++ {
+			go func(w int) {
+				for i := 0; i < nSets; i++ {
+					data := gifts.Block(fmt.Sprintf("data_%d_%d", w, i))
+					err := s.Set(&structure.BlockKV{ID: "id", Data: data, Checksum: gifts.Checksum(data)}, nil)
+					test.AF(t, err == nil, fmt.Sprintf("Storage.Set failed: %v", err))
+				}
+				done <- true
+			}(w)
+		}
+
+		nCorrupt := 0
+		for running := nWriters; running > 0; {
+			select {
+			case <-done:
+				running--
+			default:
+				_, n := sc.ScrubOnce()
+				nCorrupt += n
+			}
+		}
+		test.AF(t, nCorrupt == 0, fmt.Sprintf("Expected no corrupt block, found %d", nCorrupt))
+
+		// The last one wins, data and checksum alike
+		t.Logf("TestScrubber_ConcurrentSet: Starting test #2")
+		block, found := backend.Load("id")
+		test.AF(t, found, "Block should be stored")
+		sum, found := backend.LoadChecksum("id")
+		test.AF(t, found && sum == gifts.Checksum(block), fmt.Sprintf("Checksum %q does not match the block %q", sum, block))
+	}
+}
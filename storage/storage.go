@@ -2,9 +2,12 @@ package storage
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"fmt"
+	"hash"
+	"io"
 	"net"
-	"net/http"
 	"net/rpc"
 	"os"
 	"sync"
@@ -24,10 +27,15 @@ const (
 // Storage is a concurrency-safe key-value store.
 type Storage struct {
 	Logger     *gifts.Logger // PRODUCTION: banish this
-	blocks     sync.Map
+	blocks     Backend
 	blocksLock sync.RWMutex
 	rpc        sync.Map
 
+	// bytes the blocks may take, reported to the Master, unlimited if 0
+	Capacity int64
+	// served over TLS if not nil, see gifts.LoadTLSConfig
+	TLS *tls.Config
+
 	// stat
 	StatEnabled     bool
 	statLastCollect time.Time
@@ -37,10 +45,16 @@ type Storage struct {
 	statDone        chan bool
 }
 
-// NewStorage creates a new storage node
+// NewStorage creates a new storage node that keeps blocks in memory
 func NewStorage() *Storage {
+	return NewStorageBackend(NewMemoryBackend())
+}
+
+// NewStorageBackend creates a new storage node that keeps blocks in the backend
+func NewStorageBackend(backend Backend) *Storage {
 	return &Storage{
 		Logger: gifts.NewLogger("Storage", "local", false), // PRODUCTION: banish this
+		blocks: backend,
 	}
 }
 
@@ -70,9 +84,9 @@ func ServeRPCBlock(s *Storage, addr string, readyChan chan bool) (err error) {
 		s.Logger.Printf("ServeRPC(%q) => %v", addr, err)
 		return
 	}
-
-	mux := http.NewServeMux()
-	mux.Handle(RPCPathStorage, server)
+	if s.TLS != nil {
+		listener = tls.NewListener(listener, s.TLS)
+	}
 
 	if readyChan != nil {
 		readyChan <- true
@@ -80,7 +94,7 @@ func ServeRPCBlock(s *Storage, addr string, readyChan chan bool) (err error) {
 	}
 
 	s.Logger.Printf("ServeRPC(%q) => success", addr)
-	return http.Serve(listener, mux)
+	return gifts.ServeRPC(listener, RPCPathStorage, server)
 }
 
 // ServeRPC makes the raw Storage accessible via RPC at the specified IP
@@ -101,8 +115,23 @@ func ServeRPC(s *Storage, addr string) (err error) {
 func (s *Storage) Set(kv *structure.BlockKV, ignore *bool) error {
 	s.Logger.Printf("Storage.Set(%q, %d bytes)", kv.ID, len(kv.Data))
 
-	// Store data into block
-	s.blocks.Store(kv.ID, kv.Data)
+	// Do not store what is already corrupted
+	if kv.Checksum != "" && gifts.Checksum(kv.Data) != kv.Checksum {
+		err := fmt.Errorf("Block with ID %s does not match checksum %s", kv.ID, kv.Checksum)
+		s.Logger.Printf("Storage.Set(%q, %d bytes) => %q", kv.ID, len(kv.Data), err)
+		return err
+	}
+
+	// The scrubber must not quarantine while the block is replaced
+	s.blocksLock.RLock()
+	defer s.blocksLock.RUnlock()
+
+	// Store data into block, with the checksum for the scrubber,
+	// a concurrent Set of the same ID must not pair its data with ours
+	if err := s.blocks.Store(kv.ID, kv.Data, kv.Checksum); err != nil {
+		s.Logger.Printf("Storage.Set(%q, %d bytes) => %v", kv.ID, len(kv.Data), err)
+		return err
+	}
 
 	return nil
 }
@@ -115,7 +144,7 @@ func (s *Storage) Get(id string, ret *gifts.Block) error {
 	*ret = make([]byte, 0)
 
 	// Load block
-	value, found := s.blocks.Load(id)
+	block, found := s.blocks.Load(id)
 
 	// Check if ID exists
 	if !found {
@@ -125,7 +154,6 @@ func (s *Storage) Get(id string, ret *gifts.Block) error {
 	}
 
 	// Copy data
-	block := value.(gifts.Block)
 	*ret = make([]byte, len(block))
 	copy(*ret, block)
 
@@ -133,24 +161,66 @@ func (s *Storage) Get(id string, ret *gifts.Block) error {
 	return nil
 }
 
-// Replicate the specified block to the destination Storage node
-func (s *Storage) Replicate(kv *structure.ReplicateKV, ignore *bool) error {
-	// Load block
-	s.blocksLock.RLock()
-	block, found := s.blocks.Load(kv.ID)
-	s.blocksLock.RUnlock()
+// GetRange gets at most req.Length bytes of the block starting at req.Offset,
+// so the callers needing only a part do not pay for the whole block
+func (s *Storage) GetRange(req *structure.RangeReq, ret *[]byte) error {
+	go s.hitStat()
+
+	// Clear the return value
+	*ret = make([]byte, 0)
+
+	if req.Offset < 0 || req.Length < 0 {
+		err := fmt.Errorf("Invalid range of block %s: offset %d, length %d", req.ID, req.Offset, req.Length)
+		s.Logger.Printf("Storage.GetRange(%q, %d, %d) => %q", req.ID, req.Offset, req.Length, err)
+		return err
+	}
+
+	// Load the range
+	data, found := s.blocks.LoadRange(req.ID, req.Offset, req.Length)
 
 	// Check if ID exists
 	if !found {
+		err := fmt.Errorf("Block with ID %s does not exist", req.ID)
+		s.Logger.Printf("Storage.GetRange(%q, %d, %d) => %q", req.ID, req.Offset, req.Length, err)
+		return err
+	}
+
+	// Copy data
+	*ret = make([]byte, len(data))
+	copy(*ret, data)
+
+	s.Logger.Printf("Storage.GetRange(%q, %d, %d) => %d bytes", req.ID, req.Offset, req.Length, len(data))
+	return nil
+}
+
+// Replicate the specified block to the destination Storage node
+func (s *Storage) Replicate(kv *structure.ReplicateKV, ignore *bool) error {
+	// Check if ID exists
+	if !s.blocks.Has(kv.ID) {
 		err := fmt.Errorf("Block with ID %s does not exist", kv.ID)
 		s.Logger.Printf("Storage.Replicate(%q, %q) => %q", kv.ID, kv.Dest, err)
 		return err
 	}
 
-	// Start an RPC session with the destination and copy the block
+	checksum := kv.Checksum
+	if checksum == "" {
+		checksum, _ = s.blocks.LoadChecksum(kv.ID)
+	}
+
+	// Stream the block from the backend to the destination, never loaded whole,
+	// bounded by the call timeout of the connections, not by the caller
+	bs := structure.BlockStream{ID: kv.ID, Checksum: checksum, Open: func() (io.ReadCloser, int, error) {
+		s.blocksLock.RLock()
+		data, size, found := s.blocks.Open(kv.ID)
+		s.blocksLock.RUnlock()
+		if !found {
+			return nil, 0, fmt.Errorf("Block with ID %s does not exist", kv.ID)
+		}
+		// Do not spread a corrupted copy
+		return newCheckedReader(kv.ID, data, checksum), size, nil
+	}}
 	rs, _ := s.rpc.LoadOrStore(kv.Dest, NewRPCStorage(kv.Dest))
-	blockKV := structure.BlockKV{ID: kv.ID, Data: block.(gifts.Block)}
-	if err := rs.(*RPCStorage).Set(&blockKV); err != nil {
+	if err := rs.(*RPCStorage).SetStream(context.Background(), &bs); err != nil {
 		s.Logger.Printf("Storage.Replicate(%q, %q) => %v", kv.ID, kv.Dest, err)
 		return err
 	}
@@ -159,25 +229,109 @@ func (s *Storage) Replicate(kv *structure.ReplicateKV, ignore *bool) error {
 	return nil
 }
 
-// Unset deletes the data associated with the block's ID
-func (s *Storage) Unset(id string, ignore *bool) error {
-	// Load block
-	_, found := s.blocks.Load(id)
+// checkedReader fails at the end of the block if it does not match the checksum,
+// not checked if empty
+type checkedReader struct {
+	io.ReadCloser
+	id       string
+	checksum string
+	hash     hash.Hash
+}
 
-	// Check if ID exists
-	if !found {
-		err := fmt.Errorf("Block with ID %s does not exist", id)
-		s.Logger.Printf("Storage.Unset(%q) => %q", id, err)
-		return err
+func newCheckedReader(id string, data io.ReadCloser, checksum string) *checkedReader {
+	return &checkedReader{ReadCloser: data, id: id, checksum: checksum, hash: gifts.NewChecksumHash()}
+}
+
+func (r *checkedReader) Read(p []byte) (n int, err error) {
+	n, err = r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF && r.checksum != "" && gifts.ChecksumOf(r.hash) != r.checksum {
+		err = fmt.Errorf("Block with ID %s does not match checksum %s", r.id, r.checksum)
+	}
+	return
+}
+
+// Unset deletes the data associated with the block's ID.
+// A block already gone is no error: the caller only wants it gone,
+// and a retry must not fail a delete that went through.
+func (s *Storage) Unset(id string, ignore *bool) error {
+	if !s.blocks.Has(id) {
+		s.Logger.Printf("Storage.Unset(%q) => already gone", id)
+		return nil
 	}
 
 	// Delete block
-	s.blocks.Delete(id)
+	if err := s.blocks.Delete(id); err != nil {
+		s.Logger.Printf("Storage.Unset(%q) => %v", id, err)
+		return err
+	}
 
 	s.Logger.Printf("Storage.Unset(%q) => success", id)
 	return nil
 }
 
+// Ping tells the caller the Storage is alive
+func (s *Storage) Ping(ignore bool, alive *bool) error {
+	*alive = true
+	return nil
+}
+
+// Stat tells the caller how much space the Storage has and uses
+func (s *Storage) Stat(ignore bool, ret *structure.StorageStat) error {
+	*ret = structure.StorageStat{Capacity: s.Capacity}
+	s.blocks.Range(func(id string, size int) bool {
+		ret.Used += int64(size)
+		ret.NBlocks++
+		return true
+	})
+
+	s.Logger.Printf("Storage.Stat() => %d of %d bytes in %d blocks", ret.Used, ret.Capacity, ret.NBlocks)
+	return nil
+}
+
+// BlockReport lists all blocks held by the Storage
+func (s *Storage) BlockReport(ignore bool, report *[]structure.BlockInfo) error {
+	*report = make([]structure.BlockInfo, 0)
+	s.blocks.Range(func(id string, size int) bool {
+		*report = append(*report, structure.BlockInfo{ID: id, Size: size})
+		return true
+	})
+
+	s.Logger.Printf("Storage.BlockReport() => %d blocks", len(*report))
+	return nil
+}
+
+// Verify checks the block against the checksum stored with it, for a master
+// told it is corrupt by someone else. A corrupt block is quarantined as the
+// scrubber would; healthy is false if it is corrupt or already gone,
+// true if it matches or there is no checksum to tell.
+func (s *Storage) Verify(id string, healthy *bool) error {
+	s.blocksLock.Lock()
+	defer s.blocksLock.Unlock()
+
+	block, found := s.blocks.Load(id)
+	if !found {
+		*healthy = false
+		s.Logger.Printf("Storage.Verify(%q) => already gone", id)
+		return nil
+	}
+
+	checksum, known := s.blocks.LoadChecksum(id)
+	if !known || gifts.Checksum(block) == checksum {
+		*healthy = true
+		s.Logger.Printf("Storage.Verify(%q) => healthy", id)
+		return nil
+	}
+
+	if err := s.blocks.Quarantine(id); err != nil {
+		s.Logger.Printf("Storage.Verify(%q) => %v", id, err)
+		return err
+	}
+	*healthy = false
+	s.Logger.Printf("Storage.Verify(%q) => corrupt block quarantined", id)
+	return nil
+}
+
 func (s *Storage) hitStat() {
 	if s.StatEnabled {
 		s.statCounterLock.Lock()
@@ -38,7 +38,7 @@ func TestStorage_Set(t *testing.T) {
 	test.AF(t, err == nil, fmt.Sprintf("Storage.Set failed: %v", err))
 	for i := range kv.Data {
 		actualData, _ := s.blocks.Load("id1")
-		actual := actualData.(gifts.Block)[i]
+		actual := actualData[i]
 		test.AF(t, kv.Data[i] == actual, fmt.Sprintf("Expected %c but found %c", kv.Data[i], actual))
 	}
 
@@ -49,12 +49,22 @@ func TestStorage_Set(t *testing.T) {
 	test.AF(t, err == nil, fmt.Sprintf("Storage.Set failed: %v", err))
 	for i := range kv.Data {
 		actualData, _ := s.blocks.Load("id1")
-		actual := actualData.(gifts.Block)[i]
+		actual := actualData[i]
 		test.AF(t, kv.Data[i] == actual, fmt.Sprintf("Expected %c but found %c", kv.Data[i], actual))
 	}
 
-	// Parallel sets
+	// Checksums
 	t.Logf("TestStorage_Set: Starting test #3")
+	kv = &structure.BlockKV{ID: "id2", Data: gifts.Block("data 2"), Checksum: gifts.Checksum(gifts.Block("data 2"))}
+	err = s.Set(kv, nil)
+	test.AF(t, err == nil, fmt.Sprintf("Storage.Set failed: %v", err))
+	kv = &structure.BlockKV{ID: "id3", Data: gifts.Block("data 3"), Checksum: gifts.Checksum(gifts.Block("data 2"))}
+	err = s.Set(kv, nil)
+	test.AF(t, err != nil, "Data not matching the checksum should fail")
+	test.AF(t, !s.blocks.Has("id3"), "Data not matching the checksum should not be stored")
+
+	// Parallel sets
+	t.Logf("TestStorage_Set: Starting test #4")
 	nSets := 100
 	done := make(chan bool, nSets)
 	for i := 0; i < nSets; i++ {
@@ -80,7 +90,7 @@ func TestStorage_Set(t *testing.T) {
 		for j := range data {
 			expected := data[j]
 			actual, _ := s.blocks.Load(id)
-			test.AF(t, expected == actual.(gifts.Block)[j], fmt.Sprintf("ID %s: Expected %c but found %c", id, expected, actual))
+			test.AF(t, expected == actual[j], fmt.Sprintf("ID %s: Expected %c but found %c", id, expected, actual))
 		}
 	}
 }
@@ -97,14 +107,14 @@ func TestStorage_Get(t *testing.T) {
 
 	// Get empty data
 	t.Logf("TestStorage_Get: Starting test #2")
-	s.blocks.Store("id1", gifts.Block(""))
+	s.blocks.Store("id1", gifts.Block(""), "")
 	err = s.Get("id1", data)
 	test.AF(t, err == nil, fmt.Sprintf("Storage.Get failed: %v", err))
 	test.AF(t, len(*data) == 0, fmt.Sprintf("Expected empty data, found %q", *data))
 
 	// Get some data
 	t.Logf("TestStorage_Get: Starting test #3")
-	s.blocks.Store("id2", gifts.Block("some data"))
+	s.blocks.Store("id2", gifts.Block("some data"), "")
 	err = s.Get("id2", data)
 	test.AF(t, err == nil, fmt.Sprintf("Storage.Get failed: %v", err))
 	test.AF(t, string(*data) == "some data", fmt.Sprintf("Expected \"some data\", found %q", *data))
@@ -115,7 +125,7 @@ func TestStorage_Get(t *testing.T) {
 	for i := 0; i < nBlocks; i++ {
 		id := fmt.Sprintf("id_%d", i)
 		data := gifts.Block(fmt.Sprintf("data_%d", i))
-		s.blocks.Store(id, gifts.Block(data))
+		s.blocks.Store(id, gifts.Block(data), "")
 	}
 
 	nGets := 100
@@ -140,10 +150,43 @@ func TestStorage_Get(t *testing.T) {
 	}
 }
 
+func TestStorage_GetRange(t *testing.T) {
+	t.Parallel()
+	s := NewStorage()
+	data := new([]byte)
+
+	// Attempt to get a missing ID
+	t.Logf("TestStorage_GetRange: Starting test #1")
+	err := s.GetRange(&structure.RangeReq{ID: "fake_id", Offset: 0, Length: 1}, data)
+	test.AF(t, err != nil, "Storage.GetRange: Expected non-nil error")
+
+	// Invalid range
+	t.Logf("TestStorage_GetRange: Starting test #2")
+	s.blocks.Store("id1", gifts.Block("some data"), "")
+	err = s.GetRange(&structure.RangeReq{ID: "id1", Offset: -1, Length: 1}, data)
+	test.AF(t, err != nil, "Storage.GetRange: Expected non-nil error for a negative offset")
+	err = s.GetRange(&structure.RangeReq{ID: "id1", Offset: 0, Length: -1}, data)
+	test.AF(t, err != nil, "Storage.GetRange: Expected non-nil error for a negative length")
+
+	// Get a range in the middle
+	t.Logf("TestStorage_GetRange: Starting test #3")
+	err = s.GetRange(&structure.RangeReq{ID: "id1", Offset: 2, Length: 5}, data)
+	test.AF(t, err == nil, fmt.Sprintf("Storage.GetRange failed: %v", err))
+	test.AF(t, string(*data) == "me da", fmt.Sprintf("Expected \"me da\", found %q", *data))
+
+	// Range past the end of the block
+	t.Logf("TestStorage_GetRange: Starting test #4")
+	err = s.GetRange(&structure.RangeReq{ID: "id1", Offset: 5, Length: 100}, data)
+	test.AF(t, err == nil, fmt.Sprintf("Storage.GetRange failed: %v", err))
+	test.AF(t, string(*data) == "data", fmt.Sprintf("Expected \"data\", found %q", *data))
+	err = s.GetRange(&structure.RangeReq{ID: "id1", Offset: 100, Length: 1}, data)
+	test.AF(t, err == nil && len(*data) == 0, fmt.Sprintf("Expected empty data, found %q, %v", *data, err))
+}
+
 func TestStorage_Replicate(t *testing.T) {
 	t.Parallel()
 	s := NewStorage()
-	s.blocks.Store("valid_id", gifts.Block("Hello World"))
+	s.blocks.Store("valid_id", gifts.Block("Hello World"), "")
 	var kv structure.ReplicateKV
 	var err error
 
@@ -173,21 +216,30 @@ func TestStorage_Replicate(t *testing.T) {
 
 	expected, _ := s.blocks.Load("valid_id")
 	actual, _ := rs.blocks.Load("valid_id")
-	test.AF(t, string(expected.(gifts.Block)) == string(actual.(gifts.Block)), fmt.Sprintf("Expected %q, found %q", expected, actual))
+	test.AF(t, string(expected) == string(actual), fmt.Sprintf("Expected %q, found %q", expected, actual))
+
+	// Corrupted source
+	t.Logf("TestStorage_Replicate: Starting test #4")
+	s.blocks.Store("corrupted_id", gifts.Block("Hello Wor1d"), "")
+	kv.ID = "corrupted_id"
+	kv.Checksum = gifts.Checksum(gifts.Block("Hello World"))
+	err = s.Replicate(&kv, nil)
+	test.AF(t, err != nil, "Replicating a corrupted block should fail")
+	test.AF(t, !rs.blocks.Has("corrupted_id"), "Corrupted block should not be replicated")
 }
 
 func TestStorage_Unset(t *testing.T) {
 	t.Parallel()
 
-	// Missing ID
+	// Missing ID, already gone
 	t.Logf("TestStorage_Set: Starting test #1")
 	s := NewStorage()
 	err := s.Unset("id1", nil)
-	test.AF(t, err != nil, "Expected non-nil error")
+	test.AF(t, err == nil, fmt.Sprintf("Unset of a missing block failed: %v", err))
 
 	// Unset data
 	t.Logf("TestStorage_Set: Starting test #2")
-	s.blocks.Store("id1", gifts.Block("data 1"))
+	s.blocks.Store("id1", gifts.Block("data 1"), "")
 	err = s.Unset("id1", nil)
 	test.AF(t, err == nil, fmt.Sprintf("Storage.Unset failed: %v", err))
 	actual, found := s.blocks.Load("id1")
@@ -200,7 +252,7 @@ func TestStorage_Unset(t *testing.T) {
 	for i := 0; i < nUnsets; i++ {
 		id := fmt.Sprintf("id_%d", i)
 		data := gifts.Block(fmt.Sprintf("data_%d", i))
-		s.blocks.Store(id, data)
+		s.blocks.Store(id, data, "")
 	}
 
 	done := make(chan bool, nUnsets)
@@ -224,6 +276,33 @@ func TestStorage_Unset(t *testing.T) {
 	}
 }
 
+func TestStorage_Verify(t *testing.T) {
+	t.Parallel()
+
+	s := NewStorage()
+	var healthy bool
+
+	// Missing ID
+	t.Logf("TestStorage_Verify: Starting test #1")
+	err := s.Verify("id1", &healthy)
+	test.AF(t, err == nil && !healthy, fmt.Sprintf("A missing block should not be healthy: %v, %v", healthy, err))
+
+	// Matches its checksum
+	t.Logf("TestStorage_Verify: Starting test #2")
+	data := gifts.Block("data 1")
+	test.AF(t, s.Set(&structure.BlockKV{ID: "id1", Data: data, Checksum: gifts.Checksum(data)}, nil) == nil, "Storage.Set failed")
+	err = s.Verify("id1", &healthy)
+	test.AF(t, err == nil && healthy, fmt.Sprintf("A matching block should be healthy: %v, %v", healthy, err))
+	test.AF(t, s.blocks.Has("id1"), "A healthy block should be kept")
+
+	// Rotted under its checksum, quarantined
+	t.Logf("TestStorage_Verify: Starting test #3")
+	s.blocks.Store("id1", gifts.Block("data X"), gifts.Checksum(data))
+	err = s.Verify("id1", &healthy)
+	test.AF(t, err == nil && !healthy, fmt.Sprintf("A corrupt block should not be healthy: %v, %v", healthy, err))
+	test.AF(t, !s.blocks.Has("id1"), "A corrupt block should be quarantined")
+}
+
 func TestBenchmarkStorage_Set(t *testing.T) {
 	t.Skip()
 	g := generate.NewGenerate()
@@ -1,11 +1,32 @@
 package structure
 
+import "time"
+
 // FileCreateReq is the request type of Master.Create(),
 // needed since Go RPC only support one argument
 type FileCreateReq struct {
 	Fname   string
 	Fsize   int
 	Rfactor uint
+	// Checksums[i] is the checksum of the ith block, optional
+	Checksums []string
+	// Name the blocks by their Checksums, which are then required,
+	// so that a block already stored by any file is shared instead of uploaded again
+	Dedup bool
+	// Erasure code the file instead of replicating it, if DataShards > 0:
+	// every stripe of DataShards blocks of data is stored with ParityShards blocks of parity,
+	// and Rfactor is the number of replicas of each of them.
+	// The blocks are assigned stripe after stripe, the data blocks first,
+	// the last data block of the file is padded to the full size.
+	DataShards   int
+	ParityShards int
+}
+
+// FileCommitReq is the request type of Master.Commit()
+type FileCommitReq struct {
+	Fname string
+	// Checksums[i] is the checksum of the ith block written, optional
+	Checksums []string
 }
 
 // BlockAssign is the slice element of return value of Master.Create(),
@@ -14,10 +35,96 @@ type FileCreateReq struct {
 type BlockAssign struct {
 	BlockID  string
 	Replicas []string
+	Checksum string // empty if unknown
+	Exists   bool   // already stored with the same content, no need to write it
 }
 
 // FileBlocks is the return type of Master.Lookup()
 type FileBlocks struct {
 	Fsize       int           // size of the file, to handle padding
 	Assignments []BlockAssign // Nodes[i] stores the addr of DataNode with ith Block, where len(Replicas) >= 1
+
+	// the erasure code of the file, replicated if DataShards is 0, see FileCreateReq
+	DataShards   int
+	ParityShards int
+}
+
+// RepairStatus is the return type of Master.RepairStatus(),
+// the progress of the latest round of re-replication
+type RepairStatus struct {
+	Running    bool
+	LastStart  time.Time
+	LastFinish time.Time
+
+	NUnderReplicated int // blocks found with fewer live replicas than wanted
+	NRepaired        int // new replicas made
+	NFailed          int // blocks failed to repair, will retry next round
+	NLost            int // blocks without any live replica
+}
+
+// DecommissionStatus is the return type of Master.DecommissionStatus(),
+// the progress of the latest decommission of a storage
+type DecommissionStatus struct {
+	Running    bool
+	Done       bool // all its blocks moved away, the storage is forgotten
+	LastStart  time.Time
+	LastFinish time.Time
+
+	NBlocks   int    // blocks on the storage when it started
+	NMigrated int    // blocks moved to other storages
+	NFailed   int    // blocks failed to move, retried by decommissioning it again
+	Err       string // why it failed, empty unless it did
+}
+
+// CorruptReport is the request type of Master.ReportCorrupt()
+type CorruptReport struct {
+	Addr    string // the storage holding the corrupt block
+	BlockID string
+}
+
+// ListReq is the request type of Master.List()
+type ListReq struct {
+	Prefix string
+	Cursor string // list the names after it, from the start if empty
+	Limit  int    // at most this many names, a default page if <= 0
+}
+
+// ListResult is the return type of Master.List()
+type ListResult struct {
+	Fnames     []string // in lexicographical order
+	NextCursor string   // for the next page, empty if no more
+}
+
+// FileStat is the return type of Master.Stat()
+type FileStat struct {
+	Fname       string
+	Fsize       int
+	NBlocks     int
+	Rfactor     uint // as requested by the user
+	NReplica    int  // as currently replicated
+	Created     time.Time
+	Temperature float64 // the decaying read counter
+
+	// the erasure code, replicated if DataShards is 0
+	DataShards   int
+	ParityShards int
+}
+
+// DirEntry is the slice element of the return value of Master.ReadDir()
+type DirEntry struct {
+	Name  string // in the directory, not the full path
+	IsDir bool
+}
+
+// RenameReq is the request type of Master.Rename()
+type RenameReq struct {
+	Old       string
+	New       string
+	Overwrite bool // replace the file named New if any, fail otherwise
+}
+
+// RmdirReq is the request type of Master.Rmdir()
+type RmdirReq struct {
+	Path      string
+	Recursive bool // also remove everything under it, fail if not empty otherwise
 }
@@ -1,15 +1,69 @@
 package structure
 
-import gifts "github.com/GIFTS-fs/GIFTS"
+import (
+	"io"
+
+	gifts "github.com/GIFTS-fs/GIFTS"
+)
 
 // BlockKV is the request type of Storage.Set()
 type BlockKV struct {
-	ID   string
-	Data gifts.Block
+	ID       string
+	Data     gifts.Block
+	Checksum string // verified before storing if not empty
+}
+
+// SplitPayload the block data from the rest
+func (kv *BlockKV) SplitPayload() (interface{}, []byte) {
+	return &BlockKV{ID: kv.ID, Checksum: kv.Checksum}, kv.Data
+}
+
+// JoinPayload of the block data to the rest
+func (kv *BlockKV) JoinPayload(payload []byte) {
+	kv.Data = payload
+}
+
+// BlockStream is a BlockKV the data of which is read as it is sent,
+// the server receives it as a BlockKV
+type BlockStream struct {
+	ID       string
+	Checksum string // verified before storing if not empty
+	// Open the data of the block, size bytes, once per attempt at sending it
+	Open func() (data io.ReadCloser, size int, err error)
+}
+
+// OpenPayload of the block data, the rest is a BlockKV
+func (bs *BlockStream) OpenPayload() (interface{}, io.ReadCloser, int, error) {
+	data, size, err := bs.Open()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return &BlockKV{ID: bs.ID, Checksum: bs.Checksum}, data, size, nil
 }
 
 // ReplicateKV is the request type of Storage.Replicate()
 type ReplicateKV struct {
+	ID       string
+	Dest     string
+	Checksum string // verified before copying if not empty
+}
+
+// BlockInfo is one entry of the reply of Storage.BlockReport()
+type BlockInfo struct {
 	ID   string
-	Dest string
+	Size int
+}
+
+// RangeReq is the request type of Storage.GetRange()
+type RangeReq struct {
+	ID     string
+	Offset int // in bytes, from the start of the block
+	Length int // in bytes, fewer are returned if the block ends before
+}
+
+// StorageStat is the reply of Storage.Stat(), the space of a Storage node
+type StorageStat struct {
+	Capacity int64 // in bytes, unlimited if 0
+	Used     int64 // in bytes, by the blocks
+	NBlocks  int
 }
@@ -2,15 +2,20 @@ package test
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
 
+	"github.com/GIFTS-fs/GIFTS"
 	"github.com/GIFTS-fs/GIFTS/client"
 	"github.com/GIFTS-fs/GIFTS/config"
 	"github.com/GIFTS-fs/GIFTS/master"
 	"github.com/GIFTS-fs/GIFTS/storage"
+	"github.com/GIFTS-fs/GIFTS/structure"
 )
 
 func TestMain(m *testing.M) {
@@ -47,11 +52,11 @@ func TestIntergrationHelloWorld(t *testing.T) {
 	f1Rfactor := uint(2)
 	f1Data := []byte(strings.Repeat("Hello World!", 1024))
 
-	if c.Store(f1Name, f1Rfactor, f1Data) != nil {
+	if c.Store(context.Background(), f1Name, f1Rfactor, f1Data) != nil {
 		t.Errorf("Failed to store %v", f1Data)
 	}
 
-	dataRead, err := c.Read(f1Name)
+	dataRead, err := c.Read(context.Background(), f1Name)
 	if err != nil {
 		t.Errorf("Failed to read %v", f1Name)
 	}
@@ -60,3 +65,134 @@ func TestIntergrationHelloWorld(t *testing.T) {
 		t.Errorf("Data mismatch: want %v got %v", f1Data, dataRead)
 	}
 }
+
+func TestIntergrationTLS(t *testing.T) {
+	addrMaster := "localhost:22331"
+	addrStorage1 := "localhost:22332"
+	addrStorage2 := "localhost:22333"
+	addrStorages := []string{addrStorage1, addrStorage2}
+
+	dir, err := ioutil.TempDir("", "gifts-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tlsConfig := loadTestCA(t, filepath.Join(dir, "cluster"))
+	otherConfig := loadTestCA(t, filepath.Join(dir, "other"))
+
+	// all the RPCs of the cluster over TLS
+	defaultPool := gifts.DefaultRPCPool
+	gifts.DefaultRPCPool = gifts.NewRPCPool(1, 0, 0, gifts.ProtocolGob, tlsConfig)
+	defer func() {
+		gifts.DefaultRPCPool.Close()
+		gifts.DefaultRPCPool = defaultPool
+	}()
+
+	m := master.NewMaster(addrStorages, config.Get())
+	m.TLS = tlsConfig
+	if master.ServeRPC(m, addrMaster) != nil {
+		t.Errorf("Failed to serv master %v", m)
+	}
+
+	s1 := storage.NewStorage()
+	s1.TLS = tlsConfig
+	if storage.ServeRPC(s1, addrStorage1) != nil {
+		t.Errorf("Failed to serv storage %v", s1)
+	}
+
+	s2 := storage.NewStorage()
+	s2.TLS = tlsConfig
+	if storage.ServeRPC(s2, addrStorage2) != nil {
+		t.Errorf("Failed to serv storage %v", s2)
+	}
+
+	t.Logf("TestIntergrationTLS: Starting test #1")
+	c := client.NewClient([]string{addrMaster}, config.Get())
+
+	f1Name := "helloTLS"
+	f1Rfactor := uint(2)
+	f1Data := []byte(strings.Repeat("Hello TLS!", 1024))
+
+	if err := c.Store(context.Background(), f1Name, f1Rfactor, f1Data); err != nil {
+		t.Fatalf("Failed to store %v: %v", f1Name, err)
+	}
+
+	dataRead, err := c.Read(context.Background(), f1Name)
+	if err != nil {
+		t.Fatalf("Failed to read %v: %v", f1Name, err)
+	}
+
+	if bytes.Compare(dataRead, f1Data) != 0 {
+		t.Errorf("Data mismatch: want %v got %v", f1Data, dataRead)
+	}
+
+	t.Logf("TestIntergrationTLS: Starting test #2")
+	// the framed protocol runs over TLS all the same
+	framedPool := gifts.NewRPCPool(1, 0, 0, gifts.ProtocolFramed, tlsConfig)
+	defer framedPool.Close()
+	framed := storage.NewRPCStorageOn(addrStorage1, framedPool.NewClient(addrStorage1, storage.RPCPathStorage))
+	kv := &structure.BlockKV{ID: "framed", Data: []byte("over TLS")}
+	if err := framed.Set(context.Background(), kv); err != nil {
+		t.Errorf("Set in framed over TLS should succeed: %v", err)
+	}
+
+	t.Logf("TestIntergrationTLS: Starting test #3")
+	// no block set without a certificate of the cluster
+	plainPool := gifts.NewRPCPool(1, 0, 0, gifts.ProtocolGob, nil)
+	defer plainPool.Close()
+	plain := storage.NewRPCStorageOn(addrStorage1, plainPool.NewClient(addrStorage1, storage.RPCPathStorage))
+	kv = &structure.BlockKV{ID: "plain", Data: []byte("in the clear")}
+	if err := plain.Set(context.Background(), kv); err == nil {
+		t.Errorf("Set in plain TCP to a TLS storage should fail")
+	}
+
+	otherPool := gifts.NewRPCPool(1, 0, 0, gifts.ProtocolGob, otherConfig)
+	defer otherPool.Close()
+	other := storage.NewRPCStorageOn(addrStorage1, otherPool.NewClient(addrStorage1, storage.RPCPathStorage))
+	kv = &structure.BlockKV{ID: "other", Data: []byte("from another CA")}
+	if err := other.Set(context.Background(), kv); err == nil {
+		t.Errorf("Set with a certificate of another CA should fail")
+	}
+
+	var ignore bool
+	if err := other.Unset(context.Background(), "framed", &ignore); err == nil {
+		t.Errorf("Unset with a certificate of another CA should fail")
+	}
+
+	t.Logf("TestIntergrationTLS: Starting test #4")
+	// an address without a host needs the name to verify the peer against
+	addrNoHost := addrStorage1[strings.Index(addrStorage1, ":"):]
+	noHost := storage.NewRPCStorageOn(addrNoHost, gifts.DefaultRPCPool.NewClient(addrNoHost, storage.RPCPathStorage))
+	if err := noHost.Ping(context.Background()); err == nil {
+		t.Errorf("Ping over TLS to %q without a server name should fail", addrNoHost)
+	}
+
+	clusterDir := filepath.Join(dir, "cluster")
+	namedConfig, err := gifts.LoadTLSConfig(
+		filepath.Join(clusterDir, "ca.pem"), filepath.Join(clusterDir, "cert.pem"), filepath.Join(clusterDir, "key.pem"), "localhost")
+	if err != nil {
+		t.Fatalf("Failed to load the test CA: %v", err)
+	}
+	namedPool := gifts.NewRPCPool(1, 0, 0, gifts.ProtocolGob, namedConfig)
+	defer namedPool.Close()
+	named := storage.NewRPCStorageOn(addrNoHost, namedPool.NewClient(addrNoHost, storage.RPCPathStorage))
+	if err := named.Ping(context.Background()); err != nil {
+		t.Errorf("Ping over TLS to %q with a server name should succeed: %v", addrNoHost, err)
+	}
+}
+
+// loadTestCA made in dir, the config of a node of its cluster
+func loadTestCA(t *testing.T, dir string) *tls.Config {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	caFile, certFile, keyFile, err := NewTestCA(dir, "localhost", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("Failed to make the test CA: %v", err)
+	}
+	tlsConfig, err := gifts.LoadTLSConfig(caFile, certFile, keyFile, "")
+	if err != nil {
+		t.Fatalf("Failed to load the test CA: %v", err)
+	}
+	return tlsConfig
+}
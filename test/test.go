@@ -1,6 +1,11 @@
 package test
 
 import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"runtime/debug"
 	"testing"
 )
@@ -14,3 +19,35 @@ func AF(t *testing.T, cond bool, msg string) {
 		t.FailNow()
 	}
 }
+
+// ServeHung accepts RPC connections at addr and never answers a call,
+// nor the handshake unless handshake is true.
+// It stands for a hung node until the returned listener is closed.
+func ServeHung(addr string, handshake bool) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				if handshake {
+					if _, err := http.ReadRequest(r); err != nil {
+						return
+					}
+					io.WriteString(conn, "HTTP/1.0 200 Connected to Go RPC\n\n")
+				}
+				// swallow the calls until the caller hangs up
+				io.Copy(ioutil.Discard, r)
+			}(conn)
+		}
+	}()
+	return l, nil
+}
@@ -0,0 +1,85 @@
+package gifts
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+)
+
+// LoadTLSConfig of a node from the PEM files of the CA of the cluster, its certificate and its key.
+// The config serves and dials alike: each end presents its certificate and requires
+// the other one to present one signed by the CA.
+// The certificates of the peers dialed are verified against serverName,
+// against the host of their address if empty.
+// It is nil if no file is given, the connections are then in plain TCP.
+func LoadTLSConfig(caFile, certFile, keyFile, serverName string) (*tls.Config, error) {
+	if caFile == "" && certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if caFile == "" || certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("TLS needs the CA, the certificate and the key, given %q, %q and %q", caFile, certFile, keyFile)
+	}
+
+	caPEM, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	cas := x509.NewCertPool()
+	if !cas.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("No certificate found in %q", caFile)
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      cas,
+		ClientCAs:    cas,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+		ServerName:   serverName,
+	}, nil
+}
+
+// dialTCP the peer, in TLS if tlsConfig is not nil, until ctx is done.
+// The deadline of ctx is left on the connection for the handshake of the protocol.
+func dialTCP(ctx context.Context, addr string, tlsConfig *tls.Config) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if tlsConfig == nil {
+		return conn, nil
+	}
+
+	// the peer is verified against the host it is dialed at
+	if tlsConfig.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err == nil && host == "" {
+			// e.g. ":4000", nothing to verify it against
+			err = fmt.Errorf("TLS to %q needs a host in the address or a server name", addr)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = host
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, &net.OpError{Op: "dial-tls", Net: "tcp " + addr, Addr: nil, Err: err}
+	}
+	return tlsConn, nil
+}